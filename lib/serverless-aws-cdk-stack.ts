@@ -1,6 +1,11 @@
 import * as cdk from "aws-cdk-lib";
 import { LambdaIntegration, RestApi } from "aws-cdk-lib/aws-apigateway";
+import * as dynamodb from "aws-cdk-lib/aws-dynamodb";
+import * as events from "aws-cdk-lib/aws-events";
+import * as targets from "aws-cdk-lib/aws-events-targets";
 import * as lambda from "aws-cdk-lib/aws-lambda";
+import { DynamoEventSource, SqsDlq } from "aws-cdk-lib/aws-lambda-event-sources";
+import * as sqs from "aws-cdk-lib/aws-sqs";
 import { Construct } from "constructs";
 
 export class ServerlessAwsCdkStack extends cdk.Stack {
@@ -25,5 +30,110 @@ export class ServerlessAwsCdkStack extends cdk.Stack {
     const integration = new LambdaIntegration(myFunc);
     const proxyResource = baseResource.addResource("test/{proxy+}");
     proxyResource.addMethod("ANY", integration);
+
+    // mirrors pkg/environments/local/devtable.json
+    const table = new dynamodb.Table(this, "Table", {
+      partitionKey: { name: "pk", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "sk", type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      stream: dynamodb.StreamViewType.NEW_AND_OLD_IMAGES,
+      timeToLiveAttribute: "expiresAt",
+    });
+    table.addGlobalSecondaryIndex({
+      indexName: "Active",
+      partitionKey: { name: "pk", type: dynamodb.AttributeType.STRING },
+      sortKey: { name: "isActive", type: dynamodb.AttributeType.NUMBER },
+    });
+
+    // secrets are required outside the local stage, see pkg/environments/prod/config.json
+    const jwtSigningKey = new cdk.CfnParameter(this, "JwtSigningKey", {
+      type: "String",
+      noEcho: true,
+      description: "JWT_SIGNING_KEY, at least 32 random bytes, e.g. from `openssl rand -base64 48`.",
+    });
+    const mfaEncryptionKey = new cdk.CfnParameter(this, "MfaEncryptionKey", {
+      type: "String",
+      noEcho: true,
+      description: "MFA_ENCRYPTION_KEY, at least 32 random bytes, sealing TOTP secrets & signing MFA challenges.",
+    });
+    const mfaPreviousEncryptionKeys = new cdk.CfnParameter(this, "MfaPreviousEncryptionKeys", {
+      type: "String",
+      noEcho: true,
+      default: "",
+      description: "MFA_PREVIOUS_ENCRYPTION_KEYS, comma separated retired MFA keys still opening the secrets they sealed.",
+    });
+
+    const environment = {
+      TABLE_NAME: table.tableName,
+      JWT_SIGNING_KEY: jwtSigningKey.valueAsString,
+      MFA_ENCRYPTION_KEY: mfaEncryptionKey.valueAsString,
+      MFA_PREVIOUS_ENCRYPTION_KEYS: mfaPreviousEncryptionKeys.valueAsString,
+    };
+
+    const purgeFunc = new lambda.Function(this, "PurgeLambda", {
+      code: lambda.Code.fromAsset("out/lambdas/purge"),
+      handler: "main",
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      timeout: cdk.Duration.minutes(5), // purges every user past the retention in one run
+      environment,
+    });
+    table.grantReadWriteData(purgeFunc);
+
+    new events.Rule(this, "PurgeSchedule", {
+      schedule: events.Schedule.rate(cdk.Duration.days(1)),
+      targets: [new targets.LambdaFunction(purgeFunc)],
+    });
+
+    // the dispatcher reports the failed record & those after it, which are retried & then set aside
+    const streamsDeadLetters = new sqs.Queue(this, "StreamsDeadLetters", {
+      retentionPeriod: cdk.Duration.days(14),
+    });
+    const streamsFunc = new lambda.Function(this, "StreamsLambda", {
+      code: lambda.Code.fromAsset("out/lambdas/streams"),
+      handler: "main",
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      timeout: cdk.Duration.seconds(30),
+      environment,
+    });
+    streamsFunc.addEventSource(
+      new DynamoEventSource(table, {
+        startingPosition: lambda.StartingPosition.TRIM_HORIZON,
+        batchSize: 100,
+        reportBatchItemFailures: true,
+        retryAttempts: 5,
+        onFailure: new SqsDlq(streamsDeadLetters),
+      }),
+    );
+
+    // one relay at a time keeps the events of an aggregate in order
+    const outboxFunc = new lambda.Function(this, "OutboxLambda", {
+      code: lambda.Code.fromAsset("out/lambdas/outbox"),
+      handler: "main",
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      timeout: cdk.Duration.seconds(60),
+      reservedConcurrentExecutions: 1,
+      environment,
+    });
+    table.grantReadWriteData(outboxFunc);
+    events.EventBus.fromEventBusName(this, "DefaultBus", "default").grantPutEventsTo(outboxFunc);
+
+    // retries & delayed events are picked up by the schedule, new events are published right away
+    new events.Rule(this, "OutboxSchedule", {
+      schedule: events.Schedule.rate(cdk.Duration.minutes(1)),
+      targets: [new targets.LambdaFunction(outboxFunc)],
+    });
+    outboxFunc.addEventSource(
+      new DynamoEventSource(table, {
+        startingPosition: lambda.StartingPosition.LATEST,
+        batchSize: 100,
+        retryAttempts: 2,
+        filters: [
+          lambda.FilterCriteria.filter({
+            eventName: lambda.FilterRule.isEqual("INSERT"),
+            dynamodb: { NewImage: { entityType: { S: lambda.FilterRule.isEqual("OUTBOX_EVENT") } } },
+          }),
+        ],
+      }),
+    );
   }
 }
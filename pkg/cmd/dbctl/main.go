@@ -0,0 +1,466 @@
+// Command dbctl creates, inspects & migrates the main DynamoDB table.
+//
+// Usage:
+//
+//	dbctl [-file devtable.json] [-table name] <command> [flags]
+//
+// Commands:
+//
+//	create    create the table from its definition
+//	describe  print the live table description as JSON
+//	diff      show how the live table differs from its definition; exits 1 when it does
+//	migrate   apply index changes, then run pending data migrations
+//	seed      load fixture files into the table
+//	reset     delete every item of the given partitions
+//	export    write the table to an NDJSON dump
+//	import    load an NDJSON dump into the table, redacting PII
+//
+// The table definition defaults to the embedded environments/local/devtable.json & the table name
+// to the configured tables.main, so the usual configuration (STAGE, DYNAMODB_ENDPOINT, ...) applies.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	iofs "io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"serverless-aws-cdk/environments"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/dump"
+	"serverless-aws-cdk/internal/db/migrate"
+	"serverless-aws-cdk/internal/db/migrations"
+	"serverless-aws-cdk/internal/db/schema"
+	"serverless-aws-cdk/internal/db/seed"
+	testTable "serverless-aws-cdk/internal/db/tables"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// errDrift makes diff exit with status 1, like diff(1)
+var errDrift = errors.New("table differs from its definition")
+
+// app holds what every command needs
+type app struct {
+	cfg    *config.Config
+	def    *schema.Definition
+	client *dynamodb.Client
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"create":   {"create the table from its definition", runCreate},
+	"describe": {"print the live table description as JSON", runDescribe},
+	"diff":     {"show how the live table differs from its definition", runDiff},
+	"migrate":  {"apply index changes, then run pending data migrations", runMigrate},
+	"seed":     {"load fixture files into the table", runSeed},
+	"reset":    {"delete every item of the given partitions", runReset},
+	"export":   {"write the table to an NDJSON dump", runExport},
+	"import":   {"load an NDJSON dump into the table, redacting PII", runImport},
+}
+
+// fixtureKinds are the entities fixture files may contain, with passwords hashed as configured
+func fixtureKinds(cfg *config.Config) ([]seed.Kind, error) {
+	passwords, err := auth.NewPasswordHasher(cfg.Passwords)
+	if err != nil {
+		return nil, err
+	}
+
+	return []seed.Kind{
+		controller_users.Fixtures(passwords),
+	}, nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dbctl: ")
+
+	file := flag.String("file", "", "table definition in create-table --cli-input-json format (default: embedded "+schema.LocalDefinition+")")
+	table := flag.String("table", "", "table name (default: the configured tables.main)")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	a, err := setup(ctx, *file, *table)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cmd.run(ctx, a, flag.Args()[1:]); err != nil {
+		if errors.Is(err, errDrift) {
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: dbctl [flags] <command> [command flags]")
+	fmt.Fprintln(out, "\ncommands:")
+	for _, name := range []string{"create", "describe", "diff", "migrate", "seed", "reset", "export", "import"} {
+		fmt.Fprintf(out, "  %-9s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func setup(ctx context.Context, file, table string) (*app, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var def *schema.Definition
+	if file == "" {
+		def, err = schema.Load(environments.Files, schema.LocalDefinition)
+	} else {
+		var b []byte
+		if b, err = os.ReadFile(file); err == nil {
+			def, err = schema.Parse(b)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if table == "" {
+		table = cfg.Tables.Main
+	}
+	def.TableName = aws.String(table)
+
+	client, err := db.NewClient(ctx, cfg.DynamoDB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app{cfg: cfg, def: def, client: client}, nil
+}
+
+func (a *app) table() string {
+	return aws.ToString(a.def.TableName)
+}
+
+func runCreate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	ifNotExists := fs.Bool("if-not-exists", false, "succeed when the table already exists")
+	fs.Parse(args)
+
+	existing, err := schema.Describe(ctx, a.client, a.table())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if *ifNotExists {
+			log.Printf("table %s already exists", a.table())
+			return nil
+		}
+		return fmt.Errorf("table %s already exists; use migrate to update it", a.table())
+	}
+
+	if _, err := schema.Create(ctx, a.client, a.def); err != nil {
+		return err
+	}
+
+	log.Printf("created table %s", a.table())
+	return nil
+}
+
+func runDescribe(ctx context.Context, a *app, args []string) error {
+	flag.NewFlagSet("describe", flag.ExitOnError).Parse(args)
+
+	desc, err := schema.Describe(ctx, a.client, a.table())
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		return fmt.Errorf("table %s does not exist", a.table())
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(desc)
+}
+
+func runDiff(ctx context.Context, a *app, args []string) error {
+	flag.NewFlagSet("diff", flag.ExitOnError).Parse(args)
+
+	plan, err := a.plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(plan)
+	if !plan.Empty() {
+		return errDrift
+	}
+
+	return nil
+}
+
+func runMigrate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the pending changes without applying them")
+	prune := fs.Bool("prune", false, "remove indexes that are not in the definition")
+	allowRemote := fs.Bool("allow-remote", false, "allow index changes without a DYNAMODB_ENDPOINT, i.e. against AWS")
+	fs.Parse(args)
+
+	plan, err := a.plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(plan)
+
+	if !plan.Empty() && !*dryRun {
+		// deployed tables are owned by infrastructure code; only DynamoDB Local is changed by default
+		if a.cfg.DynamoDB.Endpoint == "" && !*allowRemote {
+			return errors.New("refusing to change a table on AWS without -allow-remote")
+		}
+
+		if err := schema.Apply(ctx, a.client, plan, *prune); err != nil {
+			return err
+		}
+	}
+
+	database := db.New(a.client)
+	runner, err := migrate.NewRunner(database, testTable.New(database, a.table()).Schema(), migrations.All())
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if plan.Create != nil {
+			fmt.Printf("%d data migrations will run after the table is created\n", len(migrations.All()))
+			return nil
+		}
+
+		pending, err := runner.Pending(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d pending data migrations\n", len(pending))
+		for _, m := range pending {
+			fmt.Printf("  %d %s\n", m.Version, m.Description)
+		}
+		return nil
+	}
+
+	applied, err := runner.Up(ctx)
+	for _, m := range applied {
+		fmt.Printf("applied migration %d %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("no pending data migrations")
+	}
+
+	return nil
+}
+
+func runSeed(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	reset := fs.Bool("reset", false, "empty the partitions the fixtures live in first, leaving exactly the fixtures")
+	dir := fs.String("dir", "", "directory to read fixtures from (default: the embedded local/fixtures)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbctl seed [-reset] [-dir dir] [pattern ...]")
+		fmt.Fprintln(fs.Output(), "patterns select fixture files, e.g. users.yaml (default: every file of the directory)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fsys, err := iofs.Sub(environments.Files, "local/fixtures")
+	if err != nil {
+		return err
+	}
+	if *dir != "" {
+		fsys = os.DirFS(*dir)
+	}
+
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	files, err := seed.ReadFS(fsys, patterns...)
+	if err != nil {
+		return err
+	}
+
+	kinds, err := fixtureKinds(a.cfg)
+	if err != nil {
+		return err
+	}
+
+	database := db.New(a.client)
+	seeder := seed.New(database, testTable.New(database, a.table()).Schema(), kinds...)
+
+	result, err := seeder.Seed(ctx, files, *reset)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("seeded %d items from %d files into %s\n", result.Items, len(files), strings.Join(result.Partitions, ", "))
+	return nil
+}
+
+func runReset(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbctl reset partition ...")
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	database := db.New(a.client)
+	deleted, err := seed.New(database, testTable.New(database, a.table()).Schema()).Reset(ctx, fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d items\n", deleted)
+	return nil
+}
+
+func runExport(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "file to write the dump to (default: stdout)")
+	segments := fs.Int("segments", dump.DefaultSegments, "parallel scan segments")
+	redact := fs.Bool("redact", false, "redact the configured PII attributes")
+	var prefixes stringList
+	fs.Var(&prefixes, "prefix", "only export partitions starting with this prefix; repeatable")
+	fs.Parse(args)
+
+	opts := dump.ExportOptions{Segments: *segments, Prefixes: prefixes}
+	if *redact {
+		redactor, err := dump.NewRedactor(a.cfg.Dump.Redact, nil)
+		if err != nil {
+			return err
+		}
+		opts.Redactor = redactor
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	database := db.New(a.client)
+	count, err := dump.Export(ctx, database, testTable.New(database, a.table()).Schema(), w, opts)
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		if err := w.Sync(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("exported %d items from %s", count, a.table())
+	return nil
+}
+
+func runImport(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	checkpoint := fs.String("checkpoint", "", "checkpoint file to resume from & record progress in (default: <dump>.checkpoint)")
+	noRedact := fs.Bool("no-redact", false, "import PII attributes as they are")
+	var prefixes stringList
+	fs.Var(&prefixes, "prefix", "only import partitions starting with this prefix; repeatable")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbctl import [flags] dump.ndjson")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts := dump.ImportOptions{
+		Prefixes:   prefixes,
+		Redact:     a.cfg.Dump.Redact,
+		Checkpoint: *checkpoint,
+	}
+	if opts.Checkpoint == "" {
+		opts.Checkpoint = fs.Arg(0) + ".checkpoint"
+	}
+	if *noRedact {
+		opts.Redact = nil
+	}
+
+	database := db.New(a.client)
+	result, err := dump.Import(ctx, database, testTable.New(database, a.table()).Schema(), f, opts)
+	if err != nil {
+		return fmt.Errorf("%w (%d items written; rerun to resume)", err, result.Written)
+	}
+
+	if result.Resumed {
+		log.Printf("resumed from %s", opts.Checkpoint)
+	}
+	log.Printf("imported %d items into %s, skipped %d", result.Written, a.table(), result.Skipped)
+	return nil
+}
+
+// stringList collects a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (a *app) plan(ctx context.Context) (schema.Plan, error) {
+	have, err := schema.Describe(ctx, a.client, a.table())
+	if err != nil {
+		return schema.Plan{}, err
+	}
+
+	return schema.Diff(a.def, have), nil
+}
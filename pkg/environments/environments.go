@@ -0,0 +1,8 @@
+// Package environments bundles the per-stage configuration files, table definitions & fixtures
+// so they ship inside every binary.
+package environments
+
+import "embed"
+
+//go:embed */*.json */fixtures
+var Files embed.FS
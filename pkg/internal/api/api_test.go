@@ -0,0 +1,461 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/api"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	controller_auth "serverless-aws-cdk/internal/controllers/auth"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/mail"
+	"serverless-aws-cdk/internal/outbox"
+	"serverless-aws-cdk/internal/ratelimit"
+	router "serverless-aws-cdk/lambdas"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const password = "correct horse battery staple 42"
+
+// server wires the users lambda on an in-memory table, as lambdas/users does on DynamoDB
+type server struct {
+	t       *testing.T
+	routes  map[string]router.RouteConfig
+	users   *controller_users.Controller
+	mailbox *mail.Memory
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+
+	mailbox := mail.NewMemory()
+	s := newServerMailing(t, mailbox)
+	s.mailbox = mailbox
+
+	return s
+}
+
+// newServerMailing wires the server sending its emails with mailer, nil disabling email
+func newServerMailing(t *testing.T, mailer mail.Mailer) *server {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Defaults()
+	cfg.Passwords.Algorithm, cfg.Passwords.BcryptCost, cfg.Passwords.CheckBreached = auth.AlgorithmBcrypt, 4, false
+	cfg.Auth.SigningKey = strings.Repeat("s", 32)
+	cfg.Auth.MFA.EncryptionKey = strings.Repeat("m", 32)
+	cfg.Auth.VerifyEmailURL = "https://example.com/verify-email"
+	cfg.Auth.PasswordResetURL = "https://example.com/reset-password"
+	cfg.Auth.Lockout.Delay = 0
+
+	passwords, err := auth.NewPasswordHasher(cfg.Passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := db.New(engine)
+	table := testTable.New(database, "test")
+	users := controller_users.New(table, outbox.New(database, table.Schema()), passwords, auth.NewPasswordPolicy(cfg.Passwords, nil))
+
+	mfaKeys, err := auth.MFAKeys(cfg.Auth.MFA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factors, err := auth.NewFactors(database, table.Schema(), mfaKeys, cfg.Auth.MFA.Skew, cfg.Auth.MFA.RecoveryCodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := mail.DefaultTemplates(cfg.Mail.Locale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := controller_auth.New(controller_auth.Stores{
+		Sessions: auth.NewSessions(database, table.Schema(), cfg.Auth.RefreshTokenTTL.Std(), cfg.Auth.MaxSessionAge.Std()),
+		Resets:   auth.NewResets(database, table.Schema(), cfg.Auth.PasswordResetTTL.Std()),
+		Throttle: auth.NewThrottle(database, table.Schema(), cfg.Auth.Lockout),
+		Factors:  factors,
+		Resends:  ratelimit.New(database, table.Schema(), "verify-email", controller_auth.ResendLimit, controller_auth.ResendWindow),
+	}, users, cfg.Auth, mailer, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := api.UserRoutes(users, accounts)
+	for path, route := range api.AuthRoutes(accounts) {
+		routes[path] = route
+	}
+
+	authenticator := router.Authenticator
+	router.Authenticator = api.Authenticator(accounts)
+	t.Cleanup(func() { router.Authenticator = authenticator })
+
+	return &server{t: t, routes: routes, users: users}
+}
+
+// call sends a request through the router as API Gateway does, with an optional bearer token & JSON body
+func (s *server) call(method, path, token string, body interface{}) (int, map[string]interface{}) {
+	s.t.Helper()
+
+	req := events.APIGatewayProxyRequest{
+		HTTPMethod:     method,
+		Path:           "/api/v1/users" + path,
+		PathParameters: map[string]string{},
+		Headers:        map[string]string{"Content-Type": "application/json"},
+	}
+	if token != "" {
+		req.Headers["Authorization"] = "Bearer " + token
+	}
+	if u, err := url.Parse(path); err == nil && u.RawQuery != "" {
+		req.Path = "/api/v1/users" + u.Path
+		req.QueryStringParameters = map[string]string{}
+		for k, v := range u.Query() {
+			req.QueryStringParameters[k] = v[0]
+		}
+	}
+	switch b := body.(type) {
+	case nil:
+	case string:
+		req.Body = b
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		req.Body = string(raw)
+	}
+
+	resp := router.Router(context.Background(), req, s.routes)
+
+	var out map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		s.t.Fatalf("%s %s answered %d with a body that is no JSON object: %s", method, path, resp.StatusCode, resp.Body)
+	}
+
+	return resp.StatusCode, out
+}
+
+// register creates a user through the API & returns its id
+func (s *server) register(name, email string) string {
+	s.t.Helper()
+
+	if status, out := s.call(http.MethodPost, "/user", "", map[string]string{"name": name, "email": email, "password": password}); status != http.StatusOK {
+		s.t.Fatalf("registering %s = %d %v", email, status, out)
+	}
+
+	user, err := s.users.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return user.ID
+}
+
+// login returns an access token of the user registered with email
+func (s *server) login(email string) string {
+	s.t.Helper()
+
+	status, out := s.call(http.MethodPost, "/auth/login", "", map[string]string{"email": email, "password": password})
+	if status != http.StatusOK {
+		s.t.Fatalf("login of %s = %d %v", email, status, out)
+	}
+
+	return out["accessToken"].(string)
+}
+
+// stepUp enrolls the user of token in TOTP & returns an access token of its session after passing MFA
+func (s *server) stepUp(token string) string {
+	s.t.Helper()
+
+	status, out := s.call(http.MethodPost, "/auth/mfa/totp", token, map[string]string{})
+	if status != http.StatusCreated {
+		s.t.Fatalf("enrolling TOTP = %d %v", status, out)
+	}
+	code, err := auth.TOTPCode(out["secret"].(string), auth.TOTPStep(time.Now()))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	status, out = s.call(http.MethodPost, "/auth/mfa/totp/confirm", token, map[string]string{"code": code})
+	if status != http.StatusOK {
+		s.t.Fatalf("confirming TOTP = %d %v", status, out)
+	}
+
+	// a recovery code passes MFA as well, without waiting for the next TOTP period
+	recoveryCode := out["recoveryCodes"].([]interface{})[0].(string)
+	status, out = s.call(http.MethodPost, "/auth/mfa/step-up", token, map[string]string{"recoveryCode": recoveryCode})
+	if status != http.StatusOK {
+		s.t.Fatalf("step-up = %d %v", status, out)
+	}
+
+	return out["accessToken"].(string)
+}
+
+var tokenParam = regexp.MustCompile(`token=([^\s&"<]+)`)
+
+// lastToken returns the token of the last link emailed to email
+func (s *server) lastToken(email string) string {
+	s.t.Helper()
+
+	messages := s.mailbox.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != email {
+			continue
+		}
+		if m := tokenParam.FindStringSubmatch(messages[i].Text); m != nil {
+			token, err := url.QueryUnescape(m[1])
+			if err != nil {
+				s.t.Fatal(err)
+			}
+			return token
+		}
+	}
+
+	s.t.Fatalf("no link was emailed to %s", email)
+	return ""
+}
+
+func TestUserLifecycle(t *testing.T) {
+	s := newServer(t)
+
+	id := s.register("Ann", "ann@example.com")
+
+	if status, _ := s.call(http.MethodPost, "/user", "", map[string]string{"name": "Ann", "email": "ANN@example.com", "password": password}); status != http.StatusConflict {
+		t.Errorf("registering a taken email = %d, want 409", status)
+	}
+	if status, _ := s.call(http.MethodPost, "/user", "", map[string]string{"name": "Bob", "email": "bob", "password": password}); status != http.StatusBadRequest {
+		t.Errorf("registering an invalid email = %d, want 400", status)
+	}
+
+	token := s.login("ann@example.com")
+
+	status, out := s.call(http.MethodGet, "/user/"+id, token, nil)
+	if status != http.StatusOK {
+		t.Fatalf("GET own user = %d %v", status, out)
+	}
+	if user := out["user"].(map[string]interface{}); user["email"] != "ann@example.com" || user["emailVerified"] != false {
+		t.Errorf("own user = %v, want ann@example.com & unverified", user)
+	}
+
+	if status, out := s.call(http.MethodPost, "/auth/verify", "", map[string]string{"token": s.lastToken("ann@example.com")}); status != http.StatusOK {
+		t.Fatalf("verifying the emailed link = %d %v", status, out)
+	}
+
+	if status, out := s.call(http.MethodPut, "/user/"+id, token, map[string]string{"currentPassword": password, "name": "Ann Lee"}); status != http.StatusOK {
+		t.Errorf("PUT own user = %d %v", status, out)
+	}
+	if status, _ := s.call(http.MethodPut, "/user/"+id, token, map[string]string{"currentPassword": "wrong password", "name": "Eve"}); status != http.StatusForbidden {
+		t.Errorf("PUT with a wrong password = %d, want 403", status)
+	}
+
+	status, out = s.call(http.MethodPatch, "/user/"+id, token, `{"name": "Ann Patched"}`)
+	if status != http.StatusOK || out["user"].(map[string]interface{})["name"] != "Ann Patched" {
+		t.Errorf("PATCH own user = %d %v", status, out)
+	}
+	if status, _ := s.call(http.MethodPatch, "/user/"+id, token, `{"email": "eve@example.com"}`); status != http.StatusBadRequest {
+		t.Errorf("PATCH of the email = %d, want 400", status)
+	}
+
+	user, err := s.users.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Ann Patched" || user.Email != "ann@example.com" || !user.EmailVerified {
+		t.Errorf("stored user = %q %q verified %v, want Ann Patched, ann@example.com & verified", user.Name, user.Email, user.EmailVerified)
+	}
+
+	if status, _ := s.call(http.MethodDelete, "/user/"+id, token, map[string]string{"password": password}); status != http.StatusOK {
+		t.Fatalf("DELETE own user = %d", status)
+	}
+	if status, _ := s.call(http.MethodPost, "/auth/login", "", map[string]string{"email": "ann@example.com", "password": password}); status != http.StatusUnauthorized {
+		t.Errorf("login of a deleted user = %d, want 401", status)
+	}
+	if status, _ := s.call(http.MethodDelete, "/user/"+id, token, map[string]string{"password": password}); status != http.StatusNotFound {
+		t.Errorf("deleting a deleted user = %d, want 404", status)
+	}
+}
+
+func TestPasswordChangeEndsSessions(t *testing.T) {
+	s := newServer(t)
+
+	id := s.register("Ann", "ann@example.com")
+
+	login := func(password string) (string, string) {
+		t.Helper()
+
+		status, out := s.call(http.MethodPost, "/auth/login", "", map[string]string{"email": "ann@example.com", "password": password})
+		if status != http.StatusOK {
+			t.Fatalf("login = %d %v", status, out)
+		}
+		return out["accessToken"].(string), out["refreshToken"].(string)
+	}
+	refresh := func(token string) int {
+		status, _ := s.call(http.MethodPost, "/auth/refresh", "", map[string]string{"refreshToken": token})
+		return status
+	}
+
+	token, refreshToken := login(password)
+	_, other := login(password)
+
+	// renaming leaves the sessions alone
+	if status, out := s.call(http.MethodPut, "/user/"+id, token, map[string]string{"currentPassword": password, "name": "Ann Lee"}); status != http.StatusOK {
+		t.Fatalf("renaming = %d %v", status, out)
+	}
+	if status := refresh(other); status != http.StatusOK {
+		t.Errorf("refresh after renaming = %d, want 200", status)
+	}
+
+	const newPassword = "another correct horse battery"
+	if status, out := s.call(http.MethodPut, "/user/"+id, token, map[string]string{"currentPassword": password, "newPassword": newPassword}); status != http.StatusOK {
+		t.Fatalf("changing the password = %d %v", status, out)
+	}
+
+	// every session started with the old password ends, the one changing it included
+	if status := refresh(refreshToken); status != http.StatusUnauthorized {
+		t.Errorf("refresh of the session changing the password = %d, want 401", status)
+	}
+
+	_, refreshToken = login(newPassword)
+	if status := refresh(refreshToken); status != http.StatusOK {
+		t.Errorf("refresh of a session started with the new password = %d, want 200", status)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newServer(t)
+
+	s.register("Ann", "ann@example.com")
+	_, loggedIn := s.call(http.MethodPost, "/auth/login", "", map[string]string{"email": "ann@example.com", "password": password})
+	sent := len(s.mailbox.Messages()) // the verification link
+
+	forgot := func(email string) (int, map[string]interface{}) {
+		return s.call(http.MethodPost, "/auth/password/forgot", "", map[string]string{"email": email})
+	}
+	reset := func(token, password string) int {
+		status, _ := s.call(http.MethodPost, "/auth/password/reset", "", map[string]string{"token": token, "password": password})
+		return status
+	}
+
+	// registered or not, every email gets the same answer, but only registered ones get a link
+	wantStatus, wantBody := forgot("ann@example.com")
+	for _, email := range []string{"nobody@example.com", "ANN@example.com", "not an email"} {
+		if status, out := forgot(email); status != wantStatus || !reflect.DeepEqual(out, wantBody) {
+			t.Errorf("forgot password of %q = %d %v, want %d %v like a registered email", email, status, out, wantStatus, wantBody)
+		}
+	}
+	if wantStatus != http.StatusAccepted {
+		t.Errorf("forgot password = %d, want 202", wantStatus)
+	}
+
+	// at most three links are pending, further requests are answered alike but send nothing
+	if status, out := forgot("ann@example.com"); status != wantStatus || !reflect.DeepEqual(out, wantBody) {
+		t.Errorf("forgot password past the pending links = %d %v, want the same answer", status, out)
+	}
+	var tokens []string
+	for _, m := range s.mailbox.Messages()[sent:] {
+		if m.To != "ann@example.com" {
+			t.Errorf("a reset link was emailed to %s", m.To)
+		}
+		token, err := url.QueryUnescape(tokenParam.FindStringSubmatch(m.Text)[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("%d reset links were emailed, want 3", len(tokens))
+	}
+
+	// a refused password leaves the token unused
+	if status := reset(tokens[1], "short"); status != http.StatusBadRequest {
+		t.Errorf("reset to a refused password = %d, want 400", status)
+	}
+
+	const newPassword = "another correct horse battery"
+	if status := reset(tokens[1], newPassword); status != http.StatusOK {
+		t.Fatalf("reset = %d, want 200", status)
+	}
+
+	// the token is spent, and so are the other pending ones
+	for i, token := range tokens {
+		if status := reset(token, "yet another horse battery"); status != http.StatusBadRequest {
+			t.Errorf("reset with link %d after the reset = %d, want 400", i+1, status)
+		}
+	}
+
+	// the session started with the old password has ended
+	if status, _ := s.call(http.MethodPost, "/auth/refresh", "", map[string]interface{}{"refreshToken": loggedIn["refreshToken"]}); status != http.StatusUnauthorized {
+		t.Errorf("refresh of a session from before the reset = %d, want 401", status)
+	}
+	if status, _ := s.call(http.MethodPost, "/auth/login", "", map[string]string{"email": "ann@example.com", "password": newPassword}); status != http.StatusOK {
+		t.Errorf("login with the new password = %d, want 200", status)
+	}
+}
+
+func TestOtherUsersAccount(t *testing.T) {
+	s := newServer(t)
+
+	ann := s.register("Ann", "ann@example.com")
+	s.register("Bob", "bob@example.com")
+	bob := s.login("bob@example.com")
+
+	for _, r := range []struct{ method, path string }{
+		{http.MethodPut, "/user/" + ann},
+		{http.MethodPatch, "/user/" + ann},
+		{http.MethodDelete, "/user/" + ann},
+		{http.MethodPost, "/user/" + ann + "/deactivate"},
+		{http.MethodPut, "/user/" + ann + "/email"},
+	} {
+		if status, _ := s.call(r.method, r.path, bob, map[string]string{"password": password}); status != http.StatusForbidden {
+			t.Errorf("%s %s by another user = %d, want 403", r.method, r.path, status)
+		}
+		if status, _ := s.call(r.method, r.path, "", map[string]string{"password": password}); status != http.StatusUnauthorized {
+			t.Errorf("%s %s anonymously = %d, want 401", r.method, r.path, status)
+		}
+	}
+
+	if status, _ := s.call(http.MethodGet, "/unknown", "", nil); status != http.StatusNotFound {
+		t.Errorf("unknown route = %d, want 404", status)
+	}
+	if status, _ := s.call(http.MethodDelete, "/user", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("unknown method = %d, want 405", status)
+	}
+}
+
+func TestWithoutMail(t *testing.T) {
+	s := newServerMailing(t, nil)
+
+	id := s.register("Ann", "ann@example.com")
+	token := s.login("ann@example.com")
+
+	// the same answer for every email, registered or not
+	for _, email := range []string{"ann@example.com", "unknown@example.com"} {
+		if status, _ := s.call(http.MethodPost, "/auth/password/forgot", "", map[string]string{"email": email}); status != http.StatusNotImplemented {
+			t.Errorf("forgot password of %s = %d, want 501", email, status)
+		}
+	}
+	if status, _ := s.call(http.MethodPost, "/auth/verify/resend", token, nil); status != http.StatusNotImplemented {
+		t.Errorf("resending the verification = %d, want 501", status)
+	}
+
+	if status, out := s.call(http.MethodPut, "/user/"+id+"/email", token, map[string]string{"email": "ann.lee@example.com", "password": password}); status != http.StatusOK {
+		t.Errorf("changing the email = %d %v", status, out)
+	}
+}
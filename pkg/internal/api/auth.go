@@ -0,0 +1,547 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"serverless-aws-cdk/internal/auth"
+	controller_auth "serverless-aws-cdk/internal/controllers/auth"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/mail"
+	"serverless-aws-cdk/internal/ratelimit"
+	router "serverless-aws-cdk/lambdas"
+	"serverless-aws-cdk/utils"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// How recently callers must have passed MFA: admins once a working day, & a caller changing its MFA
+// just before
+const (
+	adminMFAAge = 12 * time.Hour
+	freshMFAAge = 15 * time.Minute
+)
+
+type authHandlers struct {
+	auth *controller_auth.Controller
+}
+
+// AuthRoutes builds the login, MFA, refresh, logout, email verification, password reset & lockout routes on top of the given controller
+func AuthRoutes(c *controller_auth.Controller) map[string]router.RouteConfig {
+	h := &authHandlers{auth: c}
+
+	return map[string]router.RouteConfig{
+		"/auth/login": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.login,
+				},
+			},
+		},
+		"/auth/mfa/verify": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.verifyMFA,
+				},
+			},
+		},
+		"/auth/mfa/step-up": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:     h.stepUp,
+					Authenticate: true,
+				},
+			},
+		},
+		"/auth/mfa": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodGet: {
+					Callback:     h.mfaStatus,
+					Authenticate: true,
+				},
+			},
+		},
+		"/auth/mfa/totp": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:     h.enrollTOTP,
+					Authenticate: true,
+				},
+				http.MethodDelete: {
+					Callback:  h.disableTOTP,
+					RecentMFA: freshMFAAge,
+				},
+			},
+		},
+		"/auth/mfa/totp/confirm": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:     h.confirmTOTP,
+					Authenticate: true,
+				},
+			},
+		},
+		"/auth/mfa/recovery-codes": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:  h.regenerateRecoveryCodes,
+					RecentMFA: freshMFAAge,
+				},
+			},
+		},
+		"/auth/refresh": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.refresh,
+				},
+			},
+		},
+		"/auth/logout": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.logout,
+				},
+			},
+		},
+		"/auth/verify": {
+			Methods: map[string]router.RouteMethodConfig{
+				// GET serves the emailed link itself, POST a page that reads the token from the link
+				http.MethodGet: {
+					Callback: h.verifyEmail,
+				},
+				http.MethodPost: {
+					Callback: h.verifyEmail,
+				},
+			},
+		},
+		"/auth/verify/resend": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:     h.resendVerification,
+					Authenticate: true,
+				},
+			},
+		},
+		"/auth/password/forgot": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.forgotPassword,
+				},
+			},
+		},
+		"/auth/password/reset": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.resetPassword,
+				},
+			},
+		},
+		"/auth/lockouts/users/{userId}": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodDelete: {
+					Callback:    h.unlockUser,
+					Verified:    true,
+					Permissions: []string{auth.PermLockoutsDelete},
+					RecentMFA:   adminMFAAge,
+				},
+			},
+		},
+		"/auth/lockouts/ips/{ip}": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodDelete: {
+					Callback:    h.unlockIP,
+					Verified:    true,
+					Permissions: []string{auth.PermLockoutsDelete},
+					RecentMFA:   adminMFAAge,
+				},
+			},
+		},
+	}
+}
+
+// Authenticator verifies access tokens & maps their claims to the caller's identity & permissions
+func Authenticator(c *controller_auth.Controller) func(token string) (router.Principal, error) {
+	return func(token string) (router.Principal, error) {
+		claims, err := c.Authenticate(token)
+		if err != nil {
+			return router.Principal{}, err
+		}
+
+		principal := router.Principal{
+			UserID:        claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: claims.Verified,
+			Roles:         claims.Roles,
+			Permissions:   claims.Permissions,
+		}
+		if claims.MFAAt != 0 {
+			principal.MFAAt = time.Unix(claims.MFAAt, 0)
+		}
+
+		return principal, nil
+	}
+}
+
+func (h *authHandlers) login(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	email, _ := addInfo.Body["email"].(string)
+	password, _ := addInfo.Body["password"].(string)
+
+	if email == "" || password == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "email and password are required",
+		})
+	}
+
+	tokens, err := h.auth.Login(context.TODO(), email, password, addInfo.SourceIP)
+
+	var mfa *controller_auth.MFARequiredError
+	switch {
+	case errors.As(err, &mfa):
+		return utils.PrepareResponse(http.StatusUnauthorized, map[string]string{"Cache-Control": "no-store"}, map[string]interface{}{
+			"message":   mfa.Error(),
+			"error":     "mfa_required",
+			"mfaToken":  mfa.Token,
+			"expiresIn": int64(mfa.ExpiresIn.Seconds()),
+		})
+	case err != nil:
+		return authError(err)
+	}
+
+	return tokenResponse(tokens)
+}
+
+func (h *authHandlers) verifyMFA(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	challenge, _ := addInfo.Body["mfaToken"].(string)
+	code, _ := addInfo.Body["code"].(string)
+	recoveryCode, _ := addInfo.Body["recoveryCode"].(string)
+	if challenge == "" || (code == "" && recoveryCode == "") {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "mfaToken and code or recoveryCode are required",
+		})
+	}
+
+	tokens, err := h.auth.VerifyMFA(context.TODO(), challenge, code, recoveryCode, addInfo.SourceIP)
+	if err != nil {
+		return authError(err)
+	}
+
+	return tokenResponse(tokens)
+}
+
+func (h *authHandlers) stepUp(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	code, _ := addInfo.Body["code"].(string)
+	recoveryCode, _ := addInfo.Body["recoveryCode"].(string)
+	if code == "" && recoveryCode == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "code or recoveryCode is required",
+		})
+	}
+
+	tokens, err := h.auth.StepUp(context.TODO(), addInfo.Principal.UserID, code, recoveryCode, addInfo.SourceIP)
+	if err != nil {
+		return authError(err)
+	}
+
+	return tokenResponse(tokens)
+}
+
+func (h *authHandlers) mfaStatus(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	status, err := h.auth.MFAStatus(context.TODO(), addInfo.Principal.UserID)
+	if err != nil {
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"mfa": status,
+	})
+}
+
+func (h *authHandlers) enrollTOTP(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	enrollment, err := h.auth.EnrollTOTP(context.TODO(), addInfo.Principal.UserID)
+	if err != nil {
+		return authError(err)
+	}
+
+	// the secret must not be kept by browsers or proxies
+	return utils.PrepareResponse(http.StatusCreated, map[string]string{"Cache-Control": "no-store"}, map[string]interface{}{
+		"secret":     enrollment.Secret,
+		"otpauthUri": enrollment.URI,
+	})
+}
+
+func (h *authHandlers) confirmTOTP(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	code, _ := addInfo.Body["code"].(string)
+	if code == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "code is required",
+		})
+	}
+
+	codes, err := h.auth.ConfirmTOTP(context.TODO(), addInfo.Principal.UserID, code)
+	if err != nil {
+		return authError(err)
+	}
+
+	return recoveryCodesResponse(codes)
+}
+
+func (h *authHandlers) disableTOTP(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	password, _ := addInfo.Body["password"].(string)
+
+	err := h.auth.DisableTOTP(context.TODO(), addInfo.Principal.UserID, password)
+	if errors.Is(err, controller_users.ErrWrongPassword) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Multi-factor authentication disabled",
+	})
+}
+
+func (h *authHandlers) regenerateRecoveryCodes(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	codes, err := h.auth.RegenerateRecoveryCodes(context.TODO(), addInfo.Principal.UserID)
+	if err != nil {
+		return authError(err)
+	}
+
+	return recoveryCodesResponse(codes)
+}
+
+// recoveryCodesResponse shows recovery codes the only time they are available
+func recoveryCodesResponse(codes []string) events.APIGatewayProxyResponse {
+	return utils.PrepareResponse(http.StatusOK, map[string]string{"Cache-Control": "no-store"}, map[string]interface{}{
+		"recoveryCodes": codes,
+	})
+}
+
+func (h *authHandlers) refresh(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	token, _ := addInfo.Body["refreshToken"].(string)
+	if token == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "refreshToken is required",
+		})
+	}
+
+	tokens, err := h.auth.Refresh(context.TODO(), token)
+	if err != nil {
+		return authError(err)
+	}
+
+	return tokenResponse(tokens)
+}
+
+func (h *authHandlers) logout(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	token, _ := addInfo.Body["refreshToken"].(string)
+	if token == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "refreshToken is required",
+		})
+	}
+
+	if err := h.auth.Logout(context.TODO(), token); err != nil {
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Logged out",
+	})
+}
+
+func (h *authHandlers) forgotPassword(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	email, _ := addInfo.Body["email"].(string)
+	if email == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "email is required",
+		})
+	}
+
+	// failures are only logged: answering differently would tell registered emails apart
+	err := h.auth.ForgotPassword(mailContext(addInfo), email)
+	if errors.Is(err, mail.ErrDisabled) {
+		return mailDisabled() // the same for every email
+	}
+	if err != nil {
+		log.Printf("auth: forgot password: %v", err)
+	}
+
+	return utils.PrepareResponse(http.StatusAccepted, nil, map[string]interface{}{
+		"message": "If the email is registered, a reset link is on its way",
+	})
+}
+
+func (h *authHandlers) resetPassword(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	token, _ := addInfo.Body["token"].(string)
+	password, _ := addInfo.Body["password"].(string)
+	if token == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "token is required",
+		})
+	}
+
+	err := h.auth.ResetPassword(context.TODO(), token, password)
+
+	verr := (*controller_users.ValidationError)(nil)
+	switch {
+	case errors.As(err, &verr):
+		return validationError(verr)
+	case errors.Is(err, auth.ErrInvalidToken):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "invalid or expired reset token",
+		})
+	case err != nil:
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Password reset",
+	})
+}
+
+func (h *authHandlers) verifyEmail(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	token := addInfo.QueryParams["token"]
+	if t, ok := addInfo.Body["token"].(string); ok && t != "" {
+		token = t
+	}
+	if token == "" {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "token is required",
+		})
+	}
+
+	err := h.auth.VerifyEmail(context.TODO(), token)
+
+	switch {
+	case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrExpiredToken):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "invalid or expired verification link",
+		})
+	case err != nil:
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Email verified",
+	})
+}
+
+func (h *authHandlers) resendVerification(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	err := h.auth.ResendVerification(mailContext(addInfo), addInfo.Principal.UserID)
+
+	switch {
+	case errors.Is(err, controller_auth.ErrAlreadyVerified):
+		return utils.PrepareResponse(http.StatusConflict, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case errors.Is(err, mail.ErrDisabled):
+		return mailDisabled()
+	case err != nil:
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusAccepted, nil, map[string]interface{}{
+		"message": "Verification link sent",
+	})
+}
+
+func (h *authHandlers) unlockUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	err := h.auth.UnlockUser(context.TODO(), pathParams["userId"], addInfo.Principal.UserID)
+
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case err != nil:
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "User unlocked",
+	})
+}
+
+func (h *authHandlers) unlockIP(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	// IPv6 addresses arrive with their colons escaped; what fails to unescape is no address either
+	ip, err := url.PathUnescape(pathParams["ip"])
+	if err != nil {
+		ip = pathParams["ip"]
+	}
+
+	err = h.auth.UnlockIP(context.TODO(), ip, addInfo.Principal.UserID)
+
+	switch {
+	case errors.Is(err, controller_auth.ErrInvalidIP):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case err != nil:
+		return authError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "IP address unlocked",
+	})
+}
+
+// mailContext carries the language the caller asks for, so emails sent for the request use it
+func mailContext(addInfo router.AdditionalInfo) context.Context {
+	return mail.WithLocale(context.TODO(), addInfo.Header("Accept-Language"))
+}
+
+// mailDisabled answers 501 to the flows that need email while no mail driver is configured
+func mailDisabled() events.APIGatewayProxyResponse {
+	return utils.PrepareResponse(http.StatusNotImplemented, nil, map[string]interface{}{
+		"message": "email is not configured",
+	})
+}
+
+func tokenResponse(tokens controller_auth.Tokens) events.APIGatewayProxyResponse {
+	// tokens must not be kept by browsers or proxies
+	headers := map[string]string{"Cache-Control": "no-store"}
+
+	return utils.PrepareResponse(http.StatusOK, headers, map[string]interface{}{
+		"accessToken":  tokens.AccessToken,
+		"tokenType":    tokens.TokenType,
+		"expiresIn":    tokens.ExpiresIn,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+func authError(err error) events.APIGatewayProxyResponse {
+	var limited *ratelimit.LimitedError
+	switch {
+	case errors.As(err, &limited):
+		headers := map[string]string{"Retry-After": strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds())))}
+		return utils.PrepareResponse(http.StatusTooManyRequests, headers, utils.Responses[429])
+	case errors.Is(err, controller_auth.ErrInvalidCredentials), errors.Is(err, auth.ErrInvalidMFACode):
+		return utils.PrepareResponse(http.StatusUnauthorized, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, auth.ErrMFAEnabled), errors.Is(err, auth.ErrMFANotEnabled):
+		return utils.PrepareResponse(http.StatusConflict, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case errors.Is(err, auth.ErrTokenReused):
+		log.Printf("auth: %v, session revoked", err)
+		fallthrough
+	case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrExpiredToken):
+		return utils.PrepareResponse(http.StatusUnauthorized, nil, utils.Responses[401])
+	}
+
+	log.Printf("auth: %v", err)
+
+	return utils.PrepareResponse(http.StatusInternalServerError, nil, utils.Responses[500])
+}
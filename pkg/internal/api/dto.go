@@ -0,0 +1,40 @@
+package api
+
+import controller_users "serverless-aws-cdk/internal/controllers/users"
+
+// UserResponse is the public representation of a user.
+// Fields are copied explicitly, so fields added to the stored user stay private until they are added here.
+type UserResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	IsActive      bool   `json:"isActive"`
+	CreatedAt     int64  `json:"createdAt"`
+	UpdatedAt     int64  `json:"updatedAt"`
+	DeletedAt     int64  `json:"deletedAt,omitempty"` // only listed for admins, who see deleted users
+}
+
+// NewUserResponse maps a stored user to its public representation
+func NewUserResponse(u controller_users.User) UserResponse {
+	return UserResponse{
+		ID:            u.ID,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		IsActive:      u.IsActive == 1,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+		DeletedAt:     u.DeletedAt,
+	}
+}
+
+// NewUserResponses maps stored users to their public representation
+func NewUserResponses(users []controller_users.User) []UserResponse {
+	out := make([]UserResponse, len(users))
+	for i, u := range users {
+		out[i] = NewUserResponse(u)
+	}
+
+	return out
+}
@@ -0,0 +1,184 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/api"
+	"serverless-aws-cdk/internal/auth"
+	router "serverless-aws-cdk/lambdas"
+	"serverless-aws-cdk/utils"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// callers are the principals of the matrix, by bearer token; "" is the anonymous caller & "pwd-admin" an
+// admin who logged in with a password only
+var callers = []string{"", "user", "support", "admin", "pwd-admin"}
+
+// access lists the status of every route method for each of callers, in order.
+// A new route fails the test until its access is added here. The handler of GET /user/{userId} checks
+// who may read the user itself, see TestReadingUsers.
+var access = map[string][5]int{
+	"GET /all":                             {401, 403, 200, 200, 401},
+	"DELETE /auth/lockouts/ips/{ip}":       {401, 403, 200, 200, 401},
+	"DELETE /auth/lockouts/users/{userId}": {401, 403, 200, 200, 401},
+	"POST /auth/login":                     {200, 200, 200, 200, 200},
+	"POST /auth/logout":                    {200, 200, 200, 200, 200},
+	"GET /auth/mfa":                        {401, 200, 200, 200, 200},
+	"POST /auth/mfa/recovery-codes":        {401, 200, 200, 200, 401},
+	"POST /auth/mfa/step-up":               {401, 200, 200, 200, 200},
+	"DELETE /auth/mfa/totp":                {401, 200, 200, 200, 401},
+	"POST /auth/mfa/totp":                  {401, 200, 200, 200, 200},
+	"POST /auth/mfa/totp/confirm":          {401, 200, 200, 200, 200},
+	"POST /auth/mfa/verify":                {200, 200, 200, 200, 200},
+	"POST /auth/password/forgot":           {200, 200, 200, 200, 200},
+	"POST /auth/password/reset":            {200, 200, 200, 200, 200},
+	"POST /auth/refresh":                   {200, 200, 200, 200, 200},
+	"GET /auth/verify":                     {200, 200, 200, 200, 200},
+	"POST /auth/verify":                    {200, 200, 200, 200, 200},
+	"POST /auth/verify/resend":             {401, 200, 200, 200, 200},
+	"POST /user":                           {200, 200, 200, 200, 200},
+	"DELETE /user/{userId}":                {401, 200, 200, 200, 200},
+	"GET /user/{userId}":                   {401, 200, 200, 200, 200},
+	"PATCH /user/{userId}":                 {401, 200, 200, 200, 200},
+	"PUT /user/{userId}":                   {401, 200, 200, 200, 200},
+	"POST /user/{userId}/deactivate":       {401, 200, 200, 200, 200},
+	"PUT /user/{userId}/email":             {401, 200, 200, 200, 200},
+	"POST /user/{userId}/restore":          {401, 403, 200, 200, 401},
+	"PUT /user/{userId}/roles":             {401, 403, 403, 200, 401},
+}
+
+// principal authenticates the tokens of callers as verified users who just passed MFA, except pwd-admin
+func principal(token string) (router.Principal, error) {
+	roles := map[string][]string{"user": nil, "support": {auth.RoleSupport}, "admin": {auth.RoleAdmin}, "pwd-admin": {auth.RoleAdmin}}
+
+	granted, ok := roles[token]
+	if !ok {
+		return router.Principal{}, errors.New("unknown token")
+	}
+
+	p := router.Principal{
+		UserID:        token,
+		EmailVerified: true,
+		Roles:         granted,
+		Permissions:   auth.ResolvePermissions(granted, nil),
+		MFAAt:         time.Now(),
+	}
+	if token == "pwd-admin" {
+		p.MFAAt = time.Time{}
+	}
+
+	return p, nil
+}
+
+func TestRouteAccess(t *testing.T) {
+	routes := api.UserRoutes(nil, nil)
+	for path, route := range api.AuthRoutes(nil) {
+		routes[path] = route
+	}
+
+	// only the router decides here: the handlers are replaced by one that always succeeds
+	ok := func(map[string]string, router.AdditionalInfo) events.APIGatewayProxyResponse {
+		return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{})
+	}
+	for _, route := range routes {
+		for method, cfg := range route.Methods {
+			cfg.Callback = ok
+			route.Methods[method] = cfg
+		}
+	}
+
+	authenticator := router.Authenticator
+	router.Authenticator = principal
+	t.Cleanup(func() { router.Authenticator = authenticator })
+
+	params := strings.NewReplacer("{userId}", "user", "{ip}", "192.0.2.1")
+	seen := map[string]bool{}
+
+	for _, rule := range router.Rules(routes) {
+		name := rule.Method + " " + rule.Path
+		seen[name] = true
+
+		want, ok := access[name]
+		if !ok {
+			t.Errorf("%s is missing from the access matrix", name)
+			continue
+		}
+
+		for i, token := range callers {
+			req := events.APIGatewayProxyRequest{
+				HTTPMethod:     rule.Method,
+				Path:           "/api/v1/users" + params.Replace(rule.Path),
+				PathParameters: map[string]string{},
+				Headers:        map[string]string{},
+			}
+			if token != "" {
+				req.Headers["Authorization"] = "Bearer " + token
+			}
+
+			if got := router.Router(context.Background(), req, routes).StatusCode; got != want[i] {
+				t.Errorf("%s by %q = %d, want %d", name, token, got, want[i])
+			}
+		}
+	}
+
+	for name := range access {
+		if !seen[name] {
+			t.Errorf("%s is in the access matrix but no route serves it", name)
+		}
+	}
+}
+
+func TestReadingUsers(t *testing.T) {
+	s := newServer(t)
+
+	ann := s.register("Ann", "ann@example.com")
+	bob := s.register("Bob", "bob@example.com")
+	if err := s.users.SetRoles(context.Background(), bob, []string{auth.RoleSupport}, nil); err != nil {
+		t.Fatal(err)
+	}
+	cid := s.register("Cid", "cid@example.com")
+
+	annToken, bobPassword := s.login("ann@example.com"), s.login("bob@example.com")
+	bobToken := s.stepUp(bobPassword)
+
+	if status, _ := s.call(http.MethodPost, "/user/"+cid+"/deactivate", s.login("cid@example.com"), map[string]string{"password": password}); status != http.StatusOK {
+		t.Fatalf("deactivating cid = %d", status)
+	}
+
+	tests := []struct {
+		name, token, path string
+		want              int
+		users             int // listed by /all
+	}{
+		{"anonymous reads a user", "", "/user/" + bob, http.StatusUnauthorized, 0},
+		{"user reads itself", annToken, "/user/" + ann, http.StatusOK, 0},
+		{"user reads another user", annToken, "/user/" + bob, http.StatusForbidden, 0},
+		{"support reads another user", bobToken, "/user/" + ann, http.StatusOK, 0},
+		{"support reads an unknown user", bobToken, "/user/unknown", http.StatusNotFound, 0},
+		{"support without MFA reads another user", bobPassword, "/user/" + ann, http.StatusUnauthorized, 0},
+		{"support without MFA reads itself", bobPassword, "/user/" + bob, http.StatusOK, 0},
+		{"anonymous lists users", "", "/all", http.StatusUnauthorized, 0},
+		{"user lists users", annToken, "/all", http.StatusForbidden, 0},
+		{"support without MFA lists users", bobPassword, "/all", http.StatusUnauthorized, 0},
+		{"support lists active users", bobToken, "/all", http.StatusOK, 2},
+		{"support lists inactive users too", bobToken, "/all?includeInactive=true", http.StatusOK, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, out := s.call(http.MethodGet, tt.path, tt.token, nil)
+			if status != tt.want {
+				t.Fatalf("GET %s = %d %v, want %d", tt.path, status, out, tt.want)
+			}
+			if tt.users > 0 && len(out["users"].([]interface{})) != tt.users {
+				t.Errorf("GET %s listed %v, want %d users", tt.path, out["users"], tt.users)
+			}
+		})
+	}
+}
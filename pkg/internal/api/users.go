@@ -1,76 +1,400 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
+	"serverless-aws-cdk/internal/auth"
+	controller_auth "serverless-aws-cdk/internal/controllers/auth"
 	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/patch"
 	router "serverless-aws-cdk/lambdas"
 	"serverless-aws-cdk/utils"
 
 	"github.com/aws/aws-lambda-go/events"
 )
 
-var UserRoutes = map[string]router.RouteConfig{
-	"/user/{userId}": {
-		Methods: map[string]router.RouteMethodConfig{
-			http.MethodGet: {
-				Callback: getUser,
+type userHandlers struct {
+	users    *controller_users.Controller
+	accounts *controller_auth.Controller
+}
+
+// UserRoutes builds the user routes on top of the given controllers; accounts sends verification links
+func UserRoutes(users *controller_users.Controller, accounts *controller_auth.Controller) map[string]router.RouteConfig {
+	h := &userHandlers{users: users, accounts: accounts}
+
+	return map[string]router.RouteConfig{
+		"/user/{userId}": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodGet: {
+					Callback:     h.getUser,
+					Authenticate: true,
+				},
+				http.MethodPut: {
+					Callback:     h.updateUser,
+					Authenticate: true,
+				},
+				http.MethodPatch: {
+					Callback:     h.patchUser,
+					Authenticate: true,
+				},
+				http.MethodDelete: {
+					Callback:     h.deleteUser,
+					Authenticate: true,
+				},
+			},
+		},
+		"/user/{userId}/deactivate": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:     h.deactivateUser,
+					Authenticate: true,
+				},
+			},
+		},
+		"/user/{userId}/restore": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback:    h.restoreUser,
+					Permissions: []string{auth.PermUsersRestoreAny},
+					Verified:    true,
+					RecentMFA:   adminMFAAge,
+				},
 			},
 		},
-	},
-	"/user": {
-		Methods: map[string]router.RouteMethodConfig{
-			http.MethodPost: {
-				Callback: createUser,
+		"/user/{userId}/roles": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPut: {
+					Callback:    h.setRoles,
+					Permissions: []string{auth.PermUsersRolesWrite},
+					Verified:    true,
+					RecentMFA:   adminMFAAge,
+				},
 			},
 		},
-	},
-	"/all": {
-		Methods: map[string]router.RouteMethodConfig{
-			http.MethodGet: {
-				Callback: getAllUsers,
+		"/user/{userId}/email": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPut: {
+					Callback:     h.changeEmail,
+					Authenticate: true,
+				},
 			},
 		},
-	},
+		"/user": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodPost: {
+					Callback: h.createUser,
+				},
+			},
+		},
+		"/all": {
+			Methods: map[string]router.RouteMethodConfig{
+				http.MethodGet: {
+					Callback:    h.getAllUsers,
+					Permissions: []string{auth.PermUsersReadAny},
+					RecentMFA:   adminMFAAge,
+				},
+			},
+		},
+	}
 }
 
-func getUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+// getUser answers the user itself & callers who may read any user & passed MFA as recently as the admin
+// routes require; the others get 403, or a step-up challenge when only their MFA is missing or too old
+func (h *userHandlers) getUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		if !addInfo.Principal.Can(auth.PermUsersReadAny) {
+			return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+		}
+		if !addInfo.Principal.PassedMFAWithin(adminMFAAge) {
+			return router.StepUpRequired(adminMFAAge)
+		}
+	}
+
 	userId := pathParams["userId"]
-	user, err := controller_users.GetUser(userId)
+	user, err := h.users.GetUser(userId)
 
 	if err != nil {
 		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
-			"message": err,
+			"message": err.Error(),
 		})
 	}
 
+	if user.ID == "" {
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	}
+
 	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
-		"user": user,
+		"user": NewUserResponse(user),
 	})
 }
 
-func createUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+func (h *userHandlers) createUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
 	userInfo := addInfo.Body
-	err := controller_users.CreateUser(userInfo["name"].(string), userInfo["email"].(string), userInfo["password"].(string))
+	name, _ := userInfo["name"].(string)
+	email, _ := userInfo["email"].(string)
+	password, _ := userInfo["password"].(string)
+
+	user, err := h.users.CreateUser(name, email, password)
+
+	if errors.Is(err, controller_users.ErrEmailTaken) {
+		return utils.PrepareResponse(http.StatusConflict, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+
+	if verr := (*controller_users.ValidationError)(nil); errors.As(err, &verr) {
+		return validationError(verr)
+	}
 
 	if err != nil {
 		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
-			"message": err,
+			"message": err.Error(),
 		})
 	}
 
+	// the user can ask for another link, so a failed email does not fail the registration
+	if err := h.accounts.SendVerification(mailContext(addInfo), user); err != nil {
+		log.Printf("users: sending the verification link of %s: %v", user.ID, err)
+	}
+
 	return utils.PrepareResponse(http.StatusOK, nil, utils.Responses[201])
 }
 
-func getAllUsers(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
-	users, err := controller_users.GetAllUsers()
+// ownsAccount reports whether the authenticated caller is the user the route acts on.
+// Self-service routes answer 403 otherwise, whoever the caller is.
+func ownsAccount(pathParams map[string]string, addInfo router.AdditionalInfo) bool {
+	return addInfo.Principal != nil && addInfo.Principal.UserID == pathParams["userId"]
+}
+
+// validationError answers 400 with every field error, so clients can show them next to their fields
+func validationError(err *controller_users.ValidationError) events.APIGatewayProxyResponse {
+	return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+		"message": "invalid fields",
+		"errors":  err.Fields,
+	})
+}
+
+// accountError maps the errors of the self-service use cases to responses
+func accountError(err error) events.APIGatewayProxyResponse {
+	if verr := (*controller_users.ValidationError)(nil); errors.As(err, &verr) {
+		return validationError(verr)
+	}
+
+	switch {
+	case errors.Is(err, controller_users.ErrWrongPassword):
+		// not 401: the caller is authenticated, the confirmation failed
+		return utils.PrepareResponse(http.StatusForbidden, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, controller_users.ErrEmailTaken):
+		return utils.PrepareResponse(http.StatusConflict, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, controller_users.ErrInvalidEmail), errors.Is(err, controller_users.ErrSamePassword), errors.Is(err, controller_users.ErrNoChanges):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case db.IsConditionFailed(err):
+		// the user changed between reading & writing it
+		return utils.PrepareResponse(http.StatusConflict, nil, utils.Responses[409])
+	}
+
+	log.Printf("users: %v", err)
+
+	return utils.PrepareResponse(http.StatusInternalServerError, nil, utils.Responses[500])
+}
+
+func (h *userHandlers) updateUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
+	currentPassword, _ := addInfo.Body["currentPassword"].(string)
+	name, _ := addInfo.Body["name"].(string)
+	newPassword, _ := addInfo.Body["newPassword"].(string)
+
+	if err := h.users.UpdateUser(pathParams["userId"], currentPassword, name, newPassword, h.accounts.EndSessionsTx); err != nil {
+		return accountError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "User updated",
+	})
+}
+
+func (h *userHandlers) deleteUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
+	password, _ := addInfo.Body["password"].(string)
+
+	if err := h.users.DeleteUser(pathParams["userId"], password); err != nil {
+		return accountError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "User deleted",
+	})
+}
+
+func (h *userHandlers) deactivateUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
+	password, _ := addInfo.Body["password"].(string)
+
+	if err := h.users.DeactivateUser(pathParams["userId"], password); err != nil {
+		return accountError(err)
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "User deactivated",
+	})
+}
+
+func (h *userHandlers) restoreUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	err := h.users.RestoreUser(context.TODO(), pathParams["userId"])
+
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case errors.Is(err, controller_users.ErrNotDeleted):
+		return utils.PrepareResponse(http.StatusConflict, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case db.IsConditionFailed(err):
+		// restored or purged since it was read
+		return utils.PrepareResponse(http.StatusConflict, nil, utils.Responses[409])
+	case err != nil:
+		log.Printf("users: %v", err)
+		return utils.PrepareResponse(http.StatusInternalServerError, nil, utils.Responses[500])
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "User restored",
+	})
+}
+
+func (h *userHandlers) setRoles(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	roles, ok := stringList(addInfo.Body["roles"])
+	permissions, okPermissions := stringList(addInfo.Body["permissions"])
+	if !ok || !okPermissions {
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": "roles & permissions must be lists of strings",
+		})
+	}
+
+	err := h.users.SetRoles(context.TODO(), pathParams["userId"], roles, permissions)
+
+	switch {
+	case errors.Is(err, auth.ErrUnknownRole), errors.Is(err, auth.ErrUnknownPermission):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case err != nil:
+		log.Printf("users: %v", err)
+		return utils.PrepareResponse(http.StatusInternalServerError, nil, utils.Responses[500])
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Roles updated",
+	})
+}
+
+// stringList converts a JSON array of strings; a missing value is an empty list
+func stringList(v interface{}) ([]string, bool) {
+	if v == nil {
+		return nil, true
+	}
+
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	out := make([]string, len(items))
+	for i, item := range items {
+		if out[i], ok = item.(string); !ok {
+			return nil, false
+		}
+	}
+
+	return out, true
+}
+
+func (h *userHandlers) changeEmail(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
+	email, _ := addInfo.Body["email"].(string)
+	password, _ := addInfo.Body["password"].(string)
+
+	if err := h.users.ChangeEmail(context.TODO(), pathParams["userId"], password, email); err != nil {
+		return accountError(err)
+	}
+
+	if user, err := h.users.GetUser(pathParams["userId"]); err == nil && user.ID != "" && !user.EmailVerified {
+		if err := h.accounts.SendVerification(mailContext(addInfo), user); err != nil {
+			log.Printf("users: sending the verification link of %s: %v", user.ID, err)
+		}
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"message": "Email changed",
+	})
+}
+
+func (h *userHandlers) patchUser(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	if !ownsAccount(pathParams, addInfo) {
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
+	user, err := h.users.PatchUser(pathParams["userId"], addInfo.Header("Content-Type"), []byte(addInfo.RawBody))
+
+	switch {
+	case errors.Is(err, patch.ErrUnsupportedType):
+		return utils.PrepareResponse(http.StatusUnsupportedMediaType, nil, utils.Responses[415])
+	case errors.Is(err, patch.ErrInvalid):
+		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, db.ErrNotFound):
+		return utils.PrepareResponse(http.StatusNotFound, nil, utils.Responses[404])
+	case errors.Is(err, patch.ErrTestFailed), db.IsConditionFailed(err):
+		// a failed test, or the user changed between reading & writing it
+		return utils.PrepareResponse(http.StatusConflict, nil, utils.Responses[409])
+	case err != nil:
+		log.Printf("users: patching %s: %v", pathParams["userId"], err)
+		return utils.PrepareResponse(http.StatusInternalServerError, nil, utils.Responses[500])
+	}
+
+	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
+		"user": NewUserResponse(user),
+	})
+}
+
+func (h *userHandlers) getAllUsers(pathParams map[string]string, addInfo router.AdditionalInfo) events.APIGatewayProxyResponse {
+	includeInactive := addInfo.QueryParams["includeInactive"] == "true"
+
+	users, err := h.users.ListUsers(context.TODO(), includeInactive)
 
 	if err != nil {
 		return utils.PrepareResponse(http.StatusBadRequest, nil, map[string]interface{}{
-			"message": err,
+			"message": err.Error(),
 		})
 	}
 
 	return utils.PrepareResponse(http.StatusOK, nil, map[string]interface{}{
-		"users": users,
+		"users": NewUserResponses(users),
 	})
 }
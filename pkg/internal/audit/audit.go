@@ -0,0 +1,88 @@
+// Package audit records security relevant actions, such as account lockouts, in the main table.
+//
+// Entries are written in the same transaction as the change they describe, so an entry is stored
+// if & only if the change is. They are kept in one partition per UTC day, oldest first, & never expire.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the log
+const (
+	ActionLockout = "lockout" // failed logins locked an account or an IP address out
+	ActionUnlock  = "unlock"  // an admin lifted a lockout
+)
+
+// dateLayout names the daily partitions
+const dateLayout = "2006-01-02"
+
+// Entry is one recorded action
+type Entry struct {
+	Date    string            `json:"date" dynamodbav:"date"` // UTC day of At
+	ID      string            `json:"id" dynamodbav:"id"`     // UUIDv7, so entries sort in the order they were recorded
+	Action  string            `json:"action" dynamodbav:"action"`
+	Subject string            `json:"subject" dynamodbav:"subject"`                     // what was acted on, e.g. "account:ada@example.com"
+	Actor   string            `json:"actor,omitempty" dynamodbav:"actor,omitempty"`     // ID of the user who acted, empty for the system
+	Details map[string]string `json:"details,omitempty" dynamodbav:"details,omitempty"` // depending on the action
+	At      int64             `json:"at" dynamodbav:"at"`
+}
+
+// Entries stores the entries of each day in their own partition
+var Entries = db.RegisterEntity[Entry](db.EntityOptions{
+	Type:         "AUDIT_ENTRY",
+	PartitionKey: "AUDIT#{date}",
+	SortKey:      "{id}",
+})
+
+// NewEntry creates an entry of action on subject by actor, happening now
+func NewEntry(action, subject, actor string, details map[string]string) (Entry, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	now := db.Now().UTC()
+
+	return Entry{
+		Date:    now.Format(dateLayout),
+		ID:      id.String(),
+		Action:  action,
+		Subject: subject,
+		Actor:   actor,
+		Details: details,
+		At:      now.Unix(),
+	}, nil
+}
+
+// Log stores entries in a table
+type Log struct {
+	entries *db.Repository[Entry]
+}
+
+// New creates a log stored in table
+func New(database db.Client, table db.Table) *Log {
+	return &Log{entries: db.NewRepository(database, table, Entries)}
+}
+
+// Append adds entries to tx, so they are stored only if the rest of tx commits
+func (l *Log) Append(tx *db.Transaction, entries ...Entry) error {
+	for _, e := range entries {
+		if err := l.entries.CreateTx(tx, e); err != nil {
+			return fmt.Errorf("audit: adding %s entry: %w", e.Action, err)
+		}
+	}
+
+	return nil
+}
+
+// Day returns the entries recorded on the UTC day of t, oldest first
+func (l *Log) Day(ctx context.Context, t time.Time) ([]Entry, error) {
+	return l.entries.List(ctx, db.Keys{"date": t.UTC().Format(dateLayout)})
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BreachedRanges looks up breached passwords by k-anonymity: callers only reveal the first 5 hex digits
+// of the SHA-1 of a password & get back the rest of every breached hash sharing them. The Pwned Passwords
+// range API has the same shape, so a client of it can stand in for the bundled corpus.
+type BreachedRanges interface {
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
+// breached holds the upper case SHA-1 hex of common leaked passwords, one per line & sorted.
+// Add entries as hashes only, keeping the file sorted.
+//
+//go:embed breached.txt
+var breached string
+
+// Bundled is the breached password corpus shipped with the binary
+var Bundled BreachedRanges = &bundled{}
+
+type bundled struct {
+	once   sync.Once
+	hashes []string
+}
+
+func (b *bundled) Range(ctx context.Context, prefix string) ([]string, error) {
+	b.once.Do(func() {
+		b.hashes = strings.Fields(breached)
+	})
+
+	prefix = strings.ToUpper(prefix)
+
+	var suffixes []string
+	for i := sort.SearchStrings(b.hashes, prefix); i < len(b.hashes) && strings.HasPrefix(b.hashes[i], prefix); i++ {
+		suffixes = append(suffixes, b.hashes[i][len(prefix):])
+	}
+
+	return suffixes, nil
+}
+
+// IsBreached reports whether password is in ranges, revealing only the first 5 hex digits of its SHA-1
+func IsBreached(ctx context.Context, ranges BreachedRanges, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := ranges.Range(ctx, digest[:5])
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range suffixes {
+		if strings.EqualFold(s, digest[5:]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
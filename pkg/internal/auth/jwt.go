@@ -0,0 +1,162 @@
+// Package auth issues & verifies the tokens of signed-in sessions.
+//
+// Access tokens are short-lived HS256 JWTs, verified without reading the table. Refresh tokens are
+// opaque random strings stored hashed in the table. Each one can be used once & is replaced by the
+// next token of its family. A token used a second time means a copy leaked, so the whole family is
+// revoked & its holder has to log in again.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed, forged, revoked or unknown tokens
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for access tokens past their expiry
+	ErrExpiredToken = errors.New("token expired")
+	// ErrTokenReused is returned when a refresh token is used twice; its family is revoked
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// leeway tolerates clock skew between the issuing & the verifying Lambda
+const leeway = 30 * time.Second
+
+// Authentication methods of the amr claim, as registered by RFC 8176
+const (
+	MethodPassword = "pwd"
+	MethodOTP      = "otp"
+)
+
+// Claims are the registered JWT claims of an access token plus the user's email, authorization & how
+// the session was authenticated
+type Claims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"` // user id
+	Email       string   `json:"email,omitempty"`
+	Verified    bool     `json:"email_verified,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"` // resolved from the roles & the user's own grants at issue time
+	Methods     []string `json:"amr,omitempty"`
+	MFAAt       int64    `json:"mfa_at,omitempty"` // unix seconds the session last passed MFA, kept across refreshes
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	ID          string   `json:"jti"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// Signer issues & verifies HS256 access tokens
+type Signer struct {
+	key    []byte
+	issuer string
+	ttl    time.Duration
+
+	// Now returns the current time, replaceable in tests
+	Now func() time.Time
+}
+
+// NewSigner creates a signer of tokens valid for ttl
+func NewSigner(key []byte, issuer string, ttl time.Duration) *Signer {
+	return &Signer{key: key, issuer: issuer, ttl: ttl, Now: time.Now}
+}
+
+// TTL returns the lifetime of issued tokens
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+// Issue signs an access token carrying the subject, email & authorization of claims.
+// The registered claims (issuer, times & id) are set here & returned with the token.
+func (s *Signer) Issue(claims Claims) (string, Claims, error) {
+	now := s.Now()
+	claims.Issuer = s.issuer
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(s.ttl).Unix()
+	claims.ID = uuid.NewString()
+
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", Claims{}, err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+
+	signingInput := encode(h) + "." + encode(c)
+
+	return signingInput + "." + encode(s.sign(signingInput)), claims, nil
+}
+
+// Verify checks the signature, issuer & expiry of token & returns its claims
+func (s *Signer) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	sig, err := decode(parts[2])
+	if err != nil || !hmac.Equal(sig, s.sign(parts[0]+"."+parts[1])) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil || h.Alg != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	if claims.Issuer != s.issuer || claims.Subject == "" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	if !s.Now().Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return Claims{}, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+func (s *Signer) sign(input string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func decodeJSON(s string, v interface{}) error {
+	b, err := decode(s)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("decoding token: %w", err)
+	}
+
+	return nil
+}
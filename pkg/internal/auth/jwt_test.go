@@ -0,0 +1,112 @@
+package auth_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/auth"
+)
+
+var signingKey = []byte(strings.Repeat("k", 32))
+
+// newSigner issues tokens valid for 15 minutes at a settable time
+func newSigner(key []byte, issuer string, now *time.Time) *auth.Signer {
+	s := auth.NewSigner(key, issuer, 15*time.Minute)
+	s.Now = func() time.Time { return *now }
+
+	return s
+}
+
+func TestSignerIssuesVerifiableTokens(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	signer := newSigner(signingKey, "test", &now)
+
+	token, issued, err := signer.Issue(auth.Claims{
+		Subject:     "user-1",
+		Email:       "ann@example.com",
+		Roles:       []string{"admin"},
+		Permissions: []string{"users:read:any"},
+		Methods:     []string{auth.MethodPassword, auth.MethodOTP},
+		MFAAt:       now.Unix(),
+		Issuer:      "forged", // set by Issue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issued.Issuer != "test" || issued.IssuedAt != now.Unix() || issued.ExpiresAt != now.Add(15*time.Minute).Unix() || issued.ID == "" {
+		t.Errorf("registered claims = %+v", issued)
+	}
+
+	got, err := signer.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, issued) {
+		t.Errorf("Verify = %+v, want %+v", got, issued)
+	}
+}
+
+func TestVerifyRejectsForgedTokens(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	signer := newSigner(signingKey, "test", &now)
+
+	token, _, err := signer.Issue(auth.Claims{Subject: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	otherKey, _, _ := newSigner([]byte(strings.Repeat("x", 32)), "test", &now).Issue(auth.Claims{Subject: "user-1"})
+	otherIssuer, _, _ := newSigner(signingKey, "other", &now).Issue(auth.Claims{Subject: "user-1"})
+	noSubject, _, _ := signer.Issue(auth.Claims{})
+
+	// the claims of another user under the original signature
+	admin := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"test","sub":"admin-1","iat":1700000000,"exp":1700000900,"jti":"x"}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	tests := map[string]string{
+		"other key":        otherKey,
+		"other issuer":     otherIssuer,
+		"no subject":       noSubject,
+		"swapped claims":   parts[0] + "." + admin + "." + parts[2],
+		"unsigned":         none + "." + parts[1] + ".",
+		"missing part":     parts[0] + "." + parts[1],
+		"signature padded": token + "=",
+		"empty":            "",
+	}
+
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := signer.Verify(token); !errors.Is(err, auth.ErrInvalidToken) {
+				t.Errorf("Verify = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiryWithLeeway(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	signer := newSigner(signingKey, "test", &now)
+
+	token, claims, err := signer.Issue(auth.Claims{Subject: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Unix(claims.ExpiresAt, 0)
+
+	// clocks of other Lambdas may run up to 30s behind the issuer's
+	now = expiry.Add(29 * time.Second)
+	if _, err := signer.Verify(token); err != nil {
+		t.Errorf("Verify 29s after expiry = %v, want the token accepted", err)
+	}
+
+	now = expiry.Add(30 * time.Second)
+	if _, err := signer.Verify(token); !errors.Is(err, auth.ErrExpiredToken) {
+		t.Errorf("Verify 30s after expiry = %v, want ErrExpiredToken", err)
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Keyring holds the key new secrets are sealed or signed with & the retired keys that still open what
+// they sealed. Each key is known by an id stored next to what it sealed, so keys can be rotated without
+// losing the secrets sealed before.
+type Keyring struct {
+	current string
+	keys    map[string][]byte // by id
+}
+
+// KeyID identifies key without revealing it: the first 8 bytes of its SHA-256, in hex
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewKeyring creates a keyring sealing with current & also opening with the previous keys
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	if len(current) == 0 {
+		return nil, errors.New("auth: a keyring needs a current key")
+	}
+
+	k := &Keyring{current: KeyID(current), keys: map[string][]byte{}}
+	for _, key := range append([][]byte{current}, previous...) {
+		if len(key) > 0 {
+			k.keys[KeyID(key)] = key
+		}
+	}
+
+	return k, nil
+}
+
+// Current returns the key new secrets are sealed with & its id
+func (k *Keyring) Current() (id string, key []byte) {
+	return k.current, k.keys[k.current]
+}
+
+// Key returns the key with id, if the keyring holds it
+func (k *Keyring) Key(id string) ([]byte, bool) {
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// IDs returns the id of every key, the current one first
+func (k *Keyring) IDs() []string {
+	ids := []string{k.current}
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Derive returns the keyring of the keys derived from these for purpose, each under the id of the key it
+// is derived from, so keys of different purposes never coincide
+func (k *Keyring) Derive(purpose string) *Keyring {
+	derived := &Keyring{current: k.current, keys: map[string][]byte{}}
+	for id, key := range k.keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(purpose))
+		derived.keys[id] = mac.Sum(nil)
+	}
+
+	return derived
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"serverless-aws-cdk/internal/audit"
+	"serverless-aws-cdk/internal/config"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/ratelimit"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Scopes failed logins are counted & locked out in
+const (
+	ScopeAccount = "account" // keyed by normalized email, so unknown emails lock out like registered ones
+	ScopeIP      = "ip"      // keyed by source IP address
+)
+
+// ErrUnknownScope is returned for scopes other than ScopeAccount & ScopeIP
+var ErrUnknownScope = errors.New("unknown lockout scope")
+
+// Lockout is a stored lockout of an account or IP address; it expires through the table's time to live
+type Lockout struct {
+	Scope    string `json:"scope" dynamodbav:"scope"`
+	Key      string `json:"key" dynamodbav:"key"`
+	Failures int    `json:"failures" dynamodbav:"failures"` // failed logins in the window that triggered it
+	LockedAt int64  `json:"lockedAt" dynamodbav:"lockedAt"`
+	Until    int64  `json:"until" dynamodbav:"until"`
+}
+
+// Lockouts stores the lockout of each account & IP address in its own partition
+var Lockouts = db.RegisterEntity[Lockout](db.EntityOptions{
+	Type:         "LOCKOUT",
+	PartitionKey: "LOCKOUT#{scope}#{key}",
+	SortKey:      "LOCKOUT",
+})
+
+// Throttle slows down & locks out password guessing. Failed logins are counted per account & per source
+// IP address in fixed windows. After cfg.DelayAfter failures an account waits before each further attempt,
+// twice as long after each failure. Reaching cfg.MaxFailures or cfg.IPMaxFailures in a window locks the
+// account or address out for cfg.Duration, & records the lockout in the audit log.
+type Throttle struct {
+	failures map[string]*ratelimit.Counter // by scope
+	lockouts *db.Repository[Lockout]
+	audit    *audit.Log
+	db       db.Client
+	table    db.Table
+	cfg      config.Lockout
+}
+
+// NewThrottle creates a throttle counting failures & storing lockouts in table
+func NewThrottle(database db.Client, table db.Table, cfg config.Lockout) *Throttle {
+	return &Throttle{
+		failures: map[string]*ratelimit.Counter{
+			ScopeAccount: ratelimit.NewCounter(database, table, "login-account", cfg.Window.Std()),
+			ScopeIP:      ratelimit.NewCounter(database, table, "login-ip", cfg.Window.Std()),
+		},
+		lockouts: db.NewRepository(database, table, Lockouts),
+		audit:    audit.New(database, table),
+		db:       database,
+		table:    table,
+		cfg:      cfg,
+	}
+}
+
+// Check fails with a *ratelimit.LimitedError while account or ip is locked out, or while the account waits
+// after its latest failure. Callers must not check the password of refused attempts, so they guess nothing.
+// An empty ip is not checked.
+func (t *Throttle) Check(ctx context.Context, account, ip string) error {
+	for _, target := range [][2]string{{ScopeAccount, account}, {ScopeIP, ip}} {
+		if target[1] == "" {
+			continue
+		}
+
+		lockout, err := t.lockouts.Get(ctx, db.Keys{"scope": target[0], "key": target[1]})
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if wait := time.Unix(lockout.Until, 0).Sub(db.Now()); wait > 0 {
+			return &ratelimit.LimitedError{RetryAfter: wait}
+		}
+	}
+
+	w, err := t.failures[ScopeAccount].Get(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	if wait := time.Unix(w.Last, 0).Add(t.delay(w.Count)).Sub(db.Now()); w.Count > 0 && wait > 0 {
+		return &ratelimit.LimitedError{RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// Failed counts a failed login to account from ip, locking either out when it reaches its limit.
+// An empty ip is not counted.
+func (t *Throttle) Failed(ctx context.Context, account, ip string) error {
+	w, err := t.failures[ScopeAccount].Add(ctx, account)
+	if err != nil {
+		return err
+	}
+	if w.Count >= t.cfg.MaxFailures {
+		if err := t.lock(ctx, ScopeAccount, account, w.Count); err != nil {
+			return err
+		}
+	}
+
+	if ip == "" {
+		return nil
+	}
+
+	w, err = t.failures[ScopeIP].Add(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if w.Count >= t.cfg.IPMaxFailures {
+		return t.lock(ctx, ScopeIP, ip, w.Count)
+	}
+
+	return nil
+}
+
+// Succeeded forgets the failures of account after a successful login; those of its IP address remain
+func (t *Throttle) Succeeded(ctx context.Context, account string) error {
+	return t.failures[ScopeAccount].Reset(ctx, account)
+}
+
+// Unlock lifts the lockout of key in scope, if any, & forgets its failures. The unlock is recorded in the
+// audit log as done by actor, the ID of the admin.
+func (t *Throttle) Unlock(ctx context.Context, scope, key, actor string) error {
+	counter, ok := t.failures[scope]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownScope, scope)
+	}
+
+	entry, err := audit.NewEntry(audit.ActionUnlock, scope+":"+key, actor, nil)
+	if err != nil {
+		return err
+	}
+
+	tx := db.NewTransaction(t.db)
+	if err := t.lockouts.DeleteTx(tx, db.Keys{"scope": scope, "key": key}); err != nil {
+		return err
+	}
+	if err := t.audit.Append(tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return counter.Reset(ctx, key)
+}
+
+// delay returns how long an account waits after failures failed logins: nothing before cfg.DelayAfter,
+// then cfg.Delay doubled by every further failure, up to cfg.MaxDelay
+func (t *Throttle) delay(failures int) time.Duration {
+	if failures < t.cfg.DelayAfter {
+		return 0
+	}
+
+	d, limit := t.cfg.Delay.Std(), t.cfg.MaxDelay.Std()
+	for i := t.cfg.DelayAfter; i < failures && d < limit; i++ {
+		d *= 2
+	}
+
+	return min(d, limit)
+}
+
+// lock stores a lockout of key in scope with its audit entry. Only the failure that reaches the limit
+// first locks: the lockout is written on the condition that none is in force, so concurrent failures
+// record one entry.
+func (t *Throttle) lock(ctx context.Context, scope, key string, failures int) error {
+	now := db.Now()
+	until := now.Add(t.cfg.Duration.Std())
+
+	av, err := t.lockouts.Marshal(Lockout{
+		Scope:    scope,
+		Key:      key,
+		Failures: failures,
+		LockedAt: now.Unix(),
+		Until:    until.Unix(),
+	}, db.ExpiresAt(until))
+	if err != nil {
+		return err
+	}
+
+	// DynamoDB deletes expired items late, so an expired lockout counts as none
+	cond := expression.AttributeNotExists(expression.Name(t.table.PartitionKey)).
+		Or(expression.Name(t.table.TimeToLive).LessThanEqual(expression.Value(now.Unix())))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	entry, err := audit.NewEntry(audit.ActionLockout, scope+":"+key, "", map[string]string{
+		"failures": strconv.Itoa(failures),
+		"until":    until.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	tx := db.NewTransaction(t.db)
+	tx.Add(types.TransactWriteItem{Put: &types.Put{
+		TableName:                 aws.String(t.table.Name),
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}})
+	if err := t.audit.Append(tx, entry); err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if db.ConditionFailedAt(err, 0) {
+		return nil // locked out already
+	}
+	if err != nil {
+		return fmt.Errorf("auth: locking out %s %s: %w", scope, key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/audit"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/ratelimit"
+)
+
+// fakeClock pins db.Now to start for the rest of the test & returns a function moving it forward
+func fakeClock(t *testing.T, start time.Time) func(time.Duration) {
+	t.Helper()
+
+	now := start
+	orig := db.Now
+	db.Now = func() time.Time { return now }
+	t.Cleanup(func() { db.Now = orig })
+
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+// lockoutStart begins a window of failures
+var lockoutStart = time.Unix(1_700_000_000/3600*3600, 0)
+
+var lockout = config.Lockout{
+	Window:        config.Duration(time.Hour),
+	DelayAfter:    100,
+	Delay:         config.Duration(time.Second),
+	MaxDelay:      config.Duration(4 * time.Second),
+	MaxFailures:   3,
+	IPMaxFailures: 5,
+	Duration:      config.Duration(15 * time.Minute),
+}
+
+// retryAfter returns how long Check makes the login wait, 0 when it may go on
+func retryAfter(t *testing.T, throttle *auth.Throttle, account, ip string) time.Duration {
+	t.Helper()
+
+	var limited *ratelimit.LimitedError
+	err := throttle.Check(context.Background(), account, ip)
+	if errors.As(err, &limited) {
+		return limited.RetryAfter
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return 0
+}
+
+func fail(t *testing.T, throttle *auth.Throttle, account, ip string, times int) {
+	t.Helper()
+
+	for i := 0; i < times; i++ {
+		if err := throttle.Failed(context.Background(), account, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// auditLog returns the actions & subjects recorded today
+func auditLog(t *testing.T, client db.Client, table db.Table) []string {
+	t.Helper()
+
+	entries, err := audit.New(client, table).Day(context.Background(), db.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Action+" "+e.Subject+" by "+e.Actor+" "+e.Details["failures"])
+	}
+
+	return out
+}
+
+func TestThrottleDelays(t *testing.T) {
+	advance := fakeClock(t, lockoutStart)
+	client, table := newStore(t)
+
+	cfg := lockout
+	cfg.DelayAfter, cfg.MaxFailures, cfg.IPMaxFailures = 2, 100, 100
+	throttle := auth.NewThrottle(client, table, cfg)
+
+	// the wait doubles from the second failure on, up to the longest wait
+	for failures, want := range []time.Duration{0, 0, 1, 2, 4, 4} {
+		if got := retryAfter(t, throttle, "ann@example.com", "192.0.2.1"); got != want*time.Second {
+			t.Fatalf("wait after %d failures = %s, want %ds", failures, got, want)
+		}
+		if failures > 0 {
+			advance(want * time.Second)
+			if got := retryAfter(t, throttle, "ann@example.com", "192.0.2.1"); got != 0 {
+				t.Fatalf("wait after %d failures once it passed = %s", failures, got)
+			}
+		}
+		fail(t, throttle, "ann@example.com", "192.0.2.1", 1)
+	}
+
+	// only the account waits, not other accounts from the same address
+	if got := retryAfter(t, throttle, "bob@example.com", "192.0.2.1"); got != 0 {
+		t.Errorf("another account waits %s", got)
+	}
+
+	if err := throttle.Succeeded(context.Background(), "ann@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := retryAfter(t, throttle, "ann@example.com", "192.0.2.1"); got != 0 {
+		t.Errorf("wait after a successful login = %s", got)
+	}
+}
+
+func TestThrottleLocksAccounts(t *testing.T) {
+	advance := fakeClock(t, lockoutStart)
+	client, table := newStore(t)
+	throttle := auth.NewThrottle(client, table, lockout)
+
+	// failures of one account add up across addresses
+	fail(t, throttle, "ann@example.com", "192.0.2.1", 2)
+	if got := retryAfter(t, throttle, "ann@example.com", "192.0.2.1"); got != 0 {
+		t.Fatalf("locked out after 2 failures for %s", got)
+	}
+	fail(t, throttle, "ann@example.com", "198.51.100.7", 1)
+
+	for _, ip := range []string{"192.0.2.1", "203.0.113.9", ""} {
+		if got := retryAfter(t, throttle, "ann@example.com", ip); got != 15*time.Minute {
+			t.Errorf("account from %q waits %s, want the 15m lockout", ip, got)
+		}
+	}
+	if got := retryAfter(t, throttle, "bob@example.com", "192.0.2.1"); got != 0 {
+		t.Errorf("another account from the same address waits %s", got)
+	}
+
+	// failures during the lockout do not lock again
+	fail(t, throttle, "ann@example.com", "192.0.2.1", 2)
+	if got := auditLog(t, client, table); len(got) != 1 || got[0] != "lockout account:ann@example.com by  3" {
+		t.Fatalf("audit log = %q, want one lockout after 3 failures", got)
+	}
+
+	advance(10 * time.Minute)
+	if got := retryAfter(t, throttle, "ann@example.com", ""); got != 5*time.Minute {
+		t.Errorf("wait 10m into the lockout = %s, want 5m", got)
+	}
+
+	// the lockout is over, but not deleted yet: it does not hold back the next one
+	advance(5 * time.Minute)
+	if got := retryAfter(t, throttle, "ann@example.com", ""); got != 0 {
+		t.Errorf("wait after the lockout = %s", got)
+	}
+	advance(time.Hour)
+	fail(t, throttle, "ann@example.com", "", 3)
+	if got := retryAfter(t, throttle, "ann@example.com", ""); got != 15*time.Minute {
+		t.Errorf("wait after the next 3 failures = %s, want a new lockout", got)
+	}
+}
+
+func TestThrottleLocksAddresses(t *testing.T) {
+	fakeClock(t, lockoutStart)
+	client, table := newStore(t)
+	throttle := auth.NewThrottle(client, table, lockout)
+
+	// failures from one address add up across accounts
+	for _, account := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		fail(t, throttle, account, "192.0.2.1", 1)
+	}
+
+	if got := retryAfter(t, throttle, "f@example.com", "192.0.2.1"); got != 15*time.Minute {
+		t.Errorf("new account from the address waits %s, want the 15m lockout", got)
+	}
+	if got := retryAfter(t, throttle, "a@example.com", "198.51.100.7"); got != 0 {
+		t.Errorf("account from another address waits %s", got)
+	}
+
+	// failures without an address count for the account only
+	fail(t, throttle, "f@example.com", "", 2)
+
+	if got := auditLog(t, client, table); len(got) != 1 || got[0] != "lockout ip:192.0.2.1 by  5" {
+		t.Errorf("audit log = %q, want one lockout of the address after 5 failures", got)
+	}
+}
+
+func TestThrottleUnlock(t *testing.T) {
+	ctx := context.Background()
+	fakeClock(t, lockoutStart)
+	client, table := newStore(t)
+	throttle := auth.NewThrottle(client, table, lockout)
+
+	fail(t, throttle, "ann@example.com", "192.0.2.1", 5)
+	if retryAfter(t, throttle, "bob@example.com", "192.0.2.1") == 0 || retryAfter(t, throttle, "ann@example.com", "") == 0 {
+		t.Fatal("the account or the address is not locked out")
+	}
+
+	if err := throttle.Unlock(ctx, auth.ScopeAccount, "ann@example.com", "admin-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := retryAfter(t, throttle, "ann@example.com", ""); got != 0 {
+		t.Errorf("unlocked account waits %s", got)
+	}
+	if got := retryAfter(t, throttle, "bob@example.com", "192.0.2.1"); got == 0 {
+		t.Error("unlocking the account lifted the lockout of the address")
+	}
+
+	// the failures of the account are forgotten: it takes 3 new ones to lock it again
+	fail(t, throttle, "ann@example.com", "", 2)
+	if got := retryAfter(t, throttle, "ann@example.com", ""); got != 0 {
+		t.Errorf("account locked again after 2 failures for %s", got)
+	}
+
+	if err := throttle.Unlock(ctx, auth.ScopeIP, "192.0.2.1", "admin-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := retryAfter(t, throttle, "bob@example.com", "192.0.2.1"); got != 0 {
+		t.Errorf("unlocked address waits %s", got)
+	}
+
+	// unlocking what is not locked is recorded too
+	if err := throttle.Unlock(ctx, auth.ScopeIP, "203.0.113.9", "admin-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttle.Unlock(ctx, "device", "x", "admin-1"); !errors.Is(err, auth.ErrUnknownScope) {
+		t.Errorf("Unlock of an unknown scope = %v, want ErrUnknownScope", err)
+	}
+
+	want := []string{
+		"lockout account:ann@example.com by  3",
+		"lockout ip:192.0.2.1 by  5",
+		"unlock account:ann@example.com by admin-1 ",
+		"unlock ip:192.0.2.1 by admin-1 ",
+		"unlock ip:203.0.113.9 by admin-2 ",
+	}
+	if got := auditLog(t, client, table); len(got) != len(want) {
+		t.Fatalf("audit log = %q, want %q", got, want)
+	} else {
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("audit entry %d = %q, want %q", i, got[i], want[i])
+			}
+		}
+	}
+}
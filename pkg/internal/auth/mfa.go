@@ -0,0 +1,470 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"serverless-aws-cdk/internal/config"
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	// ErrMFAEnabled is returned when enrolling a user who has a confirmed factor already
+	ErrMFAEnabled = errors.New("multi-factor authentication is already enabled")
+	// ErrMFANotEnabled is returned for users without a confirmed factor, or without a pending one when confirming
+	ErrMFANotEnabled = errors.New("multi-factor authentication is not enabled")
+	// ErrInvalidMFACode is returned for wrong, replayed & used codes alike
+	ErrInvalidMFACode = errors.New("invalid authentication code")
+)
+
+// enrollmentTTL bounds how long an unconfirmed secret waits for its first code
+const enrollmentTTL = time.Hour
+
+// TOTPFactor is the stored TOTP secret of a user
+type TOTPFactor struct {
+	UserID      string `json:"userId" dynamodbav:"userId"`
+	Secret      string `json:"secret" dynamodbav:"secret" sensitive:"true"`  // sealed with a key derived from the MFA encryption key
+	KeyID       string `json:"keyId,omitempty" dynamodbav:"keyId,omitempty"` // id of that key; secrets from before key ids have none
+	Confirmed   bool   `json:"confirmed" dynamodbav:"confirmed"`
+	LastStep    int64  `json:"lastStep,omitempty" dynamodbav:"lastStep,omitempty"` // period of the latest accepted code; codes of it & earlier ones are refused
+	CreatedAt   int64  `json:"createdAt" dynamodbav:"createdAt"`
+	ConfirmedAt int64  `json:"confirmedAt,omitempty" dynamodbav:"confirmedAt,omitempty"`
+}
+
+// RecoveryCode is the stored form of a one-time recovery code; the code itself is never stored
+type RecoveryCode struct {
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	Hash      string `json:"hash" dynamodbav:"hash"` // hex SHA-256 of the normalized code
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// TOTPFactors stores the factor of a user in the user's MFA partition
+var TOTPFactors = db.RegisterEntity[TOTPFactor](db.EntityOptions{
+	Type:         "MFA_TOTP",
+	PartitionKey: "MFA#{userId}",
+	SortKey:      "TOTP",
+})
+
+// RecoveryCodes stores the unused recovery codes of a user next to its factor
+var RecoveryCodes = db.RegisterEntity[RecoveryCode](db.EntityOptions{
+	Type:         "MFA_RECOVERY_CODE",
+	PartitionKey: "MFA#{userId}",
+	SortKey:      "RECOVERY#{hash}",
+})
+
+// MFAStatus tells whether a user has MFA & how many recovery codes it has left
+type MFAStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// Factors stores the TOTP factors & recovery codes of users. Secrets are sealed with AES-GCM under a key
+// derived from the MFA encryption key, so a copy of the table alone does not yield them. A secret sealed
+// with a previous key is sealed again with the current one at its next accepted code.
+type Factors struct {
+	factors  *db.Repository[TOTPFactor]
+	recovery *db.Repository[RecoveryCode]
+	db       db.Client
+	table    db.Table
+	keys     *Keyring
+	aeads    map[string]cipher.AEAD // by key id
+	skew     int
+	codes    int
+}
+
+// MFAKeys returns the keyring of the MFA encryption key & the previous ones in cfg
+func MFAKeys(cfg config.MFA) (*Keyring, error) {
+	if cfg.EncryptionKey == "" {
+		return nil, errors.New("auth.mfa.encryptionKey (MFA_ENCRYPTION_KEY) is required")
+	}
+
+	previous := make([][]byte, len(cfg.PreviousEncryptionKeys))
+	for i, key := range cfg.PreviousEncryptionKeys {
+		previous[i] = []byte(key)
+	}
+
+	return NewKeyring([]byte(cfg.EncryptionKey), previous...)
+}
+
+// NewFactors creates a store sealing secrets with keys, accepting codes up to skew periods away from the
+// current one & issuing sets of codes recovery codes
+func NewFactors(database db.Client, table db.Table, keys *Keyring, skew, codes int) (*Factors, error) {
+	keys = keys.Derive("mfa")
+
+	aeads := map[string]cipher.AEAD{}
+	for _, id := range keys.IDs() {
+		key, _ := keys.Key(id)
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Factors{
+		factors:  db.NewRepository(database, table, TOTPFactors),
+		recovery: db.NewRepository(database, table, RecoveryCodes),
+		db:       database,
+		table:    table,
+		keys:     keys,
+		aeads:    aeads,
+		skew:     skew,
+		codes:    codes,
+	}, nil
+}
+
+// Enroll stores a new secret for the user, replacing an unconfirmed one, & returns it. It has to be
+// confirmed with a code within an hour. Users with a confirmed factor fail with ErrMFAEnabled.
+func (f *Factors) Enroll(ctx context.Context, userID string) (string, error) {
+	current, err := f.factors.Get(ctx, db.Keys{"userId": userID})
+	if err == nil && current.Confirmed {
+		return "", ErrMFAEnabled
+	}
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return "", err
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, keyID, err := f.seal(userID, secret)
+	if err != nil {
+		return "", err
+	}
+
+	factor := TOTPFactor{UserID: userID, Secret: sealed, KeyID: keyID, CreatedAt: db.Now().Unix()}
+	err = f.factors.Put(ctx, factor, db.ExpiresIn(enrollmentTTL))
+	if err != nil {
+		return "", fmt.Errorf("auth: storing TOTP secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// Confirm enables the pending factor of the user with its first code & returns a set of recovery codes.
+// It fails with ErrMFANotEnabled without a pending factor, or when the factor was replaced or confirmed
+// meanwhile, & with ErrInvalidMFACode for a wrong code.
+func (f *Factors) Confirm(ctx context.Context, userID, code string) ([]string, error) {
+	factor, err := f.factors.Get(ctx, db.Keys{"userId": userID})
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if factor.Confirmed {
+		return nil, ErrMFAEnabled
+	}
+
+	step, err := f.match(factor, code)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := factor.Secret
+	factor.Confirmed = true
+	factor.ConfirmedAt = db.Now().Unix()
+	factor.LastStep = step
+
+	// the confirmed factor replaces the pending one without its expiry, provided it still is the one the
+	// code matched: a concurrent enrollment or confirmation must not be overwritten
+	av, err := f.factors.Marshal(factor)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := expression.NewBuilder().WithCondition(expression.And(
+		expression.Name("secret").Equal(expression.Value(pending)),
+		expression.Name("confirmed").Equal(expression.Value(false)),
+	)).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := db.NewTransaction(f.db)
+	tx.Add(types.TransactWriteItem{Put: &types.Put{
+		TableName:                 aws.String(f.table.Name),
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}})
+	codes, err := f.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if db.ConditionFailedAt(err, 0) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: confirming TOTP factor: %w", err)
+	}
+
+	return codes, nil
+}
+
+// Verify accepts a code of the confirmed factor of the user, once: a code is refused after a code of
+// the same or a later period was accepted. It fails with ErrMFANotEnabled or ErrInvalidMFACode.
+func (f *Factors) Verify(ctx context.Context, userID, code string) error {
+	factor, err := f.confirmed(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	step, err := f.match(factor, code)
+	if err != nil {
+		return err
+	}
+
+	changes := map[string]interface{}{"lastStep": step}
+	if current, _ := f.keys.Current(); factor.KeyID != current {
+		if changes["secret"], changes["keyId"], err = f.reseal(factor); err != nil {
+			return err
+		}
+	}
+
+	// concurrent uses of the same code race for the update, & all but one fail its condition
+	tx := db.NewTransaction(f.db)
+	err = f.factors.UpdateTx(tx, db.Keys{"userId": userID}, changes,
+		expression.Name("confirmed").Equal(expression.Value(true)),
+		expression.Or(
+			expression.AttributeNotExists(expression.Name("lastStep")),
+			expression.Name("lastStep").LessThan(expression.Value(step)),
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if db.IsConditionFailed(err) {
+		return ErrInvalidMFACode
+	}
+
+	return err
+}
+
+// Redeem accepts a recovery code of the user in place of a TOTP code & deletes it.
+// It fails with ErrMFANotEnabled or ErrInvalidMFACode.
+func (f *Factors) Redeem(ctx context.Context, userID, code string) error {
+	if _, err := f.confirmed(ctx, userID); err != nil {
+		return err
+	}
+
+	tx := db.NewTransaction(f.db)
+	err := f.recovery.DeleteTx(tx, db.Keys{"userId": userID, "hash": hash(normalizeRecoveryCode(code))},
+		expression.AttributeExists(expression.Name("hash")))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if db.IsConditionFailed(err) {
+		return ErrInvalidMFACode
+	}
+
+	return err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user with MFA by a new set & returns it
+func (f *Factors) RegenerateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	if _, err := f.confirmed(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	tx := db.NewTransaction(f.db)
+	codes, err := f.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("auth: storing recovery codes: %w", err)
+	}
+
+	return codes, nil
+}
+
+// Status tells whether the user has a confirmed factor & how many recovery codes it has left
+func (f *Factors) Status(ctx context.Context, userID string) (MFAStatus, error) {
+	if _, err := f.confirmed(ctx, userID); errors.Is(err, ErrMFANotEnabled) {
+		return MFAStatus{}, nil
+	} else if err != nil {
+		return MFAStatus{}, err
+	}
+
+	codes, err := f.recovery.List(ctx, db.Keys{"userId": userID})
+	if err != nil {
+		return MFAStatus{}, err
+	}
+
+	return MFAStatus{Enabled: true, RecoveryCodesLeft: len(codes)}, nil
+}
+
+// Enabled reports whether the user has a confirmed factor
+func (f *Factors) Enabled(ctx context.Context, userID string) (bool, error) {
+	_, err := f.confirmed(ctx, userID)
+	if errors.Is(err, ErrMFANotEnabled) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Disable deletes the factor & recovery codes of the user; disabling twice is not an error
+func (f *Factors) Disable(ctx context.Context, userID string) error {
+	codes, err := f.recovery.List(ctx, db.Keys{"userId": userID})
+	if err != nil {
+		return err
+	}
+
+	tx := db.NewTransaction(f.db)
+	if err := f.factors.DeleteTx(tx, db.Keys{"userId": userID}); err != nil {
+		return err
+	}
+	for _, c := range codes {
+		if err := f.recovery.DeleteTx(tx, db.Keys{"userId": userID, "hash": c.Hash}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("auth: disabling MFA: %w", err)
+	}
+
+	return nil
+}
+
+func (f *Factors) confirmed(ctx context.Context, userID string) (TOTPFactor, error) {
+	factor, err := f.factors.Get(ctx, db.Keys{"userId": userID})
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !factor.Confirmed) {
+		return TOTPFactor{}, ErrMFANotEnabled
+	}
+
+	return factor, err
+}
+
+// match returns the period of code when it is a code of factor, newer than the latest accepted one
+func (f *Factors) match(factor TOTPFactor, code string) (int64, error) {
+	secret, err := f.open(factor)
+	if err != nil {
+		return 0, err
+	}
+
+	step, ok := MatchTOTP(secret, code, db.Now(), f.skew)
+	if !ok || step <= factor.LastStep {
+		return 0, ErrInvalidMFACode
+	}
+
+	return step, nil
+}
+
+// replaceRecoveryCodes adds to tx the deletion of the recovery codes of the user & the creation of a new set
+func (f *Factors) replaceRecoveryCodes(ctx context.Context, tx *db.Transaction, userID string) ([]string, error) {
+	old, err := f.recovery.List(ctx, db.Keys{"userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range old {
+		if err := f.recovery.DeleteTx(tx, db.Keys{"userId": userID, "hash": c.Hash}); err != nil {
+			return nil, err
+		}
+	}
+
+	codes := make([]string, f.codes)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+
+		// 16 base32 characters in groups of 4, e.g. "k3vq-7mzp-ra2x-c4hd"
+		code := strings.ToLower(b32.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+
+		item := RecoveryCode{UserID: userID, Hash: hash(code), CreatedAt: db.Now().Unix()}
+		if err := f.recovery.CreateTx(tx, item); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode ignores case, dashes & spaces, so codes can be typed as they are read
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// seal encrypts secret with the current key, binding it to the user so a sealed secret cannot be copied
+// to another user, & returns it with the id of the key
+func (f *Factors) seal(userID, secret string) (sealed, keyID string, err error) {
+	keyID, _ = f.keys.Current()
+	aead := f.aeads[keyID]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	return encode(aead.Seal(nonce, nonce, []byte(secret), []byte(userID))), keyID, nil
+}
+
+// reseal seals the secret of factor again with the current key
+func (f *Factors) reseal(factor TOTPFactor) (sealed, keyID string, err error) {
+	secret, err := f.open(factor)
+	if err != nil {
+		return "", "", err
+	}
+
+	return f.seal(factor.UserID, secret)
+}
+
+// open decrypts the secret of factor with the key it names. Secrets sealed before key ids existed are
+// tried with every key.
+func (f *Factors) open(factor TOTPFactor) (string, error) {
+	ids := []string{factor.KeyID}
+	if factor.KeyID == "" {
+		ids = f.keys.IDs()
+	}
+
+	b, err := decode(factor.Secret)
+	if err != nil {
+		return "", fmt.Errorf("auth: malformed TOTP secret of user %s", factor.UserID)
+	}
+
+	err = fmt.Errorf("auth: TOTP secret of user %s is sealed with unknown key %q", factor.UserID, factor.KeyID)
+	for _, id := range ids {
+		aead, ok := f.aeads[id]
+		if !ok {
+			continue
+		}
+		if len(b) < aead.NonceSize() {
+			return "", fmt.Errorf("auth: malformed TOTP secret of user %s", factor.UserID)
+		}
+
+		secret, openErr := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(factor.UserID))
+		if openErr == nil {
+			return string(secret), nil
+		}
+		err = fmt.Errorf("auth: opening TOTP secret of user %s: %w", factor.UserID, openErr)
+	}
+
+	return "", err
+}
@@ -0,0 +1,173 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	oldKey = []byte(strings.Repeat("o", 32))
+	newKey = []byte(strings.Repeat("n", 32))
+)
+
+// hookedClient runs before ahead of every transaction, e.g. to write concurrently with the use case
+type hookedClient struct {
+	db.Client
+	before func()
+}
+
+func (c *hookedClient) TransactWriteItems(ctx context.Context, items []types.TransactWriteItem) error {
+	if c.before != nil {
+		c.before()
+	}
+
+	return c.Client.TransactWriteItems(ctx, items)
+}
+
+func newStore(t *testing.T) (*hookedClient, db.Table) {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &hookedClient{Client: db.New(engine)}
+
+	return client, testTable.New(client, "test").Schema()
+}
+
+func newFactors(t *testing.T, client db.Client, table db.Table, current []byte, previous ...[]byte) *auth.Factors {
+	t.Helper()
+
+	keys, err := auth.NewKeyring(current, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := auth.NewFactors(client, table, keys, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+// codeAt returns the code of secret for the period step periods from now
+func codeAt(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	code, err := auth.TOTPCode(secret, auth.TOTPStep(db.Now())+step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestFactorsReadSecretsOfPreviousKeys(t *testing.T) {
+	ctx := context.Background()
+	client, table := newStore(t)
+
+	before := newFactors(t, client, table, oldKey)
+	secret, err := before.Enroll(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := before.Confirm(ctx, "u1", codeAt(t, secret, -1)); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newFactors(t, client, table, newKey, oldKey)
+	if err := rotated.Verify(ctx, "u1", codeAt(t, secret, 0)); err != nil {
+		t.Fatalf("Verify after rotation = %v", err)
+	}
+
+	stored, err := db.NewRepository(client, table, auth.TOTPFactors).Get(ctx, db.Keys{"userId": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.KeyID != auth.KeyID(newKey) {
+		t.Errorf("secret is sealed with key %q after a verification, want the current key %q", stored.KeyID, auth.KeyID(newKey))
+	}
+
+	// resealed, the secret no longer needs the old key
+	if err := newFactors(t, client, table, newKey).Verify(ctx, "u1", codeAt(t, secret, 1)); err != nil {
+		t.Errorf("Verify without the old key = %v", err)
+	}
+}
+
+func TestFactorsRefuseUnknownKeys(t *testing.T) {
+	ctx := context.Background()
+	client, table := newStore(t)
+
+	secret, err := newFactors(t, client, table, oldKey).Enroll(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newFactors(t, client, table, newKey).Confirm(ctx, "u1", codeAt(t, secret, 0)); err == nil {
+		t.Fatal("Confirm opened a secret sealed with a key the keyring lacks")
+	}
+}
+
+func TestConfirmKeepsConcurrentEnrollment(t *testing.T) {
+	ctx := context.Background()
+	client, table := newStore(t)
+	factors := newFactors(t, client, table, newKey)
+
+	secret, err := factors.Enroll(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another enrollment replaces the pending secret between reading & confirming it
+	var replaced string
+	client.before = func() {
+		client.before = nil
+		if replaced, err = factors.Enroll(ctx, "u1"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := factors.Confirm(ctx, "u1", codeAt(t, secret, 0)); !errors.Is(err, auth.ErrMFANotEnabled) {
+		t.Fatalf("Confirm of a replaced secret = %v, want ErrMFANotEnabled", err)
+	}
+
+	if _, err := factors.Confirm(ctx, "u1", codeAt(t, replaced, 0)); err != nil {
+		t.Errorf("Confirm of the replacing secret = %v", err)
+	}
+}
+
+func TestLinksOfPreviousKeys(t *testing.T) {
+	sign := func(current []byte, previous ...[]byte) *auth.Links {
+		keys, err := auth.NewKeyring(current, previous...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return auth.NewLinks(keys)
+	}
+
+	token, err := sign(oldKey).Sign(auth.PurposeMFAChallenge, "u1", "ann@example.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sign(newKey, oldKey).Verify(auth.PurposeMFAChallenge, token); err != nil {
+		t.Errorf("Verify with the signing key retired = %v", err)
+	}
+	if _, err := sign(newKey).Verify(auth.PurposeMFAChallenge, token); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Verify without the signing key = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"serverless-aws-cdk/internal/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms in the configuration
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// ErrMalformedHash is returned for stored hashes no supported algorithm can read
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// b64 is the unpadded base64 of PHC strings
+var b64 = base64.RawStdEncoding
+
+// PasswordHasher hashes passwords with the configured algorithm & parameters, & verifies hashes of any
+// supported algorithm. Hashes are PHC strings, e.g. "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>";
+// bcrypt keeps its own "$2a$<cost>$..." form, which PHC parsers accept.
+type PasswordHasher struct {
+	cfg   config.Passwords
+	dummy string
+}
+
+// NewPasswordHasher creates a hasher writing hashes as cfg says
+func NewPasswordHasher(cfg config.Passwords) (*PasswordHasher, error) {
+	h := &PasswordHasher{cfg: cfg}
+
+	// a hash with the configured cost, so verifying it takes as long as verifying a user's
+	dummy, err := h.Hash("not the password of anyone")
+	if err != nil {
+		return nil, err
+	}
+	h.dummy = dummy
+
+	return h, nil
+}
+
+// Hash returns a new hash of password, with a random salt
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.cfg.Algorithm {
+	case AlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		p := h.cfg.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, argon2KeyLength)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case AlgorithmBcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), h.cfg.BcryptCost)
+		return string(b), err
+	}
+
+	return "", fmt.Errorf("auth: unknown password hashing algorithm %q", h.cfg.Algorithm)
+}
+
+// VerifyPassword reports whether password matches hash, & whether hash should be replaced by a new Hash
+// of the password since its algorithm or parameters are not the configured ones. An empty hash takes as
+// long to reject as a real one, so callers need not tell unknown users apart.
+func (h *PasswordHasher) VerifyPassword(password, hash string) (ok, rehash bool) {
+	if hash == "" {
+		h.VerifyPassword(password, h.dummy)
+		return false, false
+	}
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, false
+		}
+
+		got := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false
+		}
+
+		return true, h.cfg.Algorithm != AlgorithmArgon2id || p != h.cfg.Argon2 || len(key) != argon2KeyLength
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+
+	return true, err != nil || h.cfg.Algorithm != AlgorithmBcrypt || cost != h.cfg.BcryptCost
+}
+
+// parseArgon2id reads "$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>"
+func parseArgon2id(hash string) (config.Argon2, []byte, []byte, error) {
+	var p config.Argon2
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"serverless-aws-cdk/internal/config"
+)
+
+// Codes of the password policy rules
+const (
+	PolicyTooShort     = "too_short"
+	PolicyTooLong      = "too_long"
+	PolicyPersonalInfo = "contains_personal_info"
+	PolicyTooWeak      = "too_weak"
+	PolicyBreached     = "breached"
+)
+
+// bcryptMaxBytes is the longest password bcrypt hashes
+const bcryptMaxBytes = 72
+
+// PolicyViolation is a rule a password breaks
+type PolicyViolation struct {
+	Code    string
+	Message string
+}
+
+// PasswordPolicy decides which passwords users may choose
+type PasswordPolicy struct {
+	cfg      config.Passwords
+	breaches BreachedRanges
+}
+
+// NewPasswordPolicy creates the policy of cfg, checking passwords against breaches when cfg asks to
+func NewPasswordPolicy(cfg config.Passwords, breaches BreachedRanges) *PasswordPolicy {
+	return &PasswordPolicy{cfg: cfg, breaches: breaches}
+}
+
+// Check returns every rule password breaks for the user with email & name, or none when it is accepted.
+// It only fails when the breached passwords cannot be looked up.
+func (p *PasswordPolicy) Check(ctx context.Context, password, email, name string) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+
+	switch length := utf8.RuneCountInString(password); {
+	case length < p.cfg.MinLength:
+		violations = append(violations, PolicyViolation{PolicyTooShort, fmt.Sprintf("must be at least %d characters", p.cfg.MinLength)})
+	case length > p.cfg.MaxLength:
+		violations = append(violations, PolicyViolation{PolicyTooLong, fmt.Sprintf("must be at most %d characters", p.cfg.MaxLength)})
+	case p.cfg.Algorithm == AlgorithmBcrypt && len(password) > bcryptMaxBytes:
+		// fewer characters than MaxLength can exceed it, as accented letters & emoji take several bytes
+		violations = append(violations, PolicyViolation{PolicyTooLong, fmt.Sprintf("must be at most %d bytes", bcryptMaxBytes)})
+	}
+
+	personal := personalInfo(email, name)
+	for _, info := range personal {
+		if strings.Contains(strings.ToLower(password), info) {
+			violations = append(violations, PolicyViolation{PolicyPersonalInfo, "must not contain your email or name"})
+			break
+		}
+	}
+
+	if password != "" {
+		if s := EstimateStrength(password, personal...); s.Score < p.cfg.MinScore {
+			violations = append(violations, PolicyViolation{PolicyTooWeak, "is too easy to guess; add words or characters that do not form a pattern"})
+		}
+	}
+
+	if p.cfg.CheckBreached && p.breaches != nil && password != "" {
+		found, err := IsBreached(ctx, p.breaches, password)
+		if err != nil {
+			return nil, fmt.Errorf("auth: looking up breached passwords: %w", err)
+		}
+		if found {
+			violations = append(violations, PolicyViolation{PolicyBreached, "appears in a list of breached passwords"})
+		}
+	}
+
+	return violations, nil
+}
+
+// personalInfo returns the lower case parts of the email & name a password may not contain:
+// the email, its local part & every word of the name, when they have 3 characters or more
+func personalInfo(email, name string) []string {
+	email = strings.ToLower(email)
+	local, _, _ := strings.Cut(email, "@")
+
+	var parts []string
+	for _, part := range append([]string{email, local}, strings.Fields(strings.ToLower(name))...) {
+		if utf8.RuneCountInString(part) >= 3 {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
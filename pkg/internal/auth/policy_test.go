@@ -0,0 +1,47 @@
+package auth_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+)
+
+func TestPolicyLength(t *testing.T) {
+	cfg := config.Passwords{MinLength: 8, MaxLength: 64, Algorithm: auth.AlgorithmBcrypt}
+
+	tests := []struct {
+		name     string
+		algo     string
+		password string
+		want     string // message of the too_long violation, "" for none
+	}{
+		{"within both limits", auth.AlgorithmBcrypt, strings.Repeat("é", 36), ""},
+		{"too many characters", auth.AlgorithmBcrypt, strings.Repeat("a", 65), "must be at most 64 characters"},
+		{"too many bytes for bcrypt", auth.AlgorithmBcrypt, strings.Repeat("é", 37), "must be at most 72 bytes"},
+		{"many bytes for argon2id", auth.AlgorithmArgon2id, strings.Repeat("é", 37), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Algorithm = tt.algo
+
+			violations, err := auth.NewPasswordPolicy(cfg, nil).Check(context.Background(), tt.password, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			for _, v := range violations {
+				if v.Code == auth.PolicyTooLong {
+					got = v.Message
+				}
+			}
+			if got != tt.want {
+				t.Errorf("too long message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
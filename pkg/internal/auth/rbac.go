@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Permissions routes may require, named `<resource>:<action>[:<scope>]`.
+// Users always act on their own account through ownership checks, so only actions on other users need one.
+const (
+	PermUsersReadAny    = "users:read:any"    // read any user & list users, inactive & deleted ones too
+	PermUsersRestoreAny = "users:restore:any" // restore deleted users
+	PermUsersRolesWrite = "users:roles:write" // change the roles & permissions of users
+	PermLockoutsDelete  = "lockouts:delete"   // lift the login lockouts of accounts & IP addresses
+)
+
+// Roles name sets of permissions
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+// RolePermissions are the permissions each role grants
+var RolePermissions = map[string][]string{
+	RoleAdmin:   {PermUsersReadAny, PermUsersRestoreAny, PermUsersRolesWrite, PermLockoutsDelete},
+	RoleSupport: {PermUsersReadAny, PermUsersRestoreAny, PermLockoutsDelete},
+}
+
+var (
+	// ErrUnknownRole is returned for roles missing from RolePermissions
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrUnknownPermission is returned for permissions no role grants
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+// ResolvePermissions returns the sorted union of the permissions of roles & the extra grants.
+// Unknown roles grant nothing.
+func ResolvePermissions(roles, grants []string) []string {
+	set := map[string]bool{}
+	for _, role := range roles {
+		for _, p := range RolePermissions[role] {
+			set[p] = true
+		}
+	}
+	for _, p := range grants {
+		set[p] = true
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	perms := make([]string, 0, len(set))
+	for p := range set {
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+
+	return perms
+}
+
+// ValidateRoles fails with ErrUnknownRole or ErrUnknownPermission unless every role & grant is known
+func ValidateRoles(roles, grants []string) error {
+	for _, role := range roles {
+		if _, ok := RolePermissions[role]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownRole, role)
+		}
+	}
+
+	known := ResolvePermissions(roleNames(), nil)
+	for _, p := range grants {
+		if i := sort.SearchStrings(known, p); i == len(known) || known[i] != p {
+			return fmt.Errorf("%w: %q", ErrUnknownPermission, p)
+		}
+	}
+
+	return nil
+}
+
+func roleNames() []string {
+	names := make([]string, 0, len(RolePermissions))
+	for role := range RolePermissions {
+		names = append(names, role)
+	}
+
+	return names
+}
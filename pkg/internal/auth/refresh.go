@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/google/uuid"
+)
+
+// RefreshToken is the stored form of a refresh token; the token itself is never stored
+type RefreshToken struct {
+	FamilyID  string `json:"familyId" dynamodbav:"familyId"`
+	Hash      string `json:"hash" dynamodbav:"hash"` // hex SHA-256 of the token
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+	UsedAt    int64  `json:"usedAt,omitempty" dynamodbav:"usedAt,omitempty"`       // set once exchanged for the next token
+	StartedAt int64  `json:"startedAt,omitempty" dynamodbav:"startedAt,omitempty"` // unix milliseconds the family began at, on every token
+	MFAAt     int64  `json:"mfaAt,omitempty" dynamodbav:"mfaAt,omitempty"`         // unix seconds the family passed MFA, on every token
+}
+
+// RevokedFamily marks a family of refresh tokens that can no longer be used
+type RevokedFamily struct {
+	FamilyID  string `json:"familyId" dynamodbav:"familyId"`
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	RevokedAt int64  `json:"revokedAt" dynamodbav:"revokedAt"`
+	Reason    string `json:"reason" dynamodbav:"reason"` // "logout" or "reuse"
+}
+
+// RevokedUser ends every family of a user that began before RevokedAt, e.g. when its password is reset
+type RevokedUser struct {
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	RevokedAt int64  `json:"revokedAt" dynamodbav:"revokedAt"` // unix milliseconds
+}
+
+// RefreshTokens stores every token of a family in the family's partition
+var RefreshTokens = db.RegisterEntity[RefreshToken](db.EntityOptions{
+	Type:         "REFRESH_TOKEN",
+	PartitionKey: "REFRESH#{familyId}",
+	SortKey:      "TOKEN#{hash}",
+})
+
+// RevokedFamilies stores the revocation of a family next to its tokens
+var RevokedFamilies = db.RegisterEntity[RevokedFamily](db.EntityOptions{
+	Type:         "REFRESH_REVOKED",
+	PartitionKey: "REFRESH#{familyId}",
+	SortKey:      "REVOKED",
+})
+
+// RevokedUsers stores the latest revocation of all the sessions of a user
+var RevokedUsers = db.RegisterEntity[RevokedUser](db.EntityOptions{
+	Type:         "REFRESH_REVOKED_USER",
+	PartitionKey: "REFRESH_USER#{userId}",
+	SortKey:      "REVOKED",
+})
+
+// Sessions issues, rotates & revokes refresh tokens.
+// A token is "<family id>.<secret>"; items expire through the table's time to live.
+type Sessions struct {
+	tokens       *db.Repository[RefreshToken]
+	revoked      *db.Repository[RevokedFamily]
+	revokedUsers *db.Repository[RevokedUser]
+	db           db.Client
+	ttl          time.Duration
+	maxAge       time.Duration
+}
+
+// NewSessions creates a store of refresh tokens valid for ttl after they are issued, in sessions
+// ending maxAge after they started however often they are refreshed
+func NewSessions(database db.Client, table db.Table, ttl, maxAge time.Duration) *Sessions {
+	return &Sessions{
+		tokens:       db.NewRepository(database, table, RefreshTokens),
+		revoked:      db.NewRepository(database, table, RevokedFamilies),
+		revokedUsers: db.NewRepository(database, table, RevokedUsers),
+		db:           database,
+		ttl:          ttl,
+		maxAge:       maxAge,
+	}
+}
+
+// Start begins a new family for the user & returns its first refresh token. mfaAt is when the user
+// passed MFA to start it, or the zero time.
+func (s *Sessions) Start(ctx context.Context, userID string, mfaAt time.Time) (string, error) {
+	token, item, err := s.newToken(uuid.NewString(), userID, db.Now().UnixMilli())
+	if err != nil {
+		return "", err
+	}
+
+	if !mfaAt.IsZero() {
+		item.MFAAt = mfaAt.Unix()
+	}
+
+	tx := db.NewTransaction(s.db)
+	if err := s.tokens.CreateTx(tx, item, db.ExpiresAt(s.expiry(item.StartedAt))); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("auth: storing refresh token: %w", err)
+	}
+
+	return token, nil
+}
+
+// Rotate exchanges a refresh token for the next token of its family & returns the stored token it
+// replaced, which names the user & when the family passed MFA. Reusing a token revokes the family &
+// fails with ErrTokenReused.
+func (s *Sessions) Rotate(ctx context.Context, token string) (RefreshToken, string, error) {
+	current, err := s.lookup(ctx, token)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+
+	if current.UsedAt != 0 {
+		return RefreshToken{}, "", s.reused(ctx, current)
+	}
+
+	// the next token lives for ttl, but not past the end of the session
+	expiresAt := s.expiry(current.StartedAt)
+	if !expiresAt.After(db.Now()) {
+		return RefreshToken{}, "", ErrInvalidToken
+	}
+
+	next, item, err := s.newToken(current.FamilyID, current.UserID, current.StartedAt)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	item.MFAAt = current.MFAAt
+
+	// the token is kept, marked used, until it expires so a later reuse is recognised
+	tx := db.NewTransaction(s.db)
+	err = s.tokens.UpdateTx(tx, keysOf(current), map[string]interface{}{"usedAt": db.Now().Unix()},
+		expression.AttributeExists(expression.Name("hash")),
+		expression.AttributeNotExists(expression.Name("usedAt")),
+	)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	if err := s.tokens.CreateTx(tx, item, db.ExpiresAt(expiresAt)); err != nil {
+		return RefreshToken{}, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		if db.IsConditionFailed(err) {
+			// another request exchanged the same token first
+			return RefreshToken{}, "", s.reused(ctx, current)
+		}
+		return RefreshToken{}, "", fmt.Errorf("auth: rotating refresh token: %w", err)
+	}
+
+	return current, next, nil
+}
+
+// Revoke ends the family of a refresh token, e.g. on logout; revoking twice is not an error
+func (s *Sessions) Revoke(ctx context.Context, token string) error {
+	current, err := s.lookup(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	return s.revoke(ctx, current, "logout")
+}
+
+// RevokeUserTx adds to tx the end of every session the user has started so far, e.g. with the change
+// of its password. Sessions started afterwards are not affected.
+func (s *Sessions) RevokeUserTx(tx *db.Transaction, userID string) error {
+	// tokens issued before the revocation expire within ttl, & cannot be rotated meanwhile
+	return s.revokedUsers.PutTx(tx, RevokedUser{UserID: userID, RevokedAt: db.Now().UnixMilli()}, db.ExpiresIn(s.ttl))
+}
+
+// lookup returns the stored token of a family that has not been revoked
+func (s *Sessions) lookup(ctx context.Context, token string) (RefreshToken, error) {
+	familyID, _, ok := strings.Cut(token, ".")
+	if !ok || familyID == "" {
+		return RefreshToken{}, ErrInvalidToken
+	}
+
+	current, err := s.tokens.Get(ctx, db.Keys{"familyId": familyID, "hash": hash(token)})
+	if errors.Is(err, db.ErrNotFound) {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	_, err = s.revoked.Get(ctx, db.Keys{"familyId": familyID})
+	if err == nil {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return RefreshToken{}, err
+	}
+
+	revokedUser, err := s.revokedUsers.Get(ctx, db.Keys{"userId": current.UserID})
+	if err == nil && current.StartedAt <= revokedUser.RevokedAt {
+		return RefreshToken{}, ErrInvalidToken
+	}
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return RefreshToken{}, err
+	}
+
+	return current, nil
+}
+
+func (s *Sessions) reused(ctx context.Context, t RefreshToken) error {
+	if err := s.revoke(ctx, t, "reuse"); err != nil {
+		return err
+	}
+
+	return ErrTokenReused
+}
+
+// revoke marks the family revoked for as long as any of its tokens can still be stored
+func (s *Sessions) revoke(ctx context.Context, t RefreshToken, reason string) error {
+	err := s.revoked.Put(ctx, RevokedFamily{
+		FamilyID:  t.FamilyID,
+		UserID:    t.UserID,
+		RevokedAt: db.Now().Unix(),
+		Reason:    reason,
+	}, db.ExpiresIn(s.ttl))
+	if err != nil {
+		return fmt.Errorf("auth: revoking refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Sessions) newToken(familyID, userID string, startedAt int64) (string, RefreshToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", RefreshToken{}, err
+	}
+
+	token := familyID + "." + encode(secret)
+
+	return token, RefreshToken{
+		FamilyID:  familyID,
+		Hash:      hash(token),
+		UserID:    userID,
+		CreatedAt: db.Now().Unix(),
+		StartedAt: startedAt,
+	}, nil
+}
+
+// expiry returns when a token issued now expires: after ttl, or at the end of its session if sooner.
+// startedAt is in unix milliseconds.
+func (s *Sessions) expiry(startedAt int64) time.Time {
+	expiresAt := db.Now().Add(s.ttl)
+	if end := time.UnixMilli(startedAt).Add(s.maxAge); end.Before(expiresAt) {
+		return end
+	}
+
+	return expiresAt
+}
+
+func keysOf(t RefreshToken) db.Keys {
+	return db.Keys{"familyId": t.FamilyID, "hash": t.Hash}
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
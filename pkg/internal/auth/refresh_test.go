@@ -0,0 +1,208 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/db"
+)
+
+const day = 24 * time.Hour
+
+// sessionStart is when the sessions of the tests begin
+var sessionStart = time.Unix(1_700_000_000, 0)
+
+// rotate exchanges token for the next one, failing the test on errors
+func rotate(t *testing.T, sessions *auth.Sessions, token string) string {
+	t.Helper()
+
+	_, next, err := sessions.Rotate(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return next
+}
+
+func TestRotateReplacesTokens(t *testing.T) {
+	ctx := context.Background()
+	fakeClock(t, sessionStart)
+	client, table := newStore(t)
+	sessions := auth.NewSessions(client, table, 30*day, 90*day)
+
+	token, err := sessions.Start(ctx, "user-1", sessionStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, next, err := sessions.Rotate(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.UserID != "user-1" || current.MFAAt != sessionStart.Unix() || current.StartedAt != sessionStart.UnixMilli() {
+		t.Errorf("rotated token = %+v, want user-1's session started & passing MFA now", current)
+	}
+
+	// the next token carries the session on
+	if current, _, err := sessions.Rotate(ctx, next); err != nil || current.MFAAt != sessionStart.Unix() || current.StartedAt != sessionStart.UnixMilli() {
+		t.Errorf("Rotate of the next token = %+v, %v; want the same session", current, err)
+	}
+
+	for _, token := range []string{"", "no-family", ".secret", current.FamilyID + ".unknown"} {
+		if _, _, err := sessions.Rotate(ctx, token); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Rotate(%q) = %v, want ErrInvalidToken", token, err)
+		}
+	}
+}
+
+func TestReuseRevokesTheFamily(t *testing.T) {
+	ctx := context.Background()
+	fakeClock(t, sessionStart)
+	client, table := newStore(t)
+	sessions := auth.NewSessions(client, table, 30*day, 90*day)
+
+	first, err := sessions.Start(ctx, "user-1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := rotate(t, sessions, first)
+	third := rotate(t, sessions, second)
+
+	other, err := sessions.Start(ctx, "user-1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy of the first token is used again
+	if _, _, err := sessions.Rotate(ctx, first); !errors.Is(err, auth.ErrTokenReused) {
+		t.Fatalf("Rotate of a used token = %v, want ErrTokenReused", err)
+	}
+
+	// every token of the family stops working, the latest one included
+	for name, token := range map[string]string{"used": second, "latest": third, "reused": first} {
+		if _, _, err := sessions.Rotate(ctx, token); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Rotate of the %s token = %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	// the user's other sessions go on
+	if _, _, err := sessions.Rotate(ctx, other); err != nil {
+		t.Errorf("Rotate in another session = %v", err)
+	}
+}
+
+func TestConcurrentRotateRevokesTheFamily(t *testing.T) {
+	ctx := context.Background()
+	fakeClock(t, sessionStart)
+	client, table := newStore(t)
+	sessions := auth.NewSessions(client, table, 30*day, 90*day)
+
+	token, err := sessions.Start(ctx, "user-1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another request exchanges the same token between the read & the write of this one
+	var raced string
+	client.before = func() {
+		client.before = nil
+		raced = rotate(t, sessions, token)
+	}
+
+	if _, _, err := sessions.Rotate(ctx, token); !errors.Is(err, auth.ErrTokenReused) {
+		t.Fatalf("Rotate losing the race = %v, want ErrTokenReused", err)
+	}
+
+	// which request won does not matter: both copies of the token were used, so the family is over
+	if _, _, err := sessions.Rotate(ctx, raced); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Rotate of the token issued to the winner = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestSessionsEndAtTheirMaxAge(t *testing.T) {
+	ctx := context.Background()
+	advance := fakeClock(t, sessionStart)
+	client, table := newStore(t)
+	sessions := auth.NewSessions(client, table, 10*day, 25*day)
+
+	token, err := sessions.Start(ctx, "user-1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshed well within the token lifetime, up to 24 days into the session
+	for i := 0; i < 3; i++ {
+		advance(8 * day)
+		token = rotate(t, sessions, token)
+	}
+
+	// the token issued on day 24 expires with the session on day 25, not on day 34
+	advance(day - time.Second)
+	token = rotate(t, sessions, token)
+
+	advance(time.Second)
+	if _, _, err := sessions.Rotate(ctx, token); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Rotate at the end of the session = %v, want ErrInvalidToken", err)
+	}
+
+	// a new login starts a new session
+	if _, err := sessions.Start(ctx, "user-1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	advance := fakeClock(t, sessionStart)
+	client, table := newStore(t)
+	sessions := auth.NewSessions(client, table, 30*day, 90*day)
+
+	start := func() string {
+		token, err := sessions.Start(ctx, "user-1", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	loggedOut, kept, earlier := start(), start(), start()
+
+	if err := sessions.Revoke(ctx, loggedOut); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sessions.Rotate(ctx, loggedOut); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Rotate after logout = %v, want ErrInvalidToken", err)
+	}
+	if err := sessions.Revoke(ctx, loggedOut); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("second logout = %v, want ErrInvalidToken", err)
+	}
+	kept = rotate(t, sessions, kept)
+
+	// revoking the user ends the sessions started so far, but not later ones
+	advance(time.Millisecond)
+	tx := db.NewTransaction(client)
+	if err := sessions.RevokeUserTx(tx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Millisecond)
+	later := start()
+
+	for name, token := range map[string]string{"rotated": kept, "unused": earlier} {
+		if _, _, err := sessions.Rotate(ctx, token); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Rotate of the %s token of an earlier session = %v, want ErrInvalidToken", name, err)
+		}
+	}
+	if _, _, err := sessions.Rotate(ctx, later); err != nil {
+		t.Errorf("Rotate in a session started after the revocation = %v", err)
+	}
+
+	if _, err := db.NewRepository(client, table, auth.RevokedUsers).Get(ctx, db.Keys{"userId": "user-1"}); err != nil {
+		t.Errorf("revocation of user-1 = %v, want it stored", err)
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// ErrTooManyResets is returned when a user already has as many pending reset tokens as allowed
+var ErrTooManyResets = errors.New("too many pending password resets")
+
+// maxPendingResets bounds the reset tokens a user can hold, so forgot-password requests cannot flood a mailbox
+const maxPendingResets = 3
+
+// ResetToken is the stored form of a password reset token; the token itself is never stored
+type ResetToken struct {
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	Hash      string `json:"hash" dynamodbav:"hash"` // hex SHA-256 of the token
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// ResetTokens stores the pending reset tokens of a user in the user's reset partition
+var ResetTokens = db.RegisterEntity[ResetToken](db.EntityOptions{
+	Type:         "PASSWORD_RESET",
+	PartitionKey: "PASSWORD_RESET#{userId}",
+	SortKey:      "TOKEN#{hash}",
+})
+
+// Resets issues & redeems single-use password reset tokens.
+// A token is "<user id>.<secret>"; items expire through the table's time to live.
+type Resets struct {
+	tokens *db.Repository[ResetToken]
+	db     db.Client
+	ttl    time.Duration
+}
+
+// NewResets creates a store of reset tokens valid for ttl after they are issued
+func NewResets(database db.Client, table db.Table, ttl time.Duration) *Resets {
+	return &Resets{
+		tokens: db.NewRepository(database, table, ResetTokens),
+		db:     database,
+		ttl:    ttl,
+	}
+}
+
+// Issue creates a reset token for the user; it fails with ErrTooManyResets when too many are pending
+func (r *Resets) Issue(ctx context.Context, userID string) (string, error) {
+	pending, err := r.tokens.List(ctx, db.Keys{"userId": userID})
+	if err != nil {
+		return "", err
+	}
+	if len(pending) >= maxPendingResets {
+		return "", ErrTooManyResets
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	token := userID + "." + encode(secret)
+	item := ResetToken{UserID: userID, Hash: hash(token), CreatedAt: db.Now().Unix()}
+
+	if err := r.tokens.Put(ctx, item, db.ExpiresIn(r.ttl)); err != nil {
+		return "", fmt.Errorf("auth: storing reset token: %w", err)
+	}
+
+	return token, nil
+}
+
+// Redeem consumes a reset token & every other pending token of its user, in one transaction with the
+// writes apply adds for the user, e.g. the new password. Unknown, expired & used tokens fail with ErrInvalidToken.
+func (r *Resets) Redeem(ctx context.Context, token string, apply func(tx *db.Transaction, userID string) error) error {
+	userID, _, ok := strings.Cut(token, ".")
+	if !ok || userID == "" {
+		return ErrInvalidToken
+	}
+
+	current, err := r.tokens.Get(ctx, db.Keys{"userId": userID, "hash": hash(token)})
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	pending, err := r.tokens.List(ctx, db.Keys{"userId": userID})
+	if err != nil {
+		return err
+	}
+
+	// the redeemed token goes first, so its condition failing tells a concurrent redemption apart
+	tx := db.NewTransaction(r.db)
+	err = r.tokens.DeleteTx(tx, db.Keys{"userId": userID, "hash": current.Hash},
+		expression.AttributeExists(expression.Name("hash")))
+	if err != nil {
+		return err
+	}
+	for _, t := range pending {
+		if t.Hash == current.Hash {
+			continue
+		}
+		if err := r.tokens.DeleteTx(tx, db.Keys{"userId": userID, "hash": t.Hash}); err != nil {
+			return err
+		}
+	}
+
+	if err := apply(tx, userID); err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if db.ConditionFailedAt(err, 0) {
+		return ErrInvalidToken
+	}
+
+	return err
+}
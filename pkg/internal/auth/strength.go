@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Strength is an estimate of how many guesses a password takes to find
+type Strength struct {
+	Bits  float64 // log2 of the guesses
+	Score int     // 0 to 4 as in zxcvbn: under 10^3, 10^6, 10^8 & 10^10 guesses, or more
+}
+
+// commonWords are guessed first by attackers, in rough order of popularity; their rank is their cost
+var commonWords = strings.Fields(`
+	password pass qwerty letmein welcome admin login master hello secret love iloveyou monkey dragon
+	sunshine princess football baseball soccer hockey shadow superman batman trustno1 freedom whatever
+	starwars computer michael jordan charlie jessica ashley daniel thomas andrew robert matthew joshua
+	summer winter spring autumn flower cookie cheese banana orange purple silver golden diamond angel
+	blessed family forever friends happy lucky money power magic ninja pokemon pepper ginger tigger
+	buster killer hunter ranger soldier rocket guitar music dance heaven jesus google apple samsung
+	internet access change default guest user test demo temp root system server office company
+	january february march april june july august september october november december monday friday
+`)
+
+// keyboardRows are walked by keyboard patterns such as "asdf" or "7654"
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890", "qazwsxedc"}
+
+// leet undoes common substitutions, e.g. "p@ssw0rd" to "password"
+var leet = strings.NewReplacer("@", "a", "4", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+// EstimateStrength estimates the guesses password takes, in the spirit of zxcvbn: it is split into the
+// cheapest sequence of common words, inputs such as the user's name, repeats, sequences, keyboard walks,
+// years & brute forced characters.
+func EstimateStrength(password string, inputs ...string) Strength {
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+	perChar := math.Log2(float64(charsetSize(runes)))
+
+	dictionary := make(map[string]int, len(commonWords)+len(inputs))
+	for i, w := range commonWords {
+		dictionary[w] = i + 1
+	}
+	for _, in := range inputs {
+		if in = strings.ToLower(in); len([]rune(in)) >= 3 {
+			dictionary[in] = 1
+		}
+	}
+
+	// cost[j] is the cheapest estimate of the first j characters
+	cost := make([]float64, len(runes)+1)
+	for j := 1; j <= len(runes); j++ {
+		cost[j] = cost[j-1] + perChar
+		for i := 0; i <= j-3; i++ {
+			if bits, ok := patternBits(runes[i:j], lower[i:j], dictionary); ok && cost[i]+bits < cost[j] {
+				cost[j] = cost[i] + bits
+			}
+		}
+	}
+
+	bits := cost[len(runes)]
+	digits := bits * math.Log10(2)
+
+	score := 4
+	for i, limit := range []float64{3, 6, 8, 10} {
+		if digits < limit {
+			score = i
+			break
+		}
+	}
+
+	return Strength{Bits: bits, Score: score}
+}
+
+// patternBits returns the cost of the cheapest pattern matching the whole of token
+func patternBits(token, lower []rune, dictionary map[string]int) (float64, bool) {
+	best, found := math.Inf(1), false
+	consider := func(bits float64) {
+		if bits < best {
+			best, found = bits, true
+		}
+	}
+
+	s := string(lower)
+	n := float64(len(token))
+
+	if rank, ok := dictionary[s]; ok {
+		consider(math.Log2(float64(rank)) + capitalization(token))
+	}
+	if plain := leet.Replace(s); plain != s {
+		if rank, ok := dictionary[plain]; ok {
+			consider(math.Log2(float64(rank)) + capitalization(token) + 1)
+		}
+	}
+
+	if repeated(lower) {
+		consider(math.Log2(float64(charsetSize(token[:1])) * n))
+	}
+
+	if step, ok := sequence(lower); ok {
+		bits := math.Log2(float64(charsetSize(token[:1])) * n)
+		if step < 0 {
+			bits++
+		}
+		consider(bits)
+	}
+
+	if len(token) >= 4 && keyboardWalk(s) {
+		consider(math.Log2(float64(len(keyboardRows)*10) * n))
+	}
+
+	if len(token) == 4 && s >= "1900" && s <= "2099" {
+		consider(math.Log2(200))
+	}
+
+	return best, found
+}
+
+// capitalization is the cost of the case of a word: none in lower case, a bit for a capital first letter
+// or all capitals, & a bit per capital otherwise
+func capitalization(token []rune) float64 {
+	upper := 0
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 0
+	case upper == len(token), upper == 1 && unicode.IsUpper(token[0]):
+		return 1
+	}
+
+	return float64(upper)
+}
+
+func repeated(token []rune) bool {
+	for _, r := range token[1:] {
+		if r != token[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sequence reports whether token steps by the same +1 or -1 from each character to the next, e.g. "abc"
+func sequence(token []rune) (int, bool) {
+	step := int(token[1]) - int(token[0])
+	if step != 1 && step != -1 {
+		return 0, false
+	}
+
+	for i := 2; i < len(token); i++ {
+		if int(token[i])-int(token[i-1]) != step {
+			return 0, false
+		}
+	}
+
+	return step, true
+}
+
+func keyboardWalk(s string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(reverse(row), s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+
+	return string(r)
+}
+
+// charsetSize is the size of the alphabet brute forcing runes has to try
+func charsetSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			size += class.size
+		}
+	}
+	if size == 0 {
+		size = 1
+	}
+
+	return size
+}
@@ -0,0 +1,612 @@
+// Package config loads the typed application configuration.
+//
+// Values are merged in increasing order of precedence:
+//  1. built-in defaults
+//  2. the per-stage file environments/<stage>/config.json
+//  3. the optional .env file
+//  4. process environment variables
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"serverless-aws-cdk/environments"
+
+	"github.com/joho/godotenv"
+)
+
+// Config is the configuration shared by every subsystem
+type Config struct {
+	Stage     string    `json:"-"`
+	Comment   string    `json:"$comment,omitempty"` // ignored, documents a stage file
+	DynamoDB  DynamoDB  `json:"dynamodb"`
+	Tables    Tables    `json:"tables"`
+	Dump      Dump      `json:"dump"`
+	Outbox    Outbox    `json:"outbox"`
+	Auth      Auth      `json:"auth"`
+	Users     Users     `json:"users"`
+	Passwords Passwords `json:"passwords"`
+	Mail      Mail      `json:"mail"`
+}
+
+// DynamoDB configures the DynamoDB client
+type DynamoDB struct {
+	Region     string   `json:"region"`
+	Endpoint   string   `json:"endpoint"` // empty to use the regional AWS endpoint
+	Timeout    Duration `json:"timeout"`
+	MaxRetries int      `json:"maxRetries"`
+}
+
+// Tables holds the physical table names
+type Tables struct {
+	Main string `json:"main"`
+}
+
+// Dump configures table exports & imports
+type Dump struct {
+	Redact map[string]string `json:"redact"` // PII attributes replaced on import, by name: "hash", "email" or "remove"
+}
+
+// Outbox configures how the relay delivers domain events
+type Outbox struct {
+	Publisher   string `json:"publisher"`   // "eventbridge" or "file"
+	EventBus    string `json:"eventBus"`    // event bus name or ARN, for the eventbridge publisher
+	Source      string `json:"source"`      // source of the published events, for the eventbridge publisher
+	File        string `json:"file"`        // path events are appended to, for the file publisher
+	MaxAttempts int    `json:"maxAttempts"` // publish attempts before an event is dead lettered
+}
+
+// Auth configures the tokens issued at login
+type Auth struct {
+	Issuer          string   `json:"issuer"`
+	SigningKey      string   `json:"signingKey"`      // HMAC key of access tokens, at least 32 bytes; required by the auth endpoints
+	AccessTokenTTL  Duration `json:"accessTokenTTL"`  // lifetime of access tokens
+	RefreshTokenTTL Duration `json:"refreshTokenTTL"` // lifetime of a refresh token, renewed on every refresh
+	MaxSessionAge   Duration `json:"maxSessionAge"`   // sessions end this long after login, however often they are refreshed
+
+	PasswordResetTTL Duration `json:"passwordResetTTL"` // lifetime of password reset tokens
+	PasswordResetURL string   `json:"passwordResetURL"` // page reset links point to, with the token as `token` query parameter
+
+	VerifyEmailTTL Duration `json:"verifyEmailTTL"` // lifetime of email verification links
+	VerifyEmailURL string   `json:"verifyEmailURL"` // page verification links point to, with the token as `token` query parameter
+
+	Lockout Lockout `json:"lockout"`
+	MFA     MFA     `json:"mfa"`
+}
+
+// MFA configures TOTP multi-factor authentication
+type MFA struct {
+	Issuer        string   `json:"issuer"`        // name authenticator apps show; defaults to auth.issuer
+	ChallengeTTL  Duration `json:"challengeTTL"`  // time to enter a code after the password
+	Skew          int      `json:"skew"`          // 30s periods accepted before & after the current one, for clocks running apart
+	RecoveryCodes int      `json:"recoveryCodes"` // one-time recovery codes per set
+
+	EncryptionKey          string   `json:"encryptionKey"`          // seals TOTP secrets & signs login challenges, at least 32 bytes
+	PreviousEncryptionKeys []string `json:"previousEncryptionKeys"` // retired keys, still opening what they sealed or signed
+}
+
+// Lockout configures how failed logins are throttled, per account & per source IP address
+type Lockout struct {
+	Window        Duration `json:"window"`        // failed logins are counted in fixed windows this long
+	DelayAfter    int      `json:"delayAfter"`    // failures of an account before each further attempt has to wait
+	Delay         Duration `json:"delay"`         // first wait, doubled by every further failure
+	MaxDelay      Duration `json:"maxDelay"`      // longest wait
+	MaxFailures   int      `json:"maxFailures"`   // failures of an account in a window that lock it out
+	IPMaxFailures int      `json:"ipMaxFailures"` // failures from an IP address in a window that lock it out
+	Duration      Duration `json:"duration"`      // how long lockouts last, unless an admin lifts them
+}
+
+// Users configures user accounts
+type Users struct {
+	Retention Duration `json:"retention"` // how long deleted users can be restored before they are purged
+}
+
+// Passwords configures which passwords users may choose & how they are hashed.
+// Hashes of other algorithms & parameters still verify, & are replaced at the next login.
+type Passwords struct {
+	MinLength     int  `json:"minLength"`     // in characters
+	MaxLength     int  `json:"maxLength"`     // in characters; bcrypt also caps passwords at 72 bytes
+	MinScore      int  `json:"minScore"`      // lowest strength estimate accepted, from 0 to 4 as in zxcvbn
+	CheckBreached bool `json:"checkBreached"` // refuse the passwords of the bundled breached corpus
+
+	Algorithm  string `json:"algorithm"`  // "argon2id" or "bcrypt"
+	BcryptCost int    `json:"bcryptCost"` // for the bcrypt algorithm
+	Argon2     Argon2 `json:"argon2"`
+}
+
+// Argon2 holds the argon2id parameters
+type Argon2 struct {
+	Memory      uint32 `json:"memory"` // KiB
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+}
+
+// Mail configures outgoing email
+type Mail struct {
+	Driver    string `json:"driver"`    // "smtp", "ses", "eml" or "file"; empty disables email & the flows needing it
+	From      string `json:"from"`      // sender address
+	Locale    string `json:"locale"`    // locale of subjects when the recipient asks for none available
+	QueueSize int    `json:"queueSize"` // messages waiting to be sent before senders block
+	File      string `json:"file"`      // path messages are appended to, for the file driver
+	Dir       string `json:"dir"`       // directory .eml files are written to, for the eml driver
+	SMTP      SMTP   `json:"smtp"`
+	SES       SES    `json:"ses"`
+}
+
+// SMTP configures the smtp mail driver
+type SMTP struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"` // empty to send without authentication
+	Password string `json:"password"`
+	TLS      string `json:"tls"` // "starttls", "tls" for implicit TLS, or "none" for local stand-ins
+}
+
+// SES configures the ses mail driver
+type SES struct {
+	Region   string `json:"region"`   // defaults to dynamodb.region
+	Endpoint string `json:"endpoint"` // empty to use the regional AWS endpoint, or any SES-compatible API
+}
+
+// Duration is a time.Duration read from strings such as "5s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Std returns d as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// Defaults returns the built-in configuration
+func Defaults() Config {
+	return Config{
+		Stage: "prod",
+		DynamoDB: DynamoDB{
+			Region:     "us-east-1",
+			Timeout:    Duration(5 * time.Second),
+			MaxRetries: 3,
+		},
+		Tables: Tables{
+			Main: "ServerlessAWSCDKLocal",
+		},
+		Dump: Dump{
+			Redact: map[string]string{
+				"name":     "hash",
+				"email":    "email",
+				"password": "remove",
+			},
+		},
+		Outbox: Outbox{
+			Publisher:   "eventbridge",
+			EventBus:    "default",
+			Source:      "serverless-aws-cdk",
+			MaxAttempts: 8,
+		},
+		Auth: Auth{
+			Issuer:          "serverless-aws-cdk",
+			AccessTokenTTL:  Duration(15 * time.Minute),
+			RefreshTokenTTL: Duration(30 * 24 * time.Hour),
+			MaxSessionAge:   Duration(90 * 24 * time.Hour),
+
+			PasswordResetTTL: Duration(time.Hour),
+
+			VerifyEmailTTL: Duration(48 * time.Hour),
+
+			Lockout: Lockout{
+				Window:        Duration(15 * time.Minute),
+				DelayAfter:    3,
+				Delay:         Duration(time.Second),
+				MaxDelay:      Duration(30 * time.Second),
+				MaxFailures:   10,
+				IPMaxFailures: 100,
+				Duration:      Duration(15 * time.Minute),
+			},
+
+			MFA: MFA{
+				ChallengeTTL:  Duration(5 * time.Minute),
+				Skew:          1,
+				RecoveryCodes: 10,
+			},
+		},
+		Users: Users{
+			Retention: Duration(30 * 24 * time.Hour),
+		},
+		// argon2id at the OWASP baseline
+		Passwords: Passwords{
+			MinLength:     10,
+			MaxLength:     128,
+			MinScore:      3,
+			CheckBreached: true,
+
+			Algorithm:  "argon2id",
+			BcryptCost: 12,
+			Argon2: Argon2{
+				Memory:      19 * 1024,
+				Iterations:  2,
+				Parallelism: 1,
+			},
+		},
+		Mail: Mail{
+			Locale:    "en",
+			QueueSize: 16,
+			SMTP: SMTP{
+				Port: 587,
+				TLS:  "starttls",
+			},
+		},
+	}
+}
+
+// binding maps an environment variable onto a config field
+type binding struct {
+	env string
+	set func(c *Config, v string) error
+}
+
+func setString(field func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+var bindings = []binding{
+	{"AWS_REGION", setString(func(c *Config) *string { return &c.DynamoDB.Region })},
+	{"DYNAMODB_ENDPOINT", setString(func(c *Config) *string { return &c.DynamoDB.Endpoint })},
+	{"DYNAMODB_TIMEOUT", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.DynamoDB.Timeout = Duration(d)
+		return err
+	}},
+	{"DYNAMODB_MAX_RETRIES", func(c *Config, v string) (err error) {
+		c.DynamoDB.MaxRetries, err = strconv.Atoi(v)
+		return err
+	}},
+	{"TABLE_NAME", setString(func(c *Config) *string { return &c.Tables.Main })},
+	{"OUTBOX_PUBLISHER", setString(func(c *Config) *string { return &c.Outbox.Publisher })},
+	{"EVENT_BUS_NAME", setString(func(c *Config) *string { return &c.Outbox.EventBus })},
+	{"JWT_SIGNING_KEY", setString(func(c *Config) *string { return &c.Auth.SigningKey })},
+	{"MFA_ENCRYPTION_KEY", setString(func(c *Config) *string { return &c.Auth.MFA.EncryptionKey })},
+	{"MFA_PREVIOUS_ENCRYPTION_KEYS", func(c *Config, v string) error {
+		c.Auth.MFA.PreviousEncryptionKeys = nil
+		if v != "" {
+			c.Auth.MFA.PreviousEncryptionKeys = strings.Split(v, ",")
+		}
+		return nil
+	}},
+	{"PASSWORD_RESET_URL", setString(func(c *Config) *string { return &c.Auth.PasswordResetURL })},
+	{"VERIFY_EMAIL_URL", setString(func(c *Config) *string { return &c.Auth.VerifyEmailURL })},
+	{"PASSWORD_HASH_ALGORITHM", setString(func(c *Config) *string { return &c.Passwords.Algorithm })},
+	{"MAIL_DRIVER", setString(func(c *Config) *string { return &c.Mail.Driver })},
+	{"MAIL_FROM", setString(func(c *Config) *string { return &c.Mail.From })},
+	{"SMTP_HOST", setString(func(c *Config) *string { return &c.Mail.SMTP.Host })},
+	{"SMTP_PORT", func(c *Config, v string) (err error) {
+		c.Mail.SMTP.Port, err = strconv.Atoi(v)
+		return err
+	}},
+	{"SMTP_USERNAME", setString(func(c *Config) *string { return &c.Mail.SMTP.Username })},
+	{"SMTP_PASSWORD", setString(func(c *Config) *string { return &c.Mail.SMTP.Password })},
+	{"SMTP_TLS", setString(func(c *Config) *string { return &c.Mail.SMTP.TLS })},
+	{"SES_ENDPOINT", setString(func(c *Config) *string { return &c.Mail.SES.Endpoint })},
+	{"USER_RETENTION", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Users.Retention = Duration(d)
+		return err
+	}},
+}
+
+// Loader reads configuration from its sources; zero values fall back to the real environment
+type Loader struct {
+	Files  fs.FS                           // per-stage files, defaults to the embedded environments
+	DotEnv string                          // path of the optional .env file, defaults to ".env"
+	Lookup func(key string) (string, bool) // defaults to os.LookupEnv
+}
+
+// Load reads the configuration for the current process
+func Load() (*Config, error) {
+	return Loader{}.Load()
+}
+
+// Load merges every source & validates the result
+func (l Loader) Load() (*Config, error) {
+	if l.Files == nil {
+		l.Files = environments.Files
+	}
+	if l.DotEnv == "" {
+		l.DotEnv = ".env"
+	}
+
+	lookup, err := l.lookup()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Defaults()
+	cfg.Stage = stage(lookup)
+
+	if err := loadStageFile(l.Files, cfg.Stage, &cfg); err != nil {
+		return nil, err
+	}
+
+	for _, b := range bindings {
+		if v, ok := lookup(b.env); ok && v != "" {
+			if err := b.set(&cfg, v); err != nil {
+				return nil, fmt.Errorf("config: invalid %s: %w", b.env, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// lookup layers the .env file below the real environment.
+// With the process environment, .env values are exported so the AWS SDK sees them too.
+func (l Loader) lookup() (func(string) (string, bool), error) {
+	if l.Lookup == nil {
+		if err := godotenv.Load(l.DotEnv); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("config: reading %s: %w", l.DotEnv, err)
+		}
+
+		return os.LookupEnv, nil
+	}
+
+	dotenv, err := godotenv.Read(l.DotEnv)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("config: reading %s: %w", l.DotEnv, err)
+	}
+
+	return func(key string) (string, bool) {
+		if v, ok := l.Lookup(key); ok {
+			return v, true
+		}
+		v, ok := dotenv[key]
+		return v, ok
+	}, nil
+}
+
+// LocalStage is the stage of local development, the only one that runs without secrets
+const LocalStage = "local"
+
+// stage picks the stage from STAGE, falling back to the legacy ENVIRONMENT="local-db" switch
+func stage(lookup func(string) (string, bool)) string {
+	if s, ok := lookup("STAGE"); ok && s != "" {
+		return s
+	}
+
+	if env, _ := lookup("ENVIRONMENT"); env == "local-db" {
+		return LocalStage
+	}
+
+	return Defaults().Stage
+}
+
+func loadStageFile(files fs.FS, stage string, cfg *Config) error {
+	b, err := fs.ReadFile(files, stage+"/config.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: reading stage %q: %w", stage, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config: parsing stage %q: %w", stage, err)
+	}
+
+	return nil
+}
+
+// Validate reports every missing or invalid setting at once
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.DynamoDB.Region == "" {
+		problems = append(problems, "dynamodb.region (AWS_REGION) is required")
+	}
+
+	if c.DynamoDB.Endpoint != "" {
+		if u, err := url.Parse(c.DynamoDB.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, "dynamodb.endpoint (DYNAMODB_ENDPOINT) must be an absolute URL")
+		}
+	}
+
+	if c.DynamoDB.Timeout <= 0 {
+		problems = append(problems, "dynamodb.timeout (DYNAMODB_TIMEOUT) must be positive")
+	}
+
+	if c.DynamoDB.MaxRetries < 0 {
+		problems = append(problems, "dynamodb.maxRetries (DYNAMODB_MAX_RETRIES) cannot be negative")
+	}
+
+	if c.Tables.Main == "" {
+		problems = append(problems, "tables.main (TABLE_NAME) is required")
+	}
+
+	switch c.Outbox.Publisher {
+	case "eventbridge":
+		if c.Outbox.EventBus == "" || c.Outbox.Source == "" {
+			problems = append(problems, "outbox.eventBus (EVENT_BUS_NAME) & outbox.source are required by the eventbridge publisher")
+		}
+	case "file":
+		if c.Outbox.File == "" {
+			problems = append(problems, "outbox.file is required by the file publisher")
+		}
+	default:
+		problems = append(problems, "outbox.publisher (OUTBOX_PUBLISHER) must be \"eventbridge\" or \"file\"")
+	}
+
+	if c.Outbox.MaxAttempts <= 0 {
+		problems = append(problems, "outbox.maxAttempts must be positive")
+	}
+
+	switch {
+	case c.Auth.SigningKey == "" && c.Stage != LocalStage:
+		// checked by every function at start up, so a missing secret surfaces before the first login
+		problems = append(problems, "auth.signingKey (JWT_SIGNING_KEY) is required outside the local stage")
+	case c.Auth.SigningKey != "" && len(c.Auth.SigningKey) < 32:
+		problems = append(problems, "auth.signingKey (JWT_SIGNING_KEY) must be at least 32 bytes")
+	}
+
+	if c.Auth.AccessTokenTTL <= 0 || c.Auth.RefreshTokenTTL <= c.Auth.AccessTokenTTL {
+		problems = append(problems, "auth.accessTokenTTL must be positive & shorter than auth.refreshTokenTTL")
+	}
+
+	if c.Auth.MaxSessionAge < c.Auth.RefreshTokenTTL {
+		problems = append(problems, "auth.maxSessionAge must be at least auth.refreshTokenTTL")
+	}
+
+	if c.Auth.PasswordResetTTL <= 0 {
+		problems = append(problems, "auth.passwordResetTTL must be positive")
+	}
+
+	if c.Auth.VerifyEmailTTL <= 0 {
+		problems = append(problems, "auth.verifyEmailTTL must be positive")
+	}
+
+	if l := c.Auth.Lockout; l.Window < Duration(time.Second) || l.Duration <= 0 {
+		problems = append(problems, "auth.lockout.window must be at least 1s & auth.lockout.duration positive")
+	}
+
+	if l := c.Auth.Lockout; l.DelayAfter < 1 || l.MaxFailures < l.DelayAfter || l.IPMaxFailures < l.MaxFailures {
+		problems = append(problems, "auth.lockout needs 1 <= delayAfter <= maxFailures <= ipMaxFailures")
+	}
+
+	if l := c.Auth.Lockout; l.Delay < 0 || l.MaxDelay < l.Delay {
+		problems = append(problems, "auth.lockout.delay cannot be negative nor longer than auth.lockout.maxDelay")
+	}
+
+	switch {
+	case c.Auth.MFA.EncryptionKey == "" && c.Stage != LocalStage:
+		problems = append(problems, "auth.mfa.encryptionKey (MFA_ENCRYPTION_KEY) is required outside the local stage")
+	case c.Auth.MFA.EncryptionKey != "" && len(c.Auth.MFA.EncryptionKey) < 32:
+		problems = append(problems, "auth.mfa.encryptionKey (MFA_ENCRYPTION_KEY) must be at least 32 bytes")
+	case c.Auth.MFA.EncryptionKey != "" && c.Auth.MFA.EncryptionKey == c.Auth.SigningKey:
+		problems = append(problems, "auth.mfa.encryptionKey (MFA_ENCRYPTION_KEY) must differ from auth.signingKey")
+	}
+
+	for _, key := range c.Auth.MFA.PreviousEncryptionKeys {
+		if len(key) < 32 {
+			problems = append(problems, "auth.mfa.previousEncryptionKeys (MFA_PREVIOUS_ENCRYPTION_KEYS) must each be at least 32 bytes")
+			break
+		}
+	}
+
+	if c.Auth.MFA.ChallengeTTL <= 0 {
+		problems = append(problems, "auth.mfa.challengeTTL must be positive")
+	}
+
+	if c.Auth.MFA.Skew < 0 || c.Auth.MFA.Skew > 10 {
+		problems = append(problems, "auth.mfa.skew must be between 0 & 10")
+	}
+
+	if c.Auth.MFA.RecoveryCodes < 1 || c.Auth.MFA.RecoveryCodes > 20 {
+		problems = append(problems, "auth.mfa.recoveryCodes must be between 1 & 20")
+	}
+
+	if c.Users.Retention <= 0 {
+		problems = append(problems, "users.retention (USER_RETENTION) must be positive")
+	}
+
+	if c.Passwords.MinLength < 1 || c.Passwords.MaxLength < c.Passwords.MinLength {
+		problems = append(problems, "passwords.minLength must be positive & at most passwords.maxLength")
+	}
+
+	if c.Passwords.MinScore < 0 || c.Passwords.MinScore > 4 {
+		problems = append(problems, "passwords.minScore must be between 0 & 4")
+	}
+
+	switch c.Passwords.Algorithm {
+	case "argon2id":
+		a := c.Passwords.Argon2
+		if a.Iterations < 1 || a.Parallelism < 1 || a.Memory < 8*uint32(a.Parallelism) {
+			problems = append(problems, "passwords.argon2 needs at least 1 iteration, 1 thread & 8 KiB of memory per thread")
+		}
+	case "bcrypt":
+		if c.Passwords.BcryptCost < 4 || c.Passwords.BcryptCost > 31 {
+			problems = append(problems, "passwords.bcryptCost must be between 4 & 31")
+		}
+	default:
+		problems = append(problems, "passwords.algorithm (PASSWORD_HASH_ALGORITHM) must be \"argon2id\" or \"bcrypt\"")
+	}
+
+	switch c.Mail.Driver {
+	case "":
+	case "smtp":
+		if c.Mail.SMTP.Host == "" {
+			problems = append(problems, "mail.smtp.host (SMTP_HOST) is required by the smtp driver")
+		}
+		if c.Mail.SMTP.Port <= 0 || c.Mail.SMTP.Port > 65535 {
+			problems = append(problems, "mail.smtp.port (SMTP_PORT) must be a port number")
+		}
+		if t := c.Mail.SMTP.TLS; t != "starttls" && t != "tls" && t != "none" {
+			problems = append(problems, "mail.smtp.tls (SMTP_TLS) must be \"starttls\", \"tls\" or \"none\"")
+		}
+	case "ses":
+		if c.Mail.SES.Endpoint != "" {
+			if u, err := url.Parse(c.Mail.SES.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				problems = append(problems, "mail.ses.endpoint (SES_ENDPOINT) must be an absolute URL")
+			}
+		}
+	case "eml":
+		if c.Mail.Dir == "" {
+			problems = append(problems, "mail.dir is required by the eml driver")
+		}
+	case "file":
+		if c.Mail.File == "" {
+			problems = append(problems, "mail.file is required by the file driver")
+		}
+	default:
+		problems = append(problems, "mail.driver (MAIL_DRIVER) must be empty, \"smtp\", \"ses\", \"eml\" or \"file\"")
+	}
+
+	if c.Mail.Locale == "" {
+		problems = append(problems, "mail.locale is required")
+	}
+
+	if c.Mail.QueueSize <= 0 {
+		problems = append(problems, "mail.queueSize must be positive")
+	}
+
+	if c.Mail.Driver != "" && c.Mail.From == "" {
+		problems = append(problems, "mail.from (MAIL_FROM) is required to send email")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config: invalid configuration for stage %q: %s", c.Stage, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"serverless-aws-cdk/internal/config"
+)
+
+var (
+	signingKey = strings.Repeat("k", 32)
+	mfaKey     = strings.Repeat("m", 32)
+)
+
+func TestKeysRequiredOutsideLocal(t *testing.T) {
+	files := fstest.MapFS{
+		"local/config.json": {Data: []byte(`{"outbox": {"publisher": "file", "file": "/tmp/events"}}`)},
+		"prod/config.json":  {Data: []byte(`{"$comment": "documented", "outbox": {"publisher": "file", "file": "/tmp/events"}}`)},
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string // "" when the configuration loads
+	}{
+		{"local without key", map[string]string{"STAGE": "local"}, ""},
+		{"prod without key", map[string]string{"STAGE": "prod", "MFA_ENCRYPTION_KEY": mfaKey}, "auth.signingKey (JWT_SIGNING_KEY) is required"},
+		{"prod with short key", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": "short", "MFA_ENCRYPTION_KEY": mfaKey}, "must be at least 32 bytes"},
+		{"local with short key", map[string]string{"STAGE": "local", "JWT_SIGNING_KEY": "short"}, "must be at least 32 bytes"},
+		{"prod without MFA key", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey}, "auth.mfa.encryptionKey (MFA_ENCRYPTION_KEY) is required"},
+		{"prod with short MFA key", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey, "MFA_ENCRYPTION_KEY": "short"}, "must be at least 32 bytes"},
+		{"prod with MFA key of the signing key", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey, "MFA_ENCRYPTION_KEY": signingKey}, "must differ from auth.signingKey"},
+		{"prod with short previous MFA key", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey, "MFA_ENCRYPTION_KEY": mfaKey, "MFA_PREVIOUS_ENCRYPTION_KEYS": signingKey + ",short"}, "must each be at least 32 bytes"},
+		{"prod with keys", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey, "MFA_ENCRYPTION_KEY": mfaKey, "MFA_PREVIOUS_ENCRYPTION_KEYS": ""}, ""},
+		{"prod with previous MFA keys", map[string]string{"STAGE": "prod", "JWT_SIGNING_KEY": signingKey, "MFA_ENCRYPTION_KEY": mfaKey, "MFA_PREVIOUS_ENCRYPTION_KEYS": signingKey}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := config.Loader{
+				Files:  files,
+				DotEnv: t.TempDir() + "/.env",
+				Lookup: func(key string) (string, bool) {
+					v, ok := tt.env[key]
+					return v, ok
+				},
+			}
+
+			_, err := loader.Load()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Load() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Load() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
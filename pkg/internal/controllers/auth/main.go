@@ -0,0 +1,547 @@
+package controller_auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/netip"
+	"net/url"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/mail"
+	"serverless-aws-cdk/internal/ratelimit"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidCredentials is returned for unknown emails, wrong passwords & inactive users alike
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrAlreadyVerified is returned when asking to verify an email that is verified already
+	ErrAlreadyVerified = errors.New("email is already verified")
+	// ErrInvalidIP is returned when unlocking something that is not an IP address
+	ErrInvalidIP = errors.New("invalid IP address")
+	// ErrMFARequired matches every *MFARequiredError
+	ErrMFARequired = errors.New("multi-factor authentication required")
+)
+
+// MFARequiredError is returned by logins with the right password for a user with MFA. The login
+// continues with VerifyMFA & the challenge Token, within ExpiresIn.
+type MFARequiredError struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string {
+	return ErrMFARequired.Error()
+}
+
+func (e *MFARequiredError) Unwrap() error {
+	return ErrMFARequired
+}
+
+// TOTPEnrollment is the secret of a new TOTP factor, as a base32 string to type in & as the otpauth URI
+// authenticator apps import, also the payload of the QR code they scan
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+// Verification links can be resent this many times per window & user
+const (
+	ResendLimit  = 3
+	ResendWindow = time.Hour
+)
+
+// Tokens is the response of a login or refresh
+type Tokens struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds until the access token expires
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Controller implements login, token refresh & logout
+type Controller struct {
+	users    *controller_users.Controller
+	sessions *auth.Sessions
+	resets   *auth.Resets
+	signer   *auth.Signer
+	links    *auth.Links // emailed links, signed with the signing key
+	mfa      *auth.Links // login challenges, signed with the MFA encryption key
+	resends  *ratelimit.Limiter
+	throttle *auth.Throttle
+	factors  *auth.Factors
+	mailer   mail.Mailer
+	emails   *mail.Templates
+	cfg      config.Auth
+}
+
+// Stores are where the controller keeps sessions, reset tokens, login throttling, MFA factors & the
+// count of resent verification links
+type Stores struct {
+	Sessions *auth.Sessions
+	Resets   *auth.Resets
+	Throttle *auth.Throttle
+	Factors  *auth.Factors
+	Resends  *ratelimit.Limiter // allowing ResendLimit links per ResendWindow & user
+}
+
+// New creates a Controller keeping its records in stores & sending links with mailer, rendered from
+// emails. A nil mailer disables email: ForgotPassword & ResendVerification then fail with
+// mail.ErrDisabled & SendVerification does nothing. It fails when no signing key or MFA encryption key
+// is configured.
+func New(stores Stores, users *controller_users.Controller, cfg config.Auth, mailer mail.Mailer, emails *mail.Templates) (*Controller, error) {
+	if cfg.SigningKey == "" {
+		return nil, errors.New("auth.signingKey (JWT_SIGNING_KEY) is required to issue tokens")
+	}
+	signing, err := auth.NewKeyring([]byte(cfg.SigningKey))
+	if err != nil {
+		return nil, err
+	}
+
+	mfa, err := auth.MFAKeys(cfg.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Controller{
+		users:    users,
+		sessions: stores.Sessions,
+		resets:   stores.Resets,
+		signer:   auth.NewSigner([]byte(cfg.SigningKey), cfg.Issuer, cfg.AccessTokenTTL.Std()),
+		links:    auth.NewLinks(signing),
+		mfa:      auth.NewLinks(mfa),
+		resends:  stores.Resends,
+		throttle: stores.Throttle,
+		factors:  stores.Factors,
+		mailer:   mailer,
+		emails:   emails,
+		cfg:      cfg,
+	}, nil
+}
+
+// Login checks the credentials of a caller at ip & starts a new session. While the account or ip is
+// locked out, or has to wait after failed logins, it fails with a *ratelimit.LimitedError. Users with
+// MFA get a *MFARequiredError instead of tokens.
+func (c *Controller) Login(ctx context.Context, email, password, ip string) (Tokens, error) {
+	account := accountKey(email)
+	if err := c.throttle.Check(ctx, account, ip); err != nil {
+		return Tokens{}, err
+	}
+
+	user, err := c.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, db.ErrNotFound) {
+		// checked against the zero user, so a login takes as long whether or not the user exists
+		c.users.VerifyPassword(ctx, controller_users.User{}, password)
+		return Tokens{}, c.failed(ctx, account, ip)
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	if !c.users.VerifyPassword(ctx, user, password) || user.IsActive != 1 {
+		return Tokens{}, c.failed(ctx, account, ip)
+	}
+
+	mfa, err := c.factors.Enabled(ctx, user.ID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if mfa {
+		// the failures stay counted until the second step passes, so codes cannot be guessed by logging in again
+		ttl := c.cfg.MFA.ChallengeTTL.Std()
+		challenge, err := c.mfa.Sign(auth.PurposeMFAChallenge, user.ID, user.Email, ttl)
+		if err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, &MFARequiredError{Token: challenge, ExpiresIn: ttl}
+	}
+
+	c.succeeded(ctx, account, user.ID)
+
+	refresh, err := c.sessions.Start(ctx, user.ID, time.Time{})
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return c.tokens(user, refresh, time.Time{})
+}
+
+// VerifyMFA completes a login with the challenge of its *MFARequiredError & a TOTP code, or a recovery
+// code when code is empty. Wrong codes fail with auth.ErrInvalidMFACode & count as failed logins.
+func (c *Controller) VerifyMFA(ctx context.Context, challenge, code, recoveryCode, ip string) (Tokens, error) {
+	claims, err := c.mfa.Verify(auth.PurposeMFAChallenge, challenge)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	user, err := c.users.GetUser(claims.Subject)
+	if err != nil {
+		return Tokens{}, err
+	}
+	// deleted, deactivated or with a new email since the password was checked
+	if user.ID == "" || user.IsActive != 1 || user.Email != claims.Email {
+		return Tokens{}, auth.ErrInvalidToken
+	}
+
+	return c.passMFA(ctx, user, code, recoveryCode, ip)
+}
+
+// StepUp starts a new session for an authenticated user who passes MFA again, e.g. for routes requiring
+// a recent MFA. Its other sessions keep the MFA time they had.
+func (c *Controller) StepUp(ctx context.Context, userID, code, recoveryCode, ip string) (Tokens, error) {
+	user, err := c.users.GetUser(userID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if user.ID == "" || user.IsActive != 1 {
+		return Tokens{}, auth.ErrInvalidToken
+	}
+
+	return c.passMFA(ctx, user, code, recoveryCode, ip)
+}
+
+// passMFA checks the second factor of user, counting wrong codes as failed logins, & starts a session
+// that passed MFA now
+func (c *Controller) passMFA(ctx context.Context, user controller_users.User, code, recoveryCode, ip string) (Tokens, error) {
+	account := accountKey(user.Email)
+	if err := c.throttle.Check(ctx, account, ip); err != nil {
+		return Tokens{}, err
+	}
+
+	var err error
+	if code == "" && recoveryCode != "" {
+		err = c.factors.Redeem(ctx, user.ID, recoveryCode)
+	} else {
+		err = c.factors.Verify(ctx, user.ID, code)
+	}
+	if errors.Is(err, auth.ErrInvalidMFACode) {
+		if err := c.throttle.Failed(ctx, account, ip); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, auth.ErrInvalidMFACode
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	c.succeeded(ctx, account, user.ID)
+
+	now := db.Now()
+	refresh, err := c.sessions.Start(ctx, user.ID, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return c.tokens(user, refresh, now)
+}
+
+// EnrollTOTP creates a TOTP secret for the user, to be confirmed with ConfirmTOTP.
+// Users with MFA fail with auth.ErrMFAEnabled.
+func (c *Controller) EnrollTOTP(ctx context.Context, userID string) (TOTPEnrollment, error) {
+	user, err := c.users.GetUser(userID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if user.ID == "" {
+		return TOTPEnrollment{}, db.ErrNotFound
+	}
+
+	secret, err := c.factors.Enroll(ctx, user.ID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	issuer := c.cfg.MFA.Issuer
+	if issuer == "" {
+		issuer = c.cfg.Issuer
+	}
+
+	return TOTPEnrollment{Secret: secret, URI: auth.TOTPURI(issuer, user.Email, secret)}, nil
+}
+
+// ConfirmTOTP enables MFA for the user with the first code of its new secret & returns its recovery codes.
+// They are shown once: only their hashes are stored.
+func (c *Controller) ConfirmTOTP(ctx context.Context, userID, code string) ([]string, error) {
+	return c.factors.Confirm(ctx, userID, code)
+}
+
+// DisableTOTP turns MFA off for the user once its password is confirmed
+func (c *Controller) DisableTOTP(ctx context.Context, userID, password string) error {
+	user, err := c.users.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.ID == "" {
+		return db.ErrNotFound
+	}
+
+	if !c.users.VerifyPassword(ctx, user, password) {
+		return controller_users.ErrWrongPassword
+	}
+
+	return c.factors.Disable(ctx, user.ID)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user with MFA & returns the new ones
+func (c *Controller) RegenerateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	return c.factors.RegenerateRecoveryCodes(ctx, userID)
+}
+
+// MFAStatus tells whether the user has MFA & how many recovery codes it has left
+func (c *Controller) MFAStatus(ctx context.Context, userID string) (auth.MFAStatus, error) {
+	return c.factors.Status(ctx, userID)
+}
+
+// succeeded forgets the failed logins of account once the user is in; the login stands without it,
+// since the failures expire with their window
+func (c *Controller) succeeded(ctx context.Context, account, userID string) {
+	if err := c.throttle.Succeeded(ctx, account); err != nil {
+		log.Printf("auth: clearing the failed logins of %s: %v", userID, err)
+	}
+}
+
+// failed counts a failed login & returns the error answering it
+func (c *Controller) failed(ctx context.Context, account, ip string) error {
+	if err := c.throttle.Failed(ctx, account, ip); err != nil {
+		return err
+	}
+
+	return ErrInvalidCredentials
+}
+
+// accountKey is the key failed logins to email are counted under, normalized as controller_users.NormalizeEmail
+// does but for invalid emails too, so every attempt counts
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// UnlockUser lifts the login lockout of a user & forgets its failed logins, on behalf of the admin actor
+func (c *Controller) UnlockUser(ctx context.Context, userID, actor string) error {
+	user, err := c.users.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.ID == "" {
+		return db.ErrNotFound
+	}
+
+	return c.throttle.Unlock(ctx, auth.ScopeAccount, user.Email, actor)
+}
+
+// UnlockIP lifts the login lockout of an IP address & forgets its failed logins, on behalf of the admin actor
+func (c *Controller) UnlockIP(ctx context.Context, ip, actor string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ErrInvalidIP
+	}
+
+	return c.throttle.Unlock(ctx, auth.ScopeIP, addr.String(), actor)
+}
+
+// Refresh exchanges a refresh token for new tokens. A reused token ends the session with auth.ErrTokenReused.
+func (c *Controller) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	current, next, err := c.sessions.Rotate(ctx, refreshToken)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	user, err := c.users.GetUser(current.UserID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	// the user was deleted or deactivated since logging in
+	if user.ID == "" || user.IsActive != 1 {
+		if err := c.sessions.Revoke(ctx, next); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, auth.ErrInvalidToken
+	}
+
+	var mfaAt time.Time
+	if current.MFAAt != 0 {
+		mfaAt = time.Unix(current.MFAAt, 0)
+	}
+
+	return c.tokens(user, next, mfaAt)
+}
+
+// Logout ends the session of a refresh token; access tokens stay valid until they expire
+func (c *Controller) Logout(ctx context.Context, refreshToken string) error {
+	return c.sessions.Revoke(ctx, refreshToken)
+}
+
+// ForgotPassword emails a reset link to the user registered with email, if it is active.
+// It returns nil whether or not the email is registered, so callers cannot tell, & mail.ErrDisabled
+// for every email when email is disabled.
+func (c *Controller) ForgotPassword(ctx context.Context, email string) error {
+	if c.mailer == nil {
+		return mail.ErrDisabled
+	}
+
+	user, err := c.users.GetUserByEmail(ctx, email)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && user.IsActive != 1) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := c.resets.Issue(ctx, user.ID)
+	if errors.Is(err, auth.ErrTooManyResets) {
+		return nil // the pending links still work
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.sendLink(ctx, mail.TemplatePasswordReset, user, link(c.cfg.PasswordResetURL, token), c.cfg.PasswordResetTTL.Std())
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword & ends every session of the user,
+// in one transaction. Unknown, expired & used tokens fail with auth.ErrInvalidToken. A password the policy
+// refuses fails with a *controller_users.ValidationError & leaves the token unused, so the user can choose
+// another.
+func (c *Controller) ResetPassword(ctx context.Context, token, password string) error {
+	err := c.resets.Redeem(ctx, token, func(tx *db.Transaction, id string) error {
+		if err := c.users.SetPasswordTx(ctx, tx, id, password); err != nil {
+			return err
+		}
+		return c.sessions.RevokeUserTx(tx, id)
+	})
+	if errors.Is(err, db.ErrNotFound) || db.IsConditionFailed(err) {
+		return auth.ErrInvalidToken // the user was deleted since the token was issued
+	}
+
+	return err
+}
+
+// EndSessionsTx adds to tx the end of every session the user has started so far, e.g. along with a
+// new password
+func (c *Controller) EndSessionsTx(tx *db.Transaction, userID string) error {
+	return c.sessions.RevokeUserTx(tx, userID)
+}
+
+// SendVerification emails the user a signed link proving it owns its current email; without email it
+// does nothing, & the user can ask for a link once email is enabled
+func (c *Controller) SendVerification(ctx context.Context, user controller_users.User) error {
+	if c.mailer == nil {
+		return nil
+	}
+
+	token, err := c.links.Sign(auth.PurposeVerifyEmail, user.ID, user.Email, c.cfg.VerifyEmailTTL.Std())
+	if err != nil {
+		return err
+	}
+
+	return c.sendLink(ctx, mail.TemplateVerifyEmail, user, link(c.cfg.VerifyEmailURL, token), c.cfg.VerifyEmailTTL.Std())
+}
+
+// ResendVerification sends a new verification link to a user whose email is not verified.
+// It fails with a *ratelimit.LimitedError when links were resent too often, & with mail.ErrDisabled
+// when email is disabled.
+func (c *Controller) ResendVerification(ctx context.Context, userID string) error {
+	if c.mailer == nil {
+		return mail.ErrDisabled
+	}
+
+	user, err := c.users.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.ID == "" {
+		return db.ErrNotFound
+	}
+	if user.EmailVerified {
+		return ErrAlreadyVerified
+	}
+
+	decision, err := c.resends.Allow(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := decision.Err(); err != nil {
+		return err
+	}
+
+	return c.SendVerification(ctx, user)
+}
+
+// VerifyEmail marks the email of a verification link verified. Links fail with auth.ErrInvalidToken once
+// the user changed its email or was deleted, & with auth.ErrExpiredToken after auth.verifyEmailTTL.
+func (c *Controller) VerifyEmail(ctx context.Context, token string) error {
+	claims, err := c.links.Verify(auth.PurposeVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+
+	err = c.users.MarkEmailVerified(ctx, claims.Subject, claims.Email)
+	if db.IsConditionFailed(err) {
+		return auth.ErrInvalidToken
+	}
+
+	return err
+}
+
+// sendLink emails user the template carrying href, in the locale preferred by the request of ctx
+func (c *Controller) sendLink(ctx context.Context, template string, user controller_users.User, href string, expires time.Duration) error {
+	msg, err := c.emails.Render(template, mail.LocaleFrom(ctx), mail.LinkData{Name: user.Name, URL: href, Expires: expires})
+	if err != nil {
+		return err
+	}
+	msg.To = user.Email
+
+	return c.mailer.Send(ctx, msg)
+}
+
+// link appends token to the page at base as its `token` query parameter; without a page it is the token alone
+func link(base, token string) string {
+	if base == "" {
+		return token
+	}
+
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+
+	return base + sep + "token=" + url.QueryEscape(token)
+}
+
+// Authenticate verifies an access token & returns its claims
+func (c *Controller) Authenticate(accessToken string) (auth.Claims, error) {
+	return c.signer.Verify(accessToken)
+}
+
+// tokens issues the access token of user, which passed MFA at mfaAt unless it is the zero time
+func (c *Controller) tokens(user controller_users.User, refresh string, mfaAt time.Time) (Tokens, error) {
+	roles, permissions := user.Authorization()
+	claims := auth.Claims{
+		Subject:     user.ID,
+		Email:       user.Email,
+		Verified:    user.EmailVerified,
+		Roles:       roles,
+		Permissions: permissions,
+		Methods:     []string{auth.MethodPassword},
+	}
+	if !mfaAt.IsZero() {
+		claims.Methods = append(claims.Methods, auth.MethodOTP)
+		claims.MFAAt = mfaAt.Unix()
+	}
+
+	access, _, err := c.signer.Issue(claims)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(c.signer.TTL().Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
@@ -1,79 +1,243 @@
 package controller_users
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/seed"
 	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/outbox"
+	"serverless-aws-cdk/internal/patch"
 	"serverless-aws-cdk/utils"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 )
 
 type User struct {
-	PK        string `json:"pk,omitempty" dynamodbav:"pk,omitempty"`
-	ID        string `json:"id,omitempty" dynamodbav:"sk,omitempty"`
-	Name      string `json:"name" dynamodbav:"name,omitempty"`
-	Email     string `json:"email" dynamodbav:"email,omitempty"`
-	Password  string `json:"password" dynamodbav:"password,omitempty"`
-	IsActive  int8   `json:"isActive" dynamodbav:"isActive,omitempty"`
-	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt,omitempty"`
-	UpdatedAt int64  `json:"updatedAt" dynamodbav:"updatedAt,omitempty"`
+	PK            string   `json:"pk,omitempty" dynamodbav:"pk,omitempty"`
+	ID            string   `json:"id,omitempty" dynamodbav:"sk,omitempty"`
+	Name          string   `json:"name" dynamodbav:"name,omitempty"`
+	Email         string   `json:"email" dynamodbav:"email,omitempty"`
+	EmailVerified bool     `json:"emailVerified" dynamodbav:"emailVerified"`                  // whether the user proved it owns Email; stored even when false, see migration 3
+	Password      string   `json:"password" dynamodbav:"password,omitempty" sensitive:"true"` // PHC hash, never sent to clients
+	IsActive      int8     `json:"isActive" dynamodbav:"isActive,omitempty"`
+	CreatedAt     int64    `json:"createdAt" dynamodbav:"createdAt,omitempty"`
+	UpdatedAt     int64    `json:"updatedAt" dynamodbav:"updatedAt,omitempty"`
+	DeletedAt     int64    `json:"deletedAt,omitempty" dynamodbav:"deletedAt,omitempty"` // set while a deleted user can still be restored
+	Roles         []string `json:"roles,omitempty" dynamodbav:"roles,omitempty"`
+	Permissions   []string `json:"permissions,omitempty" dynamodbav:"permissions,omitempty"` // granted on top of the roles'
+}
+
+// Authorization returns the roles of the user & every permission they grant, as embedded in access tokens
+func (u User) Authorization() (roles, permissions []string) {
+	return u.Roles, auth.ResolvePermissions(u.Roles, u.Permissions)
 }
 
 const PK = "USERS"
 
-func GetUser(id string) (User, error) {
-	item, err := testTable.GetItem(PK, id)
-	if err != nil {
-		return User{}, err
-	}
+// ActiveIndex projects users by `isActive`, so active users are listed without reading inactive & deleted ones
+const ActiveIndex = "Active"
 
-	if item == nil {
-		return User{}, nil
+// Users stores every user in the `USERS` partition, keyed by id
+var Users = db.RegisterEntity[User](db.EntityOptions{
+	Type:         "USER",
+	PartitionKey: PK,
+	SortKey:      "{id}",
+	Indexes: []db.Index{
+		{Name: ActiveIndex, PartitionKey: "pk", SortKey: "isActive"},
+	},
+})
+
+// EmailClaim reserves a normalized email for one user.
+// Its key is derived from the email, so a second claim of the same email fails its create condition.
+type EmailClaim struct {
+	Email  string `json:"email" dynamodbav:"email"`
+	UserID string `json:"userId" dynamodbav:"userId"`
+}
+
+// Emails stores one claim per registered email, in its own `EMAIL#<email>` partition
+var Emails = db.RegisterEntity[EmailClaim](db.EntityOptions{
+	Type:         "USER_EMAIL",
+	PartitionKey: "EMAIL#{email}",
+	SortKey:      "USER",
+})
+
+var (
+	// ErrEmailTaken is returned when another user already registered the email
+	ErrEmailTaken = errors.New("email is already registered")
+	// ErrInvalidEmail is returned for malformed email addresses
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrWrongPassword is returned when the current password given to confirm a change does not match
+	ErrWrongPassword = errors.New("current password does not match")
+	// ErrSamePassword is returned when a new password equals the current one
+	ErrSamePassword = errors.New("new password cannot be the same as the current password")
+	// ErrNoChanges is returned for updates that change nothing
+	ErrNoChanges = errors.New("no fields to update")
+	// ErrNotDeleted is returned when restoring a user that is not deleted
+	ErrNotDeleted = errors.New("user is not deleted")
+)
+
+// FieldError is a rule a field of a request breaks
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every rule the fields of a request break
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + " " + f.Message
 	}
 
-	user := User{}
-	if err := dynamodbattribute.UnmarshalMap(item, &user); err != nil {
-		return User{}, err
+	return "invalid fields: " + strings.Join(problems, "; ")
+}
+
+// NormalizeEmail trims & lowercases email, so addresses differing only in case or surrounding space are the same.
+// It fails with ErrInvalidEmail unless email is a bare address such as "ada@example.com".
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
 	}
 
-	return user, nil
+	return email, nil
 }
 
-func GetAllUsers() ([]User, error) {
-	var users []User
+// Fixtures seeds users from fixture files; plaintext passwords are hashed with passwords while seeding
+func Fixtures(passwords *auth.PasswordHasher) seed.Kind {
+	return seed.Entity(Users, seed.Options{
+		IDField: "id",
+		Hashed:  []string{"password"},
+		Hasher:  passwords,
+		Defaults: func(now time.Time) map[string]interface{} {
+			return map[string]interface{}{
+				"isActive":      1,
+				"emailVerified": true,
+				"createdAt":     now.Unix(),
+				"updatedAt":     now.Unix(),
+			}
+		},
+		Derived: func(fields map[string]interface{}) ([]seed.Derived, error) {
+			email, err := NormalizeEmail(fmt.Sprint(fields["email"]))
+			if err != nil {
+				return nil, fmt.Errorf("email %v: %w", fields["email"], err)
+			}
 
-	items, err := testTable.QueryItems([]map[string]interface{}{
-		{
-			"pk": PK,
+			return []seed.Derived{{Kind: emailFixtures, Fields: map[string]interface{}{
+				"email":  email,
+				"userId": fields["id"],
+			}}}, nil
 		},
 	})
+}
+
+var emailFixtures = seed.Entity(Emails, seed.Options{})
+
+// UserCreated is published once a user has been stored
+const UserCreated = "UserCreated"
+
+// UserCreatedEvent is the payload of UserCreated; it never carries the password
+type UserCreatedEvent struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// Controller implements the user use cases on top of an injected table
+type Controller struct {
+	table     *testTable.Table
+	users     *db.Repository[User]
+	emails    *db.Repository[EmailClaim]
+	outbox    *outbox.Outbox
+	passwords *auth.PasswordHasher
+	policy    *auth.PasswordPolicy
+}
+
+// New creates a Controller backed by table that records domain events in events, accepting the passwords
+// policy allows & hashing them with passwords
+func New(table *testTable.Table, events *outbox.Outbox, passwords *auth.PasswordHasher, policy *auth.PasswordPolicy) *Controller {
+	return &Controller{
+		table:     table,
+		users:     testTable.Repository(table, Users),
+		emails:    testTable.Repository(table, Emails),
+		outbox:    events,
+		passwords: passwords,
+		policy:    policy,
+	}
+}
+
+// GetUser returns the user with id, or an empty User for unknown & deleted users
+func (c *Controller) GetUser(id string) (User, error) {
+	user, err := c.users.Get(context.TODO(), db.Keys{"id": id})
+	if errors.Is(err, db.ErrNotFound) || user.DeletedAt != 0 {
+		return User{}, nil
+	}
+
+	return user, err
+}
+
+// GetUserByEmail returns the user registered with email, or db.ErrNotFound
+func (c *Controller) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	email, err := NormalizeEmail(email)
 	if err != nil {
-		return nil, err
+		return User{}, db.ErrNotFound
 	}
 
-	if len(items) == 0 {
-		return []User{}, nil
+	claim, err := c.emails.Get(ctx, db.Keys{"email": email})
+	if err != nil {
+		return User{}, err
 	}
 
-	for _, item := range items {
-		user := User{}
-		if err := dynamodbattribute.UnmarshalMap(item, &user); err != nil {
-			return nil, err
-		}
+	user, err := c.users.Get(ctx, db.Keys{"id": claim.UserID})
+	if err == nil && user.DeletedAt != 0 {
+		return User{}, db.ErrNotFound
+	}
 
-		users = append(users, user)
+	return user, err
+}
+
+// ListUsers returns the active users, read from the Active index.
+// With includeInactive, deactivated & deleted users are listed too.
+func (c *Controller) ListUsers(ctx context.Context, includeInactive bool) ([]User, error) {
+	if includeInactive {
+		return c.users.List(ctx, nil)
 	}
 
-	return users, nil
+	return c.users.QueryAll(ctx, db.Query{Index: ActiveIndex, SortKeyEquals: 1})
 }
 
-func CreateUser(name, email, password string) error {
+// CreateUser registers a user with an unverified email & returns it. It fails with ErrEmailTaken when
+// the email is already registered, & with a *ValidationError when the password policy refuses password.
+func (c *Controller) CreateUser(name, email, password string) (User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return User{}, err
+	}
 
-	hashedPass, err := utils.HashPassword(password)
+	if err := c.checkPassword(context.TODO(), "password", password, email, name); err != nil {
+		return User{}, err
+	}
+
+	hashedPass, err := c.passwords.Hash(password)
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
 	now := time.Now().Unix()
@@ -89,57 +253,444 @@ func CreateUser(name, email, password string) error {
 		UpdatedAt: now,
 	}
 
-	return testTable.PutItem(item)
-}
-
-func UpdateUser(id, currPass, name, newPass string) error {
-	user, err := GetUser(id)
+	event, err := outbox.NewEvent(UserCreated, item.ID, UserCreatedEvent{
+		ID:        item.ID,
+		Name:      item.Name,
+		Email:     item.Email,
+		CreatedAt: item.CreatedAt,
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	if user == (User{}) {
-		return errors.New("user not found")
+	// the user, its email claim & its event are stored together: the event is never lost nor sent for
+	// a user that does not exist, and a taken email cancels the whole registration
+	tx := c.table.Transaction()
+	if err := c.users.CreateTx(tx, item); err != nil {
+		return User{}, err
+	}
+	if err := c.emails.CreateTx(tx, EmailClaim{Email: email, UserID: item.ID}); err != nil {
+		return User{}, err
+	}
+	if err := c.outbox.Append(tx, event); err != nil {
+		return User{}, err
 	}
 
-	if passMatch := utils.VerifyPassword(currPass, user.Password); !passMatch {
-		return errors.New("current password does not match")
+	err = tx.Commit(context.TODO())
+	if db.ConditionFailedAt(err, 1) {
+		return User{}, ErrEmailTaken
 	}
-	if passMatch := utils.VerifyPassword(newPass, user.Password); !passMatch {
-		return errors.New("new password cannot be the same as the current password")
+	if err != nil {
+		return User{}, err
 	}
 
+	return item, nil
+}
+
+// UpdateUser changes the name and/or password of a user once its current password is confirmed.
+// Empty values leave the field unchanged. The new password has to pass the password policy & is written
+// in one transaction with what onNewPassword adds to it, e.g. the end of the user's sessions.
+// It fails with db.ErrNotFound when the user is deleted or purged before the change is written.
+func (c *Controller) UpdateUser(id, currPass, name, newPass string, onNewPassword func(tx *db.Transaction, id string) error) error {
 	if name == "" && newPass == "" {
-		return errors.New("no fields to update")
+		return ErrNoChanges
 	}
 
-	hashedPass, err := utils.HashPassword(newPass)
+	user, err := c.reauthenticate(id, currPass)
 	if err != nil {
 		return err
 	}
 
 	item := User{
 		Name:      name,
-		Password:  hashedPass,
 		UpdatedAt: time.Now().Unix(),
 	}
 
-	return testTable.UpdateItem(PK, id, utils.StructToMap(item))
+	if newPass != "" {
+		if same, _ := c.passwords.VerifyPassword(newPass, user.Password); same {
+			return ErrSamePassword
+		}
+
+		if name == "" {
+			name = user.Name
+		}
+		if err := c.checkPassword(context.TODO(), "newPassword", newPass, user.Email, name); err != nil {
+			return err
+		}
+
+		if item.Password, err = c.passwords.Hash(newPass); err != nil {
+			return err
+		}
+	}
+
+	tx := c.table.Transaction()
+	err = c.users.UpdateTx(tx, db.Keys{"id": id}, utils.StructToMap(item),
+		expression.AttributeExists(expression.Name("pk")),
+		expression.AttributeNotExists(expression.Name("deletedAt")),
+	)
+	if err != nil {
+		return err
+	}
+	if newPass != "" && onNewPassword != nil {
+		if err := onNewPassword(tx, id); err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(context.TODO())
+	if db.ConditionFailedAt(err, 0) {
+		return db.ErrNotFound
+	}
+
+	return err
+}
+
+// SetPasswordTx adds to tx the replacement of the password of a user that exists & is not deleted,
+// e.g. for a password reset where the user proved its identity another way. It fails with
+// db.ErrNotFound for unknown users & with a *ValidationError when the password policy refuses password.
+func (c *Controller) SetPasswordTx(ctx context.Context, tx *db.Transaction, id, password string) error {
+	user, err := c.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if user.ID == "" {
+		return db.ErrNotFound
+	}
+
+	if err := c.checkPassword(ctx, "password", password, user.Email, user.Name); err != nil {
+		return err
+	}
+
+	hashed, err := c.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return c.users.UpdateTx(tx, db.Keys{"id": id},
+		map[string]interface{}{"password": hashed, "updatedAt": time.Now().Unix()},
+		expression.AttributeExists(expression.Name("pk")),
+		expression.AttributeNotExists(expression.Name("deletedAt")),
+	)
+}
+
+// DeactivateUser disables a user once its password is confirmed. The user is kept but can no longer
+// log in or refresh tokens; access tokens already issued expire on their own. Deleted users are not
+// found.
+func (c *Controller) DeactivateUser(id, password string) error {
+	if _, err := c.reauthenticate(id, password); err != nil {
+		return err
+	}
+
+	return c.users.Update(context.TODO(), db.Keys{"id": id}, map[string]interface{}{
+		"isActive":  0,
+		"updatedAt": time.Now().Unix(),
+	}, expression.AttributeNotExists(expression.Name("deletedAt")))
+}
+
+// reauthenticate returns the user once password is confirmed to be its current password.
+// It fails with db.ErrNotFound for unknown users & ErrWrongPassword otherwise.
+func (c *Controller) reauthenticate(id, password string) (User, error) {
+	user, err := c.GetUser(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	if user.ID == "" {
+		return User{}, db.ErrNotFound
+	}
+
+	if !c.VerifyPassword(context.TODO(), user, password) {
+		return User{}, ErrWrongPassword
+	}
+
+	return user, nil
+}
+
+// checkPassword returns a *ValidationError for field when the password policy refuses password
+func (c *Controller) checkPassword(ctx context.Context, field, password, email, name string) error {
+	violations, err := c.policy.Check(ctx, password, email, name)
+	if err != nil || len(violations) == 0 {
+		return err
+	}
+
+	verr := &ValidationError{}
+	for _, v := range violations {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Code: v.Code, Message: v.Message})
+	}
+
+	return verr
+}
+
+// VerifyPassword reports whether password is the password of user. A hash written with other than the
+// configured algorithm or parameters is replaced, unless the password changed meanwhile; failing to
+// replace it is only logged. The zero User takes as long to reject as a real one, e.g. for unknown emails.
+func (c *Controller) VerifyPassword(ctx context.Context, user User, password string) bool {
+	ok, rehash := c.passwords.VerifyPassword(password, user.Password)
+	if !ok || !rehash {
+		return ok
+	}
+
+	hashed, err := c.passwords.Hash(password)
+	if err == nil {
+		_, err = c.table.Update(PK, user.ID).
+			Set("password", hashed).
+			If(expression.Name("password").Equal(expression.Value(user.Password))).
+			Returning(types.ReturnValueNone).
+			Exec(ctx)
+	}
+	if err != nil && !db.IsConditionFailed(err) {
+		log.Printf("users: rehashing the password of %s: %v", user.ID, err)
+	}
+
+	return true
+}
+
+// PatchFields are the user fields clients may change with PatchUser
+var PatchFields = patch.Fields{
+	"name": {Kind: patch.String, Validate: func(v interface{}) error {
+		if strings.TrimSpace(v.(string)) == "" {
+			return errors.New("must not be empty")
+		}
+		return nil
+	}},
+}
+
+// PatchUser applies a merge patch or JSON Patch document of the given content type to a user & returns the updated user.
+// It fails with db.ErrNotFound for unknown users & with a condition failure when the user changed or was
+// deleted meanwhile.
+func (c *Controller) PatchUser(id, contentType string, body []byte) (User, error) {
+	p, err := patch.Parse(contentType, body, PatchFields)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := c.users.Get(context.TODO(), db.Keys{"id": id})
+	if err != nil {
+		return User{}, err
+	}
+	if user.DeletedAt != 0 {
+		return User{}, db.ErrNotFound
+	}
+
+	changes, err := patch.Item(user, p, PatchFields)
+	if err != nil {
+		return User{}, err
+	}
+
+	if changes.Empty() {
+		return user, nil
+	}
+
+	update := patch.ApplyTo(changes, c.table.Update(PK, id).MustExist())
+	update.Set("updatedAt", time.Now().Unix())
+	update.If(expression.AttributeNotExists(expression.Name("deletedAt"))) // deleted meanwhile
+
+	var updated User
+	if err := update.ExecInto(context.TODO(), &updated); err != nil {
+		return User{}, err
+	}
+
+	return updated, nil
+}
+
+// ChangeEmail moves a user to a new email once its password is confirmed, releasing the old email
+// in the same transaction. It fails with ErrEmailTaken when another user registered the new email.
+func (c *Controller) ChangeEmail(ctx context.Context, id, password, email string) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	user, err := c.reauthenticate(id, password)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == email {
+		return nil
+	}
+
+	tx := c.table.Transaction()
+	err = c.users.UpdateTx(tx, db.Keys{"id": id}, map[string]interface{}{
+		"email":         email,
+		"emailVerified": false, // until the user proves it owns the new address
+		"updatedAt":     time.Now().Unix(),
+	}, expression.Name("email").Equal(expression.Value(user.Email))) // fails if the email changed meanwhile
+	if err != nil {
+		return err
+	}
+	if err := c.emails.DeleteTx(tx, db.Keys{"email": user.Email}); err != nil {
+		return err
+	}
+	if err := c.emails.CreateTx(tx, EmailClaim{Email: email, UserID: id}); err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if db.ConditionFailedAt(err, 2) {
+		return ErrEmailTaken
+	}
+
+	return err
+}
+
+// MarkEmailVerified records that a user proved it owns email. It fails with a condition failure when
+// the user no longer has that email or is deleted; verifying twice is not an error.
+func (c *Controller) MarkEmailVerified(ctx context.Context, id, email string) error {
+	_, err := c.table.Update(PK, id).
+		Set("emailVerified", true).
+		Set("updatedAt", time.Now().Unix()).
+		MustExist().
+		If(expression.Name("email").Equal(expression.Value(email))).
+		If(expression.AttributeNotExists(expression.Name("deletedAt"))).
+		Returning(types.ReturnValueNone).
+		Exec(ctx)
+
+	return err
+}
+
+// DeleteUser soft deletes a user once its password is confirmed. The user is deactivated & hidden,
+// but keeps its email until PurgeDeletedUsers removes it for good, so it can be restored meanwhile.
+func (c *Controller) DeleteUser(id, password string) error {
+	if _, err := c.reauthenticate(id, password); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	_, err := c.table.Update(PK, id).
+		SetIndexKey("isActive", 0).
+		Set("deletedAt", now).
+		Set("updatedAt", now).
+		MustExist().
+		If(expression.AttributeNotExists(expression.Name("deletedAt"))).
+		Returning(types.ReturnValueNone).
+		Exec(context.TODO())
+
+	return err
 }
 
-func DeleteUser(id, password string) error {
-	user, err := GetUser(id)
+// SetRoles replaces the roles & extra permissions of a user; they apply to its next access token.
+// It fails with db.ErrNotFound for unknown users & auth.ErrUnknownRole or auth.ErrUnknownPermission.
+func (c *Controller) SetRoles(ctx context.Context, id string, roles, permissions []string) error {
+	if err := auth.ValidateRoles(roles, permissions); err != nil {
+		return err
+	}
+
+	update := c.table.Update(PK, id).
+		Set("updatedAt", time.Now().Unix()).
+		MustExist().
+		If(expression.AttributeNotExists(expression.Name("deletedAt"))).
+		Returning(types.ReturnValueNone)
+
+	// empty lists are removed rather than stored, like the omitempty fields of new users
+	if len(roles) > 0 {
+		update.Set("roles", roles)
+	} else {
+		update.Remove("roles")
+	}
+	if len(permissions) > 0 {
+		update.Set("permissions", permissions)
+	} else {
+		update.Remove("permissions")
+	}
+
+	_, err := update.Exec(ctx)
+	if db.IsConditionFailed(err) {
+		return db.ErrNotFound
+	}
+
+	return err
+}
+
+// RestoreUser reactivates a deleted user that has not been purged yet.
+// It fails with db.ErrNotFound for unknown users & ErrNotDeleted for users that are not deleted.
+func (c *Controller) RestoreUser(ctx context.Context, id string) error {
+	user, err := c.users.Get(ctx, db.Keys{"id": id})
 	if err != nil {
 		return err
 	}
+	if user.DeletedAt == 0 {
+		return ErrNotDeleted
+	}
+
+	_, err = c.table.Update(PK, id).
+		SetIndexKey("isActive", 1).
+		Set("updatedAt", time.Now().Unix()).
+		Remove("deletedAt").
+		If(expression.Name("deletedAt").Equal(expression.Value(user.DeletedAt))).
+		Returning(types.ReturnValueNone).
+		Exec(ctx)
+
+	return err
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before cutoff, releasing their emails,
+// & returns how many were removed. Users restored meanwhile are skipped. A user failing to purge is
+// logged & left for the next run rather than stopping the others; the error then tells how many failed.
+func (c *Controller) PurgeDeletedUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	// deleted users are inactive, so the Active index narrows the search to inactive users
+	inactive, err := c.users.QueryAll(ctx, db.Query{Index: ActiveIndex, SortKeyEquals: 0})
+	if err != nil {
+		return 0, err
+	}
+
+	purged, failed := 0, 0
+	for _, user := range inactive {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
 
-	if user == (User{}) {
-		return errors.New("user not found")
+		if user.DeletedAt == 0 || user.DeletedAt > cutoff.Unix() {
+			continue
+		}
+
+		ok, err := c.purgeUser(ctx, user)
+		if err != nil {
+			log.Printf("users: purging %s: %v", user.ID, err)
+			failed++
+			continue
+		}
+		if ok {
+			purged++
+		}
 	}
 
-	if passMatch := utils.VerifyPassword(password, user.Password); !passMatch {
-		return errors.New("current password does not match")
+	if failed > 0 {
+		return purged, fmt.Errorf("users: %d deleted users could not be purged, they are retried on the next run", failed)
+	}
+
+	return purged, nil
+}
+
+// purgeUser removes a deleted user & its email claim, reporting false when it was restored meanwhile.
+// A missing claim, or one taken over by another user, counts as already released.
+func (c *Controller) purgeUser(ctx context.Context, user User) (bool, error) {
+	claim, err := c.emails.Get(ctx, db.Keys{"email": user.Email})
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return false, err
+	}
+
+	tx := c.table.Transaction()
+	err = c.users.DeleteTx(tx, db.Keys{"id": user.ID},
+		expression.Name("deletedAt").Equal(expression.Value(user.DeletedAt)))
+	if err != nil {
+		return false, err
+	}
+	if claim.UserID == user.ID {
+		err = c.emails.DeleteTx(tx, db.Keys{"email": user.Email},
+			expression.Name("userId").Equal(expression.Value(user.ID)))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if db.ConditionFailedAt(err, 0) {
+		return false, nil // restored since it was listed
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return testTable.DeleteItem(PK, id)
+	return true, nil
 }
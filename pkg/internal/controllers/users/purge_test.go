@@ -0,0 +1,99 @@
+package controller_users_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/outbox"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// failingClient fails the transactions deleting the user with id broken
+type failingClient struct {
+	db.Client
+	broken string
+}
+
+func (c *failingClient) TransactWriteItems(ctx context.Context, items []types.TransactWriteItem) error {
+	if del := items[0].Delete; del != nil {
+		if sk, ok := del.Key["sk"].(*types.AttributeValueMemberS); ok && sk.Value == c.broken {
+			return errors.New("throttled")
+		}
+	}
+
+	return c.Client.TransactWriteItems(ctx, items)
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	ctx := context.Background()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &failingClient{Client: db.New(engine), broken: "broken"}
+	table := testTable.New(client, "test")
+	users := testTable.Repository(table, controller_users.Users)
+	emails := testTable.Repository(table, controller_users.Emails)
+
+	cutoff := time.Now().Add(-time.Hour)
+	old, recent := cutoff.Add(-time.Hour).Unix(), cutoff.Add(time.Minute).Unix()
+
+	for _, u := range []controller_users.User{
+		{ID: "claimed", Email: "claimed@example.com", DeletedAt: old},
+		{ID: "unclaimed", Email: "unclaimed@example.com", DeletedAt: old},
+		{ID: "taken", Email: "taken@example.com", DeletedAt: old},
+		{ID: "broken", Email: "broken@example.com", DeletedAt: old},
+		{ID: "recent", Email: "recent@example.com", DeletedAt: recent},
+	} {
+		if err := users.Put(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		// isActive is omitted when 0, DeleteUser sets it explicitly to list the user in the Active index
+		if _, err := table.Update(controller_users.PK, u.ID).SetIndexKey("isActive", 0).Exec(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, claim := range []controller_users.EmailClaim{
+		{Email: "claimed@example.com", UserID: "claimed"},
+		{Email: "taken@example.com", UserID: "newcomer"},
+		{Email: "broken@example.com", UserID: "broken"},
+		{Email: "recent@example.com", UserID: "recent"},
+	} {
+		if err := emails.Put(ctx, claim); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := controller_users.New(table, outbox.New(client, table.Schema()), nil, nil)
+
+	purged, err := c.PurgeDeletedUsers(ctx, cutoff)
+	if err == nil {
+		t.Error("PurgeDeletedUsers hid the failure of broken")
+	}
+	if purged != 3 {
+		t.Errorf("purged %d users, want 3", purged)
+	}
+
+	for id, want := range map[string]bool{"claimed": false, "unclaimed": false, "taken": false, "broken": true, "recent": true} {
+		_, err := users.Get(ctx, db.Keys{"id": id})
+		if kept := err == nil; kept != want {
+			t.Errorf("user %s kept = %v, want %v (%v)", id, kept, want, err)
+		}
+	}
+
+	for email, want := range map[string]bool{"claimed@example.com": false, "taken@example.com": true, "broken@example.com": true} {
+		_, err := emails.Get(ctx, db.Keys{"email": email})
+		if kept := err == nil; kept != want {
+			t.Errorf("claim of %s kept = %v, want %v (%v)", email, kept, want, err)
+		}
+	}
+}
@@ -5,76 +5,102 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"serverless-aws-cdk/internal/config"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/joho/godotenv"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// maxUnprocessedRetries bounds how often batch requests resend the items DynamoDB could not process
+const maxUnprocessedRetries = 5
+
+// API is the subset of the DynamoDB client used by DB.
+// It is satisfied by *dynamodb.Client & by the in-memory engine in the memory package.
+type API interface {
+	GetItem(ctx context.Context, input *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, input *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, input *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, input *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	BatchGetItem(ctx context.Context, input *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItem(ctx context.Context, input *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItems(ctx context.Context, input *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// Client is the data access interface tables & repositories depend on, implemented by DB
+type Client interface {
+	GetItem(ctx context.Context, tableName string, key map[string]types.AttributeValue) (map[string]types.AttributeValue, error)
+	PutItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) error
+	DeleteItem(ctx context.Context, tableName string, key map[string]types.AttributeValue) error
+	UpdateItem(ctx context.Context, tableName string, key map[string]types.AttributeValue, updateExpression *string, updateExpressionNames map[string]string, expressionAttributeValues map[string]types.AttributeValue) error
+	UpdateItemReturning(ctx context.Context, input *dynamodb.UpdateItemInput) (map[string]types.AttributeValue, error)
+	QueryItems(ctx context.Context, tableName string, keyConditionExpression *string, expressionAttributeNames map[string]string, expressionAttributeValues map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error)
+	QueryPage(ctx context.Context, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+	ScanItems(ctx context.Context, tableName string) ([]map[string]types.AttributeValue, error)
+	ScanPage(ctx context.Context, input *dynamodb.ScanInput) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+	BatchGetItems(ctx context.Context, tableName string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error)
+	BatchWriteItems(ctx context.Context, tableName string, items []map[string]types.AttributeValue) error
+	TransactWriteItems(ctx context.Context, items []types.TransactWriteItem) error
+}
+
 // DB is a struct that holds the DynamoDB client
 type DB struct {
-	client *dynamodb.DynamoDB
+	client API
 }
 
-// NewDB creates a new DB instance
-func NewDB() *DB {
-	dotenvErr := godotenv.Load()
-	if dotenvErr != nil {
-		log.Fatal("Error loading .env file")
-	}
+var _ Client = (*DB)(nil)
 
-	var config *aws.Config
-
-	httpClient := &http.Client{
-		Timeout: time.Second * 5, // Maximum of 5 secs
+// New creates a DB backed by the given client, e.g. an in-memory engine in tests
+func New(client API) *DB {
+	return &DB{
+		client: client,
 	}
+}
 
-	creds := credentials.NewStaticCredentials(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		os.Getenv("AWS_SESSION_TOKEN"),
-	)
-
-	environment := os.Getenv("ENVIRONMENT")
-	if environment == "local-db" {
-		config = &aws.Config{
-			Region:      aws.String("us-east-1"),
-			Endpoint:    aws.String("http://host.docker.internal:8000"),
-			Credentials: creds,
-			HTTPClient:  httpClient,
-			MaxRetries:  aws.Int(1),
-			// LogLevel:   aws.LogLevel(aws.LogDebug), // Uncomment for debugging
-		}
-
-	} else {
-		config = &aws.Config{
-			Region:      aws.String("us-east-1"),
-			Credentials: creds,
-			HTTPClient:  httpClient,
-		}
+// NewDB creates a new DB instance from the DynamoDB settings in cfg
+func NewDB(ctx context.Context, cfg config.DynamoDB) (*DB, error) {
+	client, err := NewClient(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("Successfully created DynamoDB session")
+	log.Println("Successfully created DynamoDB client")
 
-	sess := session.Must(session.NewSession())
+	return New(client), nil
+}
 
-	return &DB{
-		client: dynamodb.New(sess, config),
+// NewClient creates a DynamoDB client from the settings in cfg.
+// Credentials come from the default chain: environment, shared config or the Lambda execution role.
+func NewClient(ctx context.Context, cfg config.DynamoDB) (*dynamodb.Client, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx,
+		awsconfig.WithRegion(cfg.Region),
+		awsconfig.WithHTTPClient(&http.Client{Timeout: cfg.Timeout.Std()}),
+		awsconfig.WithRetryMaxAttempts(cfg.MaxRetries+1), // the first attempt is not a retry
+		// awsconfig.WithClientLogMode(aws.LogRequestWithBody|aws.LogResponseWithBody), // Uncomment for debugging
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
+
+	return dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	}), nil
 }
 
 // GetItem fetches an item from DynamoDB
-func (db *DB) GetItem(ctx context.Context, tableName string, key map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+func (db *DB) GetItem(ctx context.Context, tableName string, key map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
 		Key:       key,
 	}
 
-	result, err := db.client.GetItemWithContext(ctx, input)
+	result, err := db.client.GetItem(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get item: %w", err)
 	}
@@ -83,13 +109,13 @@ func (db *DB) GetItem(ctx context.Context, tableName string, key map[string]*dyn
 }
 
 // PutItem inserts an item into DynamoDB
-func (db *DB) PutItem(ctx context.Context, tableName string, item map[string]*dynamodb.AttributeValue) error {
+func (db *DB) PutItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) error {
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String(tableName),
 		Item:      item,
 	}
 
-	_, err := db.client.PutItemWithContext(ctx, input)
+	_, err := db.client.PutItem(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to put item: %w", err)
 	}
@@ -98,13 +124,13 @@ func (db *DB) PutItem(ctx context.Context, tableName string, item map[string]*dy
 }
 
 // DeleteItem deletes an item from DynamoDB
-func (db *DB) DeleteItem(ctx context.Context, tableName string, key map[string]*dynamodb.AttributeValue) error {
+func (db *DB) DeleteItem(ctx context.Context, tableName string, key map[string]types.AttributeValue) error {
 	input := &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
 		Key:       key,
 	}
 
-	_, err := db.client.DeleteItemWithContext(ctx, input)
+	_, err := db.client.DeleteItem(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to delete item: %w", err)
 	}
@@ -113,7 +139,7 @@ func (db *DB) DeleteItem(ctx context.Context, tableName string, key map[string]*
 }
 
 // UpdateItem updates an item in DynamoDB
-func (db *DB) UpdateItem(ctx context.Context, tableName string, key map[string]*dynamodb.AttributeValue, updateExpression *string, updateExpressionNames map[string]*string, expressionAttributeValues map[string]*dynamodb.AttributeValue) error {
+func (db *DB) UpdateItem(ctx context.Context, tableName string, key map[string]types.AttributeValue, updateExpression *string, updateExpressionNames map[string]string, expressionAttributeValues map[string]types.AttributeValue) error {
 	input := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(tableName),
 		Key:                       key,
@@ -122,7 +148,7 @@ func (db *DB) UpdateItem(ctx context.Context, tableName string, key map[string]*
 		ExpressionAttributeValues: expressionAttributeValues,
 	}
 
-	_, err := db.client.UpdateItemWithContext(ctx, input)
+	_, err := db.client.UpdateItem(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to update item: %w", err)
 	}
@@ -130,77 +156,172 @@ func (db *DB) UpdateItem(ctx context.Context, tableName string, key map[string]*
 	return nil
 }
 
-// QueryItems queries items from DynamoDB
-func (db *DB) QueryItems(ctx context.Context, tableName string, keyConditionExpression *string, expressionAttributeNames map[string]*string, expressionAttributeValues map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+// UpdateItemReturning runs a single update request, returning the attributes selected by its ReturnValues
+func (db *DB) UpdateItemReturning(ctx context.Context, input *dynamodb.UpdateItemInput) (map[string]types.AttributeValue, error) {
+	result, err := db.client.UpdateItem(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update item: %w", err)
+	}
+
+	return result.Attributes, nil
+}
+
+// QueryItems queries every page of items from DynamoDB
+func (db *DB) QueryItems(ctx context.Context, tableName string, keyConditionExpression *string, expressionAttributeNames map[string]string, expressionAttributeValues map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
 	input := &dynamodb.QueryInput{
 		TableName:                 aws.String(tableName),
 		KeyConditionExpression:    keyConditionExpression,    // e.g. "id = :id"
 		ExpressionAttributeNames:  expressionAttributeNames,  // e.g. {"#id": "id"}
-		ExpressionAttributeValues: expressionAttributeValues, // e.g. {":id": {"S": "123"}}
+		ExpressionAttributeValues: expressionAttributeValues, // e.g. {":id": &types.AttributeValueMemberS{Value: "123"}}
 	}
 
-	result, err := db.client.QueryWithContext(ctx, input)
+	var items []map[string]types.AttributeValue
+
+	paginator := dynamodb.NewQueryPaginator(db.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query items: %w", err)
+		}
+
+		items = append(items, page.Items...)
+	}
+
+	return items, nil
+}
+
+// QueryPage runs a single query request, returning the items & the key to resume from (nil on the last page)
+func (db *DB) QueryPage(ctx context.Context, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	result, err := db.client.Query(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query items: %w", err)
+		return nil, nil, fmt.Errorf("failed to query items: %w", err)
 	}
 
-	return result.Items, nil
+	return result.Items, result.LastEvaluatedKey, nil
 }
 
-// ScanItems scans items from DynamoDB
-func (db *DB) ScanItems(ctx context.Context, tableName string) ([]map[string]*dynamodb.AttributeValue, error) {
+// ScanItems scans every page of items from DynamoDB
+func (db *DB) ScanItems(ctx context.Context, tableName string) ([]map[string]types.AttributeValue, error) {
 	input := &dynamodb.ScanInput{
 		TableName: aws.String(tableName),
 	}
 
-	result, err := db.client.ScanWithContext(ctx, input)
+	var items []map[string]types.AttributeValue
+
+	paginator := dynamodb.NewScanPaginator(db.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan items: %w", err)
+		}
+
+		items = append(items, page.Items...)
+	}
+
+	return items, nil
+}
+
+// ScanPage runs a single scan request, returning the items & the key to resume from (nil on the last page)
+func (db *DB) ScanPage(ctx context.Context, input *dynamodb.ScanInput) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	result, err := db.client.Scan(ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan items: %w", err)
+		return nil, nil, fmt.Errorf("failed to scan items: %w", err)
 	}
 
-	return result.Items, nil
+	return result.Items, result.LastEvaluatedKey, nil
 }
 
-// BatchGetItems fetches multiple items from DynamoDB
-func (db *DB) BatchGetItems(ctx context.Context, tableName string, keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
-	input := &dynamodb.BatchGetItemInput{
-		RequestItems: map[string]*dynamodb.KeysAndAttributes{
-			tableName: {
-				Keys: keys,
-			},
+// BatchGetItems fetches multiple items from DynamoDB, retrying keys DynamoDB left unprocessed
+func (db *DB) BatchGetItems(ctx context.Context, tableName string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	requestItems := map[string]types.KeysAndAttributes{
+		tableName: {
+			Keys: keys,
 		},
 	}
 
-	result, err := db.client.BatchGetItemWithContext(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to batch get items: %w", err)
+	var items []map[string]types.AttributeValue
+
+	for attempt := 0; len(requestItems) > 0; attempt++ {
+		if attempt > maxUnprocessedRetries {
+			return items, fmt.Errorf("failed to batch get items: %d keys left unprocessed", len(requestItems[tableName].Keys))
+		}
+
+		if err := backoff(ctx, attempt); err != nil {
+			return items, err
+		}
+
+		result, err := db.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: requestItems})
+		if err != nil {
+			return nil, fmt.Errorf("failed to batch get items: %w", err)
+		}
+
+		items = append(items, result.Responses[tableName]...)
+		requestItems = result.UnprocessedKeys
 	}
 
-	return result.Responses[tableName], nil
+	return items, nil
 }
 
-// BatchWriteItems writes multiple items to DynamoDB
-func (db *DB) BatchWriteItems(ctx context.Context, tableName string, items []map[string]*dynamodb.AttributeValue) error {
-	var writeRequests []*dynamodb.WriteRequest
+// BatchWriteItems writes multiple items to DynamoDB, retrying items DynamoDB left unprocessed
+func (db *DB) BatchWriteItems(ctx context.Context, tableName string, items []map[string]types.AttributeValue) error {
+	var writeRequests []types.WriteRequest
 
 	for _, item := range items {
-		writeRequests = append(writeRequests, &dynamodb.WriteRequest{
-			PutRequest: &dynamodb.PutRequest{
+		writeRequests = append(writeRequests, types.WriteRequest{
+			PutRequest: &types.PutRequest{
 				Item: item,
 			},
 		})
 	}
 
-	input := &dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{
-			tableName: writeRequests,
-		},
+	requestItems := map[string][]types.WriteRequest{
+		tableName: writeRequests,
 	}
 
-	_, err := db.client.BatchWriteItemWithContext(ctx, input)
+	for attempt := 0; len(requestItems) > 0; attempt++ {
+		if attempt > maxUnprocessedRetries {
+			return fmt.Errorf("failed to batch write items: %d items left unprocessed", len(requestItems[tableName]))
+		}
+
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
+
+		result, err := db.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: requestItems})
+		if err != nil {
+			return fmt.Errorf("failed to batch write items: %w", err)
+		}
+
+		requestItems = result.UnprocessedItems
+	}
+
+	return nil
+}
+
+// TransactWriteItems applies every write atomically; nothing is written when any condition fails
+func (db *DB) TransactWriteItems(ctx context.Context, items []types.TransactWriteItem) error {
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	}
+
+	_, err := db.client.TransactWriteItems(ctx, input)
 	if err != nil {
-		return fmt.Errorf("failed to batch write items: %w", err)
+		return fmt.Errorf("failed to write transaction: %w", err)
 	}
 
 	return nil
 }
+
+// backoff waits before a retry, doubling from 50ms; the first attempt does not wait
+func backoff(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(25<<attempt) * time.Millisecond):
+		return nil
+	}
+}
@@ -0,0 +1,164 @@
+package dump
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// encodeItem renders an item in the typed DynamoDB JSON format used by the AWS CLI & console,
+// e.g. {"pk":{"S":"USERS"},"isActive":{"N":"1"}}
+func encodeItem(item map[string]types.AttributeValue) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(item))
+	for k, av := range item {
+		v, err := encodeValue(av)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = v
+	}
+
+	return out, nil
+}
+
+func encodeValue(av types.AttributeValue) (map[string]interface{}, error) {
+	switch av := av.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": av.Value}, nil
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": av.Value}, nil
+	case *types.AttributeValueMemberB:
+		return map[string]interface{}{"B": base64.StdEncoding.EncodeToString(av.Value)}, nil
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": av.Value}, nil
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": true}, nil
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": av.Value}, nil
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": av.Value}, nil
+	case *types.AttributeValueMemberBS:
+		set := make([]string, len(av.Value))
+		for i, b := range av.Value {
+			set[i] = base64.StdEncoding.EncodeToString(b)
+		}
+		return map[string]interface{}{"BS": set}, nil
+	case *types.AttributeValueMemberM:
+		m, err := encodeItem(av.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"M": m}, nil
+	case *types.AttributeValueMemberL:
+		l := make([]interface{}, len(av.Value))
+		for i, e := range av.Value {
+			v, err := encodeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = v
+		}
+		return map[string]interface{}{"L": l}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported attribute value type %T", av)
+}
+
+// decodeItem parses an item in the typed DynamoDB JSON format
+func decodeItem(raw map[string]json.RawMessage) (map[string]types.AttributeValue, error) {
+	out := make(map[string]types.AttributeValue, len(raw))
+	for k, b := range raw {
+		av, err := decodeValue(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = av
+	}
+
+	return out, nil
+}
+
+func decodeValue(b json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(b, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("attribute value must have exactly one type, got %d", len(typed))
+	}
+
+	for t, v := range typed {
+		switch t {
+		case "S":
+			var s string
+			err := json.Unmarshal(v, &s)
+			return &types.AttributeValueMemberS{Value: s}, err
+		case "N":
+			var s string
+			err := json.Unmarshal(v, &s)
+			return &types.AttributeValueMemberN{Value: s}, err
+		case "B":
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil, err
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			return &types.AttributeValueMemberB{Value: b}, err
+		case "BOOL":
+			var bl bool
+			err := json.Unmarshal(v, &bl)
+			return &types.AttributeValueMemberBOOL{Value: bl}, err
+		case "NULL":
+			return &types.AttributeValueMemberNULL{Value: true}, nil
+		case "SS":
+			var set []string
+			err := json.Unmarshal(v, &set)
+			return &types.AttributeValueMemberSS{Value: set}, err
+		case "NS":
+			var set []string
+			err := json.Unmarshal(v, &set)
+			return &types.AttributeValueMemberNS{Value: set}, err
+		case "BS":
+			var set []string
+			if err := json.Unmarshal(v, &set); err != nil {
+				return nil, err
+			}
+			bs := make([][]byte, len(set))
+			for i, s := range set {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, err
+				}
+				bs[i] = b
+			}
+			return &types.AttributeValueMemberBS{Value: bs}, nil
+		case "M":
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return nil, err
+			}
+			item, err := decodeItem(m)
+			return &types.AttributeValueMemberM{Value: item}, err
+		case "L":
+			var l []json.RawMessage
+			if err := json.Unmarshal(v, &l); err != nil {
+				return nil, err
+			}
+			list := make([]types.AttributeValue, len(l))
+			for i, e := range l {
+				av, err := decodeValue(e)
+				if err != nil {
+					return nil, err
+				}
+				list[i] = av
+			}
+			return &types.AttributeValueMemberL{Value: list}, nil
+		default:
+			return nil, fmt.Errorf("unknown attribute type %q", t)
+		}
+	}
+
+	return nil, nil
+}
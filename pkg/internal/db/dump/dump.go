@@ -0,0 +1,350 @@
+// Package dump exports tables to NDJSON & imports them back, for backups & cloning data between environments.
+//
+// Every line of a dump is one item in the typed DynamoDB JSON format, so dumps can also be read
+// by other tools. Exports scan the table in parallel segments; imports write through the batch
+// writer, redact PII attributes & record their progress in a checkpoint file so they can resume.
+package dump
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// DefaultSegments is the number of parallel scan segments of an export
+	DefaultSegments = 4
+
+	// maxBatchWrite is the number of items DynamoDB accepts in one BatchWriteItem request
+	maxBatchWrite = 25
+)
+
+// ExportOptions configures an export
+type ExportOptions struct {
+	Segments int       // parallel scan segments, DefaultSegments when zero
+	Prefixes []string  // only export items whose partition key starts with one of these
+	Redactor *Redactor // optional, exports are not redacted by default
+}
+
+// Export writes every matching item of table to w, one JSON object per line, & returns the item count.
+// Items are written in scan order, which interleaves the segments.
+func Export(ctx context.Context, database db.Client, table db.Table, w io.Writer, opts ExportOptions) (int, error) {
+	segments := opts.Segments
+	if segments <= 0 {
+		segments = DefaultSegments
+	}
+
+	filter, err := prefixFilter(table.PartitionKey, opts.Prefixes)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		count    int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	enc := json.NewEncoder(w)
+
+	for segment := 0; segment < segments; segment++ {
+		wg.Add(1)
+
+		go func(segment int) {
+			defer wg.Done()
+
+			input := &dynamodb.ScanInput{
+				TableName:     aws.String(table.Name),
+				Segment:       aws.Int32(int32(segment)),
+				TotalSegments: aws.Int32(int32(segments)),
+			}
+			if filter != nil {
+				input.FilterExpression = filter.Filter()
+				input.ExpressionAttributeNames = filter.Names()
+				input.ExpressionAttributeValues = filter.Values()
+			}
+
+			for {
+				items, lastKey, err := database.ScanPage(ctx, input)
+				if err != nil {
+					fail(fmt.Errorf("dump: scanning segment %d: %w", segment, err))
+					return
+				}
+
+				for _, item := range items {
+					line, err := encodeItem(opts.Redactor.Redact(item))
+					if err != nil {
+						fail(fmt.Errorf("dump: encoding item: %w", err))
+						return
+					}
+
+					mu.Lock()
+					err = enc.Encode(line)
+					count++
+					mu.Unlock()
+
+					if err != nil {
+						fail(fmt.Errorf("dump: writing item: %w", err))
+						return
+					}
+				}
+
+				if len(lastKey) == 0 {
+					return
+				}
+				input.ExclusiveStartKey = lastKey
+			}
+		}(segment)
+	}
+
+	wg.Wait()
+
+	return count, firstErr
+}
+
+// ImportOptions configures an import
+type ImportOptions struct {
+	Prefixes   []string          // only import items whose partition key starts with one of these
+	Redact     map[string]string // redaction rules by attribute name, see NewRedactor
+	Checkpoint string            // path of the checkpoint file; empty disables checkpoints & resuming
+}
+
+// ImportResult describes what Import did
+type ImportResult struct {
+	Written int  // items written by this run
+	Skipped int  // items filtered out by prefix in this run
+	Resumed bool // whether the import continued from a checkpoint
+}
+
+// checkpoint records how far an import got; it is removed once the import completes
+type checkpoint struct {
+	Offset  int64  `json:"offset"`  // byte offset of the first line not yet written
+	Size    int64  `json:"size"`    // size of the dump, to detect a different file
+	Written int    `json:"written"` // items written so far, over every run
+	Salt    []byte `json:"salt"`    // redaction salt, so resumed runs redact consistently
+}
+
+// Import writes the items of a dump into table. With a checkpoint path, progress is saved after
+// every batch & a later call with the same dump & path continues where the previous one stopped.
+func Import(ctx context.Context, database db.Client, table db.Table, r io.ReadSeeker, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	for attr := range opts.Redact {
+		if attr == table.PartitionKey || attr == table.SortKey {
+			return result, fmt.Errorf("dump: key attribute %s cannot be redacted", attr)
+		}
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return result, err
+	}
+
+	cp := checkpoint{Size: size}
+	if opts.Checkpoint != "" {
+		saved, err := readCheckpoint(opts.Checkpoint)
+		if err != nil {
+			return result, err
+		}
+		if saved != nil {
+			if saved.Size != size || saved.Offset > size {
+				return result, fmt.Errorf("dump: checkpoint %s belongs to a different dump; remove it to start over", opts.Checkpoint)
+			}
+			cp = *saved
+			result.Resumed = true
+		}
+	}
+
+	redactor, err := NewRedactor(opts.Redact, cp.Salt)
+	if err != nil {
+		return result, err
+	}
+	cp.Salt = redactor.Salt()
+
+	if _, err := r.Seek(cp.Offset, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	reader := bufio.NewReader(r)
+	offset := cp.Offset
+	var batch []map[string]types.AttributeValue
+
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := database.BatchWriteItems(ctx, table.Name, batch); err != nil {
+				return fmt.Errorf("dump: writing items: %w", err)
+			}
+			result.Written += len(batch)
+			cp.Written += len(batch)
+			batch = batch[:0]
+		}
+
+		cp.Offset = offset
+		if opts.Checkpoint == "" {
+			return nil
+		}
+		return writeCheckpoint(opts.Checkpoint, cp)
+	}
+
+	// keys already in the pending batch, since a BatchWriteItem request cannot write an item twice
+	pending := map[string]bool{}
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return result, readErr
+		}
+
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(line, &raw); err != nil {
+				return result, fmt.Errorf("dump: line at offset %d: %w", offset, err)
+			}
+
+			item, err := decodeItem(raw)
+			if err != nil {
+				return result, fmt.Errorf("dump: line at offset %d: %w", offset, err)
+			}
+
+			pk, _ := item[table.PartitionKey].(*types.AttributeValueMemberS)
+			if pk == nil {
+				return result, fmt.Errorf("dump: line at offset %d has no string %s", offset, table.PartitionKey)
+			}
+
+			if !hasPrefix(pk.Value, opts.Prefixes) {
+				result.Skipped++
+			} else {
+				key := pk.Value
+				if sk, ok := item[table.SortKey].(*types.AttributeValueMemberS); ok {
+					key += "\x00" + sk.Value
+				}
+
+				if pending[key] {
+					if err := flush(); err != nil {
+						return result, err
+					}
+					pending = map[string]bool{}
+				}
+
+				pending[key] = true
+				batch = append(batch, redactor.Redact(item))
+			}
+		}
+
+		offset += int64(len(line))
+
+		if len(batch) == maxBatchWrite || readErr != nil {
+			if err := flush(); err != nil {
+				return result, err
+			}
+			pending = map[string]bool{}
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if opts.Checkpoint != "" {
+		if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dump: reading checkpoint: %w", err)
+	}
+
+	cp := &checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("dump: reading checkpoint %s: %w", path, err)
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically, so a crash never leaves a torn file
+func writeCheckpoint(path string, cp checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("dump: writing checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("dump: writing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+func prefixFilter(pk string, prefixes []string) (*expression.Expression, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	cond := expression.Name(pk).BeginsWith(prefixes[0])
+	for _, p := range prefixes[1:] {
+		cond = cond.Or(expression.Name(pk).BeginsWith(p))
+	}
+
+	expr, err := expression.NewBuilder().WithFilter(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &expr, nil
+}
+
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
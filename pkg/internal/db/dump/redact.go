@@ -0,0 +1,133 @@
+package dump
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Redaction strategies, by attribute name in the configuration
+const (
+	RedactHash   = "hash"   // replace strings with `redacted-<digest>`
+	RedactEmail  = "email"  // replace strings with `<digest>@example.invalid`, keeping them unique & email shaped
+	RedactRemove = "remove" // drop the attribute
+)
+
+// EmailKeyPrefix starts the keys of email uniqueness items, which embed the email itself
+const EmailKeyPrefix = "EMAIL#"
+
+// Redactor replaces PII attributes of items.
+// Digests are keyed with a random salt, so equal values stay equal within one run (& its resumptions)
+// without being reversible by hashing guesses.
+type Redactor struct {
+	rules map[string]string
+	salt  []byte
+}
+
+// NewRedactor creates a redactor for rules mapping top-level attribute names to a strategy.
+// An empty salt generates a random one.
+func NewRedactor(rules map[string]string, salt []byte) (*Redactor, error) {
+	var problems []string
+	for _, attr := range sortedNames(rules) {
+		switch rules[attr] {
+		case RedactHash, RedactEmail, RedactRemove:
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown strategy %q", attr, rules[attr]))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("dump: invalid redaction rules: %s", strings.Join(problems, "; "))
+	}
+
+	if len(salt) == 0 {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Redactor{rules: rules, salt: salt}, nil
+}
+
+// Salt returns the key digests are computed with
+func (r *Redactor) Salt() []byte {
+	return r.salt
+}
+
+// Redact returns item with the configured attributes replaced; item itself is not modified.
+// Only string values are rewritten, other types are removed whatever the strategy.
+func (r *Redactor) Redact(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	if r == nil || len(r.rules) == 0 {
+		return item
+	}
+
+	out := make(map[string]types.AttributeValue, len(item))
+	for k, av := range item {
+		strategy, ok := r.rules[k]
+		if !ok {
+			out[k] = r.redactEmailKey(av)
+			continue
+		}
+
+		s, isString := av.(*types.AttributeValueMemberS)
+		if strategy == RedactRemove || !isString {
+			continue
+		}
+
+		switch strategy {
+		case RedactHash:
+			out[k] = &types.AttributeValueMemberS{Value: "redacted-" + r.digest(s.Value)}
+		case RedactEmail:
+			out[k] = &types.AttributeValueMemberS{Value: r.email(s.Value)}
+		}
+	}
+
+	return out
+}
+
+// redactEmailKey rewrites `EMAIL#<email>` values like email attributes are, when any attribute is redacted as an email,
+// so uniqueness items keep matching the users they belong to
+func (r *Redactor) redactEmailKey(av types.AttributeValue) types.AttributeValue {
+	s, ok := av.(*types.AttributeValueMemberS)
+	if !ok || !strings.HasPrefix(s.Value, EmailKeyPrefix) || !r.redactsEmails() {
+		return av
+	}
+
+	return &types.AttributeValueMemberS{Value: EmailKeyPrefix + r.email(strings.TrimPrefix(s.Value, EmailKeyPrefix))}
+}
+
+func (r *Redactor) redactsEmails() bool {
+	for _, strategy := range r.rules {
+		if strategy == RedactEmail {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Redactor) email(v string) string {
+	return r.digest(strings.ToLower(v)) + "@example.invalid"
+}
+
+func (r *Redactor) digest(v string) string {
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
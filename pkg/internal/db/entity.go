@@ -0,0 +1,276 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TypeAttribute is the attribute every repository-managed item carries to tell entity types apart
+const TypeAttribute = "entityType"
+
+// Keys holds the values substituted into key templates, keyed by placeholder name
+// e.g. Keys{"id": "123"} renders `USER#{id}` as `USER#123`
+type Keys map[string]string
+
+// Index describes a global secondary index an entity is projected into.
+// PartitionTemplate & SortTemplate are optional; when set, the rendered values are written
+// to the PartitionKey & SortKey attributes on every put.
+type Index struct {
+	Name              string
+	PartitionKey      string
+	SortKey           string
+	PartitionTemplate string
+	SortTemplate      string
+}
+
+// EntityOptions configures how an entity is stored in a single-table design
+type EntityOptions struct {
+	Type         string // discriminator stored in TypeAttribute, e.g. "USER"
+	PartitionKey string // template, e.g. "USERS" or "USER#{id}"
+	SortKey      string // template, e.g. "{id}" or "PROFILE"
+	Indexes      []Index
+	TTL          time.Duration // lifetime of every item written, zero for items that never expire
+}
+
+// Entity binds a Go type to its key templates
+type Entity[T any] struct {
+	opts    EntityOptions
+	pk      template
+	sk      template
+	indexes map[string]indexTemplates
+	fields  map[string]fieldInfo
+}
+
+type indexTemplates struct {
+	Index
+	pk *template
+	sk *template
+}
+
+type fieldInfo struct {
+	index []int
+	attr  string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]reflect.Type{}
+)
+
+// RegisterEntity validates the entity options against T & records the type in the entity registry.
+// It panics on invalid options since entities are registered at package initialisation.
+func RegisterEntity[T any](opts EntityOptions) *Entity[T] {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("db: entity %s must be a struct", typ))
+	}
+
+	if opts.Type == "" {
+		panic(fmt.Sprintf("db: entity %s has no type discriminator", typ))
+	}
+
+	e := &Entity[T]{
+		opts:    opts,
+		pk:      mustParseTemplate(opts.PartitionKey),
+		sk:      mustParseTemplate(opts.SortKey),
+		indexes: map[string]indexTemplates{},
+		fields:  structFields(typ),
+	}
+
+	for _, idx := range opts.Indexes {
+		it := indexTemplates{Index: idx}
+		if idx.PartitionTemplate != "" {
+			t := mustParseTemplate(idx.PartitionTemplate)
+			it.pk = &t
+		}
+		if idx.SortTemplate != "" {
+			t := mustParseTemplate(idx.SortTemplate)
+			it.sk = &t
+		}
+		e.indexes[idx.Name] = it
+	}
+
+	templates := []template{e.pk, e.sk}
+	for _, it := range e.indexes {
+		if it.pk != nil {
+			templates = append(templates, *it.pk)
+		}
+		if it.sk != nil {
+			templates = append(templates, *it.sk)
+		}
+	}
+
+	for _, t := range templates {
+		for _, name := range t.placeholders {
+			if _, ok := e.fields[name]; !ok {
+				panic(fmt.Sprintf("db: entity %s has no field for placeholder {%s}", typ, name))
+			}
+		}
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if existing, ok := registry[opts.Type]; ok && existing != typ {
+		panic(fmt.Sprintf("db: entity type %q already registered for %s", opts.Type, existing))
+	}
+	registry[opts.Type] = typ
+
+	return e
+}
+
+// EntityType returns the Go type registered for the given discriminator
+func EntityType(name string) (reflect.Type, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	typ, ok := registry[name]
+	return typ, ok
+}
+
+// Type returns the entity's discriminator
+func (e *Entity[T]) Type() string {
+	return e.opts.Type
+}
+
+// PartitionKey renders the partition key for the given keys
+func (e *Entity[T]) PartitionKey(keys Keys) (string, error) {
+	return e.pk.render(keys)
+}
+
+// SortKey renders the sort key for the given keys
+func (e *Entity[T]) SortKey(keys Keys) (string, error) {
+	return e.sk.render(keys)
+}
+
+// KeysOf extracts the placeholder values of every template from item
+func (e *Entity[T]) KeysOf(item T) Keys {
+	val := reflect.ValueOf(item)
+	keys := Keys{}
+
+	for name, f := range e.fields {
+		keys[name] = fmt.Sprint(val.FieldByIndex(f.index).Interface())
+	}
+
+	return keys
+}
+
+// setKeys writes placeholder values parsed from the stored pk & sk back onto item
+func (e *Entity[T]) setKeys(item *T, pk, sk string) {
+	val := reflect.ValueOf(item).Elem()
+
+	for _, parsed := range []Keys{e.pk.parse(pk), e.sk.parse(sk)} {
+		for name, v := range parsed {
+			field := val.FieldByIndex(e.fields[name].index)
+			if field.Kind() == reflect.String && field.CanSet() {
+				field.SetString(v)
+			}
+		}
+	}
+}
+
+// structFields maps placeholder names (json tag name, falling back to the field name) to struct fields
+func structFields(typ reflect.Type) map[string]fieldInfo {
+	fields := map[string]fieldInfo{}
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = f.Name
+		}
+
+		attr := strings.Split(f.Tag.Get("dynamodbav"), ",")[0]
+		if attr == "" {
+			attr = f.Name
+		}
+
+		fields[name] = fieldInfo{index: f.Index, attr: attr}
+	}
+
+	return fields
+}
+
+// template is a parsed key template such as `USER#{id}`
+type template struct {
+	raw          string
+	placeholders []string
+	pattern      *regexp.Regexp
+}
+
+var placeholderRegex = regexp.MustCompile(`{([^}]*)}`)
+
+func mustParseTemplate(raw string) template {
+	t := template{raw: raw}
+
+	pattern := "^"
+	last := 0
+	matches := placeholderRegex.FindAllStringSubmatchIndex(raw, -1)
+	for i, m := range matches {
+		name := raw[m[2]:m[3]]
+		if name == "" {
+			panic(fmt.Sprintf("db: empty placeholder in key template %q", raw))
+		}
+
+		t.placeholders = append(t.placeholders, name)
+		pattern += regexp.QuoteMeta(raw[last:m[0]])
+
+		// the last placeholder swallows the rest of the value, earlier ones stop at the next literal
+		if i == len(matches)-1 {
+			pattern += "(.*)"
+		} else {
+			pattern += "(.*?)"
+		}
+		last = m[1]
+	}
+	pattern += regexp.QuoteMeta(raw[last:]) + "$"
+
+	t.pattern = regexp.MustCompile(pattern)
+	return t
+}
+
+func (t template) render(keys Keys) (string, error) {
+	var missing []string
+
+	out := placeholderRegex.ReplaceAllStringFunc(t.raw, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := keys[name]
+		if !ok || v == "" {
+			missing = append(missing, name)
+		}
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing key values for %q: %s", t.raw, strings.Join(missing, ", "))
+	}
+
+	return out, nil
+}
+
+func (t template) parse(value string) Keys {
+	matches := t.pattern.FindStringSubmatch(value)
+	if matches == nil {
+		return nil
+	}
+
+	keys := Keys{}
+	for i, name := range t.placeholders {
+		keys[name] = matches[i+1]
+	}
+
+	return keys
+}
+
+// isStatic reports whether the template renders without any key values
+func (t template) isStatic() bool {
+	return len(t.placeholders) == 0
+}
@@ -0,0 +1,522 @@
+package memory
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// resolve walks p through it, returning nil when any step is missing
+func resolve(it item, p path) *value {
+	if len(p) == 0 {
+		return nil
+	}
+
+	cur := it[p[0].name]
+	for _, e := range p[1:] {
+		if cur == nil {
+			return nil
+		}
+
+		switch {
+		case e.isIndex && cur.kind == kindL:
+			if e.index >= len(cur.l) {
+				return nil
+			}
+			cur = cur.l[e.index]
+		case !e.isIndex && cur.kind == kindM:
+			cur = cur.m[e.name]
+		default:
+			return nil
+		}
+	}
+
+	return cur
+}
+
+// conditions
+
+func (c *condition) eval(it item) (bool, error) {
+	switch c.kind {
+	case condAnd:
+		l, err := c.children[0].eval(it)
+		if err != nil || !l {
+			return false, err
+		}
+		return c.children[1].eval(it)
+
+	case condOr:
+		l, err := c.children[0].eval(it)
+		if err != nil || l {
+			return l, err
+		}
+		return c.children[1].eval(it)
+
+	case condNot:
+		r, err := c.children[0].eval(it)
+		return !r, err
+
+	case condCompare:
+		l, r := c.operands[0].eval(it), c.operands[1].eval(it)
+		switch c.op {
+		case "=":
+			return l != nil && l.equal(r), nil
+		case "<>":
+			return l == nil || r == nil || !l.equal(r), nil
+		}
+
+		cmp, ok := l.compare(r)
+		if !ok {
+			return false, nil
+		}
+		switch c.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+
+	case condBetween:
+		v := c.operands[0].eval(it)
+		lo, hi := c.operands[1].eval(it), c.operands[2].eval(it)
+		if cmp, ok := lo.compare(hi); ok && cmp > 0 {
+			return false, validationErr("Invalid KeyConditionExpression: The BETWEEN operator requires upper bound to be greater than or equal to lower bound")
+		}
+		a, okA := v.compare(lo)
+		b, okB := v.compare(hi)
+		return okA && okB && a >= 0 && b <= 0, nil
+
+	case condIn:
+		v := c.operands[0].eval(it)
+		for _, o := range c.operands[1:] {
+			if v != nil && v.equal(o.eval(it)) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case condFunc:
+		return c.evalFunc(it)
+	}
+
+	return false, nil
+}
+
+func (c *condition) evalFunc(it item) (bool, error) {
+	target := resolve(it, c.operands[0].path)
+
+	switch c.op {
+	case "attribute_exists":
+		return target != nil, nil
+
+	case "attribute_not_exists":
+		return target == nil, nil
+
+	case "attribute_type":
+		t := c.operands[1].eval(it)
+		if t == nil || t.kind != kindS {
+			return false, validationErr("Invalid ConditionExpression: Incorrect operand type for operator or function; operator or function: attribute_type")
+		}
+		return target != nil && target.kind.String() == t.s, nil
+
+	case "begins_with":
+		prefix := c.operands[1].eval(it)
+		if target == nil || prefix == nil || target.kind != prefix.kind || (target.kind != kindS && target.kind != kindB) {
+			return false, nil
+		}
+		return strings.HasPrefix(target.s, prefix.s), nil
+
+	case "contains":
+		needle := c.operands[1].eval(it)
+		if target == nil || needle == nil {
+			return false, nil
+		}
+
+		switch target.kind {
+		case kindS, kindB:
+			return needle.kind == target.kind && strings.Contains(target.s, needle.s), nil
+		case kindSS:
+			return needle.kind == kindS && target.kind.setContains(target.set, needle.s), nil
+		case kindNS:
+			return needle.kind == kindN && target.kind.setContains(target.set, needle.s), nil
+		case kindBS:
+			return needle.kind == kindB && target.kind.setContains(target.set, needle.s), nil
+		case kindL:
+			for _, e := range target.l {
+				if e.equal(needle) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// eval resolves a condition operand; nil means the attribute does not exist
+func (o *operand) eval(it item) *value {
+	switch o.kind {
+	case operandValue:
+		return o.value
+	case operandPath:
+		return resolve(it, o.path)
+	case operandSize:
+		v := resolve(it, o.path)
+		if v == nil {
+			return nil
+		}
+
+		var n int
+		switch v.kind {
+		case kindS:
+			n = utf8.RuneCountInString(v.s)
+		case kindB:
+			n = len(v.s)
+		case kindM:
+			n = len(v.m)
+		case kindL:
+			n = len(v.l)
+		case kindSS, kindNS, kindBS:
+			n = len(v.set)
+		default:
+			return nil
+		}
+		return &value{kind: kindN, s: strconv.Itoa(n)}
+	}
+
+	return nil
+}
+
+// updates
+
+// apply evaluates every action against the original item & returns the updated copy.
+// changed receives the top-level attribute names touched by the expression.
+func (u *updateExpr) apply(orig item) (updated item, changed []string, err error) {
+	if err := u.checkOverlap(); err != nil {
+		return nil, nil, err
+	}
+
+	updated = orig.clone()
+	if updated == nil {
+		updated = item{}
+	}
+
+	type assignment struct {
+		path  path
+		value *value
+	}
+
+	var sets []assignment
+	for _, a := range u.set {
+		v, err := a.value.evalUpdate(orig)
+		if err != nil {
+			return nil, nil, err
+		}
+		sets = append(sets, assignment{a.path, v})
+	}
+
+	for _, s := range sets {
+		if err := setPath(updated, s.path, s.value); err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, s.path[0].name)
+	}
+
+	// remove higher list indexes first so earlier removals do not shift later ones
+	removes := append([]path(nil), u.remove...)
+	sort.SliceStable(removes, func(i, j int) bool {
+		a, b := removes[i][len(removes[i])-1], removes[j][len(removes[j])-1]
+		return a.isIndex && b.isIndex && a.index > b.index
+	})
+	for _, p := range removes {
+		removePath(updated, p)
+		changed = append(changed, p[0].name)
+	}
+
+	for _, a := range u.add {
+		if err := addToPath(updated, a.path, a.value.value); err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, a.path[0].name)
+	}
+
+	for _, a := range u.delete {
+		if err := deleteFromPath(updated, a.path, a.value.value); err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, a.path[0].name)
+	}
+
+	return updated, changed, nil
+}
+
+func (u *updateExpr) checkOverlap() error {
+	var all []path
+	for _, a := range u.set {
+		all = append(all, a.path)
+	}
+	all = append(all, u.remove...)
+	for _, a := range u.add {
+		all = append(all, a.path)
+	}
+	for _, a := range u.delete {
+		all = append(all, a.path)
+	}
+
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			if overlaps(all[i], all[j]) {
+				return validationErr("Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [%s], path two: [%s]", all[i], all[j])
+			}
+		}
+	}
+
+	return nil
+}
+
+func overlaps(a, b path) bool {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (o *operand) evalUpdate(orig item) (*value, error) {
+	switch o.kind {
+	case operandValue:
+		return o.value.clone(), nil
+
+	case operandPath:
+		v := resolve(orig, o.path)
+		if v == nil {
+			return nil, validationErr("The provided expression refers to an attribute that does not exist in the item")
+		}
+		return v.clone(), nil
+
+	case operandIfNotExists:
+		if v := resolve(orig, o.path); v != nil {
+			return v.clone(), nil
+		}
+		return o.args[0].evalUpdate(orig)
+
+	case operandListAppend:
+		a, err := o.args[0].evalUpdate(orig)
+		if err != nil {
+			return nil, err
+		}
+		b, err := o.args[1].evalUpdate(orig)
+		if err != nil {
+			return nil, err
+		}
+		if a.kind != kindL || b.kind != kindL {
+			return nil, validationErr("Invalid UpdateExpression: Incorrect operand type for operator or function; operator or function: list_append")
+		}
+		l := make([]*value, 0, len(a.l)+len(b.l))
+		for _, e := range append(append([]*value(nil), a.l...), b.l...) {
+			l = append(l, e.clone())
+		}
+		return &value{kind: kindL, l: l}, nil
+
+	case operandPlus, operandMinus:
+		a, err := o.args[0].evalUpdate(orig)
+		if err != nil {
+			return nil, err
+		}
+		b, err := o.args[1].evalUpdate(orig)
+		if err != nil {
+			return nil, err
+		}
+		if a.kind != kindN || b.kind != kindN {
+			return nil, validationErr("An operand in the update expression has an incorrect data type")
+		}
+		sign := 1
+		if o.kind == operandMinus {
+			sign = -1
+		}
+		n, err := addNumbers(a.s, b.s, sign)
+		if err != nil {
+			return nil, validationErr("%s", err)
+		}
+		return &value{kind: kindN, s: n}, nil
+	}
+
+	return nil, validationErr("Invalid UpdateExpression: unsupported operand")
+}
+
+// parent resolves the container holding the last element of p
+func parent(it item, p path) (*value, error) {
+	if len(p) == 1 {
+		return &value{kind: kindM, m: it}, nil
+	}
+
+	v := resolve(it, p[:len(p)-1])
+	last := p[len(p)-1]
+	if v == nil || (last.isIndex && v.kind != kindL) || (!last.isIndex && v.kind != kindM) {
+		return nil, validationErr("The document path provided in the update expression is invalid for update")
+	}
+
+	return v, nil
+}
+
+func setPath(it item, p path, v *value) error {
+	container, err := parent(it, p)
+	if err != nil {
+		return err
+	}
+
+	last := p[len(p)-1]
+	if !last.isIndex {
+		container.m[last.name] = v
+		return nil
+	}
+
+	if last.index < len(container.l) {
+		container.l[last.index] = v
+	} else {
+		container.l = append(container.l, v)
+	}
+
+	return nil
+}
+
+func removePath(it item, p path) {
+	container, err := parent(it, p)
+	if err != nil {
+		return
+	}
+
+	last := p[len(p)-1]
+	if !last.isIndex {
+		delete(container.m, last.name)
+		return
+	}
+
+	if last.index < len(container.l) {
+		container.l = append(container.l[:last.index], container.l[last.index+1:]...)
+	}
+}
+
+func addToPath(it item, p path, v *value) error {
+	if v.kind != kindN && !v.isSet() {
+		return validationErr("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: ADD, operand type: %s", v.kind)
+	}
+
+	cur := resolve(it, p)
+	if cur == nil {
+		return setPath(it, p, v.clone())
+	}
+
+	if cur.kind != v.kind {
+		return validationErr("An operand in the update expression has an incorrect data type")
+	}
+
+	if cur.kind == kindN {
+		n, err := addNumbers(cur.s, v.s, 1)
+		if err != nil {
+			return validationErr("%s", err)
+		}
+		cur.s = n
+		return nil
+	}
+
+	for _, e := range v.set {
+		if !cur.kind.setContains(cur.set, e) {
+			cur.set = append(cur.set, e)
+		}
+	}
+
+	return nil
+}
+
+func deleteFromPath(it item, p path, v *value) error {
+	if !v.isSet() {
+		return validationErr("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: DELETE, operand type: %s", v.kind)
+	}
+
+	cur := resolve(it, p)
+	if cur == nil {
+		return nil
+	}
+
+	if cur.kind != v.kind {
+		return validationErr("An operand in the update expression has an incorrect data type")
+	}
+
+	var kept []string
+	for _, e := range cur.set {
+		if !v.kind.setContains(v.set, e) {
+			kept = append(kept, e)
+		}
+	}
+
+	if len(kept) == 0 {
+		removePath(it, p)
+		return nil
+	}
+
+	cur.set = kept
+	return nil
+}
+
+// project copies only the given paths of it into a new item
+func project(it item, paths []path) item {
+	out := item{}
+
+	for _, p := range paths {
+		v := resolve(it, p)
+		if v == nil {
+			continue
+		}
+
+		dst := &value{kind: kindM, m: out}
+		src := &value{kind: kindM, m: it}
+		for i, e := range p {
+			if i == len(p)-1 {
+				if e.isIndex {
+					dst.l = append(dst.l, v.clone())
+				} else {
+					dst.m[e.name] = v.clone()
+				}
+				break
+			}
+
+			var next *value
+			if e.isIndex {
+				next = src.l[e.index]
+			} else {
+				next = src.m[e.name]
+			}
+
+			child := &value{kind: next.kind}
+			if next.kind == kindM {
+				child.m = map[string]*value{}
+			}
+
+			if e.isIndex {
+				dst.l = append(dst.l, child)
+			} else if existing, ok := dst.m[e.name]; ok {
+				child = existing
+			} else {
+				dst.m[e.name] = child
+			}
+
+			dst, src = child, next
+		}
+	}
+
+	return out
+}
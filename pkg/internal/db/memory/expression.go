@@ -0,0 +1,688 @@
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName  // #name placeholder
+	tokValue // :value placeholder
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(expr string) ([]token, error) {
+	var toks []token
+	rs := []rune(expr)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || r == ':':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("invalid expression: empty placeholder at %d", i)
+			}
+			k := tokName
+			if r == ':' {
+				k = tokValue
+			}
+			toks = append(toks, token{kind: k, text: string(rs[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(rs) && unicode.IsDigit(rs[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokNumber, text: string(rs[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: string(rs[i:j])})
+			i = j
+		default:
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				if two == "<>" || two == "<=" || two == ">=" {
+					toks = append(toks, token{kind: tokPunct, text: two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[],.=<>+-", r) {
+				return nil, fmt.Errorf("invalid expression: unexpected character %q", r)
+			}
+			toks = append(toks, token{kind: tokPunct, text: string(r)})
+			i++
+		}
+	}
+
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+// AST
+
+// pathElem is one step of a document path: a map key or a list index
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type path []pathElem
+
+func (p path) String() string {
+	var sb strings.Builder
+	for i, e := range p {
+		if e.isIndex {
+			fmt.Fprintf(&sb, "[%d]", e.index)
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(e.name)
+	}
+
+	return sb.String()
+}
+
+type operandKind int
+
+const (
+	operandPath operandKind = iota
+	operandValue
+	operandSize
+	operandIfNotExists
+	operandListAppend
+	operandPlus
+	operandMinus
+)
+
+// operand is a value-producing node. Update-only kinds (if_not_exists, list_append, +, -) use args.
+type operand struct {
+	kind  operandKind
+	path  path
+	value *value
+	args  []*operand
+}
+
+type condKind int
+
+const (
+	condAnd condKind = iota
+	condOr
+	condNot
+	condCompare
+	condBetween
+	condIn
+	condFunc
+)
+
+type condition struct {
+	kind     condKind
+	op       string // comparator or function name
+	children []*condition
+	operands []*operand
+}
+
+type updateAction struct {
+	path  path
+	value *operand
+}
+
+type updateExpr struct {
+	set    []updateAction
+	remove []path
+	add    []updateAction
+	delete []updateAction
+}
+
+// parser
+
+type parser struct {
+	toks       []token
+	pos        int
+	names      map[string]string
+	values     item
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newParser(names map[string]string, values item) *parser {
+	return &parser{
+		names:      names,
+		values:     values,
+		usedNames:  map[string]bool{},
+		usedValues: map[string]bool{},
+	}
+}
+
+func (p *parser) reset(expr string) error {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return err
+	}
+
+	p.toks, p.pos = toks, 0
+	return nil
+}
+
+// checkUnused fails when a placeholder was supplied but never referenced, as DynamoDB does
+func (p *parser) checkUnused() error {
+	for k := range p.names {
+		if !p.usedNames[k] {
+			return validationErr("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", k)
+		}
+	}
+
+	for k := range p.values {
+		if !p.usedValues[k] {
+			return validationErr("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", k)
+		}
+	}
+
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, word)
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	t := p.next()
+	if t.kind != tokPunct || t.text != s {
+		return p.syntaxErr(t, s)
+	}
+	return nil
+}
+
+func (p *parser) syntaxErr(t token, want string) error {
+	got := t.text
+	if t.kind == tokEOF {
+		got = "<EOF>"
+	}
+	return validationErr("Invalid expression: syntax error; token: %q, expecting %s", got, want)
+}
+
+func (p *parser) expectEOF() error {
+	if t := p.peek(); t.kind != tokEOF {
+		return p.syntaxErr(t, "end of expression")
+	}
+	return nil
+}
+
+func (p *parser) parsePath() (path, error) {
+	var out path
+
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, pathElem{name: name})
+
+	for {
+		switch {
+		case p.isPunct("."):
+			p.next()
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pathElem{name: name})
+		case p.isPunct("["):
+			p.next()
+			t := p.next()
+			if t.kind != tokNumber {
+				return nil, p.syntaxErr(t, "list index")
+			}
+			n, err := strconv.Atoi(t.text)
+			if err != nil {
+				return nil, validationErr("Invalid list index %s", t.text)
+			}
+			if err := p.expectPunct("]"); err != nil {
+				return nil, err
+			}
+			out = append(out, pathElem{index: n, isIndex: true})
+		default:
+			return out, nil
+		}
+	}
+}
+
+func (p *parser) parseName() (string, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokIdent:
+		return t.text, nil
+	case tokName:
+		name, ok := p.names[t.text]
+		if !ok {
+			return "", validationErr("An expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+		}
+		p.usedNames[t.text] = true
+		return name, nil
+	}
+
+	return "", p.syntaxErr(t, "attribute name")
+}
+
+func (p *parser) parseValueRef() (*value, error) {
+	t := p.next()
+	if t.kind != tokValue {
+		return nil, p.syntaxErr(t, "expression attribute value")
+	}
+
+	v, ok := p.values[t.text]
+	if !ok {
+		return nil, validationErr("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+	}
+	p.usedValues[t.text] = true
+
+	return v, nil
+}
+
+// condition grammar
+
+func (p *parser) parseCondition(expr string) (*condition, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, p.expectEOF()
+}
+
+func (p *parser) parseOr() (*condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &condition{kind: condOr, children: []*condition{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (*condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &condition{kind: condAnd, children: []*condition{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot() (*condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: condNot, children: []*condition{c}}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+var conditionFuncs = map[string]int{
+	"attribute_exists":     1,
+	"attribute_not_exists": 1,
+	"attribute_type":       2,
+	"begins_with":          2,
+	"contains":             2,
+}
+
+func (p *parser) parsePrimary() (*condition, error) {
+	if p.isPunct("(") {
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expectPunct(")")
+	}
+
+	if t := p.peek(); t.kind == tokIdent && p.toks[p.pos+1].text == "(" {
+		if arity, ok := conditionFuncs[strings.ToLower(t.text)]; ok {
+			return p.parseFunction(strings.ToLower(t.text), arity)
+		}
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, p.syntaxErr(p.peek(), "AND")
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: condBetween, operands: []*operand{left, lo, hi}}, nil
+
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		ops := []*operand{left}
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, o)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		return &condition{kind: condIn, operands: ops}, p.expectPunct(")")
+	}
+
+	t := p.next()
+	switch t.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+		if t.kind != tokPunct {
+			break
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{kind: condCompare, op: t.text, operands: []*operand{left, right}}, nil
+	}
+
+	return nil, p.syntaxErr(t, "comparator")
+}
+
+func (p *parser) parseFunction(name string, arity int) (*condition, error) {
+	p.next()
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &condition{kind: condFunc, op: name, operands: []*operand{{kind: operandPath, path: target}}}
+
+	if arity == 2 {
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		c.operands = append(c.operands, arg)
+	}
+
+	return c, p.expectPunct(")")
+}
+
+func (p *parser) parseOperand() (*operand, error) {
+	t := p.peek()
+
+	if t.kind == tokValue {
+		v, err := p.parseValueRef()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{kind: operandValue, value: v}, nil
+	}
+
+	if t.kind == tokIdent && strings.EqualFold(t.text, "size") && p.toks[p.pos+1].text == "(" {
+		p.next()
+		p.next()
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{kind: operandSize, path: target}, p.expectPunct(")")
+	}
+
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	return &operand{kind: operandPath, path: target}, nil
+}
+
+// update grammar
+
+func (p *parser) parseUpdate(expr string) (*updateExpr, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+
+	u := &updateExpr{}
+	seen := map[string]bool{}
+
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokIdent || seen[clause] {
+			return nil, p.syntaxErr(t, "SET, REMOVE, ADD or DELETE")
+		}
+		seen[clause] = true
+
+		for {
+			switch clause {
+			case "SET":
+				target, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectPunct("="); err != nil {
+					return nil, err
+				}
+				v, err := p.parseSetValue()
+				if err != nil {
+					return nil, err
+				}
+				u.set = append(u.set, updateAction{path: target, value: v})
+
+			case "REMOVE":
+				target, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				u.remove = append(u.remove, target)
+
+			case "ADD", "DELETE":
+				target, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				v, err := p.parseValueRef()
+				if err != nil {
+					return nil, err
+				}
+				action := updateAction{path: target, value: &operand{kind: operandValue, value: v}}
+				if clause == "ADD" {
+					u.add = append(u.add, action)
+				} else {
+					u.delete = append(u.delete, action)
+				}
+
+			default:
+				return nil, p.syntaxErr(t, "SET, REMOVE, ADD or DELETE")
+			}
+
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if len(seen) == 0 {
+		return nil, validationErr("Invalid UpdateExpression: The expression can not be empty")
+	}
+
+	return u, nil
+}
+
+func (p *parser) parseSetValue() (*operand, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isPunct("+") || p.isPunct("-") {
+		kind := operandPlus
+		if p.next().text == "-" {
+			kind = operandMinus
+		}
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{kind: kind, args: []*operand{left, right}}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseSetOperand() (*operand, error) {
+	t := p.peek()
+
+	if t.kind == tokIdent && p.toks[p.pos+1].text == "(" {
+		switch strings.ToLower(t.text) {
+		case "if_not_exists":
+			p.next()
+			p.next()
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseSetValue()
+			if err != nil {
+				return nil, err
+			}
+			return &operand{kind: operandIfNotExists, path: target, args: []*operand{fallback}}, p.expectPunct(")")
+
+		case "list_append":
+			p.next()
+			p.next()
+			a, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &operand{kind: operandListAppend, args: []*operand{a, b}}, p.expectPunct(")")
+		}
+	}
+
+	return p.parseOperand()
+}
+
+// parseProjection parses a comma separated list of document paths
+func (p *parser) parseProjection(expr string) ([]path, error) {
+	if err := p.reset(expr); err != nil {
+		return nil, err
+	}
+
+	var paths []path
+	for {
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, target)
+
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+
+	return paths, p.expectEOF()
+}
@@ -0,0 +1,1339 @@
+// Package memory is an in-memory DynamoDB engine for offline development & tests.
+// It implements db.API with the same key, index, expression & pagination semantics as DynamoDB.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/schema"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	maxBatchGet      = 100
+	maxBatchWrite    = 25
+	maxTransactItems = 100
+)
+
+// Engine holds every table in memory & is safe for concurrent use
+type Engine struct {
+	mu     sync.Mutex
+	tables map[string]*table
+
+	// Now is the clock Expire compares time to live attributes with, replaceable in tests
+	Now func() time.Time
+}
+
+var (
+	_ db.API     = (*Engine)(nil)
+	_ schema.API = (*Engine)(nil)
+)
+
+type table struct {
+	def     *dynamodb.CreateTableInput
+	ttl     string // time to live attribute, "" while disabled
+	pk, sk  string
+	types   map[string]string
+	indexes map[string]*index
+	items   map[string]item
+}
+
+type index struct {
+	name       string
+	pk, sk     string
+	projection types.ProjectionType
+	nonKey     []string
+}
+
+// New creates an engine with the given tables already created & their time to live enabled
+func New(tables ...*schema.Definition) (*Engine, error) {
+	e := &Engine{tables: map[string]*table{}, Now: time.Now}
+
+	for _, def := range tables {
+		if _, err := e.CreateTable(context.Background(), &def.CreateTableInput); err != nil {
+			return nil, err
+		}
+
+		if def.TimeToLiveSpecification != nil {
+			_, err := e.UpdateTimeToLive(context.Background(), &dynamodb.UpdateTimeToLiveInput{
+				TableName:               def.TableName,
+				TimeToLiveSpecification: def.TimeToLiveSpecification,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+func validationErr(format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{Code: "ValidationException", Message: fmt.Sprintf(format, args...), Fault: smithy.FaultClient}
+}
+
+func conditionFailed() error {
+	return &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+}
+
+func (e *Engine) table(name *string) (*table, error) {
+	t, ok := e.tables[aws.ToString(name)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("Requested resource not found")}
+	}
+
+	return t, nil
+}
+
+// CreateTable creates a table from its definition
+func (e *Engine) CreateTable(ctx context.Context, input *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	name := aws.ToString(input.TableName)
+	if _, ok := e.tables[name]; ok {
+		return nil, &types.ResourceInUseException{Message: aws.String("Table already exists: " + name)}
+	}
+
+	def := *input
+	t := &table{
+		def:     &def,
+		types:   map[string]string{},
+		indexes: map[string]*index{},
+		items:   map[string]item{},
+	}
+
+	for _, ad := range input.AttributeDefinitions {
+		t.types[aws.ToString(ad.AttributeName)] = string(ad.AttributeType)
+	}
+
+	t.pk, t.sk = keySchema(input.KeySchema)
+	if t.pk == "" {
+		return nil, validationErr("No Hash Key specified in schema")
+	}
+
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		t.addIndex(gsi.IndexName, gsi.KeySchema, gsi.Projection)
+	}
+	for _, lsi := range input.LocalSecondaryIndexes {
+		t.addIndex(lsi.IndexName, lsi.KeySchema, lsi.Projection)
+	}
+
+	e.tables[name] = t
+
+	return &dynamodb.CreateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// DescribeTable returns a table's schema & item count
+func (e *Engine) DescribeTable(ctx context.Context, input *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.DescribeTableOutput{Table: t.describe()}, nil
+}
+
+// UpdateTable adds or removes global secondary indexes & changes the stream settings.
+// New indexes are backfilled immediately since index views are computed from the stored items.
+func (e *Engine) UpdateTable(ctx context.Context, input *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input.GlobalSecondaryIndexUpdates) > 1 {
+		return nil, validationErr("Subscriber limit exceeded: Only 1 online index can be created or deleted simultaneously per table")
+	}
+
+	def := *t.def
+	attrTypes := make(map[string]string, len(t.types))
+	for k, v := range t.types {
+		attrTypes[k] = v
+	}
+
+	for _, ad := range input.AttributeDefinitions {
+		name := aws.ToString(ad.AttributeName)
+		if existing, ok := attrTypes[name]; ok && existing != string(ad.AttributeType) {
+			return nil, validationErr("Cannot change the type of attribute %s from %s to %s", name, existing, ad.AttributeType)
+		}
+		if _, ok := attrTypes[name]; !ok {
+			def.AttributeDefinitions = append(append([]types.AttributeDefinition(nil), def.AttributeDefinitions...), ad)
+			attrTypes[name] = string(ad.AttributeType)
+		}
+	}
+
+	for _, u := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case u.Create != nil:
+			name := aws.ToString(u.Create.IndexName)
+			if _, ok := t.indexes[name]; ok {
+				return nil, validationErr("Attempting to create an index which already exists: %s", name)
+			}
+
+			pk, sk := keySchema(u.Create.KeySchema)
+			for _, attr := range []string{pk, sk} {
+				if _, ok := attrTypes[attr]; attr != "" && !ok {
+					return nil, validationErr("Global Secondary Index %s uses attribute %s, which is not defined in AttributeDefinitions", name, attr)
+				}
+			}
+
+			def.GlobalSecondaryIndexes = append(append([]types.GlobalSecondaryIndex(nil), def.GlobalSecondaryIndexes...), types.GlobalSecondaryIndex{
+				IndexName:  u.Create.IndexName,
+				KeySchema:  u.Create.KeySchema,
+				Projection: u.Create.Projection,
+			})
+		case u.Delete != nil:
+			name := aws.ToString(u.Delete.IndexName)
+			if _, ok := t.indexes[name]; !ok {
+				return nil, &types.ResourceNotFoundException{Message: aws.String("Requested resource not found: Index: " + name)}
+			}
+
+			var kept []types.GlobalSecondaryIndex
+			for _, gsi := range def.GlobalSecondaryIndexes {
+				if aws.ToString(gsi.IndexName) != name {
+					kept = append(kept, gsi)
+				}
+			}
+			def.GlobalSecondaryIndexes = kept
+		default:
+			return nil, validationErr("Only Create & Delete global secondary index updates are supported")
+		}
+	}
+
+	if input.BillingMode != "" {
+		def.BillingMode = input.BillingMode
+	}
+
+	if input.StreamSpecification != nil {
+		if aws.ToBool(input.StreamSpecification.StreamEnabled) {
+			def.StreamSpecification = input.StreamSpecification
+		} else {
+			def.StreamSpecification = nil
+		}
+	}
+
+	t.def = &def
+	t.types = attrTypes
+	t.indexes = map[string]*index{}
+	for _, gsi := range def.GlobalSecondaryIndexes {
+		t.addIndex(gsi.IndexName, gsi.KeySchema, gsi.Projection)
+	}
+	for _, lsi := range def.LocalSecondaryIndexes {
+		t.addIndex(lsi.IndexName, lsi.KeySchema, lsi.Projection)
+	}
+
+	return &dynamodb.UpdateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// UpdateTimeToLive enables or disables expiry of items by an epoch seconds attribute.
+// Expired items are only deleted by Expire, as DynamoDB deletes them some time after they expire.
+func (e *Engine) UpdateTimeToLive(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := input.TimeToLiveSpecification
+	if spec == nil || aws.ToString(spec.AttributeName) == "" {
+		return nil, validationErr("TimeToLiveSpecification must have an AttributeName")
+	}
+
+	switch enabled := aws.ToBool(spec.Enabled); {
+	case enabled && t.ttl != "":
+		return nil, validationErr("TimeToLive is already enabled")
+	case !enabled && t.ttl == "":
+		return nil, validationErr("TimeToLive is already disabled")
+	case enabled:
+		t.ttl = aws.ToString(spec.AttributeName)
+	default:
+		t.ttl = ""
+	}
+
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: spec}, nil
+}
+
+// DescribeTimeToLive reports whether expiry is enabled & on which attribute
+func (e *Engine) DescribeTimeToLive(ctx context.Context, input *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if t.ttl != "" {
+		desc = &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusEnabled, AttributeName: aws.String(t.ttl)}
+	}
+
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+// Expire deletes every item whose time to live has passed, as DynamoDB's background process does,
+// & returns how many were deleted. Items without a numeric time to live attribute never expire.
+func (e *Engine) Expire() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.Now().Unix()
+	deleted := 0
+
+	for _, t := range e.tables {
+		if t.ttl == "" {
+			continue
+		}
+
+		for key, it := range t.items {
+			v, ok := it[t.ttl]
+			if !ok || v.kind != kindN {
+				continue
+			}
+
+			if at, err := strconv.ParseFloat(v.s, 64); err == nil && int64(at) <= now {
+				delete(t.items, key)
+				deleted++
+			}
+		}
+	}
+
+	return deleted
+}
+
+// DeleteTable drops a table & all of its items
+func (e *Engine) DeleteTable(ctx context.Context, input *dynamodb.DeleteTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteTableOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(e.tables, aws.ToString(input.TableName))
+
+	return &dynamodb.DeleteTableOutput{TableDescription: t.describe()}, nil
+}
+
+// GetItem fetches a single item by its primary key
+func (e *Engine) GetItem(ctx context.Context, input *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newParser(input.ExpressionAttributeNames, nil)
+	projection, err := parseProjection(p, input.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	key, err := t.keyOf(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if it, ok := t.items[key]; ok {
+		out.Item = toAVMap(applyProjection(it, projection))
+	}
+
+	return out, nil
+}
+
+// PutItem writes an item, replacing any item with the same key
+func (e *Engine) PutItem(ctx context.Context, input *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, it, old, err := t.preparePut(input.Item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	t.items[key] = it
+
+	out := &dynamodb.PutItemOutput{}
+	if input.ReturnValues == types.ReturnValueAllOld && old != nil {
+		out.Attributes = toAVMap(old)
+	}
+
+	return out, nil
+}
+
+// DeleteItem removes a single item by its primary key
+func (e *Engine) DeleteItem(ctx context.Context, input *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, old, err := t.prepareDelete(input.Key, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(t.items, key)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if input.ReturnValues == types.ReturnValueAllOld && old != nil {
+		out.Attributes = toAVMap(old)
+	}
+
+	return out, nil
+}
+
+// UpdateItem applies an update expression, creating the item when it does not exist
+func (e *Engine) UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := t.prepareUpdate(input.Key, input.UpdateExpression, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	t.items[u.key] = u.updated
+
+	return &dynamodb.UpdateItemOutput{
+		Attributes: toAVMap(returnValues(input.ReturnValues, u.old, u.updated, u.changed)),
+	}, nil
+}
+
+// preparePut validates a put & checks its condition without writing
+func (t *table) preparePut(av map[string]types.AttributeValue, condExpr *string, names map[string]string, values map[string]types.AttributeValue) (key string, it, old item, err error) {
+	it, err = fromAVMap(av)
+	if err != nil {
+		return "", nil, nil, validationErr("One or more parameter values were invalid: %s", err)
+	}
+
+	key, err = t.itemKey(it)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	old = t.items[key]
+	if err := checkCondition(condExpr, names, values, old); err != nil {
+		return "", nil, nil, err
+	}
+
+	return key, it, old, nil
+}
+
+// prepareDelete validates a delete & checks its condition without writing
+func (t *table) prepareDelete(keyAV map[string]types.AttributeValue, condExpr *string, names map[string]string, values map[string]types.AttributeValue) (key string, old item, err error) {
+	key, err = t.keyOf(keyAV)
+	if err != nil {
+		return "", nil, err
+	}
+
+	old = t.items[key]
+	if err := checkCondition(condExpr, names, values, old); err != nil {
+		return "", nil, err
+	}
+
+	return key, old, nil
+}
+
+// preparedUpdate is the outcome of an update that has not been written yet
+type preparedUpdate struct {
+	key          string
+	old, updated item
+	changed      []string
+}
+
+// prepareUpdate evaluates an update expression & its condition without writing
+func (t *table) prepareUpdate(keyAV map[string]types.AttributeValue, updateExpr, condExpr *string, names map[string]string, rawValues map[string]types.AttributeValue) (*preparedUpdate, error) {
+	keyItem, err := fromAVMap(keyAV)
+	if err != nil {
+		return nil, validationErr("One or more parameter values were invalid: %s", err)
+	}
+
+	key, err := t.keyOf(keyAV)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := fromAVMap(rawValues)
+	if err != nil {
+		return nil, validationErr("ExpressionAttributeValues contains invalid value: %s", err)
+	}
+
+	p := newParser(names, values)
+	update, err := p.parseUpdate(aws.ToString(updateExpr))
+	if err != nil {
+		return nil, err
+	}
+
+	var cond *condition
+	if condExpr != nil {
+		if cond, err = p.parseCondition(*condExpr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	old := t.items[key]
+	if cond != nil {
+		ok, err := cond.eval(old)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, conditionFailed()
+		}
+	}
+
+	base := old
+	if base == nil {
+		base = keyItem
+	}
+
+	updated, changed, err := update.apply(base)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range changed {
+		if name == t.pk || name == t.sk {
+			return nil, validationErr("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+		}
+	}
+
+	if err := t.validateIndexKeys(updated); err != nil {
+		return nil, err
+	}
+
+	return &preparedUpdate{key: key, old: old, updated: updated, changed: changed}, nil
+}
+
+// Query returns the items of one partition of the table or of an index
+func (e *Engine) Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := fromAVMap(input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationErr("ExpressionAttributeValues contains invalid value: %s", err)
+	}
+
+	p := newParser(input.ExpressionAttributeNames, values)
+
+	if input.KeyConditionExpression == nil {
+		return nil, validationErr("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+
+	keyCond, err := p.parseCondition(*input.KeyConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, projection, err := parseReadExpressions(p, input.FilterExpression, input.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	view, err := t.view(input.IndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := view.validateKeyCondition(keyCond); err != nil {
+		return nil, err
+	}
+
+	var candidates []item
+	for _, it := range view.items() {
+		ok, err := keyCond.eval(it)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			candidates = append(candidates, it)
+		}
+	}
+
+	less := view.queryOrder(input.ScanIndexForward != nil && !*input.ScanIndexForward)
+
+	result, err := view.page(candidates, less, input.ExclusiveStartKey, input.Limit, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.QueryOutput{
+		Count:            int32(len(result.items)),
+		ScannedCount:     result.scanned,
+		LastEvaluatedKey: result.lastKey,
+	}
+	if input.Select != types.SelectCount {
+		out.Items = result.items
+	}
+
+	return out, nil
+}
+
+// Scan returns every item of the table or of an index, optionally split into parallel segments
+func (e *Engine) Scan(ctx context.Context, input *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := fromAVMap(input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationErr("ExpressionAttributeValues contains invalid value: %s", err)
+	}
+
+	p := newParser(input.ExpressionAttributeNames, values)
+	filter, projection, err := parseReadExpressions(p, input.FilterExpression, input.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	segments := aws.ToInt32(input.TotalSegments)
+	segment := aws.ToInt32(input.Segment)
+	if (input.Segment == nil) != (input.TotalSegments == nil) || (segments > 0 && (segment < 0 || segment >= segments)) {
+		return nil, validationErr("The Segment parameter must be less than TotalSegments & both must be provided together")
+	}
+
+	view, err := t.view(input.IndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []item
+	for _, it := range view.items() {
+		if segments > 0 {
+			h := fnv.New32a()
+			h.Write([]byte(t.mustItemKey(it)))
+			if int64(h.Sum32())%int64(segments) != int64(segment) {
+				continue
+			}
+		}
+		candidates = append(candidates, it)
+	}
+
+	result, err := view.page(candidates, view.scanOrder(), input.ExclusiveStartKey, input.Limit, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.ScanOutput{
+		Count:            int32(len(result.items)),
+		ScannedCount:     result.scanned,
+		LastEvaluatedKey: result.lastKey,
+	}
+	if input.Select != types.SelectCount {
+		out.Items = result.items
+	}
+
+	return out, nil
+}
+
+// BatchGetItem fetches up to 100 items across tables
+func (e *Engine) BatchGetItem(ctx context.Context, input *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]types.AttributeValue{},
+		UnprocessedKeys: map[string]types.KeysAndAttributes{},
+	}
+
+	total := 0
+	for name, ka := range input.RequestItems {
+		t, err := e.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+
+		p := newParser(ka.ExpressionAttributeNames, nil)
+		projection, err := parseProjection(p, ka.ProjectionExpression)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkUnused(); err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+		responses := []map[string]types.AttributeValue{}
+		for _, k := range ka.Keys {
+			total++
+			if total > maxBatchGet {
+				return nil, validationErr("Too many items requested for the BatchGetItem call")
+			}
+
+			key, err := t.keyOf(k)
+			if err != nil {
+				return nil, err
+			}
+			if seen[key] {
+				return nil, validationErr("Provided list of item keys contains duplicates")
+			}
+			seen[key] = true
+
+			if it, ok := t.items[key]; ok {
+				responses = append(responses, toAVMap(applyProjection(it, projection)))
+			}
+		}
+
+		out.Responses[name] = responses
+	}
+
+	return out, nil
+}
+
+// BatchWriteItem applies up to 25 put & delete requests across tables
+func (e *Engine) BatchWriteItem(ctx context.Context, input *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	type write struct {
+		t   *table
+		key string
+		it  item // nil for deletes
+	}
+
+	var writes []write
+	for name, requests := range input.RequestItems {
+		t, err := e.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+		for _, r := range requests {
+			var w write
+			switch {
+			case r.PutRequest != nil:
+				it, err := fromAVMap(r.PutRequest.Item)
+				if err != nil {
+					return nil, validationErr("One or more parameter values were invalid: %s", err)
+				}
+				key, err := t.itemKey(it)
+				if err != nil {
+					return nil, err
+				}
+				w = write{t: t, key: key, it: it}
+			case r.DeleteRequest != nil:
+				key, err := t.keyOf(r.DeleteRequest.Key)
+				if err != nil {
+					return nil, err
+				}
+				w = write{t: t, key: key}
+			default:
+				return nil, validationErr("A write request must contain a PutRequest or a DeleteRequest")
+			}
+
+			if seen[w.key] {
+				return nil, validationErr("Provided list of item keys contains duplicates")
+			}
+			seen[w.key] = true
+			writes = append(writes, w)
+		}
+	}
+
+	if len(writes) == 0 || len(writes) > maxBatchWrite {
+		return nil, validationErr("Member must have length less than or equal to %d & greater than 0", maxBatchWrite)
+	}
+
+	for _, w := range writes {
+		if w.it == nil {
+			delete(w.t.items, w.key)
+		} else {
+			w.t.items[w.key] = w.it
+		}
+	}
+
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]types.WriteRequest{},
+	}, nil
+}
+
+// TransactWriteItems applies up to 100 puts, updates, deletes & condition checks atomically.
+// When any condition fails nothing is written & the cancellation reasons list each action's outcome.
+func (e *Engine) TransactWriteItems(ctx context.Context, input *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > maxTransactItems {
+		return nil, validationErr("Member must have length less than or equal to %d & greater than 0", maxTransactItems)
+	}
+
+	type write struct {
+		t   *table
+		key string
+		it  item // nil for deletes & condition checks
+		del bool
+	}
+
+	var (
+		writes  []write
+		reasons = make([]types.CancellationReason, len(input.TransactItems))
+		failed  bool
+		seen    = map[*table]map[string]bool{}
+	)
+
+	for i, ti := range input.TransactItems {
+		var (
+			w   write
+			err error
+		)
+
+		switch {
+		case ti.Put != nil:
+			if w.t, err = e.table(ti.Put.TableName); err == nil {
+				w.key, w.it, _, err = w.t.preparePut(ti.Put.Item, ti.Put.ConditionExpression, ti.Put.ExpressionAttributeNames, ti.Put.ExpressionAttributeValues)
+			}
+		case ti.Update != nil:
+			if w.t, err = e.table(ti.Update.TableName); err == nil {
+				var u *preparedUpdate
+				if u, err = w.t.prepareUpdate(ti.Update.Key, ti.Update.UpdateExpression, ti.Update.ConditionExpression, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues); err == nil {
+					w.key, w.it = u.key, u.updated
+				}
+			}
+		case ti.Delete != nil:
+			if w.t, err = e.table(ti.Delete.TableName); err == nil {
+				w.key, _, err = w.t.prepareDelete(ti.Delete.Key, ti.Delete.ConditionExpression, ti.Delete.ExpressionAttributeNames, ti.Delete.ExpressionAttributeValues)
+				w.del = true
+			}
+		case ti.ConditionCheck != nil:
+			if ti.ConditionCheck.ConditionExpression == nil {
+				return nil, validationErr("A condition check must contain a ConditionExpression")
+			}
+			if w.t, err = e.table(ti.ConditionCheck.TableName); err == nil {
+				w.key, _, err = w.t.prepareDelete(ti.ConditionCheck.Key, ti.ConditionCheck.ConditionExpression, ti.ConditionCheck.ExpressionAttributeNames, ti.ConditionCheck.ExpressionAttributeValues)
+			}
+		default:
+			return nil, validationErr("A transact item must contain a Put, Update, Delete or ConditionCheck")
+		}
+
+		var condFailed *types.ConditionalCheckFailedException
+		switch {
+		case errors.As(err, &condFailed):
+			reasons[i] = types.CancellationReason{Code: aws.String("ConditionalCheckFailed"), Message: condFailed.Message}
+			failed = true
+		case err != nil:
+			return nil, err
+		default:
+			reasons[i] = types.CancellationReason{Code: aws.String("None")}
+		}
+
+		if seen[w.t] == nil {
+			seen[w.t] = map[string]bool{}
+		}
+		if seen[w.t][w.key] {
+			return nil, validationErr("Transaction request cannot include multiple operations on one item")
+		}
+		seen[w.t][w.key] = true
+
+		writes = append(writes, w)
+	}
+
+	if failed {
+		codes := make([]string, len(reasons))
+		for i, r := range reasons {
+			codes[i] = aws.ToString(r.Code)
+		}
+
+		return nil, &types.TransactionCanceledException{
+			Message:             aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, w := range writes {
+		switch {
+		case w.del:
+			delete(w.t.items, w.key)
+		case w.it != nil:
+			w.t.items[w.key] = w.it
+		}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// helpers
+
+func keySchema(schema []types.KeySchemaElement) (pk, sk string) {
+	for _, k := range schema {
+		switch k.KeyType {
+		case types.KeyTypeHash:
+			pk = aws.ToString(k.AttributeName)
+		case types.KeyTypeRange:
+			sk = aws.ToString(k.AttributeName)
+		}
+	}
+
+	return pk, sk
+}
+
+func (t *table) addIndex(name *string, schema []types.KeySchemaElement, projection *types.Projection) {
+	idx := &index{name: aws.ToString(name), projection: types.ProjectionTypeAll}
+	idx.pk, idx.sk = keySchema(schema)
+
+	if projection != nil {
+		idx.projection = projection.ProjectionType
+		idx.nonKey = projection.NonKeyAttributes
+	}
+
+	t.indexes[idx.name] = idx
+}
+
+func (t *table) describe() *types.TableDescription {
+	desc := &types.TableDescription{
+		TableName:            t.def.TableName,
+		TableStatus:          types.TableStatusActive,
+		KeySchema:            t.def.KeySchema,
+		AttributeDefinitions: t.def.AttributeDefinitions,
+		ItemCount:            aws.Int64(int64(len(t.items))),
+		StreamSpecification:  t.def.StreamSpecification,
+	}
+
+	if t.def.BillingMode != "" {
+		desc.BillingModeSummary = &types.BillingModeSummary{BillingMode: t.def.BillingMode}
+	}
+
+	for _, gsi := range t.def.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+
+	return desc
+}
+
+// keyOf validates a key map against the table schema & encodes it
+func (t *table) keyOf(av map[string]types.AttributeValue) (string, error) {
+	it, err := fromAVMap(av)
+	if err != nil {
+		return "", validationErr("One or more parameter values were invalid: %s", err)
+	}
+
+	want := 1
+	if t.sk != "" {
+		want = 2
+	}
+	if len(it) != want {
+		return "", validationErr("The provided key element does not match the schema")
+	}
+
+	return t.itemKey(it)
+}
+
+// itemKey validates the key attributes of a full item & encodes them
+func (t *table) itemKey(it item) (string, error) {
+	key := ""
+	for _, name := range []string{t.pk, t.sk} {
+		if name == "" {
+			continue
+		}
+
+		v, ok := it[name]
+		if !ok || kindNames[v.kind] != t.types[name] {
+			return "", validationErr("One or more parameter values were invalid: Missing the key %s in the item or its type does not match the schema", name)
+		}
+		if (v.kind == kindS || v.kind == kindB) && v.s == "" {
+			return "", validationErr("One or more parameter values are not valid. The AttributeValue for a key attribute cannot contain an empty string value. Key: %s", name)
+		}
+
+		key += fmt.Sprintf("%s:%d:%s\x00", v.kind, len(v.s), v.s)
+	}
+
+	return key, t.validateIndexKeys(it)
+}
+
+func (t *table) mustItemKey(it item) string {
+	key, _ := t.itemKey(it)
+	return key
+}
+
+// validateIndexKeys rejects items whose index key attributes have the wrong type
+func (t *table) validateIndexKeys(it item) error {
+	for _, idx := range t.indexes {
+		for _, name := range []string{idx.pk, idx.sk} {
+			if v, ok := it[name]; ok && name != "" && kindNames[v.kind] != t.types[name] {
+				return validationErr("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s", name, t.types[name], v.kind, idx.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkCondition(expr *string, names map[string]string, rawValues map[string]types.AttributeValue, current item) error {
+	values, err := fromAVMap(rawValues)
+	if err != nil {
+		return validationErr("ExpressionAttributeValues contains invalid value: %s", err)
+	}
+
+	p := newParser(names, values)
+	if expr == nil {
+		return p.checkUnused()
+	}
+
+	cond, err := p.parseCondition(*expr)
+	if err != nil {
+		return err
+	}
+
+	if err := p.checkUnused(); err != nil {
+		return err
+	}
+
+	ok, err := cond.eval(current)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conditionFailed()
+	}
+
+	return nil
+}
+
+func parseProjection(p *parser, expr *string) ([]path, error) {
+	if expr == nil {
+		return nil, nil
+	}
+
+	return p.parseProjection(*expr)
+}
+
+func parseReadExpressions(p *parser, filterExpr, projectionExpr *string) (*condition, []path, error) {
+	var filter *condition
+	if filterExpr != nil {
+		var err error
+		if filter, err = p.parseCondition(*filterExpr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	projection, err := parseProjection(p, projectionExpr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return filter, projection, nil
+}
+
+func applyProjection(it item, projection []path) item {
+	if projection == nil {
+		return it
+	}
+
+	return project(it, projection)
+}
+
+func returnValues(mode types.ReturnValue, old, updated item, changed []string) item {
+	pick := func(src item) item {
+		if src == nil {
+			return nil
+		}
+		out := item{}
+		for _, name := range changed {
+			if v, ok := src[name]; ok {
+				out[name] = v
+			}
+		}
+		return out
+	}
+
+	switch mode {
+	case types.ReturnValueAllOld:
+		return old
+	case types.ReturnValueAllNew:
+		return updated
+	case types.ReturnValueUpdatedOld:
+		return pick(old)
+	case types.ReturnValueUpdatedNew:
+		return pick(updated)
+	}
+
+	return nil
+}
+
+// views: the base table or one of its indexes, with the ordering & projection rules of each
+
+type view struct {
+	t   *table
+	idx *index
+	pk  string
+	sk  string
+}
+
+func (t *table) view(indexName *string) (*view, error) {
+	if indexName == nil {
+		return &view{t: t, pk: t.pk, sk: t.sk}, nil
+	}
+
+	idx, ok := t.indexes[*indexName]
+	if !ok {
+		return nil, validationErr("The table does not have the specified index: %s", *indexName)
+	}
+
+	return &view{t: t, idx: idx, pk: idx.pk, sk: idx.sk}, nil
+}
+
+// items returns every item visible in the view; indexes are sparse
+func (v *view) items() []item {
+	var out []item
+	for _, it := range v.t.items {
+		if v.idx != nil {
+			if _, ok := it[v.pk]; !ok {
+				continue
+			}
+			if _, ok := it[v.sk]; v.sk != "" && !ok {
+				continue
+			}
+		}
+		out = append(out, it)
+	}
+
+	return out
+}
+
+// validateKeyCondition enforces the shape DynamoDB accepts: pk equality, optionally AND one sort key condition
+func (v *view) validateKeyCondition(c *condition) error {
+	conds := []*condition{c}
+	if c.kind == condAnd {
+		conds = c.children
+		if conds[0].kind == condAnd || conds[1].kind == condAnd {
+			return validationErr("Conditions can be of length 1 or 2 only")
+		}
+	}
+
+	hasPK := false
+	for _, cc := range conds {
+		var target path
+		switch cc.kind {
+		case condCompare, condBetween:
+			target = cc.operands[0].path
+		case condFunc:
+			if cc.op != "begins_with" {
+				return validationErr("Invalid operator used in KeyConditionExpression: %s", cc.op)
+			}
+			target = cc.operands[0].path
+		default:
+			return validationErr("Invalid operator used in KeyConditionExpression")
+		}
+
+		if len(target) != 1 {
+			return validationErr("Invalid KeyConditionExpression: key attributes must be top-level")
+		}
+
+		switch target[0].name {
+		case v.pk:
+			if cc.kind != condCompare || cc.op != "=" {
+				return validationErr("Query key condition not supported")
+			}
+			hasPK = true
+		case v.sk:
+			if cc.kind == condCompare && cc.op == "<>" {
+				return validationErr("Unsupported operator on KeyConditionExpression: operator: <>")
+			}
+		default:
+			return validationErr("Query condition missed key schema element: %s", target[0].name)
+		}
+	}
+
+	if !hasPK {
+		return validationErr("Query condition missed key schema element: %s", v.pk)
+	}
+
+	return nil
+}
+
+// order compares items by the view's sort key, then by the table key for a stable order within index partitions
+func (v *view) order(a, b item) int {
+	attrs := []string{v.sk}
+	if v.idx != nil {
+		attrs = append(attrs, v.t.pk, v.t.sk)
+	}
+
+	for _, name := range attrs {
+		if name == "" {
+			continue
+		}
+		if c, ok := a[name].compare(b[name]); ok && c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// queryOrder orders items by sort key, in either direction
+func (v *view) queryOrder(descending bool) func(a, b item) bool {
+	return func(a, b item) bool {
+		c := v.order(a, b)
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+// scanOrder orders items by partition key first so scans paginate deterministically
+func (v *view) scanOrder() func(a, b item) bool {
+	return func(a, b item) bool {
+		if c, ok := a[v.pk].compare(b[v.pk]); ok && c != 0 {
+			return c < 0
+		}
+		return v.order(a, b) < 0
+	}
+}
+
+type pageResult struct {
+	items   []map[string]types.AttributeValue
+	scanned int32
+	lastKey map[string]types.AttributeValue
+}
+
+// page sorts items, resumes after startKey, evaluates up to limit items, then filters & projects them
+func (v *view) page(items []item, less func(a, b item) bool, startKey map[string]types.AttributeValue, limit *int32, filter *condition, projection []path) (pageResult, error) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	start := 0
+	if startKey != nil {
+		sk, err := fromAVMap(startKey)
+		if err != nil {
+			return pageResult{}, validationErr("The provided starting key is invalid: %s", err)
+		}
+
+		// the start key need not exist anymore, so resume at the first item ordered after it
+		start = sort.Search(len(items), func(i int) bool {
+			return less(sk, items[i])
+		})
+	}
+
+	result := pageResult{items: []map[string]types.AttributeValue{}}
+	max := int32(len(items))
+	if limit != nil {
+		if *limit < 1 {
+			return pageResult{}, validationErr("Limit must be greater than or equal to 1")
+		}
+		max = *limit
+	}
+
+	i := start
+	for ; i < len(items) && result.scanned < max; i++ {
+		it := items[i]
+		result.scanned++
+
+		if filter != nil {
+			ok, err := filter.eval(it)
+			if err != nil {
+				return pageResult{}, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		result.items = append(result.items, toAVMap(applyProjection(v.project(it), projection)))
+	}
+
+	if i < len(items) && i > start {
+		result.lastKey = toAVMap(v.key(items[i-1]))
+	}
+
+	return result, nil
+}
+
+// key returns the table & index key attributes of it
+func (v *view) key(it item) item {
+	out := item{}
+	for _, name := range []string{v.t.pk, v.t.sk, v.pk, v.sk} {
+		if val, ok := it[name]; ok && name != "" {
+			out[name] = val
+		}
+	}
+
+	return out
+}
+
+// project applies the index projection type to an item
+func (v *view) project(it item) item {
+	if v.idx == nil || v.idx.projection == types.ProjectionTypeAll {
+		return it
+	}
+
+	out := v.key(it)
+	if v.idx.projection == types.ProjectionTypeInclude {
+		for _, name := range v.idx.nonKey {
+			if val, ok := it[name]; ok {
+				out[name] = val
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,469 @@
+package memory_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+const table = "test"
+
+func newEngine(t *testing.T) *memory.Engine {
+	t.Helper()
+
+	e, err := memory.New(testTable.Definition(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func s(v string) types.AttributeValue { return &types.AttributeValueMemberS{Value: v} }
+func n(v int) types.AttributeValue    { return &types.AttributeValueMemberN{Value: strconv.Itoa(v)} }
+
+func key(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"pk": s(pk), "sk": s(sk)}
+}
+
+func put(t *testing.T, e *memory.Engine, item map[string]types.AttributeValue) {
+	t.Helper()
+
+	if _, err := e.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(table), Item: item}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, e *memory.Engine, pk, sk string) map[string]types.AttributeValue {
+	t.Helper()
+
+	out, err := e.GetItem(context.Background(), &dynamodb.GetItemInput{TableName: aws.String(table), Key: key(pk, sk)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Item
+}
+
+func isValidation(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationException"
+}
+
+func isConditionFailed(err error) bool {
+	var condErr *types.ConditionalCheckFailedException
+	return errors.As(err, &condErr)
+}
+
+func sks(items []map[string]types.AttributeValue) []string {
+	var out []string
+	for _, it := range items {
+		out = append(out, it["sk"].(*types.AttributeValueMemberS).Value)
+	}
+
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	put(t, e, map[string]types.AttributeValue{"pk": s("A"), "sk": s("1"), "v": s("first")})
+	put(t, e, map[string]types.AttributeValue{"pk": s("A"), "sk": s("1"), "v": s("second")})
+
+	if got := get(t, e, "A", "1")["v"].(*types.AttributeValueMemberS).Value; got != "second" {
+		t.Errorf("v = %q after a put on the same key, want the item replaced", got)
+	}
+	if got := get(t, e, "A", "2"); got != nil {
+		t.Errorf("GetItem of a missing key = %v, want no item", got)
+	}
+
+	invalid := map[string]map[string]types.AttributeValue{
+		"missing sort key":    {"pk": s("A")},
+		"number sort key":     {"pk": s("A"), "sk": n(1)},
+		"empty partition key": {"pk": s(""), "sk": s("1")},
+	}
+	for name, item := range invalid {
+		_, err := e.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(table), Item: item})
+		if !isValidation(err) {
+			t.Errorf("PutItem with %s = %v, want a ValidationException", name, err)
+		}
+	}
+
+	if _, err := e.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String("missing"), Key: key("A", "1")}); err == nil {
+		t.Error("GetItem of an unknown table succeeded")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	put(t, e, map[string]types.AttributeValue{"pk": s("USERS"), "sk": s("ann"), "isActive": n(1)})
+	put(t, e, map[string]types.AttributeValue{"pk": s("USERS"), "sk": s("bob"), "isActive": n(0)})
+	put(t, e, map[string]types.AttributeValue{"pk": s("USERS"), "sk": s("cid")}) // sparse: not in the index
+
+	query := func(active int) []string {
+		t.Helper()
+
+		cond := expression.Key("pk").Equal(expression.Value("USERS")).And(expression.Key("isActive").Equal(expression.Value(active)))
+		expr, err := expression.NewBuilder().WithKeyCondition(cond).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := e.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(table),
+			IndexName:                 aws.String("Active"),
+			KeyConditionExpression:    expr.KeyCondition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sks(out.Items)
+	}
+
+	if got := query(1); !equal(got, []string{"ann"}) {
+		t.Errorf("active users = %v, want [ann]", got)
+	}
+	if got := query(0); !equal(got, []string{"bob"}) {
+		t.Errorf("inactive users = %v, want [bob]", got)
+	}
+
+	_, err := e.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      map[string]types.AttributeValue{"pk": s("USERS"), "sk": s("dan"), "isActive": s("yes")},
+	})
+	if !isValidation(err) {
+		t.Errorf("PutItem with a string index key = %v, want a ValidationException", err)
+	}
+
+	_, err = e.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(table),
+		IndexName:                 aws.String("Missing"),
+		KeyConditionExpression:    aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pk": s("USERS")},
+	})
+	if !isValidation(err) {
+		t.Errorf("Query of an unknown index = %v, want a ValidationException", err)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	create := func(item map[string]types.AttributeValue) error {
+		_, err := e.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(table),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(pk)"),
+		})
+		return err
+	}
+
+	if err := create(map[string]types.AttributeValue{"pk": s("A"), "sk": s("1"), "n": n(5), "tag": s("red")}); err != nil {
+		t.Fatalf("first create = %v", err)
+	}
+	if err := create(key("A", "1")); !isConditionFailed(err) {
+		t.Errorf("second create = %v, want ConditionalCheckFailedException", err)
+	}
+
+	tests := []struct {
+		cond expression.ConditionBuilder
+		want bool
+	}{
+		{expression.Name("n").GreaterThan(expression.Value(4)), true},
+		{expression.Name("n").Between(expression.Value(6), expression.Value(9)), false},
+		{expression.Name("tag").In(expression.Value("blue"), expression.Value("red")), true},
+		{expression.Name("tag").BeginsWith("re"), true},
+		{expression.Name("tag").AttributeType(expression.Number), false},
+		{expression.Name("missing").AttributeNotExists().And(expression.Name("n").NotEqual(expression.Value(0))), true},
+		{expression.Not(expression.Name("n").Equal(expression.Value(5))), false},
+		{expression.Name("n").LessThan(expression.Value(5)).Or(expression.Name("tag").Contains("ed")), true},
+		{expression.Name("tag").Size().Equal(expression.Value(3)), true},
+	}
+
+	for _, tt := range tests {
+		expr, err := expression.NewBuilder().WithCondition(tt.cond).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(table),
+			Key:                       key("A", "1"),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+
+		switch {
+		case tt.want && err != nil:
+			t.Errorf("%s = %v, want the condition to hold", aws.ToString(expr.Condition()), err)
+		case !tt.want && !isConditionFailed(err):
+			t.Errorf("%s = %v, want ConditionalCheckFailedException", aws.ToString(expr.Condition()), err)
+		}
+
+		if tt.want {
+			put(t, e, map[string]types.AttributeValue{"pk": s("A"), "sk": s("1"), "n": n(5), "tag": s("red")})
+		}
+	}
+
+	_, err := e.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key("A", "1"),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":unused": n(1)},
+	})
+	if !isValidation(err) {
+		t.Errorf("DeleteItem with an unused value = %v, want a ValidationException", err)
+	}
+}
+
+func TestUpdateExpressions(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	put(t, e, map[string]types.AttributeValue{
+		"pk":     s("A"),
+		"sk":     s("1"),
+		"count":  n(1),
+		"list":   &types.AttributeValueMemberL{Value: []types.AttributeValue{s("a")}},
+		"tags":   &types.AttributeValueMemberSS{Value: []string{"red", "blue"}},
+		"gone":   s("x"),
+		"nested": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}}, // nested.inner needs its parent
+	})
+
+	update := expression.
+		Set(expression.Name("count"), expression.Name("count").Plus(expression.Value(2))).
+		Set(expression.Name("list"), expression.ListAppend(expression.Name("list"), expression.Value([]string{"b"}))).
+		Set(expression.Name("seen"), expression.IfNotExists(expression.Name("seen"), expression.Value(7))).
+		Set(expression.Name("nested.inner"), expression.Value("deep")).
+		Remove(expression.Name("gone")).
+		Add(expression.Name("visits"), expression.Value(3)).
+		Delete(expression.Name("tags"), expression.Value(&types.AttributeValueMemberSS{Value: []string{"red"}}))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := e.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key("A", "1"),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := out.Attributes["pk"]; ok {
+		t.Error("UPDATED_NEW returned the unchanged key")
+	}
+	if got := out.Attributes["count"].(*types.AttributeValueMemberN).Value; got != "3" {
+		t.Errorf("UPDATED_NEW count = %s, want 3", got)
+	}
+
+	item := get(t, e, "A", "1")
+	if got := item["count"].(*types.AttributeValueMemberN).Value; got != "3" {
+		t.Errorf("count = %s, want 3", got)
+	}
+	if got := item["list"].(*types.AttributeValueMemberL).Value; len(got) != 2 {
+		t.Errorf("list = %v, want 2 elements", got)
+	}
+	if got := item["seen"].(*types.AttributeValueMemberN).Value; got != "7" {
+		t.Errorf("seen = %s, want 7", got)
+	}
+	if got := item["nested"].(*types.AttributeValueMemberM).Value["inner"].(*types.AttributeValueMemberS).Value; got != "deep" {
+		t.Errorf("nested.inner = %s, want deep", got)
+	}
+	if _, ok := item["gone"]; ok {
+		t.Error("gone was not removed")
+	}
+	if got := item["visits"].(*types.AttributeValueMemberN).Value; got != "3" {
+		t.Errorf("visits = %s, want 3", got)
+	}
+	if got := item["tags"].(*types.AttributeValueMemberSS).Value; !equal(got, []string{"blue"}) {
+		t.Errorf("tags = %v, want [blue]", got)
+	}
+
+	invalid := map[string]string{
+		"key attribute":      "SET sk = :v",
+		"overlapping paths":  "SET a = :v REMOVE a",
+		"arithmetic on text": "SET gone2 = sk + :v",
+	}
+	for name, expr := range invalid {
+		_, err := e.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(table),
+			Key:                       key("A", "1"),
+			UpdateExpression:          aws.String(expr),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":v": n(1)},
+		})
+		if !isValidation(err) {
+			t.Errorf("update of %s = %v, want a ValidationException", name, err)
+		}
+	}
+
+	// updates create missing items, unless a condition requires them
+	if _, err := e.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key("A", "2"),
+		UpdateExpression:          aws.String("SET v = :v"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":v": n(1)},
+	}); err != nil || get(t, e, "A", "2") == nil {
+		t.Errorf("upsert = %v, want the item created", err)
+	}
+	if _, err := e.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key("A", "3"),
+		UpdateExpression:          aws.String("SET v = :v"),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":v": n(1)},
+	}); !isConditionFailed(err) {
+		t.Errorf("conditional update of a missing item = %v, want ConditionalCheckFailedException", err)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	for i := 1; i <= 5; i++ {
+		put(t, e, map[string]types.AttributeValue{"pk": s("P"), "sk": s(strconv.Itoa(i)), "odd": &types.AttributeValueMemberBOOL{Value: i%2 == 1}})
+	}
+	put(t, e, map[string]types.AttributeValue{"pk": s("Q"), "sk": s("1")})
+
+	queryAll := func(limit int32, forward bool, filter *string) (pages [][]string) {
+		t.Helper()
+
+		var start map[string]types.AttributeValue
+		for {
+			in := &dynamodb.QueryInput{
+				TableName:                 aws.String(table),
+				KeyConditionExpression:    aws.String("pk = :pk"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{":pk": s("P")},
+				ExclusiveStartKey:         start,
+				Limit:                     aws.Int32(limit),
+				ScanIndexForward:          aws.Bool(forward),
+				FilterExpression:          filter,
+			}
+			if filter != nil {
+				in.ExpressionAttributeValues[":odd"] = &types.AttributeValueMemberBOOL{Value: true}
+			}
+
+			out, err := e.Query(ctx, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pages = append(pages, sks(out.Items))
+			if out.LastEvaluatedKey == nil {
+				return pages
+			}
+			start = out.LastEvaluatedKey
+		}
+	}
+
+	if got := queryAll(2, true, nil); len(got) != 3 || !equal(got[0], []string{"1", "2"}) || !equal(got[2], []string{"5"}) {
+		t.Errorf("pages = %v, want [[1 2] [3 4] [5]]", got)
+	}
+	if got := queryAll(2, false, nil); !equal(got[0], []string{"5", "4"}) {
+		t.Errorf("first descending page = %v, want [5 4]", got[0])
+	}
+
+	// the limit counts the items read, before the filter drops some
+	got := queryAll(2, true, aws.String("odd = :odd"))
+	if len(got) != 3 || !equal(got[0], []string{"1"}) || !equal(got[1], []string{"3"}) {
+		t.Errorf("filtered pages = %v, want [[1] [3] [5]]", got)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t)
+
+	put(t, e, key("A", "taken"))
+
+	_, err := e.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		{Put: &types.Put{TableName: aws.String(table), Item: key("A", "new")}},
+		{Put: &types.Put{TableName: aws.String(table), Item: key("A", "taken"), ConditionExpression: aws.String("attribute_not_exists(pk)")}},
+	}})
+
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		t.Fatalf("TransactWriteItems = %v, want TransactionCanceledException", err)
+	}
+	if codes := []string{aws.ToString(canceled.CancellationReasons[0].Code), aws.ToString(canceled.CancellationReasons[1].Code)}; !equal(codes, []string{"None", "ConditionalCheckFailed"}) {
+		t.Errorf("cancellation reasons = %v, want [None ConditionalCheckFailed]", codes)
+	}
+	if get(t, e, "A", "new") != nil {
+		t.Error("a canceled transaction wrote its other items")
+	}
+
+	_, err = e.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		{Put: &types.Put{TableName: aws.String(table), Item: key("A", "new")}},
+		{Delete: &types.Delete{TableName: aws.String(table), Key: key("A", "new")}},
+	}})
+	if !isValidation(err) {
+		t.Errorf("two operations on one item = %v, want a ValidationException", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	e := newEngine(t)
+
+	now := time.Unix(1_700_000_000, 0)
+	e.Now = func() time.Time { return now }
+
+	put(t, e, map[string]types.AttributeValue{"pk": s("L"), "sk": s("past"), "expiresAt": n(int(now.Unix()) - 1)})
+	put(t, e, map[string]types.AttributeValue{"pk": s("L"), "sk": s("now"), "expiresAt": n(int(now.Unix()))})
+	put(t, e, map[string]types.AttributeValue{"pk": s("L"), "sk": s("future"), "expiresAt": n(int(now.Unix()) + 1)})
+	put(t, e, map[string]types.AttributeValue{"pk": s("L"), "sk": s("text"), "expiresAt": s("0")})
+	put(t, e, map[string]types.AttributeValue{"pk": s("L"), "sk": s("never")})
+
+	if deleted := e.Expire(); deleted != 2 {
+		t.Errorf("Expire() = %d, want 2", deleted)
+	}
+
+	for sk, kept := range map[string]bool{"past": false, "now": false, "future": true, "text": true, "never": true} {
+		if got := get(t, e, "L", sk) != nil; got != kept {
+			t.Errorf("%s kept = %v, want %v", sk, got, kept)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if deleted := e.Expire(); deleted != 1 {
+		t.Errorf("Expire() a second later = %d, want 1", deleted)
+	}
+}
@@ -0,0 +1,377 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// kind is the DynamoDB data type of a value
+type kind int
+
+const (
+	kindS kind = iota
+	kindN
+	kindB
+	kindBOOL
+	kindNULL
+	kindM
+	kindL
+	kindSS
+	kindNS
+	kindBS
+)
+
+var kindNames = map[kind]string{
+	kindS:    "S",
+	kindN:    "N",
+	kindB:    "B",
+	kindBOOL: "BOOL",
+	kindNULL: "NULL",
+	kindM:    "M",
+	kindL:    "L",
+	kindSS:   "SS",
+	kindNS:   "NS",
+	kindBS:   "BS",
+}
+
+// value is the engine's SDK-independent representation of an attribute value.
+// Numbers are kept as their canonical decimal string, binary values & binary sets as raw bytes in s/set.
+type value struct {
+	kind kind
+	s    string
+	b    bool
+	m    map[string]*value
+	l    []*value
+	set  []string
+}
+
+// item is a stored item keyed by attribute name
+type item map[string]*value
+
+func (k kind) String() string {
+	return kindNames[k]
+}
+
+func (v *value) isSet() bool {
+	return v.kind == kindSS || v.kind == kindNS || v.kind == kindBS
+}
+
+func (v *value) clone() *value {
+	if v == nil {
+		return nil
+	}
+
+	c := &value{kind: v.kind, s: v.s, b: v.b}
+	if v.m != nil {
+		c.m = make(map[string]*value, len(v.m))
+		for k, e := range v.m {
+			c.m[k] = e.clone()
+		}
+	}
+	if v.l != nil {
+		c.l = make([]*value, len(v.l))
+		for i, e := range v.l {
+			c.l[i] = e.clone()
+		}
+	}
+	if v.set != nil {
+		c.set = append([]string(nil), v.set...)
+	}
+
+	return c
+}
+
+func (it item) clone() item {
+	if it == nil {
+		return nil
+	}
+
+	c := make(item, len(it))
+	for k, v := range it {
+		c[k] = v.clone()
+	}
+
+	return c
+}
+
+// equal reports whether two values are of the same type & hold the same data
+func (v *value) equal(o *value) bool {
+	if v == nil || o == nil {
+		return v == o
+	}
+
+	if v.kind != o.kind {
+		return false
+	}
+
+	switch v.kind {
+	case kindN:
+		return compareNumbers(v.s, o.s) == 0
+	case kindBOOL:
+		return v.b == o.b
+	case kindNULL:
+		return true
+	case kindM:
+		if len(v.m) != len(o.m) {
+			return false
+		}
+		for k, e := range v.m {
+			if !e.equal(o.m[k]) {
+				return false
+			}
+		}
+		return true
+	case kindL:
+		if len(v.l) != len(o.l) {
+			return false
+		}
+		for i := range v.l {
+			if !v.l[i].equal(o.l[i]) {
+				return false
+			}
+		}
+		return true
+	case kindSS, kindBS, kindNS:
+		if len(v.set) != len(o.set) {
+			return false
+		}
+		for _, e := range v.set {
+			if !v.kind.setContains(o.set, e) {
+				return false
+			}
+		}
+		return true
+	default:
+		return v.s == o.s
+	}
+}
+
+// compare orders two scalar values of the same kind; ok is false when they are not comparable
+func (v *value) compare(o *value) (int, bool) {
+	if v == nil || o == nil || v.kind != o.kind {
+		return 0, false
+	}
+
+	switch v.kind {
+	case kindS:
+		return strings.Compare(v.s, o.s), true
+	case kindN:
+		return compareNumbers(v.s, o.s), true
+	case kindB:
+		return bytes.Compare([]byte(v.s), []byte(o.s)), true
+	}
+
+	return 0, false
+}
+
+func (k kind) setContains(set []string, e string) bool {
+	for _, s := range set {
+		if k == kindNS {
+			if compareNumbers(s, e) == 0 {
+				return true
+			}
+		} else if s == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNumber(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+
+	return r, nil
+}
+
+func compareNumbers(a, b string) int {
+	ra, errA := parseNumber(a)
+	rb, errB := parseNumber(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	return ra.Cmp(rb)
+}
+
+// formatNumber renders r as a plain decimal without trailing zeros
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	s := strings.TrimRight(r.FloatString(38), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func addNumbers(a, b string, sign int) (string, error) {
+	ra, err := parseNumber(a)
+	if err != nil {
+		return "", err
+	}
+
+	rb, err := parseNumber(b)
+	if err != nil {
+		return "", err
+	}
+
+	if sign < 0 {
+		rb.Neg(rb)
+	}
+
+	return formatNumber(ra.Add(ra, rb)), nil
+}
+
+// fromAV converts an SDK attribute value into the engine representation
+func fromAV(av types.AttributeValue) (*value, error) {
+	switch av := av.(type) {
+	case *types.AttributeValueMemberS:
+		return &value{kind: kindS, s: av.Value}, nil
+	case *types.AttributeValueMemberN:
+		r, err := parseNumber(av.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &value{kind: kindN, s: formatNumber(r)}, nil
+	case *types.AttributeValueMemberB:
+		return &value{kind: kindB, s: string(av.Value)}, nil
+	case *types.AttributeValueMemberBOOL:
+		return &value{kind: kindBOOL, b: av.Value}, nil
+	case *types.AttributeValueMemberNULL:
+		return &value{kind: kindNULL}, nil
+	case *types.AttributeValueMemberM:
+		m, err := fromAVMap(av.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &value{kind: kindM, m: m}, nil
+	case *types.AttributeValueMemberL:
+		l := make([]*value, len(av.Value))
+		for i, e := range av.Value {
+			v, err := fromAV(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = v
+		}
+		return &value{kind: kindL, l: l}, nil
+	case *types.AttributeValueMemberSS:
+		return newSet(kindSS, av.Value)
+	case *types.AttributeValueMemberNS:
+		return newSet(kindNS, av.Value)
+	case *types.AttributeValueMemberBS:
+		set := make([]string, len(av.Value))
+		for i, b := range av.Value {
+			set[i] = string(b)
+		}
+		return newSet(kindBS, set)
+	case nil:
+		return nil, fmt.Errorf("attribute value is nil")
+	}
+
+	return nil, fmt.Errorf("unsupported attribute value type %T", av)
+}
+
+func newSet(k kind, elems []string) (*value, error) {
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("an %s may not be empty", k)
+	}
+
+	v := &value{kind: k}
+	for _, s := range elems {
+		if k == kindNS {
+			r, err := parseNumber(s)
+			if err != nil {
+				return nil, err
+			}
+			s = formatNumber(r)
+		}
+
+		if k.setContains(v.set, s) {
+			return nil, fmt.Errorf("input collection contains duplicates")
+		}
+		v.set = append(v.set, s)
+	}
+
+	return v, nil
+}
+
+func fromAVMap(m map[string]types.AttributeValue) (item, error) {
+	out := make(item, len(m))
+	for k, av := range m {
+		v, err := fromAV(av)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = v
+	}
+
+	return out, nil
+}
+
+// toAV converts an engine value back into an SDK attribute value
+func toAV(v *value) types.AttributeValue {
+	switch v.kind {
+	case kindS:
+		return &types.AttributeValueMemberS{Value: v.s}
+	case kindN:
+		return &types.AttributeValueMemberN{Value: v.s}
+	case kindB:
+		return &types.AttributeValueMemberB{Value: []byte(v.s)}
+	case kindBOOL:
+		return &types.AttributeValueMemberBOOL{Value: v.b}
+	case kindM:
+		return &types.AttributeValueMemberM{Value: toAVMap(v.m)}
+	case kindL:
+		l := make([]types.AttributeValue, len(v.l))
+		for i, e := range v.l {
+			l[i] = toAV(e)
+		}
+		return &types.AttributeValueMemberL{Value: l}
+	case kindSS:
+		return &types.AttributeValueMemberSS{Value: sortedSet(v)}
+	case kindNS:
+		return &types.AttributeValueMemberNS{Value: sortedSet(v)}
+	case kindBS:
+		var set [][]byte
+		for _, s := range sortedSet(v) {
+			set = append(set, []byte(s))
+		}
+		return &types.AttributeValueMemberBS{Value: set}
+	}
+
+	return &types.AttributeValueMemberNULL{Value: true}
+}
+
+func toAVMap(it item) map[string]types.AttributeValue {
+	if it == nil {
+		return nil
+	}
+
+	out := make(map[string]types.AttributeValue, len(it))
+	for k, v := range it {
+		out[k] = toAV(v)
+	}
+
+	return out
+}
+
+func sortedSet(v *value) []string {
+	set := append([]string(nil), v.set...)
+	sort.Slice(set, func(i, j int) bool {
+		if v.kind == kindNS {
+			return compareNumbers(set[i], set[j]) < 0
+		}
+		return set[i] < set[j]
+	})
+
+	return set
+}
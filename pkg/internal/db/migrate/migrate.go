@@ -0,0 +1,154 @@
+// Package migrate runs versioned data migrations & records the applied ones in the table itself.
+//
+// Each applied migration is stored as a `MIGRATION` item in the `MIGRATIONS` partition, keyed by its
+// zero-padded version, so any environment can tell which migrations it has already run.
+// Migrations must be idempotent: a migration that fails midway is rerun from the start.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+)
+
+// Migration is a single versioned data change
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, env Env) error
+}
+
+// Env is what a migration gets to work with
+type Env struct {
+	DB    db.Client
+	Table db.Table
+}
+
+// Record is the item stored for every applied migration
+type Record struct {
+	Key         string `json:"key" dynamodbav:"sk"`
+	Version     int    `json:"version" dynamodbav:"version"`
+	Description string `json:"description" dynamodbav:"description"`
+	AppliedAt   int64  `json:"appliedAt" dynamodbav:"appliedAt"`
+	DurationMs  int64  `json:"durationMs" dynamodbav:"durationMs"`
+}
+
+// Records stores migration records next to the data they describe
+var Records = db.RegisterEntity[Record](db.EntityOptions{
+	Type:         "MIGRATION",
+	PartitionKey: "MIGRATIONS",
+	SortKey:      "{key}",
+})
+
+// Runner applies migrations to one table
+type Runner struct {
+	env        Env
+	records    *db.Repository[Record]
+	migrations []Migration
+	now        func() time.Time
+}
+
+// NewRunner creates a runner for the given migrations, which must have unique positive versions
+func NewRunner(database db.Client, table db.Table, migrations []Migration) (*Runner, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i, m := range sorted {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migrate: migration %q has no positive version", m.Description)
+		}
+		if m.Up == nil {
+			return nil, fmt.Errorf("migrate: migration %d has no Up function", m.Version)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrate: duplicate migration version %d", m.Version)
+		}
+	}
+
+	return &Runner{
+		env:        Env{DB: database, Table: table},
+		records:    db.NewRepository(database, table, Records),
+		migrations: sorted,
+		now:        time.Now,
+	}, nil
+}
+
+// Applied returns the records of every applied migration, by version
+func (r *Runner) Applied(ctx context.Context) (map[int]Record, error) {
+	records, err := r.records.List(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: reading applied migrations: %w", err)
+	}
+
+	applied := make(map[int]Record, len(records))
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+
+	return applied, nil
+}
+
+// Pending returns the migrations that have not been applied yet, in version order
+func (r *Runner) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := r.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range r.migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies every pending migration in version order, stopping at the first failure.
+// It returns the migrations applied before returning.
+func (r *Runner) Up(ctx context.Context) ([]Migration, error) {
+	pending, err := r.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range pending {
+		// another runner may have applied it since Pending was read
+		if _, err := r.records.Get(ctx, db.Keys{"key": key(m.Version)}); err == nil {
+			continue
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return done, err
+		}
+
+		start := r.now()
+		if err := m.Up(ctx, r.env); err != nil {
+			return done, fmt.Errorf("migrate: migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+
+		err := r.records.Put(ctx, Record{
+			Key:         key(m.Version),
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   r.now().Unix(),
+			DurationMs:  r.now().Sub(start).Milliseconds(),
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: recording migration %d: %w", m.Version, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// key zero-pads the version so records sort in version order
+func key(version int) string {
+	return fmt.Sprintf("%06d", version)
+}
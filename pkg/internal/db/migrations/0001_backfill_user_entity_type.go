@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/migrate"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// backfillUserEntityType tags every item of the users partition that has no discriminator yet
+func backfillUserEntityType(ctx context.Context, env migrate.Env) error {
+	keyCond := expression.Key(env.Table.PartitionKey).Equal(expression.Value(controller_users.PK))
+
+	query, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return err
+	}
+
+	items, err := env.DB.QueryItems(ctx, env.Table.Name, query.KeyCondition(), query.Names(), query.Values())
+	if err != nil {
+		return err
+	}
+
+	update, err := expression.NewBuilder().
+		WithUpdate(expression.Set(expression.Name(db.TypeAttribute), expression.Value(controller_users.Users.Type()))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if _, ok := item[db.TypeAttribute]; ok {
+			continue
+		}
+
+		key := map[string]types.AttributeValue{
+			env.Table.PartitionKey: item[env.Table.PartitionKey],
+			env.Table.SortKey:      item[env.Table.SortKey],
+		}
+
+		if err := env.DB.UpdateItem(ctx, env.Table.Name, key, update.Update(), update.Names(), update.Values()); err != nil {
+			return fmt.Errorf("tagging user %v: %w", item[env.Table.SortKey], err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/migrate"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// backfillEmailClaims normalizes the email of every user & claims it.
+// Users sharing an email are reported & left unclaimed, so the migration fails until they are resolved by hand.
+func backfillEmailClaims(ctx context.Context, env migrate.Env) error {
+	users := db.NewRepository(env.DB, env.Table, controller_users.Users)
+	emails := db.NewRepository(env.DB, env.Table, controller_users.Emails)
+
+	all, err := users.List(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+
+	for _, u := range all {
+		email, err := controller_users.NormalizeEmail(u.Email)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s has the invalid email %q", u.ID, u.Email))
+			continue
+		}
+
+		claim, err := emails.Get(ctx, db.Keys{"email": email})
+		if err == nil {
+			if claim.UserID != u.ID {
+				conflicts = append(conflicts, fmt.Sprintf("%s & %s share the email %s", claim.UserID, u.ID, email))
+			}
+			continue
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+
+		tx := db.NewTransaction(env.DB)
+		if email != u.Email {
+			err := users.UpdateTx(tx, db.Keys{"id": u.ID}, map[string]interface{}{"email": email},
+				expression.Name("email").Equal(expression.Value(u.Email)))
+			if err != nil {
+				return err
+			}
+		}
+		if err := emails.CreateTx(tx, controller_users.EmailClaim{Email: email, UserID: u.ID}); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("claiming the email of user %s: %w", u.ID, err)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		for _, c := range conflicts {
+			log.Printf("email claims: %s", c)
+		}
+		return fmt.Errorf("%d users could not claim their email: %s", len(conflicts), strings.Join(conflicts, "; "))
+	}
+
+	return nil
+}
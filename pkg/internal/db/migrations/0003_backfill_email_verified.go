@@ -0,0 +1,54 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/migrate"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// backfillEmailVerified marks the users created before email verification as verified, so they keep access
+// to verified-only routes. Users created since store emailVerified, even when false, & are left alone.
+func backfillEmailVerified(ctx context.Context, env migrate.Env) error {
+	users := db.NewRepository(env.DB, env.Table, controller_users.Users)
+
+	keyCond := expression.Key(env.Table.PartitionKey).Equal(expression.Value(controller_users.PK))
+
+	query, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return err
+	}
+
+	items, err := env.DB.QueryItems(ctx, env.Table.Name, query.KeyCondition(), query.Names(), query.Values())
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if _, ok := item["emailVerified"]; ok {
+			continue
+		}
+
+		u, err := users.Unmarshal(item)
+		if err != nil {
+			return err
+		}
+
+		tx := db.NewTransaction(env.DB)
+		err = users.UpdateTx(tx, db.Keys{"id": u.ID}, map[string]interface{}{"emailVerified": true},
+			expression.AttributeNotExists(expression.Name("emailVerified")))
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Commit(ctx); err != nil && !db.IsConditionFailed(err) {
+			return fmt.Errorf("verifying user %s: %w", u.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+// Package migrations lists the data migrations of the main table, applied in version order by dbctl.
+// Add new migrations to All with the next free version; never renumber or remove applied ones.
+package migrations
+
+import "serverless-aws-cdk/internal/db/migrate"
+
+// All returns every migration of the main table
+func All() []migrate.Migration {
+	return []migrate.Migration{
+		{Version: 1, Description: "backfill entityType on users written before entity discriminators", Up: backfillUserEntityType},
+		{Version: 2, Description: "normalize user emails & claim them for uniqueness", Up: backfillEmailClaims},
+		{Version: 3, Description: "mark users created before email verification as verified", Up: backfillEmailVerified},
+	}
+}
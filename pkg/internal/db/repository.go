@@ -0,0 +1,546 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	// ErrNotFound is returned when an item does not exist or belongs to another entity type
+	ErrNotFound = errors.New("item not found")
+	// ErrKeyAttribute is returned for updates of an attribute that keys, types or expires the item
+	ErrKeyAttribute = errors.New("cannot update key attribute")
+)
+
+// Table describes the primary key of a single-table design
+type Table struct {
+	Name         string
+	PartitionKey string
+	SortKey      string
+	IndexKeys    []string // key attributes of the global secondary indexes, other than PartitionKey & SortKey
+	TimeToLive   string   // epoch seconds attribute items expire by, empty when the table has no time to live
+}
+
+// CheckUpdatable returns an ErrKeyAttribute error when attr is a key attribute of the table or one of
+// its indexes, the entity type or the time to live attribute, which only whole item writes may change
+func (t Table) CheckUpdatable(attr string) error {
+	switch {
+	case attr == t.PartitionKey, attr == t.SortKey, attr == TypeAttribute, t.TimeToLive != "" && attr == t.TimeToLive:
+	case t.isIndexKey(attr):
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("%w %q", ErrKeyAttribute, attr)
+}
+
+func (t Table) isIndexKey(attr string) bool {
+	for _, k := range t.IndexKeys {
+		if k == attr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Repository provides typed data access for one entity type stored in a single table
+type Repository[T any] struct {
+	db     Client
+	table  Table
+	entity *Entity[T]
+}
+
+// Query selects items from the entity's partition or from one of its indexes
+type Query struct {
+	Index             string // empty for the base table
+	Keys              Keys   // values for the partition key template
+	SortKeyEquals     interface{}
+	SortKeyBeginsWith string
+	Limit             int32
+	Cursor            string // opaque cursor returned by a previous page
+	Descending        bool
+}
+
+// Page is a single page of query results
+type Page[T any] struct {
+	Items  []T    `json:"items"`
+	Cursor string `json:"cursor,omitempty"` // empty when there are no more pages
+}
+
+// NewRepository creates a repository for entity in table
+func NewRepository[T any](db Client, table Table, entity *Entity[T]) *Repository[T] {
+	return &Repository[T]{
+		db:     db,
+		table:  table,
+		entity: entity,
+	}
+}
+
+// Get fetches a single item, returning ErrNotFound when it does not exist or has expired
+func (r *Repository[T]) Get(ctx context.Context, keys Keys) (T, error) {
+	var item T
+
+	key, err := r.key(keys)
+	if err != nil {
+		return item, err
+	}
+
+	av, err := r.db.GetItem(ctx, r.table.Name, key)
+	if err != nil {
+		return item, err
+	}
+
+	if av == nil || !r.isEntity(av) || Expired(av, r.table.TimeToLive) {
+		return item, ErrNotFound
+	}
+
+	return r.Unmarshal(av)
+}
+
+// Put writes item, rendering its keys & index attributes from the entity templates
+func (r *Repository[T]) Put(ctx context.Context, item T, opts ...WriteOption) error {
+	av, err := r.Marshal(item, opts...)
+	if err != nil {
+		return err
+	}
+
+	return r.db.PutItem(ctx, r.table.Name, av)
+}
+
+// Update sets the given attributes on an existing item. It fails with ErrNotFound when the item does not
+// exist, has expired or one of conditions does not hold for it, so it never creates an item; use Upsert
+// for that.
+func (r *Repository[T]) Update(ctx context.Context, keys Keys, changes map[string]interface{}, conditions ...expression.ConditionBuilder) error {
+	exists := expression.AttributeExists(expression.Name(r.table.PartitionKey))
+
+	err := r.updateItem(ctx, keys, changes, r.live(append([]expression.ConditionBuilder{exists}, conditions...)))
+	if IsConditionFailed(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Upsert sets the given attributes on an item, creating it with only those attributes & its key when it
+// does not exist
+func (r *Repository[T]) Upsert(ctx context.Context, keys Keys, changes map[string]interface{}) error {
+	return r.updateItem(ctx, keys, changes, nil)
+}
+
+// Delete removes a single item
+func (r *Repository[T]) Delete(ctx context.Context, keys Keys) error {
+	key, err := r.key(keys)
+	if err != nil {
+		return err
+	}
+
+	return r.db.DeleteItem(ctx, r.table.Name, key)
+}
+
+// PutTx adds a put of item to tx, replacing any existing item
+func (r *Repository[T]) PutTx(tx *Transaction, item T, opts ...WriteOption) error {
+	av, err := r.Marshal(item, opts...)
+	if err != nil {
+		return err
+	}
+
+	tx.Add(types.TransactWriteItem{Put: &types.Put{
+		TableName: aws.String(r.table.Name),
+		Item:      av,
+	}})
+
+	return nil
+}
+
+// CreateTx adds a put of item to tx that cancels the transaction when the item already exists
+func (r *Repository[T]) CreateTx(tx *Transaction, item T, opts ...WriteOption) error {
+	av, err := r.Marshal(item, opts...)
+	if err != nil {
+		return err
+	}
+
+	tx.Add(types.TransactWriteItem{Put: &types.Put{
+		TableName:                aws.String(r.table.Name),
+		Item:                     av,
+		ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.table.PartitionKey},
+	}})
+
+	return nil
+}
+
+// UpdateTx adds an update of the given attributes to tx. The transaction is canceled when the stored item
+// has expired and, with conditions, unless all of them hold for it.
+func (r *Repository[T]) UpdateTx(tx *Transaction, keys Keys, changes map[string]interface{}, conditions ...expression.ConditionBuilder) error {
+	key, expr, err := r.update(keys, changes, r.live(conditions))
+	if err != nil {
+		return err
+	}
+
+	tx.Add(types.TransactWriteItem{Update: &types.Update{
+		TableName:                 aws.String(r.table.Name),
+		Key:                       key,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}})
+
+	return nil
+}
+
+// DeleteTx adds the removal of a single item to tx.
+// With conditions, the transaction is canceled unless all of them hold for the stored item.
+func (r *Repository[T]) DeleteTx(tx *Transaction, keys Keys, conditions ...expression.ConditionBuilder) error {
+	key, err := r.key(keys)
+	if err != nil {
+		return err
+	}
+
+	del := &types.Delete{
+		TableName: aws.String(r.table.Name),
+		Key:       key,
+	}
+
+	if len(conditions) > 0 {
+		cond := conditions[0]
+		for _, c := range conditions[1:] {
+			cond = cond.And(c)
+		}
+
+		expr, err := expression.NewBuilder().WithCondition(cond).Build()
+		if err != nil {
+			return err
+		}
+
+		del.ConditionExpression = expr.Condition()
+		del.ExpressionAttributeNames = expr.Names()
+		del.ExpressionAttributeValues = expr.Values()
+	}
+
+	tx.Add(types.TransactWriteItem{Delete: del})
+
+	return nil
+}
+
+// Query fetches a single page of items matching q
+func (r *Repository[T]) Query(ctx context.Context, q Query) (Page[T], error) {
+	pkAttr, skAttr := r.table.PartitionKey, r.table.SortKey
+	pk, err := r.entity.PartitionKey(q.Keys)
+
+	if q.Index != "" {
+		idx, ok := r.entity.indexes[q.Index]
+		if !ok {
+			return Page[T]{}, fmt.Errorf("entity %s is not projected into index %q", r.entity.Type(), q.Index)
+		}
+
+		pkAttr, skAttr = idx.PartitionKey, idx.SortKey
+		switch {
+		case idx.pk != nil:
+			pk, err = idx.pk.render(q.Keys)
+		case idx.PartitionKey != r.table.PartitionKey:
+			pk, err = q.Keys[idx.PartitionKey], nil
+		}
+	}
+
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	keyCond := expression.Key(pkAttr).Equal(expression.Value(pk))
+	switch {
+	case q.SortKeyEquals != nil:
+		keyCond = keyCond.And(expression.Key(skAttr).Equal(expression.Value(q.SortKeyEquals)))
+	case q.SortKeyBeginsWith != "":
+		keyCond = keyCond.And(expression.Key(skAttr).BeginsWith(q.SortKeyBeginsWith))
+	}
+
+	filter := r.typeFilter()
+	if r.table.TimeToLive != "" {
+		filter = filter.And(r.liveFilter())
+	}
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCond).
+		WithFilter(filter).
+		Build()
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table.Name),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(!q.Descending),
+	}
+
+	if q.Index != "" {
+		input.IndexName = aws.String(q.Index)
+	}
+
+	if q.Limit > 0 {
+		input.Limit = aws.Int32(q.Limit)
+	}
+
+	if q.Cursor != "" {
+		startKey, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		input.ExclusiveStartKey = startKey
+	}
+
+	items, lastKey, err := r.db.QueryPage(ctx, input)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	page := Page[T]{Items: make([]T, 0, len(items))}
+	for _, av := range items {
+		item, err := r.Unmarshal(av)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		page.Items = append(page.Items, item)
+	}
+
+	if len(lastKey) > 0 {
+		if page.Cursor, err = encodeCursor(lastKey); err != nil {
+			return Page[T]{}, err
+		}
+	}
+
+	return page, nil
+}
+
+// List fetches every item of the entity in the partition rendered from keys
+func (r *Repository[T]) List(ctx context.Context, keys Keys) ([]T, error) {
+	return r.QueryAll(ctx, Query{Keys: keys})
+}
+
+// QueryAll fetches every page of items matching q, starting at q.Cursor
+func (r *Repository[T]) QueryAll(ctx context.Context, q Query) ([]T, error) {
+	items := []T{}
+
+	for {
+		page, err := r.Query(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, page.Items...)
+
+		if page.Cursor == "" {
+			return items, nil
+		}
+
+		q.Cursor = page.Cursor
+	}
+}
+
+// updateItem sends a single update of changes, made conditional on conditions
+func (r *Repository[T]) updateItem(ctx context.Context, keys Keys, changes map[string]interface{}, conditions []expression.ConditionBuilder) error {
+	key, expr, err := r.update(keys, changes, conditions)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.table.Name),
+		Key:                       key,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueNone,
+	})
+
+	return err
+}
+
+// update builds a SET expression for changes, refusing to touch key attributes
+func (r *Repository[T]) update(keys Keys, changes map[string]interface{}, conditions []expression.ConditionBuilder) (map[string]types.AttributeValue, expression.Expression, error) {
+	if len(changes) == 0 {
+		return nil, expression.Expression{}, errors.New("no fields to update")
+	}
+
+	key, err := r.key(keys)
+	if err != nil {
+		return nil, expression.Expression{}, err
+	}
+
+	update := expression.UpdateBuilder{}
+	for k, v := range changes {
+		if err := r.checkUpdatable(k); err != nil {
+			return nil, expression.Expression{}, err
+		}
+
+		update = update.Set(expression.Name(k), expression.Value(v))
+	}
+
+	builder := expression.NewBuilder().WithUpdate(update)
+	if len(conditions) > 0 {
+		cond := conditions[0]
+		if len(conditions) > 1 {
+			cond = expression.And(conditions[0], conditions[1], conditions[2:]...)
+		}
+		builder = builder.WithCondition(cond)
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, expression.Expression{}, err
+	}
+
+	return key, expr, nil
+}
+
+// checkUpdatable is Table.CheckUpdatable, except that index keys the entity declares without a template
+// are its own fields, e.g. a status an index sorts by, & may be updated to move the item within the index
+func (r *Repository[T]) checkUpdatable(attr string) error {
+	for _, idx := range r.entity.indexes {
+		if attr == idx.PartitionKey && idx.pk == nil || attr == idx.SortKey && idx.sk == nil {
+			if attr != r.table.PartitionKey && attr != r.table.SortKey {
+				return nil
+			}
+		}
+	}
+
+	return r.table.CheckUpdatable(attr)
+}
+
+func (r *Repository[T]) key(keys Keys) (map[string]types.AttributeValue, error) {
+	pk, err := r.entity.PartitionKey(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := r.entity.SortKey(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]types.AttributeValue{
+		r.table.PartitionKey: &types.AttributeValueMemberS{Value: pk},
+		r.table.SortKey:      &types.AttributeValueMemberS{Value: sk},
+	}, nil
+}
+
+// Marshal renders item as it is stored: its attributes plus the keys, discriminator, index & expiry attributes
+func (r *Repository[T]) Marshal(item T, opts ...WriteOption) (map[string]types.AttributeValue, error) {
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := r.entity.KeysOf(item)
+
+	key, err := r.key(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range key {
+		av[k] = v
+	}
+
+	av[TypeAttribute] = &types.AttributeValueMemberS{Value: r.entity.Type()}
+
+	if err := r.setExpiry(av, opts); err != nil {
+		return nil, err
+	}
+
+	// index attributes are sparse: an item missing a template value is simply not projected
+	for _, idx := range r.entity.indexes {
+		if idx.pk != nil {
+			if v, err := idx.pk.render(keys); err == nil {
+				av[idx.PartitionKey] = &types.AttributeValueMemberS{Value: v}
+			}
+		}
+		if idx.sk != nil {
+			if v, err := idx.sk.render(keys); err == nil {
+				av[idx.SortKey] = &types.AttributeValueMemberS{Value: v}
+			}
+		}
+	}
+
+	return av, nil
+}
+
+// Unmarshal decodes a stored item, filling key fields from the pk & sk
+func (r *Repository[T]) Unmarshal(av map[string]types.AttributeValue) (T, error) {
+	var item T
+
+	if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+		return item, err
+	}
+
+	r.entity.setKeys(&item, stringValue(av[r.table.PartitionKey]), stringValue(av[r.table.SortKey]))
+
+	return item, nil
+}
+
+// isEntity reports whether av belongs to this entity; items written before discriminators existed are accepted
+func (r *Repository[T]) isEntity(av map[string]types.AttributeValue) bool {
+	t, ok := av[TypeAttribute]
+	return !ok || stringValue(t) == r.entity.Type()
+}
+
+// stringValue returns the value of a string attribute, or "" for any other type
+func stringValue(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+
+	return ""
+}
+
+func (r *Repository[T]) typeFilter() expression.ConditionBuilder {
+	return expression.Or(
+		expression.AttributeNotExists(expression.Name(TypeAttribute)),
+		expression.Name(TypeAttribute).Equal(expression.Value(r.entity.Type())),
+	)
+}
+
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	var plain map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &plain); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var plain map[string]interface{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return attributevalue.MarshalMap(plain)
+}
@@ -0,0 +1,307 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/environments"
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	"serverless-aws-cdk/internal/db/schema"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type note struct {
+	Owner string `json:"owner" dynamodbav:"owner"`
+	ID    string `json:"id" dynamodbav:"id"`
+	Title string `json:"title" dynamodbav:"title"`
+}
+
+type tag struct {
+	Owner string `json:"owner" dynamodbav:"owner"`
+	ID    string `json:"id" dynamodbav:"id"`
+}
+
+type lease struct {
+	ID string `json:"id" dynamodbav:"id"`
+}
+
+var (
+	notes  = db.RegisterEntity[note](db.EntityOptions{Type: "TEST_NOTE", PartitionKey: "OWNER#{owner}", SortKey: "NOTE#{id}"})
+	tags   = db.RegisterEntity[tag](db.EntityOptions{Type: "TEST_TAG", PartitionKey: "OWNER#{owner}", SortKey: "NOTE#{id}"})
+	leases = db.RegisterEntity[lease](db.EntityOptions{Type: "TEST_LEASE", PartitionKey: "LEASES", SortKey: "{id}", TTL: time.Hour})
+)
+
+// newTable creates the local table definition in a fresh in-memory engine
+func newTable(t *testing.T) (db.Client, db.Table) {
+	t.Helper()
+
+	def := schema.MustLoad(environments.Files, schema.LocalDefinition)
+	engine, err := memory.New(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk, sk := def.KeyAttributes()
+
+	return db.New(engine), db.Table{
+		Name:         aws.ToString(def.TableName),
+		PartitionKey: pk,
+		SortKey:      sk,
+		IndexKeys:    def.IndexKeyAttributes(),
+		TimeToLive:   def.TimeToLiveAttribute(),
+	}
+}
+
+// fakeNow pins db.Now to now for the rest of the test
+func fakeNow(t *testing.T, now time.Time) {
+	t.Helper()
+
+	orig := db.Now
+	db.Now = func() time.Time { return now }
+	t.Cleanup(func() { db.Now = orig })
+}
+
+func TestEntityKeys(t *testing.T) {
+	pk, err := notes.PartitionKey(db.Keys{"owner": "ann", "id": "1"})
+	if err != nil || pk != "OWNER#ann" {
+		t.Fatalf("PartitionKey = %q, %v; want OWNER#ann", pk, err)
+	}
+
+	sk, err := notes.SortKey(db.Keys{"owner": "ann", "id": "1"})
+	if err != nil || sk != "NOTE#1" {
+		t.Fatalf("SortKey = %q, %v; want NOTE#1", sk, err)
+	}
+
+	if _, err := notes.PartitionKey(db.Keys{"id": "1"}); err == nil {
+		t.Fatal("PartitionKey without owner succeeded")
+	}
+}
+
+func TestRepositoryParsesKeys(t *testing.T) {
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, notes)
+
+	av, err := repo.Marshal(note{Owner: "ann", ID: "1", Title: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := av["pk"].(*types.AttributeValueMemberS).Value; got != "OWNER#ann" {
+		t.Errorf("pk = %q, want OWNER#ann", got)
+	}
+	if got := av[db.TypeAttribute].(*types.AttributeValueMemberS).Value; got != "TEST_NOTE" {
+		t.Errorf("%s = %q, want TEST_NOTE", db.TypeAttribute, got)
+	}
+
+	// key fields come back from pk & sk even when the stored attributes are gone
+	delete(av, "owner")
+	delete(av, "id")
+
+	got, err := repo.Unmarshal(av)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (note{Owner: "ann", ID: "1", Title: "first"}); got != want {
+		t.Errorf("Unmarshal = %+v, want %+v", got, want)
+	}
+}
+
+func TestRepositoryFiltersEntityType(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	noteRepo := db.NewRepository(client, table, notes)
+	tagRepo := db.NewRepository(client, table, tags)
+
+	if err := noteRepo.Put(ctx, note{Owner: "ann", ID: "1", Title: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tagRepo.Put(ctx, tag{Owner: "ann", ID: "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tagRepo.Get(ctx, db.Keys{"owner": "ann", "id": "1"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get of a note through the tag repository = %v, want ErrNotFound", err)
+	}
+
+	got, err := noteRepo.List(ctx, db.Keys{"owner": "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "1" {
+		t.Errorf("List = %+v, want only note 1", got)
+	}
+}
+
+func TestRepositoryPaginates(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, notes)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if err := repo.Put(ctx, note{Owner: "ann", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := repo.Query(ctx, db.Query{Keys: db.Keys{"owner": "ann"}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Cursor == "" {
+		t.Fatalf("first page = %d items, cursor %q; want 2 items & a cursor", len(page.Items), page.Cursor)
+	}
+
+	rest, err := repo.QueryAll(ctx, db.Query{Keys: db.Keys{"owner": "ann"}, Cursor: page.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 3 || rest[0].ID != "3" {
+		t.Errorf("remaining pages = %+v, want notes 3 to 5", rest)
+	}
+}
+
+func TestRepositoryExpiry(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, leases)
+
+	now := time.Unix(1_700_000_000, 0)
+	fakeNow(t, now)
+
+	if err := repo.Put(ctx, lease{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Put(ctx, lease{ID: "b"}, db.ExpiresAt(now.Add(3*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.Get(ctx, db.Keys{"id": "a"}); err != nil {
+		t.Fatalf("Get before expiry = %v", err)
+	}
+
+	// DynamoDB deletes expired items lazily, so reads must hide them until it does
+	fakeNow(t, now.Add(2*time.Hour))
+
+	if _, err := repo.Get(ctx, db.Keys{"id": "a"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get after expiry = %v, want ErrNotFound", err)
+	}
+
+	live, err := repo.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].ID != "b" {
+		t.Errorf("List after expiry = %+v, want only lease b", live)
+	}
+
+	noTTL := table
+	noTTL.TimeToLive = ""
+	if err := db.NewRepository(client, noTTL, leases).Put(ctx, lease{ID: "c"}); err == nil {
+		t.Error("Put of an expiring entity into a table without time to live succeeded")
+	}
+}
+
+func TestRepositoryUpdate(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, notes)
+	keys := db.Keys{"owner": "ann", "id": "1"}
+
+	if err := repo.Update(ctx, keys, map[string]interface{}{"title": "ghost"}); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Update of a missing item = %v, want ErrNotFound", err)
+	}
+	if _, err := repo.Get(ctx, keys); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("Update of a missing item created it: %v", err)
+	}
+
+	if err := repo.Put(ctx, note{Owner: "ann", ID: "1", Title: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Update(ctx, keys, map[string]interface{}{"title": "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	onlyIf := expression.Name("title").Equal(expression.Value("first"))
+	if err := repo.Update(ctx, keys, map[string]interface{}{"title": "third"}, onlyIf); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Update with a failing condition = %v, want ErrNotFound", err)
+	}
+
+	got, err := repo.Get(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "second" {
+		t.Errorf("title = %q, want second", got.Title)
+	}
+
+	for _, attr := range []string{"pk", "sk", "isActive", db.TypeAttribute, "expiresAt"} {
+		if err := repo.Update(ctx, keys, map[string]interface{}{attr: "x"}); !errors.Is(err, db.ErrKeyAttribute) {
+			t.Errorf("Update of %s = %v, want ErrKeyAttribute", attr, err)
+		}
+	}
+}
+
+func TestRepositoryUpdateSkipsExpiredItems(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, leases)
+
+	now := time.Unix(1_700_000_000, 0)
+	fakeNow(t, now)
+
+	if err := repo.Put(ctx, lease{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Put(ctx, lease{ID: "b"}, db.ExpiresAt(now.Add(3*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	// lease a expired but is still stored, as DynamoDB has not deleted it yet
+	fakeNow(t, now.Add(2*time.Hour))
+
+	changes := map[string]interface{}{"holder": "worker-1"}
+	if err := repo.Update(ctx, db.Keys{"id": "a"}, changes); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Update of an expired item = %v, want ErrNotFound", err)
+	}
+	if err := repo.Update(ctx, db.Keys{"id": "b"}, changes); err != nil {
+		t.Errorf("Update of a live item = %v", err)
+	}
+
+	for id, ok := range map[string]bool{"a": false, "b": true} {
+		tx := db.NewTransaction(client)
+		if err := repo.UpdateTx(tx, db.Keys{"id": id}, changes); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(ctx); ok && err != nil {
+			t.Errorf("UpdateTx of lease %s = %v", id, err)
+		} else if !ok && !db.ConditionFailedAt(err, 0) {
+			t.Errorf("UpdateTx of lease %s = %v, want its condition failing", id, err)
+		}
+	}
+}
+
+func TestRepositoryUpsert(t *testing.T) {
+	ctx := context.Background()
+	client, table := newTable(t)
+	repo := db.NewRepository(client, table, notes)
+	keys := db.Keys{"owner": "ann", "id": "1"}
+
+	if err := repo.Upsert(ctx, keys, map[string]interface{}{"title": "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.Get(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (note{Owner: "ann", ID: "1", Title: "new"}); got != want {
+		t.Errorf("Get after Upsert = %+v, want %+v", got, want)
+	}
+}
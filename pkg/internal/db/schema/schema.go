@@ -0,0 +1,602 @@
+// Package schema loads table definitions & reconciles them with live DynamoDB tables.
+//
+// Definitions use the `aws dynamodb create-table --cli-input-json` format, plus the
+// TimeToLiveSpecification of `aws dynamodb update-time-to-live`, which DynamoDB only accepts
+// once the table exists. Only changes DynamoDB can make online are applied: adding & removing
+// global secondary indexes, enabling or disabling the stream & time to live. Key schema or
+// attribute type changes are reported as incompatible.
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// LocalDefinition is the path of the main table definition in the environments files
+const LocalDefinition = "local/devtable.json"
+
+// waitTimeout bounds how long Create & Apply wait for a table or index to become active
+const waitTimeout = 10 * time.Minute
+
+// PollInterval is how often table & index status is checked while waiting
+var PollInterval = 2 * time.Second
+
+// API is the part of the DynamoDB client used to manage tables.
+// It is satisfied by *dynamodb.Client & by the in-memory engine in the memory package.
+type API interface {
+	CreateTable(ctx context.Context, input *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	DescribeTable(ctx context.Context, input *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	UpdateTable(ctx context.Context, input *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, input *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLive(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+// Definition is a table definition: the CreateTable input & the settings applied once the table exists
+type Definition struct {
+	dynamodb.CreateTableInput
+
+	// TimeToLiveSpecification names the epoch seconds attribute DynamoDB expires items by
+	TimeToLiveSpecification *types.TimeToLiveSpecification `json:",omitempty"`
+}
+
+// TimeToLiveAttribute returns the attribute items expire by, or "" when time to live is disabled
+func (d *Definition) TimeToLiveAttribute() string {
+	return ttlAttribute(d.TimeToLiveSpecification)
+}
+
+// KeyAttributes returns the partition & sort key attributes of the table
+func (d *Definition) KeyAttributes() (partition, sort string) {
+	return keyNames(d.KeySchema)
+}
+
+// IndexKeyAttributes returns the key attributes of the global secondary indexes that are not keys of the table
+func (d *Definition) IndexKeyAttributes() []string {
+	pk, sk := d.KeyAttributes()
+	seen := map[string]bool{pk: true, sk: true, "": true}
+
+	var attrs []string
+	for _, gsi := range d.GlobalSecondaryIndexes {
+		hash, rng := keyNames(gsi.KeySchema)
+		for _, attr := range []string{hash, rng} {
+			if !seen[attr] {
+				seen[attr] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+
+	return attrs
+}
+
+// Table is the live state of a table
+type Table struct {
+	*types.TableDescription
+
+	TimeToLive *types.TimeToLiveDescription `json:"TimeToLiveDescription,omitempty"`
+}
+
+// Load reads a table definition from fsys
+func Load(fsys fs.FS, path string) (*Definition, error) {
+	b, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("schema: reading %s: %w", path, err)
+	}
+
+	def, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("schema: %s: %w", path, err)
+	}
+
+	return def, nil
+}
+
+// MustLoad is like Load but panics on error, for definitions embedded in the binary
+func MustLoad(fsys fs.FS, path string) *Definition {
+	def, err := Load(fsys, path)
+	if err != nil {
+		panic(err)
+	}
+
+	return def
+}
+
+// Parse decodes & validates a table definition
+func Parse(b []byte) (*Definition, error) {
+	def := &Definition{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(def); err != nil {
+		return nil, fmt.Errorf("invalid table definition: %w", err)
+	}
+
+	if aws.ToString(def.TableName) == "" {
+		return nil, errors.New("invalid table definition: TableName is required")
+	}
+
+	defined := attributeTypes(def.AttributeDefinitions)
+	check := func(owner string, schema []types.KeySchemaElement) error {
+		if hash, _ := keyNames(schema); hash == "" {
+			return fmt.Errorf("invalid table definition: %s has no HASH key", owner)
+		}
+		for _, k := range schema {
+			if _, ok := defined[aws.ToString(k.AttributeName)]; !ok {
+				return fmt.Errorf("invalid table definition: %s key %s is not in AttributeDefinitions", owner, aws.ToString(k.AttributeName))
+			}
+		}
+		return nil
+	}
+
+	if err := check("table", def.KeySchema); err != nil {
+		return nil, err
+	}
+	for _, gsi := range def.GlobalSecondaryIndexes {
+		if err := check("index "+aws.ToString(gsi.IndexName), gsi.KeySchema); err != nil {
+			return nil, err
+		}
+	}
+
+	if ttl := def.TimeToLiveSpecification; ttl != nil && aws.ToBool(ttl.Enabled) && aws.ToString(ttl.AttributeName) == "" {
+		return nil, errors.New("invalid table definition: TimeToLiveSpecification has no AttributeName")
+	}
+
+	return def, nil
+}
+
+// Describe returns the live table, or nil when it does not exist
+func Describe(ctx context.Context, api API, name string) (*Table, error) {
+	desc, err := describeTable(ctx, api, name)
+	if err != nil || desc == nil {
+		return nil, err
+	}
+
+	ttl, err := api.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(name)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe time to live of table %s: %w", name, err)
+	}
+
+	return &Table{TableDescription: desc, TimeToLive: ttl.TimeToLiveDescription}, nil
+}
+
+func describeTable(ctx context.Context, api API, name string) (*types.TableDescription, error) {
+	out, err := api.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %w", name, err)
+	}
+
+	return out.Table, nil
+}
+
+// Create creates the table, waits until it is active & enables time to live
+func Create(ctx context.Context, api API, def *Definition) (*types.TableDescription, error) {
+	if _, err := api.CreateTable(ctx, &def.CreateTableInput); err != nil {
+		return nil, fmt.Errorf("failed to create table %s: %w", aws.ToString(def.TableName), err)
+	}
+
+	desc, err := waitFor(ctx, api, aws.ToString(def.TableName), func(t *types.TableDescription) bool {
+		return t.TableStatus == types.TableStatusActive
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if attr := def.TimeToLiveAttribute(); attr != "" {
+		if err := updateTimeToLive(ctx, api, aws.ToString(def.TableName), attr, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return desc, nil
+}
+
+func updateTimeToLive(ctx context.Context, api API, table, attr string, enabled bool) error {
+	_, err := api.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(attr),
+			Enabled:       aws.Bool(enabled),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update time to live of table %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// ChangeKind classifies a difference between a definition & the live table
+type ChangeKind string
+
+const (
+	AddIndex      ChangeKind = "add index"
+	RemoveIndex   ChangeKind = "remove index"
+	EnableStream  ChangeKind = "enable stream"
+	DisableStream ChangeKind = "disable stream"
+	EnableTTL     ChangeKind = "enable time to live"
+	DisableTTL    ChangeKind = "disable time to live"
+	Incompatible  ChangeKind = "incompatible"
+)
+
+// Change is a single difference between a definition & the live table
+type Change struct {
+	Kind   ChangeKind
+	Index  string
+	Detail string
+
+	gsi     types.GlobalSecondaryIndex
+	attrs   []types.AttributeDefinition
+	stream  *types.StreamSpecification
+	ttlAttr string
+}
+
+func (c Change) String() string {
+	s := string(c.Kind)
+	if c.Index != "" {
+		s += " " + c.Index
+	}
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+
+	return s
+}
+
+// Plan is the set of changes needed to bring a table in line with its definition
+type Plan struct {
+	Table   string
+	Create  *Definition // set when the table does not exist yet
+	Changes []Change
+}
+
+// Empty reports whether the table already matches its definition
+func (p Plan) Empty() bool {
+	return p.Create == nil && len(p.Changes) == 0
+}
+
+// Incompatible returns the changes that cannot be applied to a live table
+func (p Plan) Incompatible() []Change {
+	var out []Change
+	for _, c := range p.Changes {
+		if c.Kind == Incompatible {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+func (p Plan) String() string {
+	switch {
+	case p.Create != nil:
+		return fmt.Sprintf("table %s does not exist and will be created", p.Table)
+	case len(p.Changes) == 0:
+		return fmt.Sprintf("table %s is up to date", p.Table)
+	}
+
+	lines := []string{fmt.Sprintf("table %s differs from its definition:", p.Table)}
+	for _, c := range p.Changes {
+		lines = append(lines, "  "+c.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Diff compares a definition with the live table; have is nil when the table does not exist
+func Diff(want *Definition, have *Table) Plan {
+	plan := Plan{Table: aws.ToString(want.TableName)}
+	if have == nil {
+		plan.Create = want
+		return plan
+	}
+
+	wantTypes := attributeTypes(want.AttributeDefinitions)
+	haveTypes := attributeTypes(have.AttributeDefinitions)
+
+	if !sameKeys(want.KeySchema, have.KeySchema) {
+		plan.Changes = append(plan.Changes, Change{
+			Kind:   Incompatible,
+			Detail: fmt.Sprintf("table key schema is %s, definition has %s; the table must be recreated", formatKeys(have.KeySchema), formatKeys(want.KeySchema)),
+		})
+	}
+
+	for _, name := range sortedKeys(wantTypes) {
+		if t, ok := haveTypes[name]; ok && t != wantTypes[name] {
+			plan.Changes = append(plan.Changes, Change{
+				Kind:   Incompatible,
+				Detail: fmt.Sprintf("attribute %s is %s, definition has %s", name, t, wantTypes[name]),
+			})
+		}
+	}
+
+	live := map[string]types.GlobalSecondaryIndexDescription{}
+	for _, gsi := range have.GlobalSecondaryIndexes {
+		live[aws.ToString(gsi.IndexName)] = gsi
+	}
+
+	for _, gsi := range want.GlobalSecondaryIndexes {
+		name := aws.ToString(gsi.IndexName)
+
+		existing, ok := live[name]
+		if !ok {
+			var attrs []types.AttributeDefinition
+			for _, k := range gsi.KeySchema {
+				attr := aws.ToString(k.AttributeName)
+				attrs = append(attrs, types.AttributeDefinition{AttributeName: aws.String(attr), AttributeType: wantTypes[attr]})
+			}
+
+			plan.Changes = append(plan.Changes, Change{
+				Kind:   AddIndex,
+				Index:  name,
+				Detail: fmt.Sprintf("%s, projection %s", formatKeys(gsi.KeySchema), formatProjection(gsi.Projection)),
+				gsi:    gsi,
+				attrs:  attrs,
+			})
+			continue
+		}
+
+		delete(live, name)
+
+		if !sameKeys(gsi.KeySchema, existing.KeySchema) || formatProjection(gsi.Projection) != formatProjection(existing.Projection) {
+			plan.Changes = append(plan.Changes, Change{
+				Kind:  Incompatible,
+				Index: name,
+				Detail: fmt.Sprintf("live index is %s, projection %s; definition has %s, projection %s; remove the index first, then add it again",
+					formatKeys(existing.KeySchema), formatProjection(existing.Projection), formatKeys(gsi.KeySchema), formatProjection(gsi.Projection)),
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(live) {
+		plan.Changes = append(plan.Changes, Change{
+			Kind:   RemoveIndex,
+			Index:  name,
+			Detail: "not in the definition",
+		})
+	}
+
+	if c, ok := diffStream(want.StreamSpecification, have.StreamSpecification); ok {
+		plan.Changes = append(plan.Changes, c)
+	}
+
+	if c, ok := diffTimeToLive(want.TimeToLiveAttribute(), have.TimeToLive); ok {
+		plan.Changes = append(plan.Changes, c)
+	}
+
+	return plan
+}
+
+// diffTimeToLive compares the expiry attributes; DynamoDB cannot rename it while time to live is enabled
+func diffTimeToLive(want string, have *types.TimeToLiveDescription) (Change, bool) {
+	var live string
+	if have != nil && (have.TimeToLiveStatus == types.TimeToLiveStatusEnabled || have.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		live = aws.ToString(have.AttributeName)
+	}
+
+	switch {
+	case want == live:
+		return Change{}, false
+	case live == "":
+		return Change{Kind: EnableTTL, Detail: "on " + want, ttlAttr: want}, true
+	case want == "":
+		return Change{Kind: DisableTTL, Detail: "not in the definition", ttlAttr: live}, true
+	}
+
+	return Change{
+		Kind:   Incompatible,
+		Detail: fmt.Sprintf("time to live is on %s, definition has %s; disable time to live first", live, want),
+	}, true
+}
+
+// diffStream compares the stream settings; a view type cannot change while the stream is enabled
+func diffStream(want, have *types.StreamSpecification) (Change, bool) {
+	wantView, haveView := streamView(want), streamView(have)
+
+	switch {
+	case wantView == haveView:
+		return Change{}, false
+	case haveView == "":
+		return Change{Kind: EnableStream, Detail: wantView, stream: want}, true
+	case wantView == "":
+		return Change{
+			Kind:   DisableStream,
+			Detail: "not in the definition",
+			stream: &types.StreamSpecification{StreamEnabled: aws.Bool(false)},
+		}, true
+	}
+
+	return Change{
+		Kind:   Incompatible,
+		Detail: fmt.Sprintf("stream view type is %s, definition has %s; disable the stream first", haveView, wantView),
+	}, true
+}
+
+// streamView returns the view type of an enabled stream, or "" when there is none
+func streamView(s *types.StreamSpecification) string {
+	if s == nil || !aws.ToBool(s.StreamEnabled) {
+		return ""
+	}
+
+	return string(s.StreamViewType)
+}
+
+// Apply creates the table or adds its missing indexes, one at a time as DynamoDB requires.
+// Indexes & streams missing from the definition are only removed when prune is set.
+func Apply(ctx context.Context, api API, plan Plan, prune bool) error {
+	if plan.Create != nil {
+		_, err := Create(ctx, api, plan.Create)
+		return err
+	}
+
+	if bad := plan.Incompatible(); len(bad) > 0 {
+		problems := make([]string, len(bad))
+		for i, c := range bad {
+			problems[i] = c.String()
+		}
+		return fmt.Errorf("table %s cannot be updated in place: %s", plan.Table, strings.Join(problems, "; "))
+	}
+
+	for _, c := range plan.Changes {
+		// time to live has its own API & takes effect without the table changing status
+		if c.Kind == EnableTTL || c.Kind == DisableTTL && prune {
+			if err := updateTimeToLive(ctx, api, plan.Table, c.ttlAttr, c.Kind == EnableTTL); err != nil {
+				return err
+			}
+			continue
+		}
+
+		input := &dynamodb.UpdateTableInput{TableName: aws.String(plan.Table)}
+
+		switch {
+		case c.Kind == AddIndex:
+			input.AttributeDefinitions = c.attrs
+			input.GlobalSecondaryIndexUpdates = []types.GlobalSecondaryIndexUpdate{{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:             c.gsi.IndexName,
+					KeySchema:             c.gsi.KeySchema,
+					Projection:            c.gsi.Projection,
+					ProvisionedThroughput: c.gsi.ProvisionedThroughput,
+				},
+			}}
+		case c.Kind == RemoveIndex && prune:
+			input.GlobalSecondaryIndexUpdates = []types.GlobalSecondaryIndexUpdate{{
+				Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: aws.String(c.Index)},
+			}}
+		case c.Kind == EnableStream, c.Kind == DisableStream && prune:
+			input.StreamSpecification = c.stream
+		default:
+			continue
+		}
+
+		if _, err := api.UpdateTable(ctx, input); err != nil {
+			return fmt.Errorf("failed to %s: %w", c, err)
+		}
+
+		_, err := waitFor(ctx, api, plan.Table, func(t *types.TableDescription) bool {
+			if c.Index == "" {
+				return t.TableStatus == types.TableStatusActive
+			}
+
+			for _, gsi := range t.GlobalSecondaryIndexes {
+				if aws.ToString(gsi.IndexName) == c.Index {
+					return c.Kind == AddIndex && gsi.IndexStatus == types.IndexStatusActive && !aws.ToBool(gsi.Backfilling)
+				}
+			}
+			return c.Kind == RemoveIndex
+		})
+		if err != nil {
+			return fmt.Errorf("waiting to %s: %w", c, err)
+		}
+	}
+
+	return nil
+}
+
+// waitFor polls the table until ready reports true
+func waitFor(ctx context.Context, api API, name string, ready func(t *types.TableDescription) bool) (*types.TableDescription, error) {
+	ctx, cancel := context.WithTimeout(ctx, waitTimeout)
+	defer cancel()
+
+	for {
+		t, err := describeTable(ctx, api, name)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil && ready(t) {
+			return t, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("table %s: %w", name, ctx.Err())
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+func attributeTypes(defs []types.AttributeDefinition) map[string]types.ScalarAttributeType {
+	out := make(map[string]types.ScalarAttributeType, len(defs))
+	for _, ad := range defs {
+		out[aws.ToString(ad.AttributeName)] = ad.AttributeType
+	}
+
+	return out
+}
+
+func keyNames(schema []types.KeySchemaElement) (hash, rng string) {
+	for _, k := range schema {
+		switch k.KeyType {
+		case types.KeyTypeHash:
+			hash = aws.ToString(k.AttributeName)
+		case types.KeyTypeRange:
+			rng = aws.ToString(k.AttributeName)
+		}
+	}
+
+	return hash, rng
+}
+
+func sameKeys(a, b []types.KeySchemaElement) bool {
+	ah, ar := keyNames(a)
+	bh, br := keyNames(b)
+	return ah == bh && ar == br
+}
+
+// formatKeys renders a key schema as e.g. `(pk, sk)` or `(pk)`
+func formatKeys(schema []types.KeySchemaElement) string {
+	hash, rng := keyNames(schema)
+	if rng == "" {
+		return "(" + hash + ")"
+	}
+
+	return "(" + hash + ", " + rng + ")"
+}
+
+// formatProjection renders a projection as e.g. `ALL` or `INCLUDE [email name]`
+func formatProjection(p *types.Projection) string {
+	if p == nil || p.ProjectionType == "" {
+		return string(types.ProjectionTypeKeysOnly)
+	}
+	if len(p.NonKeyAttributes) == 0 {
+		return string(p.ProjectionType)
+	}
+
+	attrs := append([]string(nil), p.NonKeyAttributes...)
+	sort.Strings(attrs)
+
+	return fmt.Sprintf("%s %v", p.ProjectionType, attrs)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ttlAttribute returns the attribute of an enabled time to live specification, or ""
+func ttlAttribute(s *types.TimeToLiveSpecification) string {
+	if s == nil || !aws.ToBool(s.Enabled) {
+		return ""
+	}
+
+	return aws.ToString(s.AttributeName)
+}
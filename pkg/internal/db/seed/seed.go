@@ -0,0 +1,517 @@
+// Package seed loads fixture files into the table, for local development & tests.
+//
+// A fixture file holds named fixtures of one entity type, in YAML or JSON:
+//
+//	entity: USER
+//	fixtures:
+//	  alice:
+//	    name: Alice
+//	    email: alice@example.com
+//	    password: password123
+//	  bob:
+//	    name: Bob
+//	    invitedBy: ${users.alice.id}
+//
+// Fixtures are addressed as `<file name>.<fixture name>`, so `${users.alice.id}` is the id of alice
+// in users.yaml. A value that is a single reference keeps the referenced type; references inside
+// longer strings are interpolated. Missing ids are derived from the fixture address, so seeding
+// the same files twice writes the same items.
+package seed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// maxBatchWrite is the number of items DynamoDB accepts in one BatchWriteItem request
+const maxBatchWrite = 25
+
+// namespace derives stable fixture ids
+var namespace = uuid.MustParse("3f1c8a9e-6d0b-4c57-9a8e-2b7d54f1c0aa")
+
+var referenceRegex = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Options configures how fixtures of one entity become items
+type Options struct {
+	IDField  string                                     // generated from the fixture address when missing
+	Hashed   []string                                   // fields whose plaintext values are hashed by Hasher
+	Hasher   Hasher                                     // required with Hashed
+	Defaults func(now time.Time) map[string]interface{} // values for fields a fixture leaves out
+	// Derived returns items written alongside each fixture, e.g. uniqueness claims, from its resolved fields
+	Derived func(fields map[string]interface{}) ([]Derived, error)
+}
+
+// Hasher hashes secrets such as passwords, e.g. an *auth.PasswordHasher
+type Hasher interface {
+	Hash(plain string) (string, error)
+}
+
+// Derived is an item of another kind written alongside a fixture
+type Derived struct {
+	Kind   Kind
+	Fields map[string]interface{}
+}
+
+// Kind turns fixtures of one entity type into items
+type Kind interface {
+	Type() string
+	options() Options
+	marshal(fields map[string]interface{}, table db.Table) (map[string]types.AttributeValue, error)
+}
+
+type kind[T any] struct {
+	entity *db.Entity[T]
+	opts   Options
+}
+
+// Entity makes entity seedable from fixtures
+func Entity[T any](entity *db.Entity[T], opts Options) Kind {
+	return &kind[T]{entity: entity, opts: opts}
+}
+
+func (k *kind[T]) Type() string {
+	return k.entity.Type()
+}
+
+func (k *kind[T]) options() Options {
+	return k.opts
+}
+
+// marshal decodes fields into T through its json tags, then renders it like the repository does
+func (k *kind[T]) marshal(fields map[string]interface{}, table db.Table) (map[string]types.AttributeValue, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var item T
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&item); err != nil {
+		return nil, err
+	}
+
+	return db.NewRepository[T](nil, table, k.entity).Marshal(item)
+}
+
+// File is a parsed fixture file
+type File struct {
+	Name     string                            `json:"-" yaml:"-"` // the file name without extension
+	Entity   string                            `json:"entity" yaml:"entity"`
+	Fixtures map[string]map[string]interface{} `json:"fixtures" yaml:"fixtures"`
+}
+
+// Parse decodes a fixture file, as YAML unless name ends in .json
+func Parse(name string, data []byte) (File, error) {
+	var f File
+
+	var err error
+	if path.Ext(name) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("seed: parsing %s: %w", name, err)
+	}
+
+	f.Name = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	if f.Entity == "" {
+		return File{}, fmt.Errorf("seed: %s has no entity", name)
+	}
+
+	return f, nil
+}
+
+// ReadFS parses every file of fsys matching the glob patterns
+func ReadFS(fsys fs.FS, patterns ...string) ([]File, error) {
+	var files []File
+
+	for _, pattern := range patterns {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("seed: %w", err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("seed: no fixture files match %s", pattern)
+		}
+
+		for _, name := range names {
+			b, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, fmt.Errorf("seed: %w", err)
+			}
+
+			f, err := Parse(name, b)
+			if err != nil {
+				return nil, err
+			}
+
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+// Seeder writes fixtures into a table
+type Seeder struct {
+	db    db.Client
+	table db.Table
+	kinds map[string]Kind
+	now   func() time.Time
+}
+
+// New creates a Seeder for the given entity kinds
+func New(database db.Client, table db.Table, kinds ...Kind) *Seeder {
+	s := &Seeder{
+		db:    database,
+		table: table,
+		kinds: map[string]Kind{},
+		now:   time.Now,
+	}
+
+	for _, k := range kinds {
+		s.kinds[k.Type()] = k
+	}
+
+	return s
+}
+
+// Result describes what Seed wrote
+type Result struct {
+	Items      int
+	Partitions []string
+	fixtures   map[string]*fixture
+}
+
+// Fixture returns the resolved fields of a fixture by address, e.g. "users.alice"
+func (r *Result) Fixture(ref string) map[string]interface{} {
+	if f, ok := r.fixtures[ref]; ok {
+		return f.fields
+	}
+
+	return nil
+}
+
+// fixture is a single fixture while it is being resolved
+type fixture struct {
+	ref      string
+	kind     Kind
+	fields   map[string]interface{}
+	resolved bool
+	visiting bool
+}
+
+// Seed writes every fixture of files. With reset, the partitions the fixtures live in
+// are emptied first, so they end up holding exactly the fixtures.
+func (s *Seeder) Seed(ctx context.Context, files []File, reset bool) (*Result, error) {
+	fixtures, err := s.collect(files)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]string, 0, len(fixtures))
+	for ref := range fixtures {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	hashes := map[string]string{} // plaintext to hash, so each password is only hashed once
+	seen := map[string]string{}   // rendered key to fixture address
+	partitions := map[string]bool{}
+	var items []map[string]types.AttributeValue
+
+	for _, ref := range refs {
+		f := fixtures[ref]
+		if err := resolve(f, fixtures, nil); err != nil {
+			return nil, err
+		}
+
+		if err := hashFields(f, hashes); err != nil {
+			return nil, err
+		}
+
+		av, err := f.kind.marshal(f.fields, s.table)
+		if err != nil {
+			return nil, fmt.Errorf("seed: %s: %w", ref, err)
+		}
+		fixtureItems := []map[string]types.AttributeValue{av}
+
+		if derive := f.kind.options().Derived; derive != nil {
+			derived, err := derive(f.fields)
+			if err != nil {
+				return nil, fmt.Errorf("seed: %s: %w", ref, err)
+			}
+
+			for _, d := range derived {
+				dav, err := d.Kind.marshal(d.Fields, s.table)
+				if err != nil {
+					return nil, fmt.Errorf("seed: %s: %s: %w", ref, d.Kind.Type(), err)
+				}
+				fixtureItems = append(fixtureItems, dav)
+			}
+		}
+
+		for _, av := range fixtureItems {
+			pk, sk := stringValue(av[s.table.PartitionKey]), stringValue(av[s.table.SortKey])
+			if other, ok := seen[pk+"\x00"+sk]; ok {
+				return nil, fmt.Errorf("seed: %s & %s have the same key (%s, %s)", other, ref, pk, sk)
+			}
+			seen[pk+"\x00"+sk] = ref
+
+			partitions[pk] = true
+			items = append(items, av)
+		}
+	}
+
+	result := &Result{Items: len(items), fixtures: fixtures}
+	for pk := range partitions {
+		result.Partitions = append(result.Partitions, pk)
+	}
+	sort.Strings(result.Partitions)
+
+	if reset {
+		if _, err := s.Reset(ctx, result.Partitions...); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < len(items); i += maxBatchWrite {
+		end := i + maxBatchWrite
+		if end > len(items) {
+			end = len(items)
+		}
+
+		if err := s.db.BatchWriteItems(ctx, s.table.Name, items[i:end]); err != nil {
+			return nil, fmt.Errorf("seed: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Reset deletes every item of the given partitions, returning how many were deleted
+func (s *Seeder) Reset(ctx context.Context, partitions ...string) (int, error) {
+	deleted := 0
+
+	for _, pk := range partitions {
+		keyCond := expression.Key(s.table.PartitionKey).Equal(expression.Value(pk))
+		expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+		if err != nil {
+			return deleted, err
+		}
+
+		items, err := s.db.QueryItems(ctx, s.table.Name, expr.KeyCondition(), expr.Names(), expr.Values())
+		if err != nil {
+			return deleted, fmt.Errorf("seed: resetting %s: %w", pk, err)
+		}
+
+		for _, item := range items {
+			key := map[string]types.AttributeValue{
+				s.table.PartitionKey: item[s.table.PartitionKey],
+				s.table.SortKey:      item[s.table.SortKey],
+			}
+
+			if err := s.db.DeleteItem(ctx, s.table.Name, key); err != nil {
+				return deleted, fmt.Errorf("seed: resetting %s: %w", pk, err)
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// collect indexes the fixtures by address & fills in defaults & ids
+func (s *Seeder) collect(files []File) (map[string]*fixture, error) {
+	fixtures := map[string]*fixture{}
+	now := s.now()
+
+	for _, file := range files {
+		k, ok := s.kinds[file.Entity]
+		if !ok {
+			return nil, fmt.Errorf("seed: %s: unknown entity %q", file.Name, file.Entity)
+		}
+
+		opts := k.options()
+
+		for name, raw := range file.Fixtures {
+			ref := file.Name + "." + name
+			if _, ok := fixtures[ref]; ok {
+				return nil, fmt.Errorf("seed: fixture %s is defined twice", ref)
+			}
+
+			fields := map[string]interface{}{}
+			if opts.Defaults != nil {
+				for field, v := range opts.Defaults(now) {
+					fields[field] = v
+				}
+			}
+			for field, v := range raw {
+				fields[field] = v
+			}
+
+			if opts.IDField != "" {
+				if id, _ := fields[opts.IDField].(string); id == "" {
+					fields[opts.IDField] = uuid.NewSHA1(namespace, []byte(file.Entity+"/"+ref)).String()
+				}
+			}
+
+			fixtures[ref] = &fixture{ref: ref, kind: k, fields: fields}
+		}
+	}
+
+	return fixtures, nil
+}
+
+// resolve replaces the references in f, resolving the fixtures it refers to first
+func resolve(f *fixture, fixtures map[string]*fixture, path []string) error {
+	if f.resolved {
+		return nil
+	}
+
+	path = append(path, f.ref)
+	if f.visiting {
+		return fmt.Errorf("seed: reference cycle %s", strings.Join(path, " -> "))
+	}
+	f.visiting = true
+
+	var err error
+	var substitute func(v interface{}) interface{}
+	substitute = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			if m := referenceRegex.FindStringSubmatch(v); m != nil && m[0] == v {
+				target, e := lookup(m[1], fixtures, path)
+				if e != nil && err == nil {
+					err = e
+				}
+				return target
+			}
+
+			return referenceRegex.ReplaceAllStringFunc(v, func(ref string) string {
+				target, e := lookup(ref[2:len(ref)-1], fixtures, path)
+				if e != nil && err == nil {
+					err = e
+				}
+				return fmt.Sprint(target)
+			})
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(v))
+			for k, e := range v {
+				out[k] = substitute(e)
+			}
+			return out
+		case []interface{}:
+			out := make([]interface{}, len(v))
+			for i, e := range v {
+				out[i] = substitute(e)
+			}
+			return out
+		}
+
+		return v
+	}
+
+	for k, v := range f.fields {
+		f.fields[k] = substitute(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.visiting = false
+	f.resolved = true
+
+	return nil
+}
+
+// lookup returns the value a reference such as `users.alice.id` points at
+func lookup(reference string, fixtures map[string]*fixture, path []string) (interface{}, error) {
+	from := path[len(path)-1]
+	parts := strings.Split(reference, ".")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("seed: %s: invalid reference ${%s}, expected ${file.fixture.field}", from, reference)
+	}
+
+	target, ok := fixtures[parts[0]+"."+parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("seed: %s: reference ${%s} to unknown fixture %s.%s", from, reference, parts[0], parts[1])
+	}
+
+	if err := resolve(target, fixtures, path); err != nil {
+		return nil, err
+	}
+
+	var v interface{} = target.fields
+	for _, field := range parts[2:] {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("seed: %s: reference ${%s} does not point at a field", from, reference)
+		}
+		if v, ok = m[field]; !ok {
+			return nil, fmt.Errorf("seed: %s: reference ${%s}: %s has no field %s", from, reference, target.ref, field)
+		}
+	}
+
+	return v, nil
+}
+
+// hashFields hashes plaintext values of the kind's hashed fields with its Hasher, so seeded users log in
+// like any other. Values starting with `$` already are hashes, e.g. PHC strings, & are kept.
+func hashFields(f *fixture, hashes map[string]string) error {
+	opts := f.kind.options()
+
+	for _, field := range opts.Hashed {
+		plain, ok := f.fields[field].(string)
+		if !ok || plain == "" || strings.HasPrefix(plain, "$") {
+			continue
+		}
+
+		if opts.Hasher == nil {
+			return fmt.Errorf("seed: %s: no hasher for %s", f.ref, field)
+		}
+
+		hash, ok := hashes[plain]
+		if !ok {
+			var err error
+			if hash, err = opts.Hasher.Hash(plain); err != nil {
+				return fmt.Errorf("seed: %s: hashing %s: %w", f.ref, field, err)
+			}
+
+			hashes[plain] = hash
+		}
+
+		f.fields[field] = hash
+	}
+
+	return nil
+}
+
+func stringValue(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+
+	return ""
+}
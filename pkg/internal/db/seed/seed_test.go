@@ -0,0 +1,83 @@
+package seed_test
+
+import (
+	"context"
+	"testing"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	"serverless-aws-cdk/internal/db/seed"
+	testTable "serverless-aws-cdk/internal/db/tables"
+)
+
+type account struct {
+	ID     string `json:"id" dynamodbav:"sk"`
+	Secret string `json:"secret" dynamodbav:"secret"`
+}
+
+var accounts = db.RegisterEntity[account](db.EntityOptions{Type: "TEST_ACCOUNT", PartitionKey: "ACCOUNTS", SortKey: "{id}"})
+
+// reverser stands in for a password hasher, counting its calls
+type reverser struct{ calls int }
+
+func (r *reverser) Hash(plain string) (string, error) {
+	r.calls++
+
+	b := []byte(plain)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return "$rev$" + string(b), nil
+}
+
+func seedAccounts(t *testing.T, opts seed.Options) (*seed.Result, error) {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := seed.Parse("accounts.yaml", []byte(`
+entity: TEST_ACCOUNT
+fixtures:
+  ann: {secret: abc}
+  bob: {secret: abc}
+  cid: {secret: $kept$hash}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := db.New(engine)
+	opts.IDField, opts.Hashed = "id", []string{"secret"}
+
+	return seed.New(database, testTable.New(database, "test").Schema(), seed.Entity(accounts, opts)).
+		Seed(context.Background(), []seed.File{file}, false)
+}
+
+func TestSeedHashesWithHasher(t *testing.T) {
+	hasher := &reverser{}
+
+	result, err := seedAccounts(t, seed.Options{Hasher: hasher})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, want := range map[string]string{"accounts.ann": "$rev$cba", "accounts.bob": "$rev$cba", "accounts.cid": "$kept$hash"} {
+		if got := result.Fixture(ref)["secret"]; got != want {
+			t.Errorf("%s secret = %v, want %s", ref, got, want)
+		}
+	}
+
+	if hasher.calls != 1 {
+		t.Errorf("hashed %d times, want once per distinct plaintext", hasher.calls)
+	}
+}
+
+func TestSeedRequiresHasher(t *testing.T) {
+	if _, err := seedAccounts(t, seed.Options{}); err == nil {
+		t.Fatal("seeding hashed fields without a hasher succeeded")
+	}
+}
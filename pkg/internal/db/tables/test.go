@@ -3,22 +3,70 @@ package testTable
 import (
 	"context"
 	"fmt"
+	"serverless-aws-cdk/environments"
 	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/schema"
 	"sync"
 
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-var database = db.NewDB()
+// Table gives access to the table through an injected client
+type Table struct {
+	database db.Client
+	name     string
+	schema   db.Table
+}
+
+// New creates a Table named name backed by the given client, with the keys of the local table definition
+func New(database db.Client, name string) *Table {
+	def := Definition(name)
+	pk, sk := def.KeyAttributes()
+
+	return &Table{
+		database: database,
+		name:     name,
+		schema: db.Table{
+			Name:         name,
+			PartitionKey: pk,
+			SortKey:      sk,
+			IndexKeys:    def.IndexKeyAttributes(),
+			TimeToLive:   def.TimeToLiveAttribute(),
+		},
+	}
+}
+
+// Schema describes the keys of the table & its indexes for repositories
+func (t *Table) Schema() db.Table {
+	return t.schema
+}
+
+// Definition returns the definition of environments/local/devtable.json under the given table name.
+// It is used to create the table in the in-memory engine.
+func Definition(name string) *schema.Definition {
+	def := schema.MustLoad(environments.Files, schema.LocalDefinition)
+	def.TableName = aws.String(name)
+
+	return def
+}
+
+// Repository returns a typed repository for entity backed by the table
+func Repository[T any](t *Table, entity *db.Entity[T]) *db.Repository[T] {
+	return db.NewRepository(t.database, t.Schema(), entity)
+}
 
-const TABLE_NAME = "ServerlessAWSCDKLocal"
+// Transaction starts a transaction committed through the table's client
+func (t *Table) Transaction() *db.Transaction {
+	return db.NewTransaction(t.database)
+}
 
-func GetItem(pk, sk string) (map[string]*dynamodb.AttributeValue, error) {
+func (t *Table) GetItem(pk, sk string) (map[string]types.AttributeValue, error) {
 	ctx := context.TODO()
 
-	key, err := dynamodbattribute.MarshalMap(map[string]string{
+	key, err := attributevalue.MarshalMap(map[string]string{
 		"pk": pk,
 		"sk": sk,
 	})
@@ -27,24 +75,24 @@ func GetItem(pk, sk string) (map[string]*dynamodb.AttributeValue, error) {
 		return nil, err
 	}
 
-	return database.GetItem(ctx, TABLE_NAME, key)
+	return t.database.GetItem(ctx, t.name, key)
 }
 
-func PutItem(item interface{}) error {
+func (t *Table) PutItem(item interface{}) error {
 	ctx := context.TODO()
 
-	marshalledItem, err := dynamodbattribute.MarshalMap(item)
+	marshalledItem, err := attributevalue.MarshalMap(item)
 	if err != nil {
 		return err
 	}
 
-	return database.PutItem(ctx, TABLE_NAME, marshalledItem)
+	return t.database.PutItem(ctx, t.name, marshalledItem)
 }
 
-func DeleteItem(pk, sk string) error {
+func (t *Table) DeleteItem(pk, sk string) error {
 	ctx := context.TODO()
 
-	key, err := dynamodbattribute.MarshalMap(map[string]string{
+	key, err := attributevalue.MarshalMap(map[string]string{
 		"pk": pk,
 		"sk": sk,
 	})
@@ -53,29 +101,16 @@ func DeleteItem(pk, sk string) error {
 		return err
 	}
 
-	return database.DeleteItem(ctx, TABLE_NAME, key)
+	return t.database.DeleteItem(ctx, t.name, key)
 }
 
-func UpdateItem(pk, sk string, item map[string]interface{}) error {
-	ctx := context.TODO()
-
-	updateItem := expression.UpdateBuilder{}
-
-	for k, v := range item {
-		updateItem = updateItem.Set(expression.Name(k), expression.Value(v))
-	}
-
-	key, _ := dynamodbattribute.MarshalMap(map[string]string{
-		"pk": pk,
-		"sk": sk,
-	})
-
-	expr, _ := expression.NewBuilder().WithUpdate(updateItem).Build()
-
-	return database.UpdateItem(ctx, TABLE_NAME, key, expr.Update(), expr.Names(), expr.Values())
+// UpdateItem sets the top level attributes in item; use Update for other changes
+func (t *Table) UpdateItem(pk, sk string, item map[string]interface{}) error {
+	_, err := t.Update(pk, sk).SetAll(item).Returning(types.ReturnValueNone).Exec(context.TODO())
+	return err
 }
 
-func QueryItems(keys []map[string]interface{}) ([]map[string]*dynamodb.AttributeValue, error) {
+func (t *Table) QueryItems(keys []map[string]interface{}) ([]map[string]types.AttributeValue, error) {
 	ctx := context.TODO()
 
 	if len(keys) == 0 {
@@ -104,20 +139,21 @@ func QueryItems(keys []map[string]interface{}) ([]map[string]*dynamodb.Attribute
 		return nil, err
 	}
 
-	return database.QueryItems(ctx, TABLE_NAME, queryExpr.KeyCondition(), queryExpr.Names(), queryExpr.Values())
+	return t.database.QueryItems(ctx, t.name, queryExpr.KeyCondition(), queryExpr.Names(), queryExpr.Values())
 }
 
-func ScanItems() ([]map[string]*dynamodb.AttributeValue, error) {
+func (t *Table) ScanItems() ([]map[string]types.AttributeValue, error) {
 	ctx := context.TODO()
 
-	return database.ScanItems(ctx, TABLE_NAME)
+	return t.database.ScanItems(ctx, t.name)
 }
 
-func BatchGetItems(keys []interface{}) ([]map[string]*dynamodb.AttributeValue, error) {
+func (t *Table) BatchGetItems(keys []interface{}) ([]map[string]types.AttributeValue, error) {
 	ctx := context.TODO()
 	const maxBatchSize = 100
 
-	var allResults []map[string]*dynamodb.AttributeValue
+	var allResults []map[string]types.AttributeValue
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 	errCh := make(chan error, len(keys))
 
@@ -133,9 +169,9 @@ func BatchGetItems(keys []interface{}) ([]map[string]*dynamodb.AttributeValue, e
 		go func(chunk []interface{}) {
 			defer wg.Done()
 
-			marshalledKeys := make([]map[string]*dynamodb.AttributeValue, len(chunk))
+			marshalledKeys := make([]map[string]types.AttributeValue, len(chunk))
 			for j, key := range chunk {
-				marshalledKey, err := dynamodbattribute.MarshalMap(key)
+				marshalledKey, err := attributevalue.MarshalMap(key)
 				if err != nil {
 					errCh <- err
 					return
@@ -143,13 +179,15 @@ func BatchGetItems(keys []interface{}) ([]map[string]*dynamodb.AttributeValue, e
 				marshalledKeys[j] = marshalledKey
 			}
 
-			resp, err := database.BatchGetItems(ctx, TABLE_NAME, marshalledKeys)
+			resp, err := t.database.BatchGetItems(ctx, t.name, marshalledKeys)
 			if err != nil {
 				errCh <- err
 				return
 			}
 
+			mu.Lock()
 			allResults = append(allResults, resp...) // equivalent to [...allResults, ...resp] in JavaScript
+			mu.Unlock()
 		}(chunk)
 	}
 
@@ -168,7 +206,7 @@ func BatchGetItems(keys []interface{}) ([]map[string]*dynamodb.AttributeValue, e
 	return allResults, finalErr
 }
 
-func BatchWriteItems(requestItems []interface{}) error {
+func (t *Table) BatchWriteItems(requestItems []interface{}) error {
 	ctx := context.TODO()
 
 	const MAX_BATCH_WRITE = 25
@@ -194,9 +232,9 @@ func BatchWriteItems(requestItems []interface{}) error {
 		go func(items []interface{}) {
 			defer wg.Done()
 
-			marshalledItems := make([]map[string]*dynamodb.AttributeValue, len(items))
+			marshalledItems := make([]map[string]types.AttributeValue, len(items))
 			for i, item := range items {
-				marshalledItem, err := dynamodbattribute.MarshalMap(item)
+				marshalledItem, err := attributevalue.MarshalMap(item)
 				if err != nil {
 					errCh <- err
 					return
@@ -205,7 +243,7 @@ func BatchWriteItems(requestItems []interface{}) error {
 				marshalledItems[i] = marshalledItem
 			}
 
-			if err := database.BatchWriteItems(ctx, TABLE_NAME, marshalledItems); err != nil {
+			if err := t.database.BatchWriteItems(ctx, t.name, marshalledItems); err != nil {
 				errCh <- err
 			}
 		}(chunk)
@@ -0,0 +1,262 @@
+package testTable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Update builds a single UpdateItem request on an item of the table.
+//
+// Paths are document paths, so nested attributes & list elements are written as
+// "address.city" or "tags[0]". Actions are collected in the order they are added &
+// sent together by Exec; the first invalid call is reported by Exec.
+type Update struct {
+	table        *Table
+	pk, sk       string
+	update       expression.UpdateBuilder
+	actions      int
+	condition    *expression.ConditionBuilder
+	returnValues types.ReturnValue
+	err          error
+}
+
+// StringSet is a DynamoDB string set, for ADD & DELETE on set attributes
+type StringSet []string
+
+func (s StringSet) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberSS{Value: s}, nil
+}
+
+// NumberSet is a DynamoDB number set, for ADD & DELETE on set attributes
+type NumberSet []float64
+
+func (s NumberSet) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	values := make([]string, len(s))
+	for i, n := range s {
+		values[i] = strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	return &types.AttributeValueMemberNS{Value: values}, nil
+}
+
+// Update starts an update of the item with the given keys.
+// It returns the item as it is after the update (ALL_NEW) unless Returning says otherwise.
+func (t *Table) Update(pk, sk string) *Update {
+	return &Update{
+		table:        t,
+		pk:           pk,
+		sk:           sk,
+		returnValues: types.ReturnValueAllNew,
+	}
+}
+
+// Set sets the attribute at path to value
+func (u *Update) Set(path string, value interface{}) *Update {
+	return u.set(path, expression.Value(value))
+}
+
+// SetAll sets every top level attribute of values
+func (u *Update) SetAll(values map[string]interface{}) *Update {
+	for k, v := range values {
+		u.Set(k, v)
+	}
+
+	return u
+}
+
+// SetIndexKey sets the top level attribute that keys one of the table's indexes, moving the item within
+// that index. Set refuses index keys, so that they only change where the item's place in an index is meant to.
+func (u *Update) SetIndexKey(attr string, value interface{}) *Update {
+	if u.err != nil {
+		return u
+	}
+
+	for _, k := range u.table.schema.IndexKeys {
+		if k == attr {
+			u.update = u.update.Set(expression.Name(attr), expression.Value(value))
+			u.actions++
+
+			return u
+		}
+	}
+
+	u.err = fmt.Errorf("update: %q is not an index key attribute", attr)
+
+	return u
+}
+
+// SetIfNotExists sets the attribute at path to value unless it already has one
+func (u *Update) SetIfNotExists(path string, value interface{}) *Update {
+	return u.set(path, expression.IfNotExists(expression.Name(path), expression.Value(value)))
+}
+
+// Append adds values to the end of the list at path, creating the list if it does not exist
+func (u *Update) Append(path string, values ...interface{}) *Update {
+	return u.set(path, expression.ListAppend(u.listAt(path), expression.Value(values)))
+}
+
+// Prepend adds values to the start of the list at path, creating the list if it does not exist
+func (u *Update) Prepend(path string, values ...interface{}) *Update {
+	return u.set(path, expression.ListAppend(expression.Value(values), u.listAt(path)))
+}
+
+// Increment adds by to the number at path, treating a missing attribute as 0
+func (u *Update) Increment(path string, by float64) *Update {
+	return u.set(path, expression.Plus(expression.IfNotExists(expression.Name(path), expression.Value(0)), expression.Value(by)))
+}
+
+// Remove deletes the attributes at paths; removing a list element shifts the following ones down
+func (u *Update) Remove(paths ...string) *Update {
+	for _, path := range paths {
+		if !u.valid(path) {
+			return u
+		}
+
+		u.update = u.update.Remove(expression.Name(path))
+		u.actions++
+	}
+
+	return u
+}
+
+// Add adds a number to the number at path, or the elements of a StringSet or NumberSet to the set at path.
+// A missing attribute is created with value. Only top level attributes can be used with ADD.
+func (u *Update) Add(path string, value interface{}) *Update {
+	if !u.valid(path) {
+		return u
+	}
+
+	u.update = u.update.Add(expression.Name(path), expression.Value(value))
+	u.actions++
+
+	return u
+}
+
+// Delete removes the elements of a StringSet or NumberSet from the set at path
+func (u *Update) Delete(path string, value interface{}) *Update {
+	if !u.valid(path) {
+		return u
+	}
+
+	u.update = u.update.Delete(expression.Name(path), expression.Value(value))
+	u.actions++
+
+	return u
+}
+
+// If makes the update conditional; Exec fails with a ConditionalCheckFailedException when cond does not hold
+func (u *Update) If(cond expression.ConditionBuilder) *Update {
+	if u.condition != nil {
+		cond = u.condition.And(cond)
+	}
+	u.condition = &cond
+
+	return u
+}
+
+// MustExist makes the update fail instead of creating the item when it does not exist
+func (u *Update) MustExist() *Update {
+	return u.If(expression.AttributeExists(expression.Name(u.table.schema.PartitionKey)))
+}
+
+// Returning selects what Exec returns: types.ReturnValueAllNew, types.ReturnValueUpdatedNew,
+// types.ReturnValueAllOld, types.ReturnValueUpdatedOld or types.ReturnValueNone
+func (u *Update) Returning(rv types.ReturnValue) *Update {
+	u.returnValues = rv
+	return u
+}
+
+// Exec sends the update, returning the attributes selected by Returning
+func (u *Update) Exec(ctx context.Context) (map[string]types.AttributeValue, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	if u.actions == 0 {
+		return nil, errors.New("no changes to update")
+	}
+
+	key, err := attributevalue.MarshalMap(map[string]string{
+		"pk": u.pk,
+		"sk": u.sk,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	builder := expression.NewBuilder().WithUpdate(u.update)
+	if u.condition != nil {
+		builder = builder.WithCondition(*u.condition)
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build update expression: %w", err)
+	}
+
+	return u.table.database.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(u.table.name),
+		Key:                       key,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              u.returnValues,
+	})
+}
+
+// ExecInto sends the update & unmarshals the returned attributes into out
+func (u *Update) ExecInto(ctx context.Context, out interface{}) error {
+	av, err := u.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return attributevalue.UnmarshalMap(av, out)
+}
+
+func (u *Update) set(path string, value expression.OperandBuilder) *Update {
+	if !u.valid(path) {
+		return u
+	}
+
+	u.update = u.update.Set(expression.Name(path), value)
+	u.actions++
+
+	return u
+}
+
+// listAt is the list at path, or an empty list when there is none yet
+func (u *Update) listAt(path string) expression.OperandBuilder {
+	return expression.IfNotExists(expression.Name(path), expression.Value([]interface{}{}))
+}
+
+// valid records an error for paths within an attribute that keys, types or expires the item
+func (u *Update) valid(path string) bool {
+	if u.err != nil {
+		return false
+	}
+
+	if path == "" {
+		u.err = errors.New("update: empty attribute path")
+		return false
+	}
+
+	// only the top level attribute of a document path is a key
+	attr := path
+	if i := strings.IndexAny(path, ".["); i >= 0 {
+		attr = path[:i]
+	}
+	u.err = u.table.schema.CheckUpdatable(attr)
+
+	return u.err == nil
+}
@@ -0,0 +1,59 @@
+package testTable_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func newTable(t *testing.T) *testTable.Table {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testTable.New(db.New(engine), "test")
+}
+
+func TestUpdateRefusesKeyAttributes(t *testing.T) {
+	table := newTable(t)
+
+	for _, path := range []string{"pk", "sk", "isActive", db.TypeAttribute, "expiresAt", "isActive.nested"} {
+		_, err := table.Update("USERS", "1").Set(path, 1).Exec(context.Background())
+		if !errors.Is(err, db.ErrKeyAttribute) {
+			t.Errorf("Set(%q) = %v, want ErrKeyAttribute", path, err)
+		}
+
+		_, err = table.Update("USERS", "1").Remove(path).Exec(context.Background())
+		if !errors.Is(err, db.ErrKeyAttribute) {
+			t.Errorf("Remove(%q) = %v, want ErrKeyAttribute", path, err)
+		}
+	}
+}
+
+func TestUpdateSetIndexKey(t *testing.T) {
+	ctx := context.Background()
+	table := newTable(t)
+
+	av, err := table.Update("USERS", "1").SetIndexKey("isActive", 1).Set("name", "ann").Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := av["isActive"].(*types.AttributeValueMemberN); !ok || n.Value != "1" {
+		t.Errorf("isActive = %#v, want 1", av["isActive"])
+	}
+
+	for _, attr := range []string{"pk", "name"} {
+		if _, err := table.Update("USERS", "1").SetIndexKey(attr, "x").Exec(ctx); err == nil {
+			t.Errorf("SetIndexKey(%q) succeeded", attr)
+		}
+	}
+}
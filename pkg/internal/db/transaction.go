@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxTransactItems is the number of actions DynamoDB accepts in one TransactWriteItems request
+const maxTransactItems = 100
+
+// Transaction collects writes to several items, e.g. an entity & the events it emits,
+// so they are committed together or not at all
+type Transaction struct {
+	db    Client
+	items []types.TransactWriteItem
+}
+
+// NewTransaction starts an empty transaction committed through db
+func NewTransaction(db Client) *Transaction {
+	return &Transaction{db: db}
+}
+
+// Add appends raw actions to the transaction
+func (tx *Transaction) Add(items ...types.TransactWriteItem) {
+	tx.items = append(tx.items, items...)
+}
+
+// Len returns the number of actions in the transaction
+func (tx *Transaction) Len() int {
+	return len(tx.items)
+}
+
+// Commit writes every action atomically
+func (tx *Transaction) Commit(ctx context.Context) error {
+	if len(tx.items) == 0 {
+		return errors.New("transaction has no actions")
+	}
+
+	if len(tx.items) > maxTransactItems {
+		return fmt.Errorf("transaction has %d actions, at most %d are allowed", len(tx.items), maxTransactItems)
+	}
+
+	return tx.db.TransactWriteItems(ctx, tx.items)
+}
+
+// IsConditionFailed reports whether err is a failed condition of a single write or of any action of a transaction
+func IsConditionFailed(err error) bool {
+	var condFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &condFailed) {
+		return true
+	}
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, r := range canceled.CancellationReasons {
+			if aws.ToString(r.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ConditionFailedAt reports whether err canceled a transaction because the condition of its i-th action failed
+func ConditionFailedAt(err error, i int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || i >= len(canceled.CancellationReasons) {
+		return false
+	}
+
+	return aws.ToString(canceled.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Now is the clock expiry times are computed & checked with, replaceable in tests
+var Now = time.Now
+
+// WriteOption customises how a repository writes an item
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	expiresAt time.Time
+}
+
+// ExpiresIn writes the item with a lifetime of d, overriding the entity's TTL
+func ExpiresIn(d time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.expiresAt = Now().Add(d)
+	}
+}
+
+// ExpiresAt writes the item to expire at t, overriding the entity's TTL
+func ExpiresAt(t time.Time) WriteOption {
+	return func(o *writeOptions) {
+		o.expiresAt = t
+	}
+}
+
+// ExpiresAtOf returns when a stored item expires, or the zero time when it never does.
+// ttlAttr is the table's time to live attribute.
+func ExpiresAtOf(av map[string]types.AttributeValue, ttlAttr string) time.Time {
+	n, ok := av[ttlAttr].(*types.AttributeValueMemberN)
+	if ttlAttr == "" || !ok {
+		return time.Time{}
+	}
+
+	secs, err := strconv.ParseFloat(n.Value, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(secs), 0)
+}
+
+// Expired reports whether a stored item's time to live has passed.
+// DynamoDB deletes expired items some time later, so reads must not rely on them being gone.
+func Expired(av map[string]types.AttributeValue, ttlAttr string) bool {
+	at := ExpiresAtOf(av, ttlAttr)
+	return !at.IsZero() && !at.After(Now())
+}
+
+// setExpiry writes the expiry chosen by the options or the entity's TTL onto av
+func (r *Repository[T]) setExpiry(av map[string]types.AttributeValue, opts []WriteOption) error {
+	o := writeOptions{}
+	if r.entity.opts.TTL > 0 {
+		o.expiresAt = Now().Add(r.entity.opts.TTL)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.expiresAt.IsZero() {
+		return nil
+	}
+
+	if r.table.TimeToLive == "" {
+		return fmt.Errorf("table %s has no time to live attribute to expire %s items by", r.table.Name, r.entity.Type())
+	}
+
+	av[r.table.TimeToLive] = &types.AttributeValueMemberN{Value: strconv.FormatInt(o.expiresAt.Unix(), 10)}
+
+	return nil
+}
+
+// liveFilter matches items that have not expired; items without a numeric expiry never do
+func (r *Repository[T]) liveFilter() expression.ConditionBuilder {
+	ttl := expression.Name(r.table.TimeToLive)
+
+	return expression.Or(
+		expression.AttributeNotExists(ttl),
+		expression.Not(expression.AttributeType(ttl, expression.Number)),
+		ttl.GreaterThan(expression.Value(Now().Unix())),
+	)
+}
+
+// live adds to conditions that the item has not expired, so an update never revives an item DynamoDB has
+// yet to delete
+func (r *Repository[T]) live(conditions []expression.ConditionBuilder) []expression.ConditionBuilder {
+	if r.table.TimeToLive == "" {
+		return conditions
+	}
+
+	return append(conditions, r.liveFilter())
+}
@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EML writes each message to its own .eml file, for local development.
+// Mail clients open them as they would be delivered.
+type EML struct {
+	dir string
+}
+
+// NewEML creates a mailer writing messages into dir, which is created when missing
+func NewEML(dir string) *EML {
+	return &EML{dir: dir}
+}
+
+func (e *EML) Send(ctx context.Context, m Message) error {
+	now := time.Now().UTC()
+
+	raw, err := Compose(m, now)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.dir, 0o700); err != nil {
+		return err
+	}
+
+	// sortable by time, & unique since CreateTemp appends a random suffix
+	file, err := os.CreateTemp(e.dir, now.Format("20060102T150405.000000000Z")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return fmt.Errorf("mail: writing %s: %w", filepath.Base(file.Name()), err)
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,110 @@
+package mail_test
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"serverless-aws-cdk/internal/mail"
+)
+
+func TestEML(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox") // created by the first Send
+	eml := mail.NewEML(dir)
+
+	msg := message
+	msg.Subject = "Restablece tu contraseña"
+	msg.HTML = "<p>Follow <a href=\"https://example.com\">this link</a></p>"
+
+	for i := 0; i < 2; i++ {
+		if err := eml.Send(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrote %v, want 2 .eml files", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	parsed, err := netmail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("Subject = %q (%v), want %q", subject, err, msg.Subject)
+	}
+	if to, err := parsed.Header.AddressList("To"); err != nil || to[0].Address != "ann@example.com" {
+		t.Errorf("To = %v (%v), want ann@example.com", to, err)
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("Message-ID = %q, want one of the sender domain", parsed.Header.Get("Message-ID"))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q (%v), want multipart/alternative", mediaType, err)
+	}
+
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		part, err := parts.NextPart() // decodes the quoted-printable body
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := part.Header.Get("Content-Type"); got != want.contentType || strings.TrimSpace(string(body)) != want.body {
+			t.Errorf("part %s = %q, want %s %q", got, body, want.contentType, want.body)
+		}
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("more than 2 parts: %v", err)
+	}
+}
+
+func TestEMLTextOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := mail.NewEML(dir).Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("wrote %v, want 1 .eml file", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := readHeaders(t, string(raw))
+	if header.Get("Content-Type") != "text/plain; charset=utf-8" || header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Errorf("headers = %v, want quoted-printable text/plain", header)
+	}
+}
@@ -0,0 +1,158 @@
+// Package mail sends the emails of account flows, such as password reset links.
+//
+// Messages are rendered from the templates embedded in the package, then handed to a Mailer: a driver
+// delivering them, usually behind a Queue so requests do not wait on the mail server.
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"serverless-aws-cdk/internal/config"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Driver names in the configuration
+const (
+	DriverSMTP = "smtp"
+	DriverSES  = "ses"
+	DriverEML  = "eml"
+	DriverFile = "file"
+)
+
+// ErrDisabled is returned by New when no driver is configured, & by the flows needing email then
+var ErrDisabled = errors.New("mail: no driver configured (mail.driver)")
+
+// Message is an email with a plain text body & an optional HTML alternative
+type Message struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New creates the mailer selected by cfg; messages without a sender are sent from cfg.From.
+// The ses driver uses region unless cfg.SES.Region is set.
+func New(ctx context.Context, cfg config.Mail, region string) (Mailer, error) {
+	var driver Mailer
+
+	switch cfg.Driver {
+	case "":
+		return nil, ErrDisabled
+	case DriverSMTP:
+		driver = NewSMTP(cfg.SMTP)
+	case DriverSES:
+		if cfg.SES.Region != "" {
+			region = cfg.SES.Region
+		}
+
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+
+		driver = NewSES(NewSESClient(awsCfg, cfg.SES.Endpoint))
+	case DriverEML:
+		driver = NewEML(cfg.Dir)
+	case DriverFile:
+		driver = NewFile(cfg.File)
+	default:
+		return nil, fmt.Errorf("mail: unknown driver %q", cfg.Driver)
+	}
+
+	return WithSender(driver, cfg.From), nil
+}
+
+type withSender struct {
+	Mailer
+	from string
+}
+
+// WithSender wraps m to send messages without a sender from the given address
+func WithSender(m Mailer, from string) Mailer {
+	return withSender{Mailer: m, from: from}
+}
+
+func (w withSender) Send(ctx context.Context, m Message) error {
+	if m.From == "" {
+		m.From = w.from
+	}
+
+	return w.Mailer.Send(ctx, m)
+}
+
+// Memory keeps sent messages in memory; for tests & local tooling
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemory creates an empty in-memory mailer
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+// Messages returns the messages sent so far, in sending order
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// File appends one JSON message per line to a file, for local development
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFile creates a mailer appending to the file at path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Send(ctx context.Context, m Message) error {
+	line, err := json.Marshal(struct {
+		Message
+		SentAt time.Time `json:"sentAt"`
+	}{m, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
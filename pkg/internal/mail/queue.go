@@ -0,0 +1,124 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned when sending through a closed queue
+var ErrQueueClosed = errors.New("mail: queue closed")
+
+// sendAttempts bounds how often the queue tries each message
+const sendAttempts = 3
+
+// sendTimeout bounds each attempt, so a stalled server cannot hold the queue
+const sendTimeout = 30 * time.Second
+
+// Queue sends messages in the background through a mailer, so requests do not wait on the mail server.
+// Failed sends are retried with backoff, then handed to OnError.
+//
+// Lambda freezes background goroutines between invocations, so handlers Flush the queue before answering.
+type Queue struct {
+	mailer  Mailer
+	jobs    chan Message
+	pending sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	// OnError receives the messages that could not be sent; it logs them by default
+	OnError func(m Message, err error)
+}
+
+// NewQueue starts a queue holding up to size messages waiting for mailer; Send blocks while it is full
+func NewQueue(mailer Mailer, size int) *Queue {
+	q := &Queue{
+		mailer: mailer,
+		jobs:   make(chan Message, size),
+		OnError: func(m Message, err error) {
+			log.Printf("mail: dropping %q to %s: %v", m.Subject, m.To, err)
+		},
+	}
+
+	go q.work()
+
+	return q
+}
+
+// Send queues m; it only fails when the queue is closed or ctx ends while the queue is full
+func (q *Queue) Send(ctx context.Context, m Message) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	q.pending.Add(1)
+	select {
+	case q.jobs <- m:
+		return nil
+	case <-ctx.Done():
+		q.pending.Done()
+		return ctx.Err()
+	}
+}
+
+// Flush waits until every queued message was sent or given up on, or until ctx ends
+func (q *Queue) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages & flushes the queue
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	return q.Flush(ctx)
+}
+
+func (q *Queue) work() {
+	for m := range q.jobs {
+		if err := q.deliver(m); err != nil && q.OnError != nil {
+			q.OnError(m, err)
+		}
+		q.pending.Done()
+	}
+}
+
+func (q *Queue) deliver(m Message) error {
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(100 * time.Millisecond << attempt)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err = q.mailer.Send(ctx, m)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
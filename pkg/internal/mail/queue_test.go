@@ -0,0 +1,98 @@
+package mail_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/mail"
+)
+
+// flaky fails the first failures sends of each message, or blocks them until release is closed
+type flaky struct {
+	mail.Memory
+	failures int
+	release  chan struct{}
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (f *flaky) Send(ctx context.Context, m mail.Message) error {
+	if f.release != nil {
+		<-f.release
+	}
+
+	f.mu.Lock()
+	f.attempts[m.Subject]++
+	attempt := f.attempts[m.Subject]
+	f.mu.Unlock()
+
+	if attempt <= f.failures {
+		return errors.New("server busy")
+	}
+
+	return f.Memory.Send(ctx, m)
+}
+
+func TestQueueFlush(t *testing.T) {
+	mailer := &flaky{failures: 1, attempts: map[string]int{}}
+	q := mail.NewQueue(mailer, 1)
+
+	for _, subject := range []string{"first", "second", "third"} {
+		if err := q.Send(context.Background(), mail.Message{Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// each message failed once & was retried before Flush returned
+	sent := mailer.Messages()
+	if len(sent) != 3 || sent[0].Subject != "first" || sent[2].Subject != "third" {
+		t.Errorf("sent %+v, want first, second & third in order", sent)
+	}
+}
+
+func TestQueueGivesUp(t *testing.T) {
+	mailer := &flaky{failures: 10, attempts: map[string]int{}}
+	q := mail.NewQueue(mailer, 1)
+
+	var dropped []string
+	q.OnError = func(m mail.Message, err error) { dropped = append(dropped, m.Subject) }
+
+	if err := q.Send(context.Background(), mail.Message{Subject: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dropped) != 1 || mailer.attempts["lost"] != 3 {
+		t.Errorf("dropped %v after %d attempts, want lost after 3", dropped, mailer.attempts["lost"])
+	}
+	if err := q.Send(context.Background(), mail.Message{}); !errors.Is(err, mail.ErrQueueClosed) {
+		t.Errorf("Send after Close = %v, want ErrQueueClosed", err)
+	}
+}
+
+func TestQueueFlushDeadline(t *testing.T) {
+	mailer := &flaky{attempts: map[string]int{}, release: make(chan struct{})}
+	q := mail.NewQueue(mailer, 1)
+	defer close(mailer.release)
+
+	if err := q.Send(context.Background(), mail.Message{Subject: "stalled"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := q.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Flush of a stalled queue = %v, want DeadlineExceeded", err)
+	}
+}
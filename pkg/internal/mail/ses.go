@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// SESAPI is the part of the SES v2 client used to send messages, satisfied by *sesv2.Client
+type SESAPI interface {
+	SendEmail(ctx context.Context, input *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error)
+}
+
+// SES delivers messages through Amazon SES or an SES-compatible API, as raw MIME content
+type SES struct {
+	api SESAPI
+}
+
+// NewSES creates a mailer sending through api
+func NewSES(api SESAPI) *SES {
+	return &SES{api: api}
+}
+
+// NewSESClient creates an SES v2 client from cfg, calling endpoint instead of SES when it is set,
+// e.g. LocalStack
+func NewSESClient(cfg aws.Config, endpoint string) *sesv2.Client {
+	return sesv2.NewFromConfig(cfg, func(o *sesv2.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
+
+func (s *SES) Send(ctx context.Context, m Message) error {
+	raw, err := Compose(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Compose validated both addresses
+	from, _ := mail.ParseAddress(m.From)
+	to, _ := mail.ParseAddress(m.To)
+
+	_, err = s.api.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from.Address),
+		Destination:      &sestypes.Destination{ToAddresses: []string{to.Address}},
+		Content:          &sestypes.EmailContent{Raw: &sestypes.RawMessage{Data: raw}},
+	})
+	if err != nil {
+		return fmt.Errorf("mail: sending through SES: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package mail_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"serverless-aws-cdk/internal/mail"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// sesAPI records the SendEmail inputs it receives, failing with err
+type sesAPI struct {
+	inputs []*sesv2.SendEmailInput
+	err    error
+}
+
+func (s *sesAPI) SendEmail(ctx context.Context, input *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+	s.inputs = append(s.inputs, input)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &sesv2.SendEmailOutput{MessageId: aws.String("id")}, nil
+}
+
+func TestSES(t *testing.T) {
+	api := &sesAPI{}
+	if err := mail.NewSES(api).Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.inputs) != 1 {
+		t.Fatalf("SendEmail called %d times, want 1", len(api.inputs))
+	}
+	in := api.inputs[0]
+	if aws.ToString(in.FromEmailAddress) != "accounts@example.com" || len(in.Destination.ToAddresses) != 1 || in.Destination.ToAddresses[0] != "ann@example.com" {
+		t.Errorf("envelope = %s -> %v, want accounts@example.com -> ann@example.com", aws.ToString(in.FromEmailAddress), in.Destination.ToAddresses)
+	}
+	if raw := string(in.Content.Raw.Data); !strings.Contains(raw, "Subject: Reset your password\r\n") {
+		t.Errorf("raw content is not the composed message:\n%s", raw)
+	}
+
+	api.err = errors.New("MessageRejected")
+	if err := mail.NewSES(api).Send(context.Background(), message); !errors.Is(err, api.err) {
+		t.Errorf("Send = %v, want the API error", err)
+	}
+}
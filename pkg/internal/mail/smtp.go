@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"serverless-aws-cdk/internal/config"
+)
+
+// SMTP delivers messages to an SMTP server, such as a provider's relay or a local stand-in like Mailpit.
+// Each message uses its own connection, so Lambdas hold none while frozen.
+type SMTP struct {
+	cfg config.SMTP
+}
+
+// NewSMTP creates a mailer delivering to the server in cfg
+func NewSMTP(cfg config.SMTP) *SMTP {
+	return &SMTP{cfg: cfg}
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	raw, err := Compose(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Compose validated both addresses
+	from, _ := mail.ParseAddress(m.From)
+	to, _ := mail.ParseAddress(m.To)
+
+	client, err := s.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("mail: connecting to %s: %w", s.cfg.Host, err)
+	}
+	defer client.Close()
+
+	if err := s.deliver(client, from.Address, to.Address, raw); err != nil {
+		return fmt.Errorf("mail: sending through %s: %w", s.cfg.Host, err)
+	}
+
+	return nil
+}
+
+// dial connects & secures the session as configured, bounded by the deadline of ctx
+func (s *SMTP) dial(ctx context.Context) (*smtp.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host, MinVersion: tls.VersionTLS12}
+	if s.cfg.TLS == "tls" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.cfg.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("the server does not offer STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	// PlainAuth refuses to send credentials unencrypted, except to localhost
+	if s.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (s *SMTP) deliver(client *smtp.Client, from, to string, raw []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,220 @@
+package mail_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/config"
+	"serverless-aws-cdk/internal/mail"
+)
+
+// smtpServer is a fake SMTP server on a local port, recording the sessions it accepts
+type smtpServer struct {
+	listener net.Listener
+	auth     bool   // whether AUTH PLAIN is offered
+	reject   string // RCPT TO address answered with 550
+
+	mu       sync.Mutex
+	sessions []smtpSession
+}
+
+type smtpSession struct {
+	credentials string // decoded AUTH PLAIN response
+	from, to    string
+	data        string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &smtpServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// config returns the SMTP settings of a client of s
+func (s *smtpServer) config() config.SMTP {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+
+	return config.SMTP{Host: host, Port: n, TLS: "none"}
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tp := textproto.NewConn(conn)
+	var session smtpSession
+
+	tp.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if s.auth {
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250 localhost")
+			}
+		case "AUTH":
+			_, initial, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(initial)
+			session.credentials = string(decoded)
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			session.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			session.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if session.to == s.reject {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.data = string(data)
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			s.mu.Lock()
+			s.sessions = append(s.sessions, session)
+			s.mu.Unlock()
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpServer) received() []smtpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]smtpSession(nil), s.sessions...)
+}
+
+var message = mail.Message{
+	From:    "Accounts <accounts@example.com>",
+	To:      "Ann <ann@example.com>",
+	Subject: "Reset your password",
+	Text:    "Follow this link",
+}
+
+func TestSMTPDelivers(t *testing.T) {
+	server := newSMTPServer(t)
+
+	if err := mail.NewSMTP(server.config()).Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := server.received()
+	if len(sessions) != 1 {
+		t.Fatalf("server received %d sessions, want 1", len(sessions))
+	}
+	got := sessions[0]
+	if got.from != "accounts@example.com" || got.to != "ann@example.com" {
+		t.Errorf("envelope = %s -> %s, want accounts@example.com -> ann@example.com", got.from, got.to)
+	}
+	if got.credentials != "" {
+		t.Errorf("authenticated without a username, with %q", got.credentials)
+	}
+	if header := readHeaders(t, got.data); header.Get("Subject") != "Reset your password" || header.Get("To") != `"Ann" <ann@example.com>` {
+		t.Errorf("headers = %v, want the subject & recipient of the message", header)
+	}
+	if !strings.Contains(got.data, "Follow this link") {
+		t.Errorf("data misses the text:\n%s", got.data)
+	}
+}
+
+func TestSMTPAuthenticates(t *testing.T) {
+	server := newSMTPServer(t)
+	server.auth = true
+
+	cfg := server.config()
+	cfg.Username, cfg.Password = "relay", "secret"
+
+	if err := mail.NewSMTP(cfg).Send(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions := server.received(); len(sessions) != 1 || sessions[0].credentials != "\x00relay\x00secret" {
+		t.Errorf("sessions = %+v, want one authenticated as relay", sessions)
+	}
+}
+
+func TestSMTPFailures(t *testing.T) {
+	server := newSMTPServer(t)
+	server.reject = "ann@example.com"
+
+	tests := []struct {
+		name   string
+		cfg    func(config.SMTP) config.SMTP
+		msg    mail.Message
+		detail string
+	}{
+		{"rejected recipient", func(c config.SMTP) config.SMTP { return c }, message, "550"},
+		{"no STARTTLS offered", func(c config.SMTP) config.SMTP { c.TLS = "starttls"; return c }, message, "STARTTLS"},
+		{"closed port", func(c config.SMTP) config.SMTP { c.Port = 1; return c }, message, "connecting"},
+		{"invalid recipient", func(c config.SMTP) config.SMTP { return c }, mail.Message{From: message.From, To: "ann"}, "invalid recipient"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mail.NewSMTP(tt.cfg(server.config())).Send(context.Background(), tt.msg)
+			if err == nil || !strings.Contains(err.Error(), tt.detail) {
+				t.Errorf("Send = %v, want an error about %s", err, tt.detail)
+			}
+		})
+	}
+
+	if sessions := server.received(); len(sessions) != 0 {
+		t.Errorf("failed sends delivered %+v", sessions)
+	}
+}
+
+// readHeaders parses the header of a composed message
+func readHeaders(t *testing.T, raw string) textproto.MIMEHeader {
+	t.Helper()
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(raw))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header
+}
@@ -0,0 +1,228 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates
+var embedded embed.FS
+
+// Template names
+const (
+	TemplateVerifyEmail   = "verify_email"
+	TemplatePasswordReset = "password_reset"
+)
+
+// LinkData is the data of the emails carrying a link, such as TemplateVerifyEmail & TemplatePasswordReset
+type LinkData struct {
+	Name    string // of the recipient
+	URL     string
+	Expires time.Duration // how long the link stays valid
+}
+
+// locale is an entry of locales.json, with the templates parsed for it
+type locale struct {
+	Subjects  map[string]string   `json:"subjects"`  // by template name
+	Durations map[string][]string `json:"durations"` // singular & plural of "minute", "hour" & "day"
+
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// Templates renders emails from text bodies, optional HTML alternatives & subjects in several locales
+type Templates struct {
+	locales  map[string]*locale
+	fallback string
+}
+
+// DefaultTemplates parses the templates embedded in the package, with fallback as the default locale
+func DefaultTemplates(fallback string) (*Templates, error) {
+	files, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadTemplates(files, fallback)
+}
+
+// LoadTemplates parses the templates in files:
+//   - locales.json holds the subjects & duration units of each locale
+//   - <name>.txt.tmpl is the text body of each subject, translated by <name>.<locale>.txt.tmpl
+//   - <name>.html.tmpl & <name>.<locale>.html.tmpl are optional HTML alternatives, sharing layout.html.tmpl
+//
+// Every locale needs a subject for each template of the fallback locale.
+func LoadTemplates(files fs.FS, fallback string) (*Templates, error) {
+	b, err := fs.ReadFile(files, "locales.json")
+	if err != nil {
+		return nil, fmt.Errorf("mail: reading locales: %w", err)
+	}
+
+	var locales map[string]*locale
+	if err := json.Unmarshal(b, &locales); err != nil {
+		return nil, fmt.Errorf("mail: parsing locales: %w", err)
+	}
+
+	base, ok := locales[fallback]
+	if !ok {
+		return nil, fmt.Errorf("mail: no locale %q in locales.json", fallback)
+	}
+
+	htmlFiles, err := fs.Glob(files, "*.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	for tag, l := range locales {
+		for _, unit := range []string{"minute", "hour", "day"} {
+			if len(l.Durations[unit]) != 2 {
+				return nil, fmt.Errorf("mail: locale %q needs the singular & plural of %q", tag, unit)
+			}
+		}
+
+		funcs := map[string]interface{}{
+			"duration": l.duration,
+			"link": func(url, label string) map[string]string {
+				return map[string]string{"URL": url, "Label": label}
+			},
+		}
+
+		if l.text, err = texttemplate.New("").Funcs(funcs).ParseFS(files, "*.txt.tmpl"); err != nil {
+			return nil, fmt.Errorf("mail: parsing text templates: %w", err)
+		}
+		l.html = htmltemplate.New("").Funcs(funcs)
+		if len(htmlFiles) > 0 {
+			if l.html, err = l.html.ParseFS(files, htmlFiles...); err != nil {
+				return nil, fmt.Errorf("mail: parsing HTML templates: %w", err)
+			}
+		}
+
+		for name := range base.Subjects {
+			if l.Subjects[name] == "" {
+				return nil, fmt.Errorf("mail: locale %q has no subject for %q", tag, name)
+			}
+			if l.text.Lookup(name+".txt.tmpl") == nil {
+				return nil, fmt.Errorf("mail: no text body for %q", name)
+			}
+		}
+	}
+
+	return &Templates{locales: locales, fallback: fallback}, nil
+}
+
+// Render renders the template name for a recipient with the given locale preferences, an Accept-Language
+// value such as "es-MX,es;q=0.9". The message has no sender nor recipient yet.
+func (t *Templates) Render(name, preferences string, data interface{}) (Message, error) {
+	tag := t.Match(preferences)
+	l := t.locales[tag]
+
+	subject, ok := l.Subjects[name]
+	if !ok {
+		return Message{}, fmt.Errorf("mail: unknown template %q", name)
+	}
+
+	var text bytes.Buffer
+	if err := l.text.ExecuteTemplate(&text, localized(l.text.Lookup, name, tag, ".txt.tmpl"), data); err != nil {
+		return Message{}, fmt.Errorf("mail: rendering %s: %w", name, err)
+	}
+
+	msg := Message{Subject: subject, Text: text.String()}
+
+	htmlName := localized(l.html.Lookup, name, tag, ".html.tmpl")
+	if l.html.Lookup(htmlName) != nil {
+		var html bytes.Buffer
+		if err := l.html.ExecuteTemplate(&html, htmlName, data); err != nil {
+			return Message{}, fmt.Errorf("mail: rendering %s: %w", name, err)
+		}
+		msg.HTML = html.String()
+	}
+
+	return msg, nil
+}
+
+// Match returns the available locale that best matches preferences, or the fallback locale
+func (t *Templates) Match(preferences string) string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+
+	var prefs []preference
+	for _, part := range strings.Split(preferences, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && q > 0 {
+			prefs = append(prefs, preference{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	for _, p := range prefs {
+		if _, ok := t.locales[p.tag]; ok {
+			return p.tag
+		}
+		if base, _, _ := strings.Cut(p.tag, "-"); t.locales[base] != nil {
+			return base
+		}
+	}
+
+	return t.fallback
+}
+
+// localized returns the name of the translation of a template when there is one
+func localized[T any](lookup func(string) *T, name, tag, ext string) string {
+	if lookup(name+"."+tag+ext) != nil {
+		return name + "." + tag + ext
+	}
+
+	return name + ext
+}
+
+// duration formats d in its largest whole unit, e.g. "90 minutes" or "2 days"
+func (l *locale) duration(d time.Duration) string {
+	const day = 24 * time.Hour
+
+	unit, n := "minute", int(d/time.Minute)
+	switch {
+	case d >= day && d%day == 0:
+		unit, n = "day", int(d/day)
+	case d >= time.Hour && d%time.Hour == 0:
+		unit, n = "hour", int(d/time.Hour)
+	}
+
+	forms := l.Durations[unit]
+	if n == 1 {
+		return "1 " + forms[0]
+	}
+
+	return strconv.Itoa(n) + " " + forms[1]
+}
+
+type localeKey struct{}
+
+// WithLocale returns a context carrying the locale preferences of the recipient of emails sent with it,
+// e.g. the Accept-Language header of its request
+func WithLocale(ctx context.Context, preferences string) context.Context {
+	return context.WithValue(ctx, localeKey{}, preferences)
+}
+
+// LocaleFrom returns the preferences set by WithLocale, or ""
+func LocaleFrom(ctx context.Context) string {
+	preferences, _ := ctx.Value(localeKey{}).(string)
+	return preferences
+}
@@ -0,0 +1,112 @@
+package mail_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"serverless-aws-cdk/internal/mail"
+)
+
+func TestRenderLocalized(t *testing.T) {
+	templates, err := mail.DefaultTemplates("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := mail.LinkData{Name: "Ann", URL: "https://example.com/reset?token=t", Expires: 2 * time.Hour}
+
+	tests := []struct {
+		preferences, subject, text string
+	}{
+		{"", "Reset your password", "The link expires in 2 hours."},
+		{"es", "Restablece tu contraseña", "El enlace caduca en 2 horas."},
+		{"es-MX,es;q=0.9", "Restablece tu contraseña", "Hola Ann"},
+		{"fr-CA,fr;q=0.9", "Reset your password", "Hi Ann"},
+		{"fr, es;q=0.5, en;q=0.8", "Reset your password", "Hi Ann"},
+		{"en;q=0, es", "Restablece tu contraseña", "Hola Ann"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.preferences, func(t *testing.T) {
+			msg, err := templates.Render(mail.TemplatePasswordReset, tt.preferences, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject != tt.subject {
+				t.Errorf("subject = %q, want %q", msg.Subject, tt.subject)
+			}
+			if !strings.Contains(msg.Text, tt.text) || !strings.Contains(msg.Text, data.URL) {
+				t.Errorf("text misses %q or the link:\n%s", tt.text, msg.Text)
+			}
+			if !strings.Contains(msg.HTML, `href="https://example.com/reset?token=t"`) {
+				t.Errorf("HTML misses the link:\n%s", msg.HTML)
+			}
+		})
+	}
+
+	if _, err := templates.Render("unknown", "en", data); err == nil {
+		t.Error("rendering an unknown template succeeded")
+	}
+}
+
+var durations = `"durations": {"minute": ["m", "ms"], "hour": ["h", "hs"], "day": ["d", "ds"]}`
+
+func TestTemplateFallback(t *testing.T) {
+	// de translates the subject only, so its bodies are the untranslated ones; there is no HTML
+	files := fstest.MapFS{
+		"locales.json": {Data: []byte(`{
+			"en": {"subjects": {"notice": "Notice"}, ` + durations + `},
+			"de": {"subjects": {"notice": "Hinweis"}, ` + durations + `}
+		}`)},
+		"notice.txt.tmpl":    {Data: []byte("valid for {{duration .Expires}}")},
+		"notice.es.txt.tmpl": {Data: []byte("unused")},
+	}
+
+	templates, err := mail.LoadTemplates(files, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for expires, want := range map[time.Duration]string{
+		time.Minute:      "valid for 1 m",
+		90 * time.Minute: "valid for 90 ms",
+		time.Hour:        "valid for 1 h",
+		48 * time.Hour:   "valid for 2 ds",
+	} {
+		msg, err := templates.Render("notice", "de-AT", mail.LinkData{Expires: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Subject != "Hinweis" || msg.Text != want || msg.HTML != "" {
+			t.Errorf("rendered %q %q %q, want Hinweis %q & no HTML", msg.Subject, msg.Text, msg.HTML, want)
+		}
+	}
+}
+
+func TestLoadTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name, locales string
+		fallback      string
+	}{
+		{"unknown fallback", `{"en": {"subjects": {"notice": "Notice"}, ` + durations + `}}`, "de"},
+		{"missing subject", `{"en": {"subjects": {"notice": "Notice"}, ` + durations + `}, "de": {"subjects": {}, ` + durations + `}}`, "en"},
+		{"missing duration", `{"en": {"subjects": {"notice": "Notice"}, "durations": {}}}`, "en"},
+		{"missing body", `{"en": {"subjects": {"notice": "Notice", "other": "Other"}, ` + durations + `}}`, "en"},
+		{"invalid JSON", `{`, "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := fstest.MapFS{
+				"locales.json":    {Data: []byte(tt.locales)},
+				"notice.txt.tmpl": {Data: []byte("text")},
+			}
+
+			if _, err := mail.LoadTemplates(files, tt.fallback); err == nil {
+				t.Error("LoadTemplates succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Package outbox implements the transactional outbox pattern for domain events.
+//
+// Events are written as items of the main table in the same transaction as the entity change
+// they describe, so an event is stored if & only if the change is. A Relay later delivers stored
+// events through a Publisher, retrying failures with backoff & moving events that keep failing
+// to a dead letter partition. Delivery is at least once: every event carries a stable ID that
+// consumers use to drop duplicates.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/google/uuid"
+)
+
+// Event is a domain event stored in the outbox
+type Event struct {
+	ID            string `json:"id" dynamodbav:"sk"` // UUIDv7, so events sort in the order they were recorded
+	Type          string `json:"type" dynamodbav:"eventType"`
+	AggregateID   string `json:"aggregateId" dynamodbav:"aggregateId"`
+	Payload       string `json:"payload" dynamodbav:"payload"` // JSON document
+	OccurredAt    int64  `json:"occurredAt" dynamodbav:"occurredAt"`
+	Attempts      int    `json:"attempts" dynamodbav:"attempts"`
+	NextAttemptAt int64  `json:"nextAttemptAt" dynamodbav:"nextAttemptAt"`
+	LastError     string `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+}
+
+// Events stores pending events in the `OUTBOX` partition, in the order they were recorded
+var Events = db.RegisterEntity[Event](db.EntityOptions{
+	Type:         "OUTBOX_EVENT",
+	PartitionKey: "OUTBOX",
+	SortKey:      "{id}",
+})
+
+// DeadLetters stores events the relay gave up on, for inspection & replay
+var DeadLetters = db.RegisterEntity[Event](db.EntityOptions{
+	Type:         "OUTBOX_DEAD_EVENT",
+	PartitionKey: "OUTBOX#DEAD",
+	SortKey:      "{id}",
+})
+
+// NewEvent creates an event about the aggregate with the given id, encoding payload as JSON
+func NewEvent(eventType, aggregateID string, payload interface{}) (Event, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Event{}, err
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("outbox: encoding %s payload: %w", eventType, err)
+	}
+
+	return Event{
+		ID:          id.String(),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Payload:     string(b),
+		OccurredAt:  time.Now().Unix(),
+	}, nil
+}
+
+// Outbox stores events in a table
+type Outbox struct {
+	db     db.Client
+	events *db.Repository[Event]
+	dead   *db.Repository[Event]
+}
+
+// New creates an outbox stored in table
+func New(database db.Client, table db.Table) *Outbox {
+	return &Outbox{
+		db:     database,
+		events: db.NewRepository(database, table, Events),
+		dead:   db.NewRepository(database, table, DeadLetters),
+	}
+}
+
+// Append adds events to tx, so they are stored only if the rest of tx commits
+func (o *Outbox) Append(tx *db.Transaction, events ...Event) error {
+	for _, e := range events {
+		if err := o.events.CreateTx(tx, e); err != nil {
+			return fmt.Errorf("outbox: adding %s event: %w", e.Type, err)
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the events waiting for delivery, oldest first
+func (o *Outbox) Pending(ctx context.Context) ([]Event, error) {
+	return o.events.List(ctx, nil)
+}
+
+// Dead returns the events the relay gave up on, oldest first
+func (o *Outbox) Dead(ctx context.Context) ([]Event, error) {
+	return o.dead.List(ctx, nil)
+}
@@ -0,0 +1,173 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"serverless-aws-cdk/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// Publisher names in the configuration
+const (
+	PublisherFile        = "file"
+	PublisherEventBridge = "eventbridge"
+)
+
+// Message is the JSON document consumers receive for an event
+type Message struct {
+	ID          string          `json:"id"` // deduplication id, the same for every delivery of an event
+	Type        string          `json:"type"`
+	AggregateID string          `json:"aggregateId"`
+	OccurredAt  time.Time       `json:"occurredAt"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// MessageOf builds the message published for e
+func MessageOf(e Event) Message {
+	return Message{
+		ID:          e.ID,
+		Type:        e.Type,
+		AggregateID: e.AggregateID,
+		OccurredAt:  time.Unix(e.OccurredAt, 0).UTC(),
+		Data:        json.RawMessage(e.Payload),
+	}
+}
+
+// NewPublisher creates the publisher selected by cfg
+func NewPublisher(ctx context.Context, cfg config.Outbox, region string) (Publisher, error) {
+	switch cfg.Publisher {
+	case PublisherFile:
+		return NewFile(cfg.File), nil
+	case PublisherEventBridge:
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+
+		return NewEventBridge(eventbridge.NewFromConfig(awsCfg), cfg.EventBus, cfg.Source), nil
+	}
+
+	return nil, fmt.Errorf("outbox: unknown publisher %q", cfg.Publisher)
+}
+
+// Memory keeps published events in memory, dropping duplicates; for tests & local tooling
+type Memory struct {
+	mu     sync.Mutex
+	events []Event
+	seen   map[string]bool
+}
+
+// NewMemory creates an empty in-memory publisher
+func NewMemory() *Memory {
+	return &Memory{seen: map[string]bool{}}
+}
+
+func (m *Memory) Publish(ctx context.Context, e Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.seen[e.ID] {
+		m.seen[e.ID] = true
+		m.events = append(m.events, e)
+	}
+
+	return nil
+}
+
+// Events returns the events published so far, in publishing order
+func (m *Memory) Events() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Event(nil), m.events...)
+}
+
+// File appends one message per line to a file, for local development
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFile creates a publisher appending to the file at path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Publish(ctx context.Context, e Event) error {
+	line, err := json.Marshal(MessageOf(e))
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// EventBridgeAPI is the part of the EventBridge client used to publish events, satisfied by *eventbridge.Client
+type EventBridgeAPI interface {
+	PutEvents(ctx context.Context, input *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// EventBridge puts each event on an event bus, with the event type as detail type & the message as detail
+type EventBridge struct {
+	api    EventBridgeAPI
+	bus    string
+	source string
+}
+
+// NewEventBridge creates a publisher putting events on bus with the given source
+func NewEventBridge(api EventBridgeAPI, bus, source string) *EventBridge {
+	return &EventBridge{api: api, bus: bus, source: source}
+}
+
+func (b *EventBridge) Publish(ctx context.Context, e Event) error {
+	detail, err := json.Marshal(MessageOf(e))
+	if err != nil {
+		return err
+	}
+
+	out, err := b.api.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []ebtypes.PutEventsRequestEntry{{
+			EventBusName: aws.String(b.bus),
+			Source:       aws.String(b.source),
+			DetailType:   aws.String(e.Type),
+			Detail:       aws.String(string(detail)),
+			Time:         aws.Time(time.Unix(e.OccurredAt, 0)),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put event: %w", err)
+	}
+
+	if out.FailedEntryCount > 0 && len(out.Entries) > 0 {
+		entry := out.Entries[0]
+		return fmt.Errorf("failed to put event: %s: %s", aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+	}
+	if out.FailedEntryCount > 0 {
+		return errors.New("failed to put event")
+	}
+
+	return nil
+}
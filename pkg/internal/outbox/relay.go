@@ -0,0 +1,155 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+)
+
+// DefaultMaxAttempts is how often the relay tries to publish an event before dead lettering it
+const DefaultMaxAttempts = 8
+
+// Publisher delivers events to consumers.
+// Publish may be called more than once for the same event; e.ID identifies duplicates.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Relay moves events from the outbox to a publisher
+type Relay struct {
+	outbox      *Outbox
+	publisher   Publisher
+	maxAttempts int
+
+	// Backoff returns how long to wait before the next attempt after the given number of failures
+	Backoff func(attempts int) time.Duration
+	// Now returns the current time, replaceable in tests
+	Now func() time.Time
+}
+
+// RelayResult counts what a relay run did
+type RelayResult struct {
+	Delivered int `json:"delivered"`
+	Retried   int `json:"retried"`  // failed & rescheduled
+	Dead      int `json:"dead"`     // failed too often & moved to the dead letters
+	Deferred  int `json:"deferred"` // not due yet, or behind an undelivered event of the same aggregate
+}
+
+// NewRelay creates a relay publishing the events of o; maxAttempts <= 0 uses DefaultMaxAttempts
+func NewRelay(o *Outbox, publisher Publisher, maxAttempts int) *Relay {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	return &Relay{
+		outbox:      o,
+		publisher:   publisher,
+		maxAttempts: maxAttempts,
+		Backoff:     backoff,
+		Now:         time.Now,
+	}
+}
+
+// backoff doubles from 30 seconds up to about half an hour
+func backoff(attempts int) time.Duration {
+	if attempts > 7 {
+		attempts = 7
+	}
+
+	return time.Duration(1<<attempts) * 15 * time.Second
+}
+
+// Run delivers every due event once, oldest first.
+// Events of one aggregate are published in order: once one of them is not delivered,
+// the later ones wait for the next run.
+func (r *Relay) Run(ctx context.Context) (RelayResult, error) {
+	var result RelayResult
+
+	events, err := r.outbox.Pending(ctx)
+	if err != nil {
+		return result, fmt.Errorf("outbox: listing pending events: %w", err)
+	}
+
+	blocked := map[string]bool{}
+	now := r.Now().Unix()
+
+	for _, e := range events {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		if blocked[e.AggregateID] || e.NextAttemptAt > now {
+			blocked[e.AggregateID] = true
+			result.Deferred++
+			continue
+		}
+
+		pubErr := r.publisher.Publish(ctx, e)
+		if pubErr == nil {
+			if err := r.outbox.events.Delete(ctx, db.Keys{"id": e.ID}); err != nil {
+				// the event is published again on the next run, consumers drop the duplicate
+				return result, fmt.Errorf("outbox: removing delivered event %s: %w", e.ID, err)
+			}
+			result.Delivered++
+			continue
+		}
+
+		blocked[e.AggregateID] = true
+		log.Printf("outbox: publishing %s event %s failed (attempt %d): %v", e.Type, e.ID, e.Attempts+1, pubErr)
+
+		dead, err := r.fail(ctx, e, pubErr)
+		if err != nil {
+			return result, err
+		}
+		if dead {
+			result.Dead++
+		} else {
+			result.Retried++
+		}
+	}
+
+	return result, nil
+}
+
+// fail records a failed attempt, moving the event to the dead letters once it ran out of attempts
+func (r *Relay) fail(ctx context.Context, e Event, pubErr error) (dead bool, err error) {
+	e.Attempts++
+	e.LastError = pubErr.Error()
+
+	if e.Attempts < r.maxAttempts {
+		e.NextAttemptAt = r.Now().Add(r.Backoff(e.Attempts)).Unix()
+
+		err := r.outbox.events.Update(ctx, db.Keys{"id": e.ID}, map[string]interface{}{
+			"attempts":      e.Attempts,
+			"nextAttemptAt": e.NextAttemptAt,
+			"lastError":     e.LastError,
+		})
+		if errors.Is(err, db.ErrNotFound) {
+			return false, nil // delivered or dead lettered by another run meanwhile
+		}
+		if err != nil {
+			return false, fmt.Errorf("outbox: rescheduling event %s: %w", e.ID, err)
+		}
+
+		return false, nil
+	}
+
+	tx := db.NewTransaction(r.outbox.db)
+	if err := r.outbox.events.DeleteTx(tx, db.Keys{"id": e.ID}); err != nil {
+		return false, err
+	}
+	if err := r.outbox.dead.PutTx(tx, e); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("outbox: dead lettering event %s: %w", e.ID, err)
+	}
+
+	log.Printf("outbox: %s event %s dead lettered after %d attempts", e.Type, e.ID, e.Attempts)
+
+	return true, nil
+}
@@ -0,0 +1,174 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/outbox"
+)
+
+// publisher records the types of the events it publishes, failing those of failing types
+type publisher struct {
+	failures  map[string]int // by event type, how many more attempts fail; -1 fails forever
+	published []string
+}
+
+func (p *publisher) Publish(ctx context.Context, e outbox.Event) error {
+	if n := p.failures[e.Type]; n != 0 {
+		p.failures[e.Type] = n - 1
+		return errors.New("bus unavailable")
+	}
+
+	p.published = append(p.published, e.Type)
+	return nil
+}
+
+// clock is a settable time for Relay.Now
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newOutbox stores events named by their types, e.g. "A1" about aggregate "A", in the given order
+func newOutbox(t *testing.T, types ...string) *outbox.Outbox {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := db.New(engine)
+	table := testTable.New(database, "test")
+	o := outbox.New(database, table.Schema())
+
+	for _, typ := range types {
+		e, err := outbox.NewEvent(typ, typ[:1], map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := table.Transaction()
+		if err := o.Append(tx, e); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return o
+}
+
+func run(t *testing.T, r *outbox.Relay, want outbox.RelayResult) {
+	t.Helper()
+
+	got, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Run = %+v, want %+v", got, want)
+	}
+}
+
+func TestRelayRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	o := newOutbox(t, "A1")
+	pub := &publisher{failures: map[string]int{"A1": 2}}
+	relay := outbox.NewRelay(o, pub, 0)
+	clock := &clock{now: time.Unix(1_700_000_000, 0)}
+	relay.Now = clock.Now
+	start := clock.Now()
+
+	run(t, relay, outbox.RelayResult{Retried: 1})
+
+	pending, err := o.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "bus unavailable" {
+		t.Fatalf("pending = %+v, want A1 after 1 failed attempt", pending)
+	}
+	if next := time.Unix(pending[0].NextAttemptAt, 0); !next.Equal(start.Add(30 * time.Second)) {
+		t.Errorf("next attempt at %s, want 30s after the first", next.Sub(start))
+	}
+
+	clock.Advance(29 * time.Second)
+	run(t, relay, outbox.RelayResult{Deferred: 1})
+
+	clock.Advance(time.Second)
+	run(t, relay, outbox.RelayResult{Retried: 1})
+
+	// the backoff doubles: 60s after the second failure
+	clock.Advance(59 * time.Second)
+	run(t, relay, outbox.RelayResult{Deferred: 1})
+
+	clock.Advance(time.Second)
+	run(t, relay, outbox.RelayResult{Delivered: 1})
+
+	if pending, _ := o.Pending(ctx); len(pending) != 0 {
+		t.Errorf("pending after delivery = %+v", pending)
+	}
+	if !reflect.DeepEqual(pub.published, []string{"A1"}) {
+		t.Errorf("published %q, want A1 once", pub.published)
+	}
+}
+
+func TestRelayDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	o := newOutbox(t, "A1", "A2", "B1")
+	pub := &publisher{failures: map[string]int{"A1": -1}}
+	relay := outbox.NewRelay(o, pub, 3)
+	relay.Backoff = func(int) time.Duration { return 0 }
+
+	run(t, relay, outbox.RelayResult{Retried: 1, Deferred: 1, Delivered: 1})
+	run(t, relay, outbox.RelayResult{Retried: 1, Deferred: 1})
+	run(t, relay, outbox.RelayResult{Dead: 1, Deferred: 1})
+
+	dead, err := o.Dead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Type != "A1" || dead[0].Attempts != 3 || dead[0].LastError != "bus unavailable" {
+		t.Fatalf("dead letters = %+v, want A1 after 3 attempts", dead)
+	}
+
+	// the dead letter no longer holds back the later events of its aggregate
+	run(t, relay, outbox.RelayResult{Delivered: 1})
+
+	if pending, _ := o.Pending(ctx); len(pending) != 0 {
+		t.Errorf("pending = %+v, want none", pending)
+	}
+	if !reflect.DeepEqual(pub.published, []string{"B1", "A2"}) {
+		t.Errorf("published %q, want B1 then A2", pub.published)
+	}
+}
+
+func TestRelayOrdersAggregates(t *testing.T) {
+	o := newOutbox(t, "A1", "B1", "A2", "C1", "A3", "B2")
+	pub := &publisher{failures: map[string]int{"A1": 1}}
+	relay := outbox.NewRelay(o, pub, 0)
+	clock := &clock{now: time.Unix(1_700_000_000, 0)}
+	relay.Now = clock.Now
+
+	// A1 fails, so A2 & A3 wait behind it while the other aggregates go on
+	run(t, relay, outbox.RelayResult{Retried: 1, Deferred: 2, Delivered: 3})
+	if !reflect.DeepEqual(pub.published, []string{"B1", "C1", "B2"}) {
+		t.Fatalf("published %q, want B1, C1 & B2", pub.published)
+	}
+
+	// A1 is not due yet, which holds back A2 & A3 as well
+	run(t, relay, outbox.RelayResult{Deferred: 3})
+
+	clock.Advance(time.Hour)
+	run(t, relay, outbox.RelayResult{Delivered: 3})
+
+	if want := []string{"B1", "C1", "B2", "A1", "A2", "A3"}; !reflect.DeepEqual(pub.published, want) {
+		t.Errorf("published %q, want %q", pub.published, want)
+	}
+}
@@ -0,0 +1,262 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Apply applies the patch to a copy of doc, the JSON form of an item, and returns the patched copy
+func (p *Patch) Apply(doc map[string]interface{}) (map[string]interface{}, error) {
+	out := deepCopy(doc).(map[string]interface{})
+
+	if p.merge != nil {
+		return mergePatch(out, p.merge).(map[string]interface{}), nil
+	}
+
+	var node interface{} = out
+	for _, op := range p.ops {
+		var err error
+		if node, err = op.apply(node); err != nil {
+			return nil, err
+		}
+	}
+
+	return node.(map[string]interface{}), nil
+}
+
+// mergePatch is the MergePatch function of RFC 7396
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
+
+func (op operation) apply(doc interface{}) (interface{}, error) {
+	switch op.op {
+	case "add":
+		return walk(doc, op.path, addLeaf(deepCopy(op.value)))
+	case "remove":
+		return walk(doc, op.path, removeLeaf)
+	case "replace":
+		return walk(doc, op.path, replaceLeaf(deepCopy(op.value)))
+	case "move":
+		v, err := get(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = walk(doc, op.from, removeLeaf); err != nil {
+			return nil, err
+		}
+		return walk(doc, op.path, addLeaf(v))
+	case "copy":
+		v, err := get(doc, op.from)
+		if err != nil {
+			return nil, err
+		}
+		return walk(doc, op.path, addLeaf(deepCopy(v)))
+	case "test":
+		v, err := get(doc, op.path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTestFailed, err)
+		}
+		if !reflect.DeepEqual(v, op.value) {
+			return nil, fmt.Errorf("%w: %s", ErrTestFailed, displayPath(op.path))
+		}
+		return doc, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalid, op.op)
+}
+
+// leaf changes the member tok of parent, returning the changed parent
+type leaf func(parent interface{}, tok string) (interface{}, error)
+
+// walk descends to the parent of the last token of path & lets change modify it.
+// Every container on the way is updated in place, so slices that grow are stored back.
+func walk(node interface{}, path []string, change leaf) (interface{}, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, notFound(path)
+		}
+		c, err := walk(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = c
+		return n, nil
+	case []interface{}:
+		i, err := index(path[0], len(n))
+		if err != nil {
+			return nil, err
+		}
+		c, err := walk(n[i], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = c
+		return n, nil
+	}
+
+	return nil, notFound(path)
+}
+
+func addLeaf(v interface{}) leaf {
+	return func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[tok] = v
+			return p, nil
+		case []interface{}:
+			if tok == "-" {
+				return append(p, v), nil
+			}
+			i, err := index(tok, len(p)+1)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = v
+			return p, nil
+		}
+
+		return nil, notFound([]string{tok})
+	}
+}
+
+func replaceLeaf(v interface{}) leaf {
+	return func(parent interface{}, tok string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[tok]; !ok {
+				return nil, notFound([]string{tok})
+			}
+			p[tok] = v
+			return p, nil
+		case []interface{}:
+			i, err := index(tok, len(p))
+			if err != nil {
+				return nil, err
+			}
+			p[i] = v
+			return p, nil
+		}
+
+		return nil, notFound([]string{tok})
+	}
+}
+
+func removeLeaf(parent interface{}, tok string) (interface{}, error) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[tok]; !ok {
+			return nil, notFound([]string{tok})
+		}
+		delete(p, tok)
+		return p, nil
+	case []interface{}:
+		i, err := index(tok, len(p))
+		if err != nil {
+			return nil, err
+		}
+		return append(p[:i], p[i+1:]...), nil
+	}
+
+	return nil, notFound([]string{tok})
+}
+
+// get returns the value at path
+func get(node interface{}, path []string) (interface{}, error) {
+	for i, tok := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[tok]
+			if !ok {
+				return nil, notFound(path[:i+1])
+			}
+			node = v
+		case []interface{}:
+			idx, err := index(tok, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[idx]
+		default:
+			return nil, notFound(path[:i+1])
+		}
+	}
+
+	return node, nil
+}
+
+// index parses an array index that must be below n
+func index(tok string, n int) (int, error) {
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || i >= n || (len(tok) > 1 && tok[0] == '0') {
+		return 0, fmt.Errorf("%w: array index %s out of range", ErrInvalid, tok)
+	}
+
+	return i, nil
+}
+
+func notFound(path []string) error {
+	return fmt.Errorf("%w: %s does not exist", ErrInvalid, displayPath(path))
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = deepCopy(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = deepCopy(e)
+		}
+		return out
+	}
+
+	return v
+}
+
+// toDocument returns the JSON form of v as a map
+func toDocument(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,210 @@
+package patch
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// Changes are the top level attributes a patch sets & removes
+type Changes struct {
+	Set    map[string]interface{} // new values by attribute
+	Remove []string               // attributes to remove
+	old    map[string]interface{} // values the patch was applied to, by attribute; nil when absent
+}
+
+// Empty reports whether the patch changes nothing
+func (c *Changes) Empty() bool {
+	return len(c.Set) == 0 && len(c.Remove) == 0
+}
+
+// Item applies the patch to the JSON form of item & returns the resulting changes
+func Item(item interface{}, p *Patch, fields Fields) (*Changes, error) {
+	before, err := toDocument(item)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := p.Apply(before)
+	if err != nil {
+		return nil, err
+	}
+
+	return Diff(before, after, fields)
+}
+
+// Diff compares two JSON documents & returns the changes of their top level fields.
+// Every changed field is checked against its allow-list entry.
+func Diff(before, after map[string]interface{}, fields Fields) (*Changes, error) {
+	if err := fields.validate(before, after); err != nil {
+		return nil, err
+	}
+
+	c := &Changes{Set: map[string]interface{}{}, old: map[string]interface{}{}}
+
+	for _, name := range changedFields(before, after) {
+		if fields.check([]string{name}) != nil && !fields.hasNested([]string{name}) {
+			return nil, fmt.Errorf("%w: %s cannot be changed", ErrInvalid, name)
+		}
+
+		attr := fields.attribute(name)
+		c.old[attr] = before[name]
+
+		if v, ok := after[name]; ok && v != nil {
+			c.Set[attr] = v
+		} else {
+			c.Remove = append(c.Remove, attr)
+		}
+	}
+
+	return c, nil
+}
+
+// Update is the part of an update builder the changes are added to, such as *testTable.Update
+type Update[U any] interface {
+	Set(path string, value interface{}) U
+	Remove(paths ...string) U
+	If(cond expression.ConditionBuilder) U
+}
+
+// ApplyTo adds the changes to u, made conditional on the changed attributes still holding their old values
+func ApplyTo[U Update[U]](c *Changes, u U) U {
+	for _, attr := range sortedKeys(c.Set) {
+		u.Set(attr, c.Set[attr])
+	}
+	u.Remove(c.Remove...)
+
+	for _, attr := range sortedKeys(c.old) {
+		u.If(unchanged(attr, c.old[attr]))
+	}
+
+	return u
+}
+
+// unchanged holds while attr has the value old.
+// Zero JSON values may not be stored at all, so they also match a missing attribute.
+func unchanged(attr string, old interface{}) expression.ConditionBuilder {
+	name := expression.Name(attr)
+	if old == nil {
+		return expression.AttributeNotExists(name)
+	}
+
+	cond := name.Equal(expression.Value(old))
+	if reflect.ValueOf(old).IsZero() || isEmpty(old) {
+		cond = expression.Or(expression.AttributeNotExists(name), cond)
+	}
+
+	return cond
+}
+
+func isEmpty(v interface{}) bool {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	}
+
+	return false
+}
+
+// validate checks the new value of every allowed field the patch changed
+func (f Fields) validate(before, after map[string]interface{}) error {
+	for _, name := range sortedKeys(f) {
+		field := f[name]
+		path := strings.Split(name, ".")
+		old, _ := lookup(before, path)
+		v, exists := lookup(after, path)
+
+		if reflect.DeepEqual(old, v) {
+			continue
+		}
+
+		if !exists || v == nil {
+			if !field.Nullable {
+				return fmt.Errorf("%w: %s cannot be removed", ErrInvalid, name)
+			}
+			continue
+		}
+
+		if !field.Kind.matches(v) {
+			return fmt.Errorf("%w: %s must be %s", ErrInvalid, name, field.Kind)
+		}
+
+		if field.Validate != nil {
+			if err := field.Validate(v); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalid, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (k Kind) matches(v interface{}) bool {
+	switch k {
+	case String:
+		_, ok := v.(string)
+		return ok
+	case Number:
+		_, ok := v.(float64)
+		return ok
+	case Bool:
+		_, ok := v.(bool)
+		return ok
+	case Object:
+		_, ok := v.(map[string]interface{})
+		return ok
+	case Array:
+		_, ok := v.([]interface{})
+		return ok
+	}
+
+	return true
+}
+
+// lookup returns the value at a path of object members
+func lookup(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var node interface{} = doc
+	for _, name := range path {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+func changedFields(before, after map[string]interface{}) []string {
+	var names []string
+	for name, v := range after {
+		if old, ok := before[name]; !ok || !reflect.DeepEqual(old, v) {
+			names = append(names, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,103 @@
+package patch_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/patch"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TestApplyToConditions runs the updates ApplyTo builds on an item written to meanwhile: they only
+// succeed while every attribute the patch changes still holds the value the patch was applied to
+func TestApplyToConditions(t *testing.T) {
+	ctx := context.Background()
+
+	profile := patch.Fields{
+		"name":     {Kind: patch.String, Attribute: "fullName"},
+		"nickname": {Kind: patch.String, Nullable: true},
+		"bio":      {Kind: patch.String},
+		"tags":     {Kind: patch.Array, Nullable: true},
+	}
+
+	// bio is empty, so it is not stored at all; nickname is not set
+	stored := map[string]interface{}{"fullName": "Ann", "tags": []string{"a", "b"}, "role": "user"}
+	before := map[string]interface{}{"name": "Ann", "bio": "", "tags": []interface{}{"a", "b"}}
+	after := map[string]interface{}{"name": "Bea", "bio": "hi", "nickname": "bee"}
+
+	tests := []struct {
+		name      string
+		meanwhile map[string]interface{} // written between reading the item & the update
+		removed   string                 // removed between reading the item & the update
+		ok        bool
+	}{
+		{"nothing changed", nil, "", true},
+		{"unpatched attribute changed", map[string]interface{}{"role": "admin"}, "", true},
+		{"patched attribute changed", map[string]interface{}{"fullName": "Cid"}, "", false},
+		{"missing attribute set", map[string]interface{}{"nickname": "annie"}, "", false},
+		{"empty attribute set", map[string]interface{}{"bio": "other"}, "", false},
+		{"empty attribute stored empty", map[string]interface{}{"bio": ""}, "", true},
+		{"removed attribute already removed", nil, "tags", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := memory.New(testTable.Definition("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			table := testTable.New(db.New(engine), "test")
+
+			if _, err := table.Update("PROFILES", "1").SetAll(stored).Exec(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			changes, err := patch.Diff(before, after, profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.meanwhile != nil {
+				if _, err := table.Update("PROFILES", "1").SetAll(tt.meanwhile).Exec(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.removed != "" {
+				if _, err := table.Update("PROFILES", "1").Remove(tt.removed).Exec(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			av, err := patch.ApplyTo(changes, table.Update("PROFILES", "1").Returning(types.ReturnValueAllNew)).Exec(ctx)
+			if !tt.ok {
+				if !db.IsConditionFailed(err) {
+					t.Errorf("update = %v, want a condition failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var item map[string]interface{}
+			if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{"fullName": "Bea", "bio": "hi", "nickname": "bee"}
+			for attr, v := range want {
+				if !reflect.DeepEqual(item[attr], v) {
+					t.Errorf("%s = %v, want %v", attr, item[attr], v)
+				}
+			}
+			if _, ok := item["tags"]; ok {
+				t.Errorf("tags = %v, want removed", item["tags"])
+			}
+		})
+	}
+}
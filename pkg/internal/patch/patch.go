@@ -0,0 +1,287 @@
+// Package patch implements partial updates from RFC 7396 JSON Merge Patch & RFC 6902 JSON Patch documents.
+//
+// A patch is parsed & checked against an allow-list of the fields clients may change, applied to the
+// JSON form of the current item, and the changed top level fields become the SET & REMOVE actions of
+// a single conditional update. The update only succeeds while the changed attributes still hold the
+// values the patch was applied to, so concurrent writes are never silently overwritten.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Media types of the supported patch documents
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalid is wrapped by every error caused by a malformed or disallowed patch
+	ErrInvalid = errors.New("invalid patch")
+	// ErrUnsupportedType is returned for request bodies that are not a patch document
+	ErrUnsupportedType = errors.New("unsupported patch media type")
+	// ErrTestFailed is returned when a JSON Patch `test` operation does not hold
+	ErrTestFailed = errors.New("patch test failed")
+)
+
+// Kind is the JSON type a field accepts
+type Kind int
+
+const (
+	Any Kind = iota
+	String
+	Number
+	Bool
+	Object
+	Array
+)
+
+func (k Kind) String() string {
+	return [...]string{"any value", "a string", "a number", "a boolean", "an object", "an array"}[k]
+}
+
+// Field describes a field clients may patch
+type Field struct {
+	Kind      Kind
+	Attribute string                        // stored attribute of a top level field, its JSON name when empty
+	Nullable  bool                          // the field may be removed
+	Validate  func(value interface{}) error // optional check of a new value
+}
+
+// Fields is the allow-list of patchable fields by JSON name.
+// Nested fields are named with dots, e.g. "address.city". Allowing a field allows everything inside it.
+type Fields map[string]Field
+
+// Operation is a single RFC 6902 operation
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Patch is a parsed patch document whose paths are all allowed
+type Patch struct {
+	merge interface{} // merge patch object, nil for a JSON Patch
+	ops   []operation
+}
+
+type operation struct {
+	op         string
+	path, from []string
+	value      interface{}
+}
+
+// Parse parses a patch document of the given content type.
+// Plain application/json bodies are treated as merge patches.
+func Parse(contentType string, body []byte, fields Fields) (*Patch, error) {
+	mediaType := MergePatchType
+	if contentType != "" {
+		t, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+		}
+		mediaType = t
+	}
+
+	switch mediaType {
+	case MergePatchType, "application/json":
+		return ParseMergePatch(body, fields)
+	case JSONPatchType:
+		return ParseJSONPatch(body, fields)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, mediaType)
+}
+
+// ParseMergePatch parses an RFC 7396 merge patch; a null member removes the field
+func ParseMergePatch(body []byte, fields Fields) (*Patch, error) {
+	var doc interface{}
+	if err := decode(body, &doc); err != nil {
+		return nil, err
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: a merge patch must be a JSON object", ErrInvalid)
+	}
+
+	if err := fields.checkMerge(nil, obj); err != nil {
+		return nil, err
+	}
+
+	return &Patch{merge: obj}, nil
+}
+
+// ParseJSONPatch parses an RFC 6902 JSON Patch, a list of add, remove, replace, move, copy & test operations
+func ParseJSONPatch(body []byte, fields Fields) (*Patch, error) {
+	var ops []Operation
+	if err := decode(body, &ops); err != nil {
+		return nil, err
+	}
+
+	p := &Patch{}
+	for i, o := range ops {
+		op, err := fields.parseOperation(o)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		p.ops = append(p.ops, op)
+	}
+
+	return p, nil
+}
+
+func decode(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: unexpected data after the document", ErrInvalid)
+	}
+
+	return nil
+}
+
+func (f Fields) parseOperation(o Operation) (operation, error) {
+	op := operation{op: o.Op}
+
+	path, err := parsePointer(o.Path)
+	if err != nil {
+		return op, err
+	}
+	op.path = path
+
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return op, fmt.Errorf("%w: %s needs a value", ErrInvalid, o.Op)
+		}
+		if err := json.Unmarshal(o.Value, &op.value); err != nil {
+			return op, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	case "remove":
+	case "move", "copy":
+		if op.from, err = parsePointer(o.From); err != nil {
+			return op, err
+		}
+		if o.Op == "move" && isPrefix(op.from, op.path) && len(op.from) < len(op.path) {
+			return op, fmt.Errorf("%w: cannot move %s into itself", ErrInvalid, o.From)
+		}
+		if err := f.check(op.from); err != nil {
+			return op, err
+		}
+	default:
+		return op, fmt.Errorf("%w: unknown operation %q", ErrInvalid, o.Op)
+	}
+
+	// test only reads, but is restricted as well so the patch cannot probe hidden fields
+	return op, f.check(op.path)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" || pointer == "/" {
+		return nil, fmt.Errorf("%w: the whole document cannot be patched", ErrInvalid)
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalid, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// check fails unless path is an allowed field or inside one
+func (f Fields) check(path []string) error {
+	var names []string
+	for _, t := range path {
+		if isIndex(t) {
+			continue
+		}
+		names = append(names, t)
+		if _, ok := f[strings.Join(names, ".")]; ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s cannot be changed", ErrInvalid, displayPath(path))
+}
+
+// checkMerge checks the members of a merge patch object, descending into objects whose own fields are allowed
+func (f Fields) checkMerge(prefix []string, obj map[string]interface{}) error {
+	for k, v := range obj {
+		path := append(append([]string(nil), prefix...), k)
+		if f.check(path) == nil {
+			continue
+		}
+
+		nested, ok := v.(map[string]interface{})
+		if !ok || !f.hasNested(path) {
+			return fmt.Errorf("%w: %s cannot be changed", ErrInvalid, displayPath(path))
+		}
+		if err := f.checkMerge(path, nested); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasNested reports whether fields inside path are allowed
+func (f Fields) hasNested(path []string) bool {
+	prefix := strings.Join(path, ".") + "."
+	for name := range f {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attribute returns the stored attribute of a top level field
+func (f Fields) attribute(name string) string {
+	if a := f[name].Attribute; a != "" {
+		return a
+	}
+
+	return name
+}
+
+func isIndex(token string) bool {
+	if token == "-" {
+		return true
+	}
+	_, err := strconv.Atoi(token)
+	return err == nil
+}
+
+func displayPath(path []string) string {
+	return strings.Join(path, ".")
+}
@@ -0,0 +1,216 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"serverless-aws-cdk/internal/patch"
+)
+
+// fields allow the top level fields but role, & the city & lines of address but not its zip code
+var fields = patch.Fields{
+	"name":         {Kind: patch.String},
+	"nickname":     {Kind: patch.String, Nullable: true},
+	"tags":         {Kind: patch.Array, Nullable: true},
+	"address.city": {Kind: patch.String, Nullable: true},
+	"address.line": {Kind: patch.Array},
+}
+
+func document(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	return doc
+}
+
+const before = `{
+	"name": "Ann",
+	"nickname": "annie",
+	"role": "user",
+	"tags": ["a", "b"],
+	"address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}
+}`
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name, patch, want string
+	}{
+		{"sets a field", `{"name": "Bea"}`,
+			`{"name": "Bea", "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"null removes a field", `{"nickname": null}`,
+			`{"name": "Ann", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"null removes a missing field", `{"nickname": null, "tags": null}`,
+			`{"name": "Ann", "role": "user", "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"objects merge", `{"address": {"city": null, "line": ["Jr. Union 2"]}}`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"zip": "15001", "line": ["Jr. Union 2"]}}`},
+		{"arrays are replaced", `{"tags": ["c"]}`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["c"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"empty patch", `{}`, before},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := patch.Parse(patch.MergePatchType, []byte(tt.patch), fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc := document(t, before)
+			got, err := p.Apply(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := document(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("patched = %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(doc, document(t, before)) {
+				t.Errorf("Apply changed its input to %v", doc)
+			}
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name, patch, want string
+	}{
+		{"add a field", `[{"op": "add", "path": "/nickname", "value": "ann"}]`,
+			`{"name": "Ann", "nickname": "ann", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"add into an array", `[{"op": "add", "path": "/tags/1", "value": "x"}, {"op": "add", "path": "/tags/-", "value": "z"}]`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["a", "x", "b", "z"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"remove", `[{"op": "remove", "path": "/nickname"}, {"op": "remove", "path": "/tags/0"}]`,
+			`{"name": "Ann", "role": "user", "tags": ["b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"replace", `[{"op": "replace", "path": "/address/city", "value": "Cusco"}]`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Cusco", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"test then replace", `[{"op": "test", "path": "/name", "value": "Ann"}, {"op": "replace", "path": "/name", "value": "Bea"}]`,
+			`{"name": "Bea", "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"move", `[{"op": "move", "from": "/nickname", "path": "/name"}]`,
+			`{"name": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+		{"copy", `[{"op": "copy", "from": "/tags", "path": "/address/line"}, {"op": "add", "path": "/tags/-", "value": "c"}]`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["a", "b", "c"], "address": {"city": "Lima", "zip": "15001", "line": ["a", "b"]}}`},
+		{"escaped pointers", `[{"op": "add", "path": "/tags/0", "value": "a/b~c"}, {"op": "test", "path": "/tags/0", "value": "a/b~c"}]`,
+			`{"name": "Ann", "nickname": "annie", "role": "user", "tags": ["a/b~c", "a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := patch.Parse(patch.JSONPatchType, []byte(tt.patch), fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.Apply(document(t, before))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := document(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("patched = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, contentType, patch string
+		want                     error
+	}{
+		{"unsupported type", "text/plain", `{}`, patch.ErrUnsupportedType},
+		{"malformed type", "application/", `{}`, patch.ErrUnsupportedType},
+		{"malformed JSON", patch.MergePatchType, `{"name":`, patch.ErrInvalid},
+		{"data after the document", patch.MergePatchType, `{} {}`, patch.ErrInvalid},
+		{"merge patch of an array", patch.MergePatchType, `["name"]`, patch.ErrInvalid},
+		{"merge patch of a hidden field", patch.MergePatchType, `{"role": "admin"}`, patch.ErrInvalid},
+		{"merge patch of a hidden nested field", patch.MergePatchType, `{"address": {"zip": "1"}}`, patch.ErrInvalid},
+		{"merge patch replacing a partly allowed object", "application/json", `{"address": "Lima"}`, patch.ErrInvalid},
+		{"JSON Patch of an object", patch.JSONPatchType, `{"op": "remove", "path": "/name"}`, patch.ErrInvalid},
+		{"unknown operation", patch.JSONPatchType, `[{"op": "increment", "path": "/name"}]`, patch.ErrInvalid},
+		{"add without a value", patch.JSONPatchType, `[{"op": "add", "path": "/name"}]`, patch.ErrInvalid},
+		{"whole document", patch.JSONPatchType, `[{"op": "replace", "path": "", "value": {}}]`, patch.ErrInvalid},
+		{"relative path", patch.JSONPatchType, `[{"op": "remove", "path": "name"}]`, patch.ErrInvalid},
+		{"hidden path", patch.JSONPatchType, `[{"op": "replace", "path": "/role", "value": "admin"}]`, patch.ErrInvalid},
+		{"hidden nested path", patch.JSONPatchType, `[{"op": "remove", "path": "/address/zip"}]`, patch.ErrInvalid},
+		{"test of a hidden path", patch.JSONPatchType, `[{"op": "test", "path": "/role", "value": "admin"}]`, patch.ErrInvalid},
+		{"copy from a hidden path", patch.JSONPatchType, `[{"op": "copy", "from": "/role", "path": "/name"}]`, patch.ErrInvalid},
+		{"move into itself", patch.JSONPatchType, `[{"op": "move", "from": "/tags", "path": "/tags/0"}]`, patch.ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := patch.Parse(tt.contentType, []byte(tt.patch), fields); !errors.Is(err, tt.want) {
+				t.Errorf("Parse = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name, patch string
+		want        error
+	}{
+		{"failed test", `[{"op": "test", "path": "/name", "value": "Bea"}]`, patch.ErrTestFailed},
+		{"test of a missing field", `[{"op": "test", "path": "/address/city/x", "value": 1}]`, patch.ErrTestFailed},
+		{"remove of a missing field", `[{"op": "remove", "path": "/address/city/x"}]`, patch.ErrInvalid},
+		{"replace of a missing field", `[{"op": "remove", "path": "/nickname"}, {"op": "replace", "path": "/nickname", "value": "x"}]`, patch.ErrInvalid},
+		{"index out of range", `[{"op": "add", "path": "/tags/3", "value": "x"}]`, patch.ErrInvalid},
+		{"index with a leading zero", `[{"op": "remove", "path": "/tags/01"}]`, patch.ErrInvalid},
+		{"move from a missing field", `[{"op": "move", "from": "/tags/5", "path": "/name"}]`, patch.ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := patch.Parse(patch.JSONPatchType, []byte(tt.patch), fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.Apply(document(t, before)); !errors.Is(err, tt.want) {
+				t.Errorf("Apply = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	short := patch.Fields{
+		"name": {Kind: patch.String, Attribute: "fullName", Validate: func(v interface{}) error {
+			if len(v.(string)) > 5 {
+				return errors.New("too long")
+			}
+			return nil
+		}},
+		"nickname": {Kind: patch.String, Nullable: true},
+		"tags":     {Kind: patch.Array, Nullable: true},
+	}
+
+	changes, err := patch.Diff(document(t, before), document(t, `{
+		"name": "Bea",
+		"role": "user",
+		"tags": ["a", "b"],
+		"address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}
+	}`), short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes.Set, map[string]interface{}{"fullName": "Bea"}) || !reflect.DeepEqual(changes.Remove, []string{"nickname"}) {
+		t.Errorf("changes = set %v remove %v, want fullName set & nickname removed", changes.Set, changes.Remove)
+	}
+
+	for name, after := range map[string]string{
+		"invalid value":         `{"name": "Beatrice", "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`,
+		"wrong kind":            `{"name": 7, "nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`,
+		"removed, not nullable": `{"nickname": "annie", "role": "user", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`,
+		"hidden field changed":  `{"name": "Ann", "nickname": "annie", "role": "admin", "tags": ["a", "b"], "address": {"city": "Lima", "zip": "15001", "line": ["Av. Arequipa 1"]}}`,
+	} {
+		if _, err := patch.Diff(document(t, before), document(t, after), short); !errors.Is(err, patch.ErrInvalid) {
+			t.Errorf("Diff with %s = %v, want ErrInvalid", name, err)
+		}
+	}
+}
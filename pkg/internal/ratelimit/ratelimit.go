@@ -0,0 +1,224 @@
+// Package ratelimit counts events per key in fixed time windows stored in the main table.
+//
+// Each window is one item whose counter is incremented atomically, on the condition that it is
+// below the limit, so concurrent Lambdas never let more events through than allowed. Windows
+// expire through the table's time to live once they are over. A Counter counts the same way
+// without a limit, for callers deciding themselves what a count means.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Window is the stored counter of one key during one window
+type Window struct {
+	Name  string `json:"name" dynamodbav:"name"`
+	Key   string `json:"key" dynamodbav:"key"`
+	Start string `json:"start" dynamodbav:"start"` // unix seconds the window began at
+	Count int    `json:"count" dynamodbav:"count"`
+	Last  int64  `json:"last,omitempty" dynamodbav:"last,omitempty"` // unix seconds of the latest event, kept by Counter
+}
+
+// Windows stores the windows of a key in their own partition
+var Windows = db.RegisterEntity[Window](db.EntityOptions{
+	Type:         "RATE_WINDOW",
+	PartitionKey: "RATE#{name}#{key}",
+	SortKey:      "WINDOW#{start}",
+})
+
+// ErrLimited matches every *LimitedError
+var ErrLimited = errors.New("rate limit reached")
+
+// LimitedError is returned by callers refusing an event over the limit
+type LimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit reached, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *LimitedError) Unwrap() error {
+	return ErrLimited
+}
+
+// Decision is the outcome of counting an event
+type Decision struct {
+	Allowed    bool
+	Count      int           // events counted in the window, including this one when allowed
+	RetryAfter time.Duration // until the window ends, when not allowed
+}
+
+// Err returns a *LimitedError when the event was not allowed, nil otherwise
+func (d Decision) Err() error {
+	if d.Allowed {
+		return nil
+	}
+
+	return &LimitedError{RetryAfter: d.RetryAfter}
+}
+
+// windows reads & increments the windows of one named counter
+type windows struct {
+	db     db.Client
+	table  db.Table
+	name   string
+	window time.Duration
+}
+
+// Limiter allows up to limit events per key & window
+type Limiter struct {
+	windows
+	limit int
+}
+
+// New creates a limiter of limit events per window, named to keep its counters apart from other limiters
+func New(database db.Client, table db.Table, name string, limit int, window time.Duration) *Limiter {
+	return &Limiter{windows: windows{db: database, table: table, name: name, window: window}, limit: limit}
+}
+
+// Allow counts an event for key unless the limit of the current window is reached
+func (l *Limiter) Allow(ctx context.Context, key string) (Decision, error) {
+	_, end := l.bounds(db.Now())
+
+	cond := expression.AttributeNotExists(expression.Name("count")).
+		Or(expression.Name("count").LessThan(expression.Value(l.limit)))
+
+	w, err := l.add(ctx, key, &cond)
+	if db.IsConditionFailed(err) {
+		return Decision{Allowed: false, Count: l.limit, RetryAfter: end.Sub(db.Now())}, nil
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+
+	return Decision{Allowed: true, Count: w.Count}, nil
+}
+
+// Counter counts every event per key & window, & remembers when the latest one happened
+type Counter struct {
+	windows
+}
+
+// NewCounter creates a counter of events per window, named to keep its counters apart from other counters
+func NewCounter(database db.Client, table db.Table, name string, window time.Duration) *Counter {
+	return &Counter{windows: windows{db: database, table: table, name: name, window: window}}
+}
+
+// Add counts an event for key & returns the current window including it
+func (c *Counter) Add(ctx context.Context, key string) (Window, error) {
+	return c.add(ctx, key, nil)
+}
+
+// Get returns the current window of key, with a zero Count when nothing happened in it yet
+func (c *Counter) Get(ctx context.Context, key string) (Window, error) {
+	w, err := c.repository().Get(ctx, c.keys(key, db.Now()))
+	if errors.Is(err, db.ErrNotFound) {
+		return Window{Name: c.name, Key: key}, nil
+	}
+
+	return w, err
+}
+
+// Reset forgets the events of key in the current window
+func (c *Counter) Reset(ctx context.Context, key string) error {
+	return c.repository().Delete(ctx, c.keys(key, db.Now()))
+}
+
+func (w *windows) repository() *db.Repository[Window] {
+	return db.NewRepository(w.db, w.table, Windows)
+}
+
+// keys returns the keys of the window of key containing t
+func (w *windows) keys(key string, t time.Time) db.Keys {
+	start, _ := w.bounds(t)
+
+	return db.Keys{"name": w.name, "key": key, "start": strconv.FormatInt(start.Unix(), 10)}
+}
+
+// add increments the counter of the current window of key, on condition cond when it is set
+func (w *windows) add(ctx context.Context, key string, cond *expression.ConditionBuilder) (Window, error) {
+	now := db.Now()
+	_, end := w.bounds(now)
+
+	keys := w.keys(key, now)
+	pk, err := Windows.PartitionKey(keys)
+	if err != nil {
+		return Window{}, err
+	}
+	sk, err := Windows.SortKey(keys)
+	if err != nil {
+		return Window{}, err
+	}
+
+	update := expression.Add(expression.Name("count"), expression.Value(1)).
+		Set(expression.Name(db.TypeAttribute), expression.Value(Windows.Type())).
+		Set(expression.Name("name"), expression.Value(w.name)).
+		Set(expression.Name("key"), expression.Value(key)).
+		Set(expression.Name("start"), expression.Value(keys["start"])).
+		Set(expression.Name("last"), expression.Value(now.Unix()))
+	if w.table.TimeToLive != "" {
+		update = update.Set(expression.Name(w.table.TimeToLive), expression.Value(end.Unix()))
+	}
+
+	builder := expression.NewBuilder().WithUpdate(update)
+	if cond != nil {
+		builder = builder.WithCondition(*cond)
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return Window{}, err
+	}
+
+	itemKey, err := attributevalue.MarshalMap(map[string]string{w.table.PartitionKey: pk, w.table.SortKey: sk})
+	if err != nil {
+		return Window{}, err
+	}
+
+	out, err := w.db.UpdateItemReturning(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(w.table.Name),
+		Key:                       itemKey,
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if db.IsConditionFailed(err) {
+		return Window{}, err
+	}
+	if err != nil {
+		return Window{}, fmt.Errorf("ratelimit: counting %s: %w", w.name, err)
+	}
+
+	var counted Window
+	if err := attributevalue.UnmarshalMap(out, &counted); err != nil {
+		return Window{}, err
+	}
+
+	return counted, nil
+}
+
+// bounds returns the start & end of the window containing t
+func (w *windows) bounds(t time.Time) (time.Time, time.Time) {
+	secs := int64(w.window / time.Second)
+	if secs <= 0 {
+		secs = 1
+	}
+
+	start := time.Unix(t.Unix()/secs*secs, 0)
+
+	return start, start.Add(time.Duration(secs) * time.Second)
+}
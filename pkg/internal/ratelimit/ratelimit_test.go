@@ -0,0 +1,140 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/db/memory"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/ratelimit"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeClock pins db.Now to start for the rest of the test & returns a function moving it forward
+func fakeClock(t *testing.T, start time.Time) func(time.Duration) {
+	t.Helper()
+
+	now := start
+	orig := db.Now
+	db.Now = func() time.Time { return now }
+	t.Cleanup(func() { db.Now = orig })
+
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func newTable(t *testing.T) (db.Client, *testTable.Table) {
+	t.Helper()
+
+	engine, err := memory.New(testTable.Definition("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := db.New(engine)
+
+	return client, testTable.New(client, "test")
+}
+
+// start is 10 seconds into a minute, so windows of a minute end 50 seconds later
+var start = time.Unix(1_700_000_000/60*60+10, 0)
+
+func TestLimiterWindows(t *testing.T) {
+	ctx := context.Background()
+	advance := fakeClock(t, start)
+	client, table := newTable(t)
+	limiter := ratelimit.New(client, table.Schema(), "test", 3, time.Minute)
+
+	for i := 1; i <= 3; i++ {
+		d, err := limiter.Allow(ctx, "a")
+		if err != nil || !d.Allowed || d.Count != i {
+			t.Fatalf("event %d = %+v, %v; want allowed as number %d", i, d, err, i)
+		}
+	}
+
+	d, err := limiter.Allow(ctx, "a")
+	if err != nil || d.Allowed || d.Count != 3 || d.RetryAfter != 50*time.Second {
+		t.Fatalf("event 4 = %+v, %v; want refused for the 50s left of the window", d, err)
+	}
+	var limited *ratelimit.LimitedError
+	if err := d.Err(); !errors.As(err, &limited) || !errors.Is(err, ratelimit.ErrLimited) || limited.RetryAfter != 50*time.Second {
+		t.Errorf("Err = %v, want a *LimitedError retrying in 50s", err)
+	}
+
+	// keys are counted apart
+	if d, err := limiter.Allow(ctx, "b"); err != nil || !d.Allowed || d.Count != 1 {
+		t.Errorf("first event of b = %+v, %v; want allowed", d, err)
+	}
+
+	advance(49 * time.Second)
+	if d, _ := limiter.Allow(ctx, "a"); d.Allowed || d.RetryAfter != time.Second {
+		t.Errorf("event in the last second = %+v, want refused for 1s", d)
+	}
+
+	// the next window starts from zero
+	advance(time.Second)
+	if d, err := limiter.Allow(ctx, "a"); err != nil || !d.Allowed || d.Count != 1 {
+		t.Errorf("first event of the next window = %+v, %v; want allowed as number 1", d, err)
+	}
+}
+
+func TestWindowsExpire(t *testing.T) {
+	ctx := context.Background()
+	fakeClock(t, start)
+	client, table := newTable(t)
+
+	if _, err := ratelimit.New(client, table.Schema(), "test", 3, time.Minute).Allow(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := table.GetItem("RATE#test#a", "WINDOW#"+strconv.FormatInt(start.Unix()-10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strconv.FormatInt(start.Unix()+50, 10)
+	if ttl, ok := item["expiresAt"].(*types.AttributeValueMemberN); !ok || ttl.Value != want {
+		t.Errorf("expiresAt = %#v, want the end of the window %s", item["expiresAt"], want)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	ctx := context.Background()
+	advance := fakeClock(t, start)
+	client, table := newTable(t)
+	counter := ratelimit.NewCounter(client, table.Schema(), "test", time.Minute)
+
+	if w, err := counter.Get(ctx, "a"); err != nil || w.Count != 0 {
+		t.Fatalf("Get before any event = %+v, %v; want a zero count", w, err)
+	}
+
+	// a counter has no limit
+	for i := 1; i <= 5; i++ {
+		advance(time.Second)
+		if w, err := counter.Add(ctx, "a"); err != nil || w.Count != i {
+			t.Fatalf("Add %d = %+v, %v", i, w, err)
+		}
+	}
+
+	w, err := counter.Get(ctx, "a")
+	if err != nil || w.Count != 5 || w.Last != start.Unix()+5 {
+		t.Errorf("Get = %+v, %v; want 5 events, the last at %d", w, err, start.Unix()+5)
+	}
+
+	if err := counter.Reset(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := counter.Get(ctx, "a"); w.Count != 0 {
+		t.Errorf("Get after Reset = %+v, want a zero count", w)
+	}
+
+	if _, err := counter.Add(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	if w, _ := counter.Get(ctx, "a"); w.Count != 0 {
+		t.Errorf("Get in the next window = %+v, want a zero count", w)
+	}
+}
@@ -0,0 +1,232 @@
+// Package streams dispatches DynamoDB stream records to handlers registered per entity type & operation.
+//
+// Record images are decoded once, into the type of the entity registered with On for their
+// discriminator, or else into the Go type the entity registry holds for it.
+// Records are handled in order; when one fails, it & the records after it are reported as
+// batch item failures, so Lambda retries from there without blocking the shard on a poison record
+// forever. The event source mapping should enable ReportBatchItemFailures & bound retries with
+// MaximumRetryAttempts & an on-failure destination.
+package streams
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	"serverless-aws-cdk/internal/db"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Operation is the kind of change a stream record describes
+type Operation string
+
+const (
+	Insert Operation = "INSERT"
+	Modify Operation = "MODIFY"
+	Remove Operation = "REMOVE"
+)
+
+// Record is a decoded stream record
+type Record struct {
+	Operation  Operation
+	EntityType string
+	PK, SK     string
+	Old, New   interface{} // pointers to the entity type, nil when the image is absent
+	OldImage   map[string]types.AttributeValue
+	NewImage   map[string]types.AttributeValue
+	Raw        events.DynamoDBEventRecord
+}
+
+// ChangedAttributes returns the names of the top-level attributes that differ between the images
+func (r *Record) ChangedAttributes() []string {
+	var changed []string
+
+	for k, v := range r.NewImage {
+		if old, ok := r.OldImage[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range r.OldImage {
+		if _, ok := r.NewImage[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// Change is a record with its images decoded as T
+type Change[T any] struct {
+	Operation Operation
+	Old, New  *T
+	Record    *Record
+}
+
+type handler struct {
+	ops map[Operation]bool // empty for every operation
+	fn  func(ctx context.Context, r *Record) error
+}
+
+// decoder decodes a non-nil image into a pointer to an entity type
+type decoder func(image map[string]types.AttributeValue) (interface{}, error)
+
+// Dispatcher routes stream records of one table to handlers
+type Dispatcher struct {
+	table    db.Table
+	handlers map[string][]handler
+	decoders map[string]decoder // by entity type, for the entities registered with On
+}
+
+// New creates a dispatcher for records of table
+func New(table db.Table) *Dispatcher {
+	return &Dispatcher{
+		table:    table,
+		handlers: map[string][]handler{},
+		decoders: map[string]decoder{},
+	}
+}
+
+// On registers fn for changes of entity; without ops it receives every operation.
+// Images of the entity are then decoded as T with the key fields parsed back from pk & sk, for every
+// handler of its type.
+func On[T any](d *Dispatcher, entity *db.Entity[T], fn func(ctx context.Context, c Change[T]) error, ops ...Operation) {
+	repo := db.NewRepository[T](nil, d.table, entity)
+
+	d.decoders[entity.Type()] = func(image map[string]types.AttributeValue) (interface{}, error) {
+		item, err := repo.Unmarshal(image)
+		if err != nil {
+			return nil, err
+		}
+
+		return &item, nil
+	}
+
+	d.OnAny(entity.Type(), func(ctx context.Context, r *Record) error {
+		c := Change[T]{Operation: r.Operation, Record: r}
+		c.Old, _ = r.Old.(*T)
+		c.New, _ = r.New.(*T)
+
+		return fn(ctx, c)
+	}, ops...)
+}
+
+// OnAny registers fn for records of the given entity type, with images decoded through the entity
+// registry unless the type is registered with On
+func (d *Dispatcher) OnAny(entityType string, fn func(ctx context.Context, r *Record) error, ops ...Operation) {
+	h := handler{ops: map[Operation]bool{}, fn: fn}
+	for _, op := range ops {
+		h.ops[op] = true
+	}
+
+	d.handlers[entityType] = append(d.handlers[entityType], h)
+}
+
+// Handle processes a stream batch, reporting the first failed record & every record after it
+func (d *Dispatcher) Handle(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	resp := events.DynamoDBEventResponse{BatchItemFailures: []events.DynamoDBBatchItemFailure{}}
+
+	for i, raw := range event.Records {
+		if err := d.dispatch(ctx, raw); err != nil {
+			log.Printf("streams: record %s (%s) failed: %v", raw.EventID, raw.Change.SequenceNumber, err)
+
+			for _, rest := range event.Records[i:] {
+				resp.BatchItemFailures = append(resp.BatchItemFailures, events.DynamoDBBatchItemFailure{
+					ItemIdentifier: rest.Change.SequenceNumber,
+				})
+			}
+			break
+		}
+	}
+
+	return resp, nil
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, raw events.DynamoDBEventRecord) (err error) {
+	r, err := d.decode(raw)
+	if err != nil || r == nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("handler panicked: %v", p)
+		}
+	}()
+
+	for _, h := range d.handlers[r.EntityType] {
+		if len(h.ops) > 0 && !h.ops[r.Operation] {
+			continue
+		}
+
+		if err := h.fn(ctx, r); err != nil {
+			return fmt.Errorf("%s %s: %w", r.EntityType, r.Operation, err)
+		}
+	}
+
+	return nil
+}
+
+// decode converts a raw record, returning nil for records no handler is interested in
+func (d *Dispatcher) decode(raw events.DynamoDBEventRecord) (*Record, error) {
+	r := &Record{Operation: Operation(raw.EventName), Raw: raw}
+
+	var err error
+	if r.OldImage, err = toAVMap(raw.Change.OldImage); err != nil {
+		return nil, fmt.Errorf("old image: %w", err)
+	}
+	if r.NewImage, err = toAVMap(raw.Change.NewImage); err != nil {
+		return nil, fmt.Errorf("new image: %w", err)
+	}
+
+	if r.OldImage == nil && r.NewImage == nil {
+		return nil, fmt.Errorf("record has no images; the stream view type must be NEW_AND_OLD_IMAGES")
+	}
+
+	for _, image := range []map[string]types.AttributeValue{r.NewImage, r.OldImage} {
+		if s, ok := image[db.TypeAttribute].(*types.AttributeValueMemberS); ok && r.EntityType == "" {
+			r.EntityType = s.Value
+		}
+	}
+
+	if len(d.handlers[r.EntityType]) == 0 {
+		return nil, nil
+	}
+
+	decode, ok := d.decoders[r.EntityType]
+	if !ok {
+		typ, ok := db.EntityType(r.EntityType)
+		if !ok {
+			return nil, fmt.Errorf("entity type %q is not registered", r.EntityType)
+		}
+		decode = func(image map[string]types.AttributeValue) (interface{}, error) {
+			v := reflect.New(typ)
+			return v.Interface(), attributevalue.UnmarshalMap(image, v.Interface())
+		}
+	}
+
+	if r.OldImage != nil {
+		if r.Old, err = decode(r.OldImage); err != nil {
+			return nil, fmt.Errorf("old image: %w", err)
+		}
+	}
+	if r.NewImage != nil {
+		if r.New, err = decode(r.NewImage); err != nil {
+			return nil, fmt.Errorf("new image: %w", err)
+		}
+	}
+
+	if pk, ok := raw.Change.Keys[d.table.PartitionKey]; ok && pk.DataType() == events.DataTypeString {
+		r.PK = pk.String()
+	}
+	if sk, ok := raw.Change.Keys[d.table.SortKey]; ok && sk.DataType() == events.DataTypeString {
+		r.SK = sk.String()
+	}
+
+	return r, nil
+}
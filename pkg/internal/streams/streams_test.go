@@ -0,0 +1,258 @@
+package streams_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"serverless-aws-cdk/internal/db"
+	"serverless-aws-cdk/internal/streams"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type widget struct {
+	Owner string `json:"owner" dynamodbav:"-"` // only in the partition key
+	ID    string `json:"id" dynamodbav:"id"`
+	Color string `json:"color" dynamodbav:"color"`
+}
+
+type gadget struct {
+	ID string `json:"id" dynamodbav:"id"`
+}
+
+var (
+	widgets = db.RegisterEntity[widget](db.EntityOptions{Type: "TEST_WIDGET", PartitionKey: "OWNER#{owner}", SortKey: "WIDGET#{id}"})
+	_       = db.RegisterEntity[gadget](db.EntityOptions{Type: "TEST_GADGET", PartitionKey: "GADGETS", SortKey: "{id}"})
+)
+
+var table = db.Table{Name: "test", PartitionKey: "pk", SortKey: "sk"}
+
+// image builds a stream image of an item of entityType with the given string attributes
+func image(entityType string, attrs map[string]string) map[string]events.DynamoDBAttributeValue {
+	out := map[string]events.DynamoDBAttributeValue{db.TypeAttribute: events.NewStringAttribute(entityType)}
+	for k, v := range attrs {
+		out[k] = events.NewStringAttribute(v)
+	}
+
+	return out
+}
+
+// record builds a stream record numbered seq; a nil image is absent
+func record(seq int, op streams.Operation, old, new map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+	keys := map[string]events.DynamoDBAttributeValue{}
+	for _, img := range []map[string]events.DynamoDBAttributeValue{old, new} {
+		for _, k := range []string{"pk", "sk"} {
+			if v, ok := img[k]; ok {
+				keys[k] = v
+			}
+		}
+	}
+
+	return events.DynamoDBEventRecord{
+		EventID:   "event-" + strconv.Itoa(seq),
+		EventName: string(op),
+		Change: events.DynamoDBStreamRecord{
+			Keys:           keys,
+			OldImage:       old,
+			NewImage:       new,
+			SequenceNumber: strconv.Itoa(seq),
+		},
+	}
+}
+
+func widgetImage(id, color string) map[string]events.DynamoDBAttributeValue {
+	return image("TEST_WIDGET", map[string]string{"pk": "OWNER#ann", "sk": "WIDGET#" + id, "id": id, "color": color})
+}
+
+func gadgetImage(id string) map[string]events.DynamoDBAttributeValue {
+	return image("TEST_GADGET", map[string]string{"pk": "GADGETS", "sk": id, "id": id})
+}
+
+func TestRouting(t *testing.T) {
+	d := streams.New(table)
+
+	var calls []string
+	streams.On(d, widgets, func(ctx context.Context, c streams.Change[widget]) error {
+		calls = append(calls, fmt.Sprintf("widget created %s/%s %s", c.New.Owner, c.New.ID, c.New.Color))
+		if c.Old != nil {
+			t.Errorf("INSERT has an old widget %+v", c.Old)
+		}
+		return nil
+	}, streams.Insert)
+	streams.On(d, widgets, func(ctx context.Context, c streams.Change[widget]) error {
+		if c.Old != nil && c.New != nil {
+			calls = append(calls, fmt.Sprintf("widget %s %s->%s", c.Operation, c.Old.Color, c.New.Color))
+		} else {
+			calls = append(calls, fmt.Sprintf("widget %s", c.Operation))
+		}
+
+		// the record was decoded once, for every handler
+		if c.New != nil && c.New != c.Record.New {
+			t.Error("the change & its record hold different decodings of the new image")
+		}
+		return nil
+	})
+	d.OnAny("TEST_GADGET", func(ctx context.Context, r *streams.Record) error {
+		g, ok := r.Old.(*gadget)
+		if !ok {
+			t.Fatalf("old gadget = %T, want *gadget", r.Old)
+		}
+		calls = append(calls, fmt.Sprintf("gadget %s %s %s/%s", r.Operation, g.ID, r.PK, r.SK))
+		return nil
+	}, streams.Modify, streams.Remove)
+
+	resp, err := d.Handle(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record(1, streams.Insert, nil, widgetImage("1", "red")),
+		record(2, streams.Modify, widgetImage("1", "red"), widgetImage("1", "blue")),
+		record(3, streams.Insert, nil, gadgetImage("g")), // no gadget handler for INSERT
+		record(4, streams.Remove, gadgetImage("g"), nil),
+		record(5, streams.Insert, nil, image("TEST_UNHANDLED", nil)), // no handler at all, not even registered
+		record(6, streams.Remove, widgetImage("1", "blue"), nil),
+	}})
+	if err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("Handle = %+v, %v, want no failures", resp, err)
+	}
+
+	want := []string{
+		"widget created ann/1 red",
+		"widget INSERT",
+		"widget MODIFY red->blue",
+		"gadget REMOVE g GADGETS/g",
+		"widget REMOVE",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestChangedAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new map[string]events.DynamoDBAttributeValue
+		want     []string
+	}{
+		{"insert", nil, map[string]events.DynamoDBAttributeValue{
+			"b": events.NewStringAttribute("1"),
+			"a": events.NewNumberAttribute("2"),
+		}, []string{"a", "b", db.TypeAttribute}},
+		{"remove", map[string]events.DynamoDBAttributeValue{
+			"a": events.NewStringAttribute("1"),
+		}, nil, []string{"a", db.TypeAttribute}},
+		{"modify", map[string]events.DynamoDBAttributeValue{
+			"same":    events.NewStringAttribute("x"),
+			"changed": events.NewNumberAttribute("1"),
+			"removed": events.NewBooleanAttribute(true),
+			"nested":  events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{"k": events.NewStringAttribute("v")}),
+			"list":    events.NewListAttribute([]events.DynamoDBAttributeValue{events.NewStringAttribute("v")}),
+		}, map[string]events.DynamoDBAttributeValue{
+			"same":    events.NewStringAttribute("x"),
+			"changed": events.NewNumberAttribute("2"),
+			"added":   events.NewNullAttribute(),
+			"nested":  events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{"k": events.NewStringAttribute("w")}),
+			"list":    events.NewListAttribute([]events.DynamoDBAttributeValue{events.NewStringAttribute("v")}),
+		}, []string{"added", "changed", "nested", "removed"}},
+		{"no change", map[string]events.DynamoDBAttributeValue{
+			"a": events.NewStringSetAttribute([]string{"x"}),
+		}, map[string]events.DynamoDBAttributeValue{
+			"a": events.NewStringSetAttribute([]string{"x"}),
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, img := range []map[string]events.DynamoDBAttributeValue{tt.old, tt.new} {
+				if img != nil {
+					img[db.TypeAttribute] = events.NewStringAttribute("TEST_GADGET")
+				}
+			}
+
+			var got []string
+			d := streams.New(table)
+			d.OnAny("TEST_GADGET", func(ctx context.Context, r *streams.Record) error {
+				got = r.ChangedAttributes()
+				return nil
+			})
+
+			resp, _ := d.Handle(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record(1, streams.Modify, tt.old, tt.new)}})
+			if len(resp.BatchItemFailures) != 0 {
+				t.Fatalf("the record failed: %+v", resp)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChangedAttributes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchItemFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w *widget) error
+		record  events.DynamoDBEventRecord // third of the batch
+		want    []string
+	}{
+		{"all handled", func(*widget) error { return nil }, record(3, streams.Insert, nil, widgetImage("3", "red")), nil},
+		{"handler error", func(w *widget) error {
+			if w.ID == "3" {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		}, record(3, streams.Insert, nil, widgetImage("3", "red")), []string{"3", "4", "5"}},
+		{"handler panic", func(w *widget) error {
+			if w.ID == "3" {
+				panic("nil map")
+			}
+			return nil
+		}, record(3, streams.Insert, nil, widgetImage("3", "red")), []string{"3", "4", "5"}},
+		{"undecodable image", func(*widget) error { return nil }, record(3, streams.Insert, nil, map[string]events.DynamoDBAttributeValue{
+			db.TypeAttribute: events.NewStringAttribute("TEST_WIDGET"),
+			"color":          events.NewListAttribute(nil),
+		}), []string{"3", "4", "5"}},
+		{"no images", func(*widget) error { return nil }, record(3, streams.Insert, nil, nil), []string{"3", "4", "5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handled []string
+			d := streams.New(table)
+			streams.On(d, widgets, func(ctx context.Context, c streams.Change[widget]) error {
+				if err := tt.handler(c.New); err != nil {
+					return err
+				}
+				handled = append(handled, c.New.ID)
+				return nil
+			})
+
+			resp, err := d.Handle(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+				record(1, streams.Insert, nil, widgetImage("1", "red")),
+				record(2, streams.Insert, nil, widgetImage("2", "red")),
+				tt.record,
+				record(4, streams.Insert, nil, widgetImage("4", "red")),
+				record(5, streams.Insert, nil, widgetImage("5", "red")),
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var failed []string
+			for _, f := range resp.BatchItemFailures {
+				failed = append(failed, f.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(failed, tt.want) {
+				t.Errorf("failures = %q, want %q", failed, tt.want)
+			}
+			if resp.BatchItemFailures == nil {
+				t.Error("BatchItemFailures is null, Lambda would treat it as a failed batch")
+			}
+
+			// nothing after the failed record is handled before the retry
+			if tt.want != nil && !reflect.DeepEqual(handled, []string{"1", "2"}) {
+				t.Errorf("handled %q, want 1 & 2 only", handled)
+			}
+		})
+	}
+}
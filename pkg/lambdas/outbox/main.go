@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"serverless-aws-cdk/internal/config"
+	"serverless-aws-cdk/internal/db"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/outbox"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var relay *outbox.Relay
+
+// handler ignores its event, so the relay can run on a schedule & on stream records of new outbox items alike
+func handler(ctx context.Context) (outbox.RelayResult, error) {
+	result, err := relay.Run(ctx)
+	log.Printf("outbox: delivered %d, retried %d, dead lettered %d, deferred %d", result.Delivered, result.Retried, result.Dead, result.Deferred)
+
+	return result, err
+}
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database, err := db.NewDB(context.Background(), cfg.DynamoDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publisher, err := outbox.NewPublisher(context.Background(), cfg.Outbox, cfg.DynamoDB.Region)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	table := testTable.New(database, cfg.Tables.Main)
+	relay = outbox.NewRelay(outbox.New(database, table.Schema()), publisher, cfg.Outbox.MaxAttempts)
+
+	lambda.Start(handler)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/outbox"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var (
+	users     *controller_users.Controller
+	retention time.Duration
+)
+
+// handler ignores its event & is meant to run on a schedule, e.g. daily
+func handler(ctx context.Context) error {
+	cutoff := time.Now().Add(-retention)
+
+	purged, err := users.PurgeDeletedUsers(ctx, cutoff)
+	log.Printf("purge: removed %d users deleted before %s", purged, cutoff.Format(time.RFC3339))
+
+	return err
+}
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database, err := db.NewDB(context.Background(), cfg.DynamoDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwords, err := auth.NewPasswordHasher(cfg.Passwords)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	table := testTable.New(database, cfg.Tables.Main)
+	users = controller_users.New(table, outbox.New(database, table.Schema()), passwords, auth.NewPasswordPolicy(cfg.Passwords, auth.Bundled))
+	retention = cfg.Users.Retention.Std()
+
+	lambda.Start(handler)
+}
@@ -3,9 +3,12 @@ package router
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"serverless-aws-cdk/utils"
 
@@ -14,14 +17,146 @@ import (
 
 type AdditionalInfo struct {
 	QueryParams map[string]string
+	Principal   *Principal // the authenticated caller; always set for routes with Authenticate set
+	Headers     map[string]string
 	Body        map[string]interface{}
+	RawBody     string // the body as sent, e.g. for JSON Patch documents which are not objects
+	SourceIP    string // the address of the caller as seen by API Gateway
+}
+
+// Header returns the value of the request header name, matched case-insensitively
+func (a AdditionalInfo) Header(name string) string {
+	for k, v := range a.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
 }
 
 type RouteMethodConfig struct {
 	Callback     func(pathParams map[string]string, addInfo AdditionalInfo) events.APIGatewayProxyResponse
-	Authenticate bool // You can add more fields as needed
+	Authenticate bool          // You can add more fields as needed
+	Permissions  []string      // required of the caller, all of them; implies Authenticate
+	Verified     bool          // requires a caller whose email is verified; implies Authenticate
+	RecentMFA    time.Duration // requires a caller who passed MFA at most this long ago; implies Authenticate
+}
+
+// Authorize returns the status answering a caller who may not use the route: 401 when it needs an
+// authenticated caller & principal is nil, 403 when the email is unverified or a permission is missing,
+// 401 again when the caller has to pass MFA (again), or 0 when the caller may use it
+func (c RouteMethodConfig) Authorize(principal *Principal) int {
+	if principal == nil {
+		if c.authenticates() {
+			return http.StatusUnauthorized
+		}
+		return 0
+	}
+
+	if c.Verified && !principal.EmailVerified {
+		return http.StatusForbidden
+	}
+
+	for _, p := range c.Permissions {
+		if !principal.Can(p) {
+			return http.StatusForbidden
+		}
+	}
+
+	if c.RecentMFA > 0 && !principal.PassedMFAWithin(c.RecentMFA) {
+		return http.StatusUnauthorized
+	}
+
+	return 0
+}
+
+func (c RouteMethodConfig) authenticates() bool {
+	return c.Authenticate || c.Verified || len(c.Permissions) > 0 || c.RecentMFA > 0
+}
+
+// Principal is the caller identified by a bearer token
+type Principal struct {
+	UserID        string
+	Email         string
+	EmailVerified bool
+	Roles         []string
+	Permissions   []string
+	MFAAt         time.Time // when the caller last passed MFA, or the zero time
+}
+
+// Can reports whether the caller was granted permission
+func (p *Principal) Can(permission string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PassedMFAWithin reports whether the caller passed MFA at most d ago
+func (p *Principal) PassedMFAWithin(d time.Duration) bool {
+	return p != nil && !p.MFAAt.IsZero() && time.Since(p.MFAAt) <= d
+}
+
+// StepUpRequired answers an authenticated caller who has to pass MFA again, at most maxAge before the
+// request, with a step-up challenge as in RFC 9470: the token is valid, its MFA is missing or too old
+func StepUpRequired(maxAge time.Duration) events.APIGatewayProxyResponse {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description="recent multi-factor authentication required", max_age=%d`,
+		int(maxAge.Seconds()))
+
+	return utils.PrepareResponse(http.StatusUnauthorized, map[string]string{"WWW-Authenticate": challenge}, map[string]interface{}{
+		"message": "recent multi-factor authentication required",
+	})
+}
+
+// Rule is the access requirement of one method of one route
+type Rule struct {
+	Method       string
+	Path         string
+	Authenticate bool
+	Verified     bool
+	Permissions  []string
+	RecentMFA    time.Duration
 }
 
+// Rules lists the access requirements of every route method, sorted by path & method,
+// e.g. to check the whole route/permission matrix in one place
+func Rules(routes map[string]RouteConfig) []Rule {
+	var rules []Rule
+	for path, route := range routes {
+		for method, cfg := range route.Methods {
+			rules = append(rules, Rule{
+				Method:       method,
+				Path:         path,
+				Authenticate: cfg.authenticates(),
+				Verified:     cfg.Verified,
+				Permissions:  cfg.Permissions,
+				RecentMFA:    cfg.RecentMFA,
+			})
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Path != rules[j].Path {
+			return rules[i].Path < rules[j].Path
+		}
+		return rules[i].Method < rules[j].Method
+	})
+
+	return rules
+}
+
+// Authenticator verifies the bearer token of requests. Routes with Authenticate set answer 401
+// without a valid token, or without an Authenticator; other routes ignore invalid tokens.
+var Authenticator func(token string) (Principal, error)
+
 type RouteConfig struct {
 	Methods map[string]RouteMethodConfig
 }
@@ -30,6 +165,9 @@ func Router(ctx context.Context, req events.APIGatewayProxyRequest, routes map[s
 	pathParams := req.PathParameters
 	addInfo := AdditionalInfo{
 		QueryParams: req.QueryStringParameters,
+		Headers:     req.Headers,
+		RawBody:     req.Body,
+		SourceIP:    req.RequestContext.Identity.SourceIP,
 	}
 	pathname := strings.TrimSuffix(req.Path, "/") // remove trailing slash
 	parts := strings.Split(pathname, "/")
@@ -79,5 +217,31 @@ func Router(ctx context.Context, req events.APIGatewayProxyRequest, routes map[s
 		return utils.PrepareResponse(http.StatusMethodNotAllowed, nil, utils.Responses[405])
 	}
 
+	// public routes see the caller too when a valid token is sent, e.g. to show admins more
+	if principal, ok := authenticate(addInfo.Header("Authorization")); ok {
+		addInfo.Principal = &principal
+	}
+
+	switch methodConfig.Authorize(addInfo.Principal) {
+	case http.StatusUnauthorized:
+		if addInfo.Principal != nil {
+			return StepUpRequired(methodConfig.RecentMFA)
+		}
+		return utils.PrepareResponse(http.StatusUnauthorized, map[string]string{"WWW-Authenticate": "Bearer"}, utils.Responses[401])
+	case http.StatusForbidden:
+		return utils.PrepareResponse(http.StatusForbidden, nil, utils.Responses[403])
+	}
+
 	return methodConfig.Callback(pathParams, addInfo)
 }
+
+func authenticate(authorization string) (Principal, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if Authenticator == nil || !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Principal{}, false
+	}
+
+	principal, err := Authenticator(strings.TrimSpace(token))
+
+	return principal, err == nil
+}
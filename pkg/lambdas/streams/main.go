@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"serverless-aws-cdk/internal/config"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/streams"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var dispatcher *streams.Dispatcher
+
+func handler(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	return dispatcher.Handle(ctx, event)
+}
+
+// logUserChange records user lifecycle events without logging any of the user's data
+func logUserChange(ctx context.Context, c streams.Change[controller_users.User]) error {
+	switch c.Operation {
+	case streams.Insert:
+		log.Printf("user %s created", c.New.ID)
+	case streams.Modify:
+		log.Printf("user %s updated: %s", c.New.ID, strings.Join(c.Record.ChangedAttributes(), ", "))
+	case streams.Remove:
+		log.Printf("user %s deleted", c.Old.ID)
+	}
+
+	return nil
+}
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database, err := db.NewDB(context.Background(), cfg.DynamoDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	table := testTable.New(database, cfg.Tables.Main)
+
+	dispatcher = streams.New(table.Schema())
+	streams.On(dispatcher, controller_users.Users, logUserChange)
+
+	lambda.Start(handler)
+}
@@ -2,17 +2,108 @@ package main
 
 import (
 	"context"
+	"errors"
+	"log"
 	"serverless-aws-cdk/internal/api"
+	"serverless-aws-cdk/internal/auth"
+	"serverless-aws-cdk/internal/config"
+	controller_auth "serverless-aws-cdk/internal/controllers/auth"
+	controller_users "serverless-aws-cdk/internal/controllers/users"
+	"serverless-aws-cdk/internal/db"
+	testTable "serverless-aws-cdk/internal/db/tables"
+	"serverless-aws-cdk/internal/mail"
+	"serverless-aws-cdk/internal/outbox"
+	"serverless-aws-cdk/internal/ratelimit"
 	router "serverless-aws-cdk/lambdas"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
+var (
+	routes map[string]router.RouteConfig
+	emails *mail.Queue
+)
+
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	return router.Router(ctx, req, api.UserRoutes), nil
+	resp := router.Router(ctx, req, routes)
+
+	// the execution environment freezes once the handler returns, which would hold queued emails
+	if emails == nil {
+		return resp, nil
+	}
+	if err := emails.Flush(ctx); err != nil {
+		log.Printf("mail: flushing the queue: %v", err)
+	}
+
+	return resp, nil
 }
 
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database, err := db.NewDB(context.Background(), cfg.DynamoDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwords, err := auth.NewPasswordHasher(cfg.Passwords)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	table := testTable.New(database, cfg.Tables.Main)
+	users := controller_users.New(table, outbox.New(database, table.Schema()), passwords, auth.NewPasswordPolicy(cfg.Passwords, auth.Bundled))
+
+	// without a driver the flows needing email answer 501, the others work as usual
+	var mailer mail.Mailer
+	driver, err := mail.New(context.Background(), cfg.Mail, cfg.DynamoDB.Region)
+	switch {
+	case errors.Is(err, mail.ErrDisabled):
+		log.Print("mail: no driver configured, password resets & email verification are disabled")
+	case err != nil:
+		log.Fatal(err)
+	default:
+		emails = mail.NewQueue(driver, cfg.Mail.QueueSize)
+		mailer = emails
+	}
+
+	templates, err := mail.DefaultTemplates(cfg.Mail.Locale)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mfaKeys, err := auth.MFAKeys(cfg.Auth.MFA)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	factors, err := auth.NewFactors(database, table.Schema(), mfaKeys, cfg.Auth.MFA.Skew, cfg.Auth.MFA.RecoveryCodes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stores := controller_auth.Stores{
+		Sessions: auth.NewSessions(database, table.Schema(), cfg.Auth.RefreshTokenTTL.Std(), cfg.Auth.MaxSessionAge.Std()),
+		Resets:   auth.NewResets(database, table.Schema(), cfg.Auth.PasswordResetTTL.Std()),
+		Throttle: auth.NewThrottle(database, table.Schema(), cfg.Auth.Lockout),
+		Factors:  factors,
+		Resends:  ratelimit.New(database, table.Schema(), "verify-email", controller_auth.ResendLimit, controller_auth.ResendWindow),
+	}
+
+	authController, err := controller_auth.New(stores, users, cfg.Auth, mailer, templates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	routes = api.UserRoutes(users, authController)
+	for path, route := range api.AuthRoutes(authController) {
+		routes[path] = route
+	}
+	router.Authenticator = api.Authenticator(authController)
+
 	lambda.Start(handler)
 }
@@ -1,30 +1,35 @@
 package utils
 
-import "reflect"
+import (
+	"reflect"
+	"strings"
+)
 
+// StructToMap returns the non-zero fields of a struct by their json name.
+// Zero values are skipped, so it cannot clear a field; use the patch package for partial updates.
 func StructToMap(item interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
-	val := reflect.ValueOf(item)
-	typ := reflect.TypeOf(item)
+	val := reflect.Indirect(reflect.ValueOf(item))
+	typ := val.Type()
 
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Field(i)
 		fieldType := typ.Field(i)
 
-		// Skip zero value fields; i.e. fields that are not set
-		if field.IsZero() {
+		// Skip unexported & zero value fields; i.e. fields that are not set
+		if !fieldType.IsExported() || field.IsZero() {
 			continue
 		}
 
-		tag := fieldType.Tag.Get("json")
-		if tag == "" {
-			tag = fieldType.Name
-		} else {
-			// Remove ",omitempty" if present
-			tag = tag[:len(tag)-len(",omitempty")]
+		name, _, _ := strings.Cut(fieldType.Tag.Get("json"), ",") // drop options such as ",omitempty"
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = fieldType.Name
 		}
 
-		result[tag] = field.Interface()
+		result[name] = field.Interface()
 	}
 
 	return result
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"log"
 
 	"github.com/aws/aws-lambda-go/events"
 )
@@ -28,9 +29,21 @@ var Responses = map[int]map[string]interface{}{
 	405: {
 		"message": "Method Not Allowed",
 	},
+	409: {
+		"message": "Conflict",
+	},
+	415: {
+		"message": "Unsupported Media Type",
+	},
+	429: {
+		"message": "Too Many Requests",
+	},
 	500: {
 		"message": "Internal Server Error",
 	},
+	501: {
+		"message": "Not Implemented",
+	},
 	502: {
 		"message": "Bad Gateway",
 	},
@@ -51,6 +64,13 @@ func PrepareResponse(statusCode int, headers map[string]string, body map[string]
 		headers["Content-Type"] = "application/json"
 	}
 
+	// a sensitive field in a response is a bug; answer 500 rather than leak it
+	if err := CheckSensitive(body); err != nil {
+		log.Printf("response: %v", err)
+		body = Responses[500]
+		statusCode = 500
+	}
+
 	bodyJson, err := json.Marshal(body)
 	if err != nil {
 		bodyJson = []byte(`{"message": "Internal Server Error"}`)
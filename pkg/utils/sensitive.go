@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SensitiveTag marks struct fields that must never be sent to clients, e.g. `sensitive:"true"` on a password hash
+const SensitiveTag = "sensitive"
+
+// sensitiveFields caches the json names of the sensitive fields of each struct type
+var sensitiveFields sync.Map // reflect.Type -> []string
+
+// CheckSensitive fails when encoding v as JSON would emit a field tagged sensitive.
+// Fields the JSON encoder skips (`json:"-"`, unexported) are allowed, since they never leave the process.
+func CheckSensitive(v interface{}) error {
+	return checkSensitive(reflect.ValueOf(v), "body", map[uintptr]bool{})
+}
+
+func checkSensitive(v reflect.Value, path string, visited map[uintptr]bool) error {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return checkSensitive(v.Elem(), path, visited)
+
+	case reflect.Pointer:
+		if v.IsNil() || visited[v.Pointer()] {
+			return nil
+		}
+		visited[v.Pointer()] = true
+		return checkSensitive(v.Elem(), path, visited)
+
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := checkSensitive(iter.Value(), fmt.Sprintf("%s.%v", path, iter.Key()), visited); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil // []byte is encoded as a string
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := checkSensitive(v.Index(i), fmt.Sprintf("%s[%d]", path, i), visited); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		if names := sensitiveFieldsOf(v.Type()); len(names) > 0 {
+			return fmt.Errorf("refusing to send sensitive field %s.%s of %s", path, names[0], v.Type())
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, emitted := jsonName(field)
+			if !emitted {
+				continue
+			}
+			if err := checkSensitive(v.Field(i), path+"."+name, visited); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sensitiveFieldsOf returns the json names of the emitted fields of t tagged sensitive
+func sensitiveFieldsOf(t reflect.Type) []string {
+	if names, ok := sensitiveFields.Load(t); ok {
+		return names.([]string)
+	}
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, emitted := jsonName(field); emitted && field.Tag.Get(SensitiveTag) == "true" {
+			names = append(names, name)
+		}
+	}
+
+	sensitiveFields.Store(t, names)
+
+	return names
+}
+
+// jsonName returns the name encoding/json emits a field under, and whether it emits it at all
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() && !field.Anonymous {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+
+	return name, true
+}